@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// shellSplit splits a command line the way a POSIX shell does, for the
+// quoting shellQuote produces: single quotes, and backslashes outside
+// them.
+func shellSplit(t *testing.T, line string) []string {
+	t.Helper()
+	var args []string
+	var cur strings.Builder
+	inArg, quoted := false, false
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quoted:
+			if c == '\'' {
+				quoted = false
+			} else {
+				cur.WriteByte(c)
+			}
+		case c == '\'':
+			quoted, inArg = true, true
+		case c == '\\' && i+1 < len(line):
+			i++
+			cur.WriteByte(line[i])
+			inArg = true
+		case c == ' ' || c == '\t' || c == '\n':
+			if inArg {
+				args = append(args, cur.String())
+				cur.Reset()
+				inArg = false
+			}
+		default:
+			cur.WriteByte(c)
+			inArg = true
+		}
+	}
+	if quoted {
+		t.Fatalf("unterminated quote in %q", line)
+	}
+	if inArg {
+		args = append(args, cur.String())
+	}
+	return args
+}
+
+// testFlags defines a few flags of each kind netpump has, recording them.
+func testFlags(rec *flagRecord) *flag.FlagSet {
+	flags := flag.NewFlagSet("netpump", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	flags.Bool("server", false, "")
+	flags.String("banner", "", "")
+	flags.String("admin-token", "", "")
+	flags.Int("port", 8080, "")
+	flags.Func("tenant", "", func(string) error { return nil })
+	flags.Func("socks-user", "", func(string) error { return nil })
+	flags.Bool("print-config", false, "")
+	rec.record(flags)
+	return flags
+}
+
+func TestPrintConfigRoundTrip(t *testing.T) {
+	args := []string{
+		"--server",
+		"--port", "9999",
+		"--banner=it's down for \"maintenance\", back at 5",
+		"--banner", "  spaced  out  ",
+		"--tenant=alice:s3cret:64",
+		"--tenant=bob:it's a secret",
+		"--socks-user=carol:p@ss word",
+		"--admin-token=$(rm -rf /)",
+		"--print-config",
+	}
+	for _, tc := range []struct {
+		name    string
+		secrets bool
+		want    []flagSet
+	}{
+		{"secrets", true, []flagSet{
+			{name: "server", value: "true", isBool: true},
+			{name: "port", value: "9999"},
+			{name: "banner", value: "it's down for \"maintenance\", back at 5"},
+			{name: "banner", value: "  spaced  out  "},
+			{name: "tenant", value: "alice:s3cret:64"},
+			{name: "tenant", value: "bob:it's a secret"},
+			{name: "socks-user", value: "carol:p@ss word"},
+			{name: "admin-token", value: "$(rm -rf /)"},
+		}},
+		{"redacted", false, []flagSet{
+			{name: "server", value: "true", isBool: true},
+			{name: "port", value: "9999"},
+			{name: "banner", value: "it's down for \"maintenance\", back at 5"},
+			{name: "banner", value: "  spaced  out  "},
+			{name: "tenant", value: "alice:" + redacted + ":64"},
+			{name: "tenant", value: "bob:" + redacted},
+			{name: "socks-user", value: "carol:" + redacted},
+			{name: "admin-token", value: redacted},
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var rec flagRecord
+			if err := testFlags(&rec).Parse(args); err != nil {
+				t.Fatal(err)
+			}
+			var out bytes.Buffer
+			printConfig(&out, &rec, tc.secrets)
+
+			printed := shellSplit(t, out.String())
+			if len(printed) == 0 || printed[0] != "netpump" {
+				t.Fatalf("printed %q, want a netpump command line", out.String())
+			}
+			var again flagRecord
+			if err := testFlags(&again).Parse(printed[1:]); err != nil {
+				t.Fatalf("parsing printed %q: %v", out.String(), err)
+			}
+			if !reflect.DeepEqual(again.sets, tc.want) {
+				t.Errorf("printed %q parses as\n%+v\nwant\n%+v", out.String(), again.sets, tc.want)
+			}
+		})
+	}
+}
+
+// TestPrintConfigRun checks the printed configuration of netpump's own
+// flags comes out the same when it's run again.
+func TestPrintConfigRun(t *testing.T) {
+	var first, second bytes.Buffer
+	if code := run([]string{"config", "--server", "--port=9999", "--deny-target=10.0.0.0/8,*.internal",
+		"--tenant=alice:s3cret", "--instance-id=east 1"}, &first, io.Discard); code != exitOK {
+		t.Fatalf("exit code %d", code)
+	}
+	printed := shellSplit(t, first.String())
+	if code := run(append([]string{"config", "--print-config-secrets"}, printed[1:]...), &second, io.Discard); code != exitOK {
+		t.Fatalf("exit code %d running the printed %q", code, first.String())
+	}
+	if first.String() != second.String() {
+		t.Errorf("printed %q, then from that %q", first.String(), second.String())
+	}
+}
+
+// TestUsageDespiteRecording checks that recording flags doesn't hide their
+// types and defaults from the usage message.
+func TestUsageDespiteRecording(t *testing.T) {
+	var stdout bytes.Buffer
+	if code := run([]string{"--help"}, &stdout, io.Discard); code != exitOK {
+		t.Fatalf("exit code %d", code)
+	}
+	usage := stdout.String()
+	for _, want := range []string{"-port int", "(default 8080)", "-shutdown-timeout duration", "(default 10s)"} {
+		if !strings.Contains(usage, want) {
+			t.Errorf("usage doesn't contain %q", want)
+		}
+	}
+	if strings.Contains(usage, "panic") {
+		t.Errorf("usage has panics in it:\n%s", usage)
+	}
+}
@@ -1,63 +1,734 @@
 package main
 
 import (
+	"bytes"
+	"errors"
 	"flag"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
+	"net/url"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
+	"time"
 
+	"github.com/armon/go-socks5"
 	"github.com/jtolio/netpump-go/private/client"
 	"github.com/jtolio/netpump-go/private/server"
+	"github.com/jtolio/netpump-go/private/wsconn"
 )
 
 func main() {
-	isClient := flag.Bool("client", false, "run as client")
-	isServer := flag.Bool("server", false, "run as server")
-	host := flag.String("host", "0.0.0.0", "host to listen on")
-	port := flag.Int("port", 8080, "port for web interface (client) or websocket (server)")
-	proxyPort := flag.Int("proxy-port", 1080, "SOCKS5 proxy port (client only)")
-	serverURL := flag.String("server-url", "", "websocket server URL (client only)")
-	flag.Parse()
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// run is the whole CLI short of exiting the process: it parses args, runs
+// the client or server until a signal, and returns the exit code. Usage
+// and configuration errors go to stderr, help to stdout.
+func run(args []string, stdout, stderr io.Writer) int {
+	// "netpump config ..." is short for --print-config.
+	configCmd := len(args) > 0 && args[0] == "config"
+	if configCmd {
+		args = args[1:]
+	}
+
+	flags := flag.NewFlagSet("netpump", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	isClient := flags.Bool("client", false, "run as client")
+	isServer := flags.Bool("server", false, "run as server")
+	debug := flags.Bool("debug", false, "also log debug messages, such as each connection's setup timings, in key=value form")
+	host := flags.String("host", "0.0.0.0", "host to listen on")
+	port := flags.Int("port", 8080, "port for web interface (client) or websocket (server)")
+	proxyHost := flags.String("proxy-host", "127.0.0.1", "SOCKS5 proxy host (client only)")
+	proxyPort := flags.Int("proxy-port", 1080, "SOCKS5 proxy port (client only)")
+	serverURL := flags.String("server-url", "", "websocket server URL (client only)")
+	sharedPort := flags.Bool("shared-port", false, "serve SOCKS5 on the web interface port, to loopback clients only unless --socks-user is set (client only)")
+	webBindWait := flags.Duration("web-bind-wait", 0, "how long to wait for the web interface port if it's in use (client only)")
+	webBindFallback := flags.Bool("web-bind-fallback", false, "serve the web interface on another port if its port is in use (client only)")
+	shutdownTimeout := flags.Duration("shutdown-timeout", 10*time.Second, "how long to let in-flight connections finish on shutdown")
+	writeTimeout := flags.Duration("write-timeout", wsconn.DefaultWriteTimeout, "how long a websocket write may stall before the session is dropped (0 disables)")
+	keepAlive := flags.Duration("keepalive", 30*time.Second, "how often to ping the tunnel to notice a dead link (0 disables)")
+	dialTimeout := flags.Duration("dial-timeout", 10*time.Second, "how long connecting to a target may take (0 disables, server only)")
+	dnsCoalesce := flags.Bool("dns-coalesce", false, "have connections to a host dialed at the same time share one lookup of it (server only)")
+	browserWait := flags.Duration("browser-wait", 30*time.Second, "how long a connection waits for the browser to connect, 0 to fail right away (client only)")
+	banner := flags.String("banner", "", "message to show on the web interface (client only)")
+	webDir := flags.String("web-dir", "", "directory with files overriding the built-in web interface (client only)")
+	maxSocksConns := flags.Int("max-socks-conns", 0, "cap on concurrent SOCKS5 connections, 0 for none (client only)")
+	socksCert := flags.String("socks-cert", "", "certificate file to serve SOCKS5 over TLS with, along with --socks-key (client only)")
+	socksKey := flags.String("socks-key", "", "key file for --socks-cert (client only)")
+	sendSource := flags.Bool("send-source", false, "tell the server which local address each SOCKS5 connection came from, for its logs (client only)")
+	dialAttempts := flags.Int("dial-attempts", client.DefaultRetryPolicy.MaxAttempts, "how many times to try a connection whose tunnel session went away, 1 for no retries (client only)")
+	failureReasons := flags.Bool("failure-reasons", false, "ask the server why connections fail and log it; needs a server that knows request extensions (client only)")
+	serverToken := flags.String("server-token", "", "token to present to the server (client only)")
+	rateLimit := flags.Int64("rate-limit", 0, "cap on total relayed bytes per second across all clients, 0 for none (server only)")
+	hostRateLimit := flags.Int64("host-rate-limit", 0, "cap on relayed bytes per second to and from each target host, 0 for none (server only)")
+	allowedOrigins := flags.String("allowed-origins", "", "comma-separated origins allowed to open websockets, empty for any (server only)")
+	allowedClients := flags.String("allowed-clients", "", "comma-separated client IPs or CIDR ranges allowed to connect, empty for any (server only)")
+	trustedProxies := flags.String("trusted-proxies", "", "comma-separated IPs or CIDR ranges of reverse proxies whose X-Forwarded-For to believe (server only)")
+	denyTargets := flags.String("deny-target", "", "comma-separated targets to refuse: host names, *.example.com for subdomains, IPs or CIDR ranges (server only)")
+	sniAllow := flags.String("sni-allow", "", "comma-separated TLS server names targets may be reached with, *.example.com for subdomains (server only)")
+	sniMatch := flags.Bool("sni-match", false, "block TLS connections whose server name differs from the requested host (server only)")
+	targetTLS := flags.String("target-tls", "", "comma-separated targets (host or host:port, *.example.com for subdomains) the server connects to over TLS itself (server only)")
+	instanceID := flags.String("instance-id", "", "name for this server in logs and responses, random by default (server only)")
+	tlsCert := flags.String("tls-cert", "", "certificate file to serve HTTPS and wss:// with, along with --tls-key (server only)")
+	tlsKey := flags.String("tls-key", "", "key file for --tls-cert (server only)")
+	httpsRedirect := flags.Bool("https-redirect", false, "redirect plaintext requests for / and /health to https:// instead of rejecting them (server only)")
+	relayBuffer := flags.Int("relay-buffer", 0, "bytes to read ahead in each relay direction, smoothing bursty links, 0 for none (server only)")
+	maxStreamMemory := flags.Int64("max-stream-memory", 0, "cap on the buffer memory held by connections being relayed, each charged the most it can hold, 0 for none (server only)")
+	maxRequestBytes := flags.Int64("max-request-bytes", 0, "cap on bytes of stream requests being read at once across all clients, 0 for none (server only)")
+	accessLogPath := flags.String("access-log", "", "file to append an access log line to per target connection, - for stdout (server only)")
+	accessLogFormat := flags.String("access-log-format", "common", "access log format: common or w3c (server only)")
+	accessLogBuffer := flags.Int("access-log-buffer", 0, "bytes of access log lines to collect in memory between writes, 0 to write each line right away (server only)")
+	accessLogFlush := flags.Duration("access-log-flush", time.Second, "how often to write out a buffered access log (server only)")
+	accessLogDrop := flags.Bool("access-log-drop", false, "drop access log lines while the buffer is full instead of holding up connections (server only)")
+	subSessions := flags.Int("sub-sessions", 1, fmt.Sprintf("independent tunnel sessions to spread connections across, up to %d; the server must support them (client only)", wsconn.MaxDemux))
+	maxFrame := flags.Int("max-frame-bytes", 0, "cap on the data in one tunnel frame, so bulk transfers don't hold up other connections, 0 for none")
+	invalidDataLimit := flags.Int("invalid-data-limit", 5, "refuse a browser for --invalid-data-cooldown after this many of its sessions fail on invalid data, 0 to never refuse (client only)")
+	invalidDataCooldown := flags.Duration("invalid-data-cooldown", time.Minute, "how long to refuse a browser that keeps sending invalid data (client only)")
+	streamWindow := flags.Int("stream-window", 0, "bytes each connection may have in flight towards this side, at least 262144, 0 for yamux's default")
+	copyBuffer := flags.Int("copy-buffer", 32*1024, "size of the relay's copy buffers, two per connection (server only)")
+	dscp := flags.Int("dscp", -1, "DSCP value (0-63) to mark connections to targets with, -1 for none (server only)")
+	carrierDSCP := flags.Int("carrier-dscp", -1, "DSCP value (0-63) to mark websocket connections to clients with, -1 for none (server only)")
+	maxPooledBuffers := flags.Int("max-pooled-buffers", 256, "idle relay copy buffers to keep for reuse (server only)")
+	minThroughput := flags.Int64("min-throughput", 0, "flag streams relaying fewer bytes than this per --min-throughput-window while not idle, 0 for no minimum (server only)")
+	minThroughputWindow := flags.Duration("min-throughput-window", 30*time.Second, "window --min-throughput is checked over (server only)")
+	minThroughputClose := flags.Bool("min-throughput-close", false, "close streams below --min-throughput instead of only logging them (server only)")
+	migrateTo := flags.String("migrate-to", "", "ws:// or wss:// URL of another server to send clients to on shutdown (server only)")
+	maxSessions := flags.Int("max-sessions", 0, "cap on clients served at once, 0 for none (server only)")
+	shedStreams := flags.Int64("shed-streams", 0, "refuse new clients and connections while this many connections are being relayed, 0 for no limit (server only)")
+	shedGoroutines := flags.Int("shed-goroutines", 0, "refuse new clients and connections while the server runs this many goroutines, 0 for no limit (server only)")
+	shedHeap := flags.Uint64("shed-heap-bytes", 0, "refuse new clients and connections while the server's heap is this large, 0 for no limit (server only)")
+	maxStreams := flags.Int("max-streams", 0, "cap on connections relayed at once across all clients, 0 for none (server only)")
+	streamQueue := flags.Duration("stream-queue-wait", 0, "how long a connection over --max-streams waits for a slot, shared fairly between clients, before it's refused (server only)")
+	maxPending := flags.Int("max-pending-streams", 0, "cap on streams per client still waiting to send their request, 0 for none (server only)")
+	carrierIdle := flags.Duration("carrier-idle", 0, "close a client's websocket after this long without connections, until it has one to make, 0 for never (server only)")
+	idleProbe := flags.Duration("idle-stream-probe", 0, "ask clients this often about streams idle this long and close the ones they've dropped, 0 for never (server only)")
+	metrics := flags.Bool("metrics", false, "serve Prometheus or OpenMetrics metrics on /metrics (server only)")
+	logSample := flags.Int("log-sample", 1, "log only one in this many connections; failures are always logged")
+	dashboard := flags.Bool("dashboard", false, "show every tunneled connection, and with --event-log recent problems, on the web interface (client only)")
+	eventLog := flags.Int("event-log", 0, "keep this many recent log events in memory, served on /events (the server's needs --admin-token)")
+	adminToken := flags.String("admin-token", "", "bearer token for the server's admin endpoints such as /events (server only)")
+	healthCanary := flags.String("health-canary", "", "host:port that /health/deep checks the server can reach (server only)")
+	slowDial := flags.Duration("slow-dial", 0, "warn about target dials slower than this, 0 for never (server only)")
+	slowFirstByte := flags.Duration("slow-first-byte", 0, "warn when a target's first byte takes longer than this, 0 for never (server only)")
+	targetLimit := flags.Int("target-limit", 0, "warn when a client connects to more distinct targets than this within --target-window, 0 for no limit (server only)")
+	targetWindow := flags.Duration("target-window", time.Minute, "window --target-limit counts distinct targets over (server only)")
+	targetReject := flags.Bool("target-reject", false, "refuse new targets to clients over --target-limit (server only)")
+	var labelRules []client.LabelRule
+	flags.Func("label", "tag connections to some targets for stats, as label=host[,host...] with *.example.com for subdomains (client only, repeatable)", func(v string) error {
+		label, hosts, ok := strings.Cut(v, "=")
+		if !ok || label == "" || hosts == "" {
+			return fmt.Errorf("expected label=host[,host...]")
+		}
+		labelRules = append(labelRules, client.LabelRule{Label: label, Hosts: strings.Split(hosts, ",")})
+		return nil
+	})
+	var socksUsers map[string]string
+	flags.Func("socks-user", "require SOCKS5 clients to log in, as user:password (client only, repeatable)", func(v string) error {
+		user, pass, ok := strings.Cut(v, ":")
+		if !ok || user == "" {
+			return fmt.Errorf("expected user:password")
+		}
+		if socksUsers == nil {
+			socksUsers = make(map[string]string)
+		}
+		socksUsers[user] = pass
+		return nil
+	})
+	socksDeny := flags.String("socks-deny", "", "comma-separated targets the SOCKS5 proxy refuses without tunneling them: hosts, with *.example.com for subdomains, IPs or CIDR ranges (client only)")
+	socksAllow := flags.String("socks-allow", "", "comma-separated targets, as for --socks-deny, that are the only ones the SOCKS5 proxy tunnels (client only)")
+	pacDirect := flags.String("pac-direct", "", "comma-separated hosts, with *.example.com for subdomains, that /proxy.pac sends browsers to directly (client only)")
+	var hostOverrides map[string]string
+	flags.Func("host-override", "send connections to a host to another host or IP instead, as host=address (client only, repeatable)", func(v string) error {
+		from, to, ok := strings.Cut(v, "=")
+		if !ok || from == "" || to == "" {
+			return fmt.Errorf("expected host=address")
+		}
+		if hostOverrides == nil {
+			hostOverrides = make(map[string]string)
+		}
+		hostOverrides[from] = to
+		return nil
+	})
+	var webUser, webPass string
+	flags.Func("web-auth", "require HTTP basic auth for the web interface, as user:password (client only)", func(v string) error {
+		user, pass, ok := strings.Cut(v, ":")
+		if !ok || user == "" {
+			return fmt.Errorf("expected user:password")
+		}
+		webUser, webPass = user, pass
+		return nil
+	})
+	var tenants []server.Tenant
+	flags.Func("tenant", "allow a tenant, as name:token[:max-streams[:byte-quota]] (server only, repeatable)", func(v string) error {
+		t, err := parseTenant(v)
+		if err != nil {
+			return err
+		}
+		tenants = append(tenants, t)
+		return nil
+	})
+	sessionPolicy := server.SessionsConcurrent
+	flags.Func("session-policy", "when a client connects as a tenant while it has a session as that tenant: concurrent, replace or reject (server only)", func(v string) error {
+		switch v {
+		case "concurrent":
+			sessionPolicy = server.SessionsConcurrent
+		case "replace":
+			sessionPolicy = server.SessionsReplace
+		case "reject":
+			sessionPolicy = server.SessionsReject
+		default:
+			return fmt.Errorf("unknown session policy %q", v)
+		}
+		return nil
+	})
+	var upstreams []server.Upstream
+	flags.Func("upstream", "egress path for targets, as direct[,weight] or socks5://host:port[,weight] (server only, repeatable)", func(v string) error {
+		u, err := parseUpstream(v)
+		if err != nil {
+			return err
+		}
+		upstreams = append(upstreams, u)
+		return nil
+	})
+	configPath := flags.String("config", "", "file of further flags, one --name=value per line; SIGHUP reads it again and applies the changes to --deny-target, --allowed-clients, --allowed-origins, --rate-limit, --host-rate-limit, --socks-deny and --socks-allow")
+	printCfg := flags.Bool("print-config", false, "print the flags that reproduce this configuration, with secrets redacted, and exit")
+	printSecrets := flags.Bool("print-config-secrets", false, "include secrets such as tokens and passwords with --print-config")
+	var rec flagRecord
+	rec.record(flags)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: netpump --client or --server")
+		fmt.Fprintln(flags.Output(), "       netpump config --client or --server (same as --print-config)")
+		rec.restore(flags)
+		flags.PrintDefaults()
+	}
+	// Parse prints usage for --help as it would for a bad flag; only
+	// errors belong on stderr.
+	var parseOut bytes.Buffer
+	flags.SetOutput(&parseOut)
+	err := flags.Parse(args)
+	flags.SetOutput(stderr)
+	if errors.Is(err, flag.ErrHelp) {
+		stdout.Write(parseOut.Bytes())
+		return exitOK
+	}
+	stderr.Write(parseOut.Bytes())
+	if err != nil {
+		return exitConfig
+	}
+	var config *configFile
+	if *configPath != "" {
+		var err error
+		if config, err = loadConfigFile(*configPath, flags, &rec); err != nil {
+			fmt.Fprintln(stderr, "Error:", err)
+			return exitConfig
+		}
+	}
 
 	if (!*isClient && !*isServer) || (*isClient && *isServer) {
-		fmt.Println("Usage: netpump --client or --server")
-		flag.PrintDefaults()
-		os.Exit(1)
+		flags.Usage()
+		return exitConfig
+	}
+	if *debug {
+		// The default handler can't be wrapped to let debug messages
+		// through, as it writes through the log package, which SetDefault
+		// sends back to slog.
+		slog.SetDefault(slog.New(slog.NewTextHandler(stderr, &slog.HandlerOptions{Level: slog.LevelDebug})))
 	}
 
 	if *isClient && *serverURL == "" {
-		fmt.Println("Error: --server-url is required for client mode")
-		os.Exit(1)
+		fmt.Fprintln(stderr, "Error: --server-url is required for client mode")
+		return exitConfig
+	}
+	if *isClient {
+		u, err := client.NormalizeServerURL(*serverURL)
+		if err != nil {
+			fmt.Fprintln(stderr, "Error:", err)
+			return exitConfig
+		}
+		*serverURL = u
+	}
+	if *printCfg || configCmd {
+		printConfig(stdout, &rec, *printSecrets)
+		return exitOK
 	}
 
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+	sigChan := make(chan os.Signal, 2)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(sigChan)
+	reload := reloader{config: config}
 
 	if *isServer {
-		s := server.New(*host, *port)
-		go func() {
-			<-sigChan
-			log.Println("Shutting down server...")
-			s.Stop()
-			os.Exit(0)
-		}()
-		if err := s.Start(); err != nil {
-			log.Fatalf("Server error: %v", err)
+		opts := []server.Option{
+			server.WithTimeouts(server.Timeouts{
+				Dial:      offIfZero(*dialTimeout),
+				Write:     offIfZero(*writeTimeout),
+				Shutdown:  *shutdownTimeout,
+				KeepAlive: offIfZero(*keepAlive),
+			}),
+		}
+		if len(tenants) > 0 {
+			opts = append(opts, server.WithTenants(tenants...), server.WithSessionPolicy(sessionPolicy))
+		}
+		if *allowedClients != "" {
+			opts = append(opts, server.WithAllowedClients(strings.Split(*allowedClients, ",")...))
+		}
+		if *trustedProxies != "" {
+			opts = append(opts, server.WithTrustedProxies(strings.Split(*trustedProxies, ",")...))
+		}
+		if *allowedOrigins != "" {
+			opts = append(opts, server.WithAllowedOrigins(strings.Split(*allowedOrigins, ",")...))
+		}
+		if *denyTargets != "" {
+			opts = append(opts, server.WithDenyTargets(strings.Split(*denyTargets, ",")...))
+		}
+		if *sniAllow != "" {
+			opts = append(opts, server.WithSNIAllowlist(strings.Split(*sniAllow, ",")...))
+		}
+		if *sniMatch {
+			opts = append(opts, server.WithSNIMatch())
+		}
+		if *targetTLS != "" {
+			opts = append(opts, server.WithTargetTLS(server.TargetTLS{Hosts: strings.Split(*targetTLS, ",")}))
+		}
+		if *eventLog > 0 {
+			opts = append(opts, server.WithEventLog(*eventLog))
+		}
+		if *logSample > 1 {
+			opts = append(opts, server.WithLogSampling(*logSample))
+		}
+		if *adminToken != "" {
+			opts = append(opts, server.WithAdminToken(*adminToken))
 		}
+		if *instanceID != "" {
+			opts = append(opts, server.WithInstanceID(*instanceID))
+		}
+		if (*tlsCert == "") != (*tlsKey == "") {
+			fmt.Fprintln(stderr, "Error: --tls-cert and --tls-key go together")
+			return exitConfig
+		}
+		if *tlsCert != "" {
+			cert, err := loadKeyPair(*tlsCert, *tlsKey)
+			if err != nil {
+				fmt.Fprintln(stderr, "Error:", err)
+				return exitConfig
+			}
+			reload.certs = append(reload.certs, cert)
+			opts = append(opts, server.WithTLS(cert.tlsConfig()))
+		}
+		if *httpsRedirect {
+			opts = append(opts, server.WithHTTPSRedirect())
+		}
+		if *relayBuffer > 0 {
+			opts = append(opts, server.WithRelayBufferBytes(*relayBuffer))
+		}
+		if *maxRequestBytes > 0 {
+			opts = append(opts, server.WithMaxRequestBytes(*maxRequestBytes))
+		}
+		if *maxStreamMemory > 0 {
+			opts = append(opts, server.WithMaxStreamMemory(*maxStreamMemory))
+		}
+		if *dnsCoalesce {
+			opts = append(opts, server.WithDNSCoalescing())
+		}
+		if *accessLogPath != "" {
+			var format server.AccessLogFormat
+			switch *accessLogFormat {
+			case "common":
+				format = server.AccessLogCommon
+			case "w3c":
+				format = server.AccessLogW3C
+			default:
+				fmt.Fprintf(stderr, "Error: unknown --access-log-format %q\n", *accessLogFormat)
+				return exitConfig
+			}
+			w := stdout
+			if *accessLogPath != "-" {
+				f, err := openReopenFile(*accessLogPath)
+				if err != nil {
+					fmt.Fprintln(stderr, "Error:", err)
+					return exitConfig
+				}
+				defer f.Close()
+				reload.logs = append(reload.logs, f)
+				w = f
+			}
+			opts = append(opts, server.WithAccessLog(w, format))
+			if *accessLogBuffer > 0 {
+				opts = append(opts, server.WithAccessLogBuffer(*accessLogBuffer, *accessLogFlush, *accessLogDrop))
+			}
+		}
+		if *maxFrame > 0 {
+			opts = append(opts, server.WithMaxFrameBytes(*maxFrame))
+		}
+		if *streamWindow > 0 {
+			opts = append(opts, server.WithStreamWindow(*streamWindow))
+		}
+		opts = append(opts, server.WithCopyBufferBytes(*copyBuffer))
+		if *dscp > 63 || *carrierDSCP > 63 {
+			fmt.Fprintln(stderr, "Error: DSCP values go up to 63")
+			return exitConfig
+		}
+		if *dscp >= 0 {
+			opts = append(opts, server.WithDSCP(*dscp))
+		}
+		if *carrierDSCP >= 0 {
+			opts = append(opts, server.WithCarrierDSCP(*carrierDSCP))
+		}
+		opts = append(opts, server.WithMaxPooledBuffers(*maxPooledBuffers))
+		if *minThroughput > 0 {
+			opts = append(opts, server.WithMinThroughput(*minThroughput, *minThroughputWindow, *minThroughputClose))
+		}
+		if *maxSessions > 0 {
+			opts = append(opts, server.WithMaxSessions(*maxSessions))
+		}
+		if *maxStreams > 0 {
+			opts = append(opts, server.WithMaxStreams(*maxStreams, *streamQueue))
+		}
+		if *migrateTo != "" {
+			opts = append(opts, server.WithMigrateTo(*migrateTo))
+		}
+		if *shedStreams > 0 || *shedGoroutines > 0 || *shedHeap > 0 {
+			opts = append(opts, server.WithLoadShedding(server.LoadLimits{
+				Streams:    *shedStreams,
+				Goroutines: *shedGoroutines,
+				HeapBytes:  *shedHeap,
+			}))
+		}
+		if *maxPending > 0 {
+			opts = append(opts, server.WithMaxPendingStreams(*maxPending))
+		}
+		if *idleProbe > 0 {
+			opts = append(opts, server.WithIdleStreamProbe(*idleProbe))
+		}
+		if *carrierIdle > 0 {
+			opts = append(opts, server.WithCarrierIdleTimeout(*carrierIdle))
+		}
+		if *metrics {
+			opts = append(opts, server.WithMetricsSink(server.NewPrometheusSink()))
+		}
+		if *healthCanary != "" {
+			opts = append(opts, server.WithHealthCanary(*healthCanary))
+		}
+		if *slowDial > 0 || *slowFirstByte > 0 {
+			opts = append(opts, server.WithSlowThresholds(*slowDial, *slowFirstByte))
+		}
+		if *targetLimit > 0 {
+			opts = append(opts, server.WithDistinctTargetLimit(*targetLimit, *targetWindow, *targetReject))
+		}
+		if *rateLimit > 0 {
+			opts = append(opts, server.WithGlobalRateLimit(*rateLimit))
+		}
+		if *hostRateLimit > 0 {
+			opts = append(opts, server.WithPerHostRateLimit(*hostRateLimit))
+		}
+		if len(upstreams) > 0 {
+			opts = append(opts, server.WithUpstreams(upstreams...))
+		}
+		s := server.New(*host, *port, opts...)
+		reload.reopenLog = s.ReopenAccessLog
+		reload.live = map[string]func(string) error{
+			"deny-target": func(v string) error {
+				s.SetDenyTargets(splitList(v)...)
+				return nil
+			},
+			"allowed-clients": func(v string) error { return s.SetAllowedClients(splitList(v)...) },
+			"allowed-origins": func(v string) error {
+				s.SetAllowedOrigins(splitList(v)...)
+				return nil
+			},
+			"rate-limit": func(v string) error {
+				n, err := strconv.ParseInt(v, 10, 64)
+				if err != nil {
+					return err
+				}
+				return s.SetGlobalRateLimit(n)
+			},
+			"host-rate-limit": func(v string) error {
+				n, err := strconv.ParseInt(v, 10, 64)
+				if err != nil {
+					return err
+				}
+				return s.SetPerHostRateLimit(n)
+			},
+		}
+		return serve("server", s, sigChan, reload.reload)
 	}
 
-	if *isClient {
-		c := client.New(*host, *port, *proxyPort, *serverURL)
-		go func() {
-			<-sigChan
-			log.Println("Shutting down client...")
-			c.Stop()
-			os.Exit(0)
-		}()
-		if err := c.Start(); err != nil {
-			log.Fatalf("Client error: %v", err)
+	// Client mode
+	opts := []client.Option{
+		client.WithProxyHost(*proxyHost),
+		client.WithTimeouts(client.Timeouts{
+			BrowserWait: offIfZero(*browserWait),
+			Write:       offIfZero(*writeTimeout),
+			Shutdown:    *shutdownTimeout,
+			KeepAlive:   offIfZero(*keepAlive),
+		}),
+	}
+	if *sharedPort {
+		opts = append(opts, client.WithSharedPort())
+	}
+	if *webBindWait > 0 || *webBindFallback {
+		opts = append(opts, client.WithWebBindRetry(*webBindWait, *webBindFallback))
+	}
+	if *serverToken != "" {
+		opts = append(opts, client.WithServerToken(*serverToken))
+	}
+	if *banner != "" {
+		opts = append(opts, client.WithBanner(*banner))
+	}
+	if *webDir != "" {
+		opts = append(opts, client.WithWebDir(*webDir))
+	}
+	if len(labelRules) > 0 {
+		opts = append(opts, client.WithLabelRules(labelRules...))
+	}
+	if *maxSocksConns > 0 {
+		opts = append(opts, client.WithMaxSocksConns(*maxSocksConns))
+	}
+	if rules := socksRules(*socksDeny, *socksAllow); len(rules) > 0 {
+		opts = append(opts, client.WithSocksRules(rules...))
+	}
+	if (*socksCert == "") != (*socksKey == "") {
+		fmt.Fprintln(stderr, "Error: --socks-cert and --socks-key go together")
+		return exitConfig
+	}
+	if *socksCert != "" {
+		cert, err := loadKeyPair(*socksCert, *socksKey)
+		if err != nil {
+			fmt.Fprintln(stderr, "Error:", err)
+			return exitConfig
+		}
+		reload.certs = append(reload.certs, cert)
+		opts = append(opts, client.WithSocksTLS(cert.tlsConfig()))
+	}
+	if socksUsers != nil {
+		opts = append(opts, client.WithSocksAuth(socksUsers))
+	}
+	if *pacDirect != "" {
+		opts = append(opts, client.WithPACDirect(strings.Split(*pacDirect, ",")...))
+	}
+	if hostOverrides != nil {
+		opts = append(opts, client.WithHostOverrides(hostOverrides))
+	}
+	if *failureReasons {
+		opts = append(opts, client.WithFailureReasons())
+	}
+	if *dialAttempts != client.DefaultRetryPolicy.MaxAttempts {
+		policy := client.DefaultRetryPolicy
+		policy.MaxAttempts = *dialAttempts
+		opts = append(opts, client.WithRetryPolicy(policy))
+	}
+	if *sendSource {
+		opts = append(opts, client.WithSendSource())
+	}
+	if webUser != "" {
+		opts = append(opts, client.WithWebAuth(webUser, webPass))
+	}
+	if *subSessions < 1 || *subSessions > wsconn.MaxDemux {
+		fmt.Fprintf(stderr, "Error: --sub-sessions must be between 1 and %d\n", wsconn.MaxDemux)
+		return exitConfig
+	}
+	if *subSessions > 1 {
+		opts = append(opts, client.WithSubSessions(*subSessions))
+	}
+	if *maxFrame > 0 {
+		opts = append(opts, client.WithMaxFrameBytes(*maxFrame))
+	}
+	if *streamWindow > 0 {
+		opts = append(opts, client.WithStreamWindow(*streamWindow))
+	}
+	opts = append(opts, client.WithInvalidDataThrottle(*invalidDataLimit, *invalidDataCooldown))
+	if *dashboard {
+		opts = append(opts, client.WithDashboard())
+	}
+	if *eventLog > 0 {
+		opts = append(opts, client.WithEventLog(*eventLog))
+	}
+	if *logSample > 1 {
+		opts = append(opts, client.WithLogSampling(*logSample))
+	}
+	c := client.New(*host, *port, *proxyPort, *serverURL, opts...)
+	deny, allow := *socksDeny, *socksAllow
+	reload.live = map[string]func(string) error{
+		"socks-deny": func(v string) error {
+			deny = v
+			c.SetSocksRules(socksRules(deny, allow)...)
+			return nil
+		},
+		"socks-allow": func(v string) error {
+			allow = v
+			c.SetSocksRules(socksRules(deny, allow)...)
+			return nil
+		},
+	}
+	return serve("client", c, sigChan, reload.reload)
+}
+
+// socksRules builds the SOCKS5 rules for --socks-deny and --socks-allow.
+func socksRules(deny, allow string) []socks5.RuleSet {
+	var rules []socks5.RuleSet
+	if deny != "" {
+		rules = append(rules, client.DenyTargetsRule(strings.Split(deny, ",")...))
+	}
+	if allow != "" {
+		rules = append(rules, client.AllowTargetsRule(strings.Split(allow, ",")...))
+	}
+	return rules
+}
+
+// splitList splits a comma-separated flag value, empty meaning none.
+func splitList(v string) []string {
+	if v == "" {
+		return nil
+	}
+	return strings.Split(v, ",")
+}
+
+// Exit codes, so process supervisors can tell a bad configuration, which
+// won't fix itself on restart, from a failure while running.
+const (
+	exitOK      = 0
+	exitRuntime = 1
+	exitConfig  = 2
+)
+
+// service is what the client and server have in common.
+type service interface {
+	Start() error
+	Stop() error
+}
+
+// serve runs svc until it fails or a signal arrives, then shuts it down
+// gracefully and returns the exit code. SIGHUP calls reload instead. A
+// second signal during shutdown gives up on it and returns right away.
+func serve(mode string, svc service, sigChan <-chan os.Signal, reload func()) int {
+	started := time.Now()
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- svc.Start()
+	}()
+
+	var sig os.Signal
+	var runErr error
+	for done := false; !done; {
+		select {
+		case sig = <-sigChan:
+			if sig == syscall.SIGHUP {
+				slog.Info("reloading", "mode", mode)
+				reload()
+				sig = nil
+				continue
+			}
+			slog.Info("shutting down", "mode", mode, "signal", sig.String())
+		case runErr = <-errCh:
+			slog.Error("stopped unexpectedly", "mode", mode, "error", runErr)
+		}
+		done = true
+	}
+
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- svc.Stop()
+	}()
+	var stopErr error
+	for done := false; !done; {
+		select {
+		case stopErr = <-stopped:
+			done = true
+		case sig := <-sigChan:
+			if sig == syscall.SIGHUP {
+				continue
+			}
+			slog.Warn("second signal, exiting without cleanup", "mode", mode, "signal", sig.String())
+			return exitRuntime
+		}
+	}
+	if sig != nil {
+		runErr = <-errCh
+	}
+
+	code := exitOK
+	if runErr != nil || stopErr != nil {
+		code = exitRuntime
+	}
+	if errors.Is(runErr, server.ErrInvalidConfig) || errors.Is(runErr, client.ErrInvalidConfig) {
+		code = exitConfig
+	}
+	attrs := []any{
+		"mode", mode,
+		"uptime", time.Since(started).Round(time.Millisecond).String(),
+		"exit_code", code,
+	}
+	if sig != nil {
+		attrs = append(attrs, "signal", sig.String())
+	}
+	if runErr != nil {
+		attrs = append(attrs, "error", runErr)
+	}
+	if stopErr != nil {
+		attrs = append(attrs, "shutdown_error", stopErr)
+	}
+	slog.Info("shutdown complete", attrs...)
+	return code
+}
+
+// offIfZero turns a flag's 0, which means off, into the negative duration
+// that does in client.Timeouts and server.Timeouts, where 0 means the
+// default.
+func offIfZero(d time.Duration) time.Duration {
+	if d == 0 {
+		return -1
+	}
+	return d
+}
+
+// parseTenant parses a --tenant value of the form
+// name:token[:max-streams[:byte-quota]].
+func parseTenant(v string) (server.Tenant, error) {
+	parts := strings.Split(v, ":")
+	if len(parts) < 2 || len(parts) > 4 || parts[0] == "" || parts[1] == "" {
+		return server.Tenant{}, fmt.Errorf("expected name:token[:max-streams[:byte-quota]]")
+	}
+	t := server.Tenant{Name: parts[0], Token: parts[1]}
+	if len(parts) > 2 {
+		n, err := strconv.Atoi(parts[2])
+		if err != nil || n < 0 {
+			return server.Tenant{}, fmt.Errorf("invalid max-streams %q", parts[2])
+		}
+		t.MaxStreams = n
+	}
+	if len(parts) > 3 {
+		n, err := strconv.ParseInt(parts[3], 10, 64)
+		if err != nil || n < 0 {
+			return server.Tenant{}, fmt.Errorf("invalid byte-quota %q", parts[3])
+		}
+		t.ByteQuota = n
+	}
+	return t, nil
+}
+
+// parseUpstream parses an --upstream value of the form URL[,weight].
+func parseUpstream(v string) (server.Upstream, error) {
+	rawURL, weight, hasWeight := strings.Cut(v, ",")
+	u := server.Upstream{Name: rawURL, URL: rawURL}
+	if rawURL != "direct" {
+		pu, err := url.Parse(rawURL)
+		if err != nil || pu.Scheme != "socks5" || pu.Host == "" {
+			return server.Upstream{}, fmt.Errorf("expected direct or socks5://host:port, got %q", rawURL)
+		}
+		// Keep credentials out of the logs.
+		u.Name = pu.Host
+	}
+	if hasWeight {
+		n, err := strconv.Atoi(weight)
+		if err != nil || n <= 0 {
+			return server.Upstream{}, fmt.Errorf("invalid weight %q", weight)
 		}
+		u.Weight = n
 	}
+	return u, nil
 }
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/jtolio/netpump-go/private/client"
+	"github.com/jtolio/netpump-go/private/server"
+)
+
+// failingService fails to start with err.
+type failingService struct{ err error }
+
+func (f failingService) Start() error { return f.err }
+func (f failingService) Stop() error  { return nil }
+
+func TestServeExitCodes(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want int
+	}{
+		{fmt.Errorf("listen tcp: address already in use"), exitRuntime},
+		{fmt.Errorf("%w: stream window must be between 1 and 2 bytes", server.ErrInvalidConfig), exitConfig},
+		{fmt.Errorf("%w: bad server URL", client.ErrInvalidConfig), exitConfig},
+	} {
+		if got := serve("test", failingService{tc.err}, make(chan os.Signal), func() {}); got != tc.want {
+			t.Errorf("%v: exit code %d, want %d", tc.err, got, tc.want)
+		}
+	}
+}
+
+func TestRunExitCodes(t *testing.T) {
+	// Something else has the port, so the server fails once running.
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+	_, takenPort, _ := net.SplitHostPort(taken.Addr().String())
+
+	for _, tc := range []struct {
+		name   string
+		args   []string
+		code   int
+		stdout string // contained in stdout, or empty if nothing should be
+		stderr string // contained in stderr, likewise
+	}{
+		{"help", []string{"--help"}, exitOK, "Usage: netpump", ""},
+		{"print config", []string{"config", "--server", "--port=9999"}, exitOK, "netpump --server --port=9999\n", ""},
+		{"no mode", nil, exitConfig, "", "Usage: netpump"},
+		{"both modes", []string{"--client", "--server"}, exitConfig, "", "Usage: netpump"},
+		{"unknown flag", []string{"--server", "--no-such-flag"}, exitConfig, "", "flag provided but not defined"},
+		{"bad value", []string{"--server", "--port=eighty"}, exitConfig, "", "invalid value"},
+		{"client without server", []string{"--client"}, exitConfig, "", "--server-url is required"},
+		{"bad server URL", []string{"--client", "--server-url=http://example.com"}, exitConfig, "", "use ws:// or wss://"},
+		{"half TLS", []string{"--server", "--tls-cert=cert.pem"}, exitConfig, "", "--tls-cert and --tls-key go together"},
+		{"missing config file", []string{"--server", "--config=" + t.TempDir() + "/none"}, exitConfig, "", "no such file"},
+		{"port in use", []string{"--server", "--host=127.0.0.1", "--port=" + takenPort}, exitRuntime, "", ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			if code := run(tc.args, &stdout, &stderr); code != tc.code {
+				t.Errorf("exit code %d, want %d; stderr %q", code, tc.code, stderr.String())
+			}
+			for _, out := range []struct {
+				name      string
+				got, want string
+			}{
+				{"stdout", stdout.String(), tc.stdout},
+				{"stderr", stderr.String(), tc.stderr},
+			} {
+				if out.want == "" && out.got != "" {
+					t.Errorf("%s = %q, want nothing", out.name, out.got)
+				} else if !strings.Contains(out.got, out.want) {
+					t.Errorf("%s = %q, want it to contain %q", out.name, out.got, out.want)
+				}
+			}
+		})
+	}
+}
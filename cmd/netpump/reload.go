@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// reloader re-reads, on SIGHUP, what the command line names by file, so
+// certificates can be renewed, logs rotated and the --config file's live
+// settings changed without dropping connections. Other settings take a
+// restart to change.
+type reloader struct {
+	certs []*keyPair
+	logs  []*reopenFile
+	// reopenLog, if set, reopens a log with the service holding off
+	// writing to it meanwhile.
+	reopenLog func(reopen func() error) error
+
+	config *configFile
+	// live applies a new value of the flag it's keyed by to the running
+	// service.
+	live map[string]func(value string) error
+}
+
+func (r *reloader) reload() {
+	for _, k := range r.certs {
+		if err := k.load(); err != nil {
+			slog.Error("certificate reload failed, keeping the old one", "cert", k.certFile, "error", err)
+			continue
+		}
+		slog.Info("certificate reloaded", "cert", k.certFile)
+	}
+	for _, f := range r.logs {
+		var err error
+		if r.reopenLog != nil {
+			err = r.reopenLog(f.reopen)
+		} else {
+			err = f.reopen()
+		}
+		if err != nil {
+			slog.Error("log reopen failed, writing to the old file", "path", f.path, "error", err)
+			continue
+		}
+		slog.Info("log reopened", "path", f.path)
+	}
+	if r.config == nil {
+		slog.Info("other settings take a restart to change unless given with --config")
+		return
+	}
+	r.config.reload(r.live)
+}
+
+// configFile is the file --config names: further flags, one per line as
+// --name=value, applied after the command line's. Blank lines and lines
+// starting with # are skipped.
+type configFile struct {
+	path  string
+	flags *flag.FlagSet
+	// base is each flag's value as the command line left it, which a flag
+	// dropped from the file goes back to.
+	base map[string]string
+	sets []flagSet // as last read
+}
+
+// loadConfigFile reads the file at path and applies it to flags, which
+// the command line has been parsed into. rec doesn't note the file's
+// flags, so the configuration prints with --config instead.
+func loadConfigFile(path string, flags *flag.FlagSet, rec *flagRecord) (*configFile, error) {
+	c := &configFile{path: path, flags: flags, base: make(map[string]string)}
+	flags.VisitAll(func(f *flag.Flag) {
+		c.base[f.Name] = f.Value.String()
+	})
+	sets, err := c.read()
+	if err != nil {
+		return nil, err
+	}
+	rec.off = true
+	defer func() { rec.off = false }()
+	for _, s := range sets {
+		if s.name == "config" {
+			return nil, fmt.Errorf("%s: --config can't be nested", path)
+		}
+		if err := flags.Set(s.name, s.value); err != nil {
+			return nil, fmt.Errorf("%s: invalid value %q for --%s: %w", path, s.value, s.name, err)
+		}
+	}
+	c.sets = sets
+	return c, nil
+}
+
+// read reads the flags set in the file, checking they're known flags
+// without otherwise applying them.
+func (c *configFile) read() ([]flagSet, error) {
+	f, err := os.Open(c.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var args []string
+	lines := bufio.NewScanner(f)
+	for lines.Scan() {
+		line := strings.TrimSpace(lines.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		args = append(args, line)
+	}
+	if err := lines.Err(); err != nil {
+		return nil, err
+	}
+
+	shadow := flag.NewFlagSet(c.path, flag.ContinueOnError)
+	shadow.SetOutput(io.Discard)
+	c.flags.VisitAll(func(f *flag.Flag) {
+		b, ok := f.Value.(interface{ IsBoolFlag() bool })
+		shadow.Var(anyValue{isBool: ok && b.IsBoolFlag()}, f.Name, "")
+	})
+	var rec flagRecord
+	rec.record(shadow)
+	if err := shadow.Parse(args); err != nil {
+		return nil, fmt.Errorf("%s: %w", c.path, err)
+	}
+	if shadow.NArg() > 0 {
+		return nil, fmt.Errorf("%s: expected --name=value, got %q", c.path, shadow.Arg(0))
+	}
+	return rec.sets, nil
+}
+
+// anyValue accepts any value, for reading which flags a file sets.
+type anyValue struct{ isBool bool }
+
+func (anyValue) String() string     { return "" }
+func (anyValue) Set(string) error   { return nil }
+func (v anyValue) IsBoolFlag() bool { return v.isBool }
+
+// reload reads the file again and applies the flags it changes that have
+// a function in live, logging the others as taking a restart. A file that
+// can't be read leaves everything as it was.
+func (c *configFile) reload(live map[string]func(value string) error) {
+	sets, err := c.read()
+	if err != nil {
+		slog.Error("config reload failed, keeping the current settings", "error", err)
+		return
+	}
+	old, cur := flagValues(c.sets), flagValues(sets)
+	var names []string
+	for name := range old {
+		names = append(names, name)
+	}
+	for name := range cur {
+		if _, ok := old[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var restart []string
+	for _, name := range names {
+		if slices.Equal(old[name], cur[name]) {
+			continue
+		}
+		apply, ok := live[name]
+		if !ok {
+			restart = append(restart, "--"+name)
+			continue
+		}
+		value := c.base[name]
+		if values := cur[name]; len(values) > 0 {
+			value = values[len(values)-1]
+		}
+		if err := apply(value); err != nil {
+			slog.Error("config change takes a restart", "flag", name, "error", err)
+			continue
+		}
+		slog.Info("config change applied", "flag", name, "value", redact(name, value))
+	}
+	if len(restart) > 0 {
+		slog.Warn("config changes take a restart to apply", "flags", restart)
+	}
+	c.sets = sets
+}
+
+// flagValues maps the name of each flag in sets to its values in order.
+func flagValues(sets []flagSet) map[string][]string {
+	m := make(map[string][]string)
+	for _, s := range sets {
+		m[s.name] = append(m[s.name], s.value)
+	}
+	return m
+}
+
+// keyPair is a certificate and key loaded from files, served through
+// GetCertificate so that reloading them affects new handshakes only.
+type keyPair struct {
+	certFile, keyFile string
+	cert              atomic.Pointer[tls.Certificate]
+}
+
+func loadKeyPair(certFile, keyFile string) (*keyPair, error) {
+	k := &keyPair{certFile: certFile, keyFile: keyFile}
+	return k, k.load()
+}
+
+func (k *keyPair) load() error {
+	cert, err := tls.LoadX509KeyPair(k.certFile, k.keyFile)
+	if err != nil {
+		return err
+	}
+	k.cert.Store(&cert)
+	return nil
+}
+
+// tlsConfig returns a TLS configuration serving the current certificate.
+func (k *keyPair) tlsConfig() *tls.Config {
+	return &tls.Config{
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return k.cert.Load(), nil
+		},
+	}
+}
+
+// reopenFile is a file opened for appending that can be reopened at the
+// same path, for log rotation.
+type reopenFile struct {
+	path string
+	mu   sync.Mutex
+	f    *os.File
+}
+
+func openAppend(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+}
+
+func openReopenFile(path string) (*reopenFile, error) {
+	f, err := openAppend(path)
+	if err != nil {
+		return nil, err
+	}
+	return &reopenFile{path: path, f: f}, nil
+}
+
+func (r *reopenFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.f.Write(p)
+}
+
+// reopen switches to a fresh file at r's path, such as after the old one
+// was renamed away.
+func (r *reopenFile) reopen() error {
+	f, err := openAppend(r.path)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	old := r.f
+	r.f = f
+	r.mu.Unlock()
+	return old.Close()
+}
+
+func (r *reopenFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.f.Close()
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/hashicorp/yamux"
+
+	"github.com/jtolio/netpump-go/private/protocol"
+	"github.com/jtolio/netpump-go/private/wsconn"
+)
+
+// writeCert writes a self-signed certificate for 127.0.0.1 with serial to
+// certPath and its key to keyPath.
+func writeCert(t *testing.T, certPath, keyPath string, serial int64) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "netpump test"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := os.WriteFile(certPath, certPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyPath, keyPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// servedSerial returns the serial number of the certificate served at
+// addr, or -1 if it can't be had yet.
+func servedSerial(addr string) int64 {
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: time.Second}, "tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		return -1
+	}
+	defer conn.Close()
+	return conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64()
+}
+
+// requestStatus opens a session with the server at addr over wss and
+// returns its answer to a request for target.
+func requestStatus(t *testing.T, addr, target string) byte {
+	t.Helper()
+	dialer := websocket.Dialer{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	ws, _, err := dialer.Dial("wss://"+addr+"/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, err := yamux.Client(wsconn.New(ws), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	stream, err := session.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	stream.SetDeadline(time.Now().Add(10 * time.Second))
+	if err := protocol.WriteRequest(stream, protocol.Request{Addr: target}); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := protocol.ReadResponse(stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.Status
+}
+
+// eventually polls cond until it holds or 10 seconds pass.
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(10 * time.Second); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestReloadOnSIGHUP(t *testing.T) {
+	dir := t.TempDir()
+	certPath := filepath.Join(dir, "cert.pem")
+	keyPath := filepath.Join(dir, "key.pem")
+	logPath := filepath.Join(dir, "access.log")
+	configPath := filepath.Join(dir, "netpump.conf")
+	writeCert(t, certPath, keyPath, 1)
+	if err := os.WriteFile(configPath, []byte("# nothing denied yet\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	_, port, _ := net.SplitHostPort(addr)
+	ln.Close()
+
+	done := make(chan int, 1)
+	go func() {
+		done <- run([]string{
+			"--server", "--host=127.0.0.1", "--port=" + port,
+			"--tls-cert=" + certPath, "--tls-key=" + keyPath,
+			"--access-log=" + logPath, "--access-log-format=w3c",
+			"--config=" + configPath,
+		}, io.Discard, io.Discard)
+	}()
+	defer func() {
+		syscall.Kill(os.Getpid(), syscall.SIGTERM)
+		select {
+		case code := <-done:
+			if code != exitOK {
+				t.Errorf("exit code %d, want %d", code, exitOK)
+			}
+		case <-time.After(10 * time.Second):
+			t.Error("run didn't return after SIGTERM")
+		}
+	}()
+
+	eventually(t, "the first certificate", func() bool { return servedSerial(addr) == 1 })
+	if got := requestStatus(t, addr, target.Addr().String()); got != protocol.StatusOK {
+		t.Fatalf("status %#x before reload, want OK", got)
+	}
+
+	writeCert(t, certPath, keyPath, 2)
+	if err := os.Rename(logPath, logPath+".1"); err != nil {
+		t.Fatal(err)
+	}
+	config := "--deny-target=" + target.Addr().(*net.TCPAddr).IP.String() + "\n"
+	if err := os.WriteFile(configPath, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	syscall.Kill(os.Getpid(), syscall.SIGHUP)
+
+	eventually(t, "the new certificate", func() bool { return servedSerial(addr) == 2 })
+	eventually(t, "the reopened log's header", func() bool {
+		b, err := os.ReadFile(logPath)
+		return err == nil && strings.HasPrefix(string(b), "#Software: netpump\n")
+	})
+	if got := requestStatus(t, addr, target.Addr().String()); got != protocol.StatusDenied {
+		t.Errorf("status %#x after reload, want denied (%#x)", got, protocol.StatusDenied)
+	}
+}
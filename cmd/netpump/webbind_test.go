@@ -0,0 +1,91 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// occupiedPort listens on a free loopback port and returns the listener
+// holding it, with the port.
+func occupiedPort(t *testing.T) (net.Listener, string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	return ln, strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+}
+
+// clientArgs returns the arguments for a client with its web interface on
+// webPort, and extra.
+func clientArgs(t *testing.T, webPort string, extra ...string) []string {
+	t.Helper()
+	ln, proxyPort := occupiedPort(t)
+	ln.Close()
+	return append([]string{
+		"--client", "--host=127.0.0.1", "--port=" + webPort,
+		"--proxy-host=127.0.0.1", "--proxy-port=" + proxyPort,
+		"--server-url=ws://127.0.0.1:1",
+	}, extra...)
+}
+
+func TestWebPortInUse(t *testing.T) {
+	_, port := occupiedPort(t)
+	done := make(chan int, 1)
+	go func() { done <- run(clientArgs(t, port), io.Discard, io.Discard) }()
+	select {
+	case code := <-done:
+		if code != exitRuntime {
+			t.Errorf("exit code %d, want %d", code, exitRuntime)
+		}
+	case <-time.After(10 * time.Second):
+		syscall.Kill(os.Getpid(), syscall.SIGTERM)
+		<-done
+		t.Error("started with its web port in use")
+	}
+}
+
+// TestWebBindWait checks a client told to wait for its web port keeps
+// trying while the port is in use, and serves on it once it's freed.
+func TestWebBindWait(t *testing.T) {
+	held, port := occupiedPort(t)
+	done := make(chan int, 1)
+	go func() { done <- run(clientArgs(t, port, "--web-bind-wait=10s"), io.Discard, io.Discard) }()
+	defer func() {
+		if len(done) > 0 {
+			// It's returned, and stopped handling signals: don't SIGTERM.
+			return
+		}
+		syscall.Kill(os.Getpid(), syscall.SIGTERM)
+		select {
+		case code := <-done:
+			if code != exitOK {
+				t.Errorf("exit code %d, want %d", code, exitOK)
+			}
+		case <-time.After(10 * time.Second):
+			t.Error("run didn't return after SIGTERM")
+		}
+	}()
+
+	time.Sleep(300 * time.Millisecond)
+	if len(done) > 0 {
+		t.Fatal("gave up with its web port in use")
+	}
+	held.Close()
+
+	eventually(t, "the web interface", func() bool {
+		resp, err := http.Get("http://127.0.0.1:" + port + "/")
+		if err != nil {
+			return false
+		}
+		resp.Body.Close()
+		return resp.StatusCode == http.StatusOK
+	})
+}
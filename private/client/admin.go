@@ -0,0 +1,120 @@
+package client
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Stats is a snapshot of the client's state, as served on /stats.
+type Stats struct {
+	Paused      bool `json:"paused"`
+	Connected   bool `json:"connected"`
+	Connections int  `json:"connections"`
+	// RTTMillis is the last measured round trip time to the server
+	// through the browser, or 0 before there is one.
+	RTTMillis float64               `json:"rtt_ms"`
+	Labels    map[string]LabelStats `json:"labels,omitempty"`
+	// Sessions counts the tunnel's sub-sessions still up, and
+	// ConnectedSince is when the browser's current session began, zero
+	// while there's none.
+	Sessions       int       `json:"sessions"`
+	ConnectedSince time.Time `json:"connected_since"`
+	// Reconnects counts the browser sessions after the first.
+	Reconnects uint64 `json:"reconnects"`
+}
+
+// Stats returns the client's current state.
+func (c *Client) Stats() Stats {
+	var st Stats
+	c.muxMu.Lock()
+	st.Paused = c.paused
+	st.Connected = c.muxSession != nil
+	st.RTTMillis = float64(c.rtt) / float64(time.Millisecond)
+	for _, s := range c.muxSessions {
+		if !s.IsClosed() {
+			st.Sessions++
+		}
+	}
+	st.ConnectedSince = c.connectedSince
+	st.Reconnects = max(c.muxGen, 1) - 1
+	c.muxMu.Unlock()
+
+	c.trackMu.Lock()
+	st.Connections = len(c.socksConns)
+	c.trackMu.Unlock()
+
+	st.Labels = c.labels.stats()
+	return st
+}
+
+func (c *Client) handleStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(c.Stats())
+}
+
+// handlePause pauses the tunnel. With ?disconnect=1 the browser's session
+// is closed as well.
+func (c *Client) handlePause(w http.ResponseWriter, r *http.Request) {
+	if !adminRequest(w, r) {
+		return
+	}
+	c.Pause(r.URL.Query().Get("disconnect") == "1")
+	c.handleStats(w, r)
+}
+
+func (c *Client) handleResume(w http.ResponseWriter, r *http.Request) {
+	if !adminRequest(w, r) {
+		return
+	}
+	c.Resume()
+	c.handleStats(w, r)
+}
+
+// adminRequest only lets state-changing requests through as POSTs from
+// the web interface itself, so other pages open in the browser can't
+// trigger them.
+func adminRequest(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+	if !sameOrigin(r) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// sameOrigin reports whether r comes from a page the web interface served,
+// or from something other than a browser, which sends no Origin.
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == r.Host
+}
+
+// requireLogin serves h only to requests with the web interface's basic
+// auth credentials. Browsers send them on the websocket upgrade to the
+// same origin too, so the relay keeps working.
+func (c *Client) requireLogin(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		// Check both, so a wrong user takes as long as a wrong password.
+		userOK := subtle.ConstantTimeCompare([]byte(user), []byte(c.webUser))
+		passOK := subtle.ConstantTimeCompare([]byte(pass), []byte(c.webPass))
+		if !ok || userOK&passOK != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="netpump", charset="UTF-8"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
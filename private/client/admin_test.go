@@ -0,0 +1,180 @@
+package client
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// adminPost sends a POST to the web interface's path from origin, if not
+// empty, and returns the status.
+func adminPost(c *Client, path, origin string) int {
+	r := httptest.NewRequest(http.MethodPost, "http://127.0.0.1:8080"+path, nil)
+	if origin != "" {
+		r.Header.Set("Origin", origin)
+	}
+	w := httptest.NewRecorder()
+	switch path {
+	case "/pause":
+		c.handlePause(w, r)
+	case "/resume":
+		c.handleResume(w, r)
+	}
+	return w.Code
+}
+
+func TestPauseResume(t *testing.T) {
+	tn := startTunnel(t, nil)
+	target := echoTarget(t)
+	echoes := func() bool {
+		conn, err := tn.dial(target)
+		if err != nil {
+			return false
+		}
+		defer conn.Close()
+		if _, err := conn.Write([]byte("x")); err != nil {
+			return false
+		}
+		_, err = io.ReadFull(conn, make([]byte, 1))
+		return err == nil
+	}
+	if !echoes() {
+		t.Fatal("dial failed before pausing")
+	}
+
+	if code := adminPost(tn.client, "/pause", "http://127.0.0.1:8080"); code != http.StatusOK {
+		t.Fatalf("pause from the web interface: status %d", code)
+	}
+	if !tn.client.Paused() {
+		t.Fatal("not paused")
+	}
+	if echoes() {
+		t.Error("dial went through while paused")
+	}
+
+	// Other pages in the browser can't resume it, nor can a GET.
+	if code := adminPost(tn.client, "/resume", "http://evil.example"); code != http.StatusForbidden {
+		t.Errorf("resume from another origin: status %d, want %d", code, http.StatusForbidden)
+	}
+	w := httptest.NewRecorder()
+	tn.client.handleResume(w, httptest.NewRequest(http.MethodGet, "http://127.0.0.1:8080/resume", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("resume with GET: status %d, want %d", w.Code, http.StatusMethodNotAllowed)
+	}
+	if !tn.client.Paused() {
+		t.Fatal("refused resume requests resumed the tunnel")
+	}
+
+	// Tools without a browser send no Origin.
+	if code := adminPost(tn.client, "/resume", ""); code != http.StatusOK {
+		t.Fatalf("resume: status %d", code)
+	}
+	if !echoes() {
+		t.Error("dial failed after resuming")
+	}
+}
+
+// getStats fetches /stats from c.
+func getStats(t *testing.T, c *Client) Stats {
+	t.Helper()
+	w := httptest.NewRecorder()
+	c.handleStats(w, httptest.NewRequest(http.MethodGet, "http://127.0.0.1:8080/stats", nil))
+	var st Stats
+	if err := json.NewDecoder(w.Body).Decode(&st); err != nil {
+		t.Fatal(err)
+	}
+	return st
+}
+
+func TestStatsRTT(t *testing.T) {
+	idle := New("127.0.0.1", 0, 0, "ws://127.0.0.1:1")
+	if st := getStats(t, idle); st.RTTMillis != 0 {
+		t.Errorf("rtt_ms = %v before any session", st.RTTMillis)
+	}
+
+	// The client pings as soon as the session is up.
+	tn := startTunnel(t, nil)
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if st := getStats(t, tn.client); st.RTTMillis > 0 {
+			if st.RTTMillis > 5000 {
+				t.Errorf("rtt_ms = %v over loopback", st.RTTMillis)
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("rtt_ms still 0 with the tunnel up")
+		}
+	}
+}
+
+func TestWebAuth(t *testing.T) {
+	_, base := startClient(t, WithWebAuth("alice", "s3cret"))
+	send := func(method, path, user, pass string) int {
+		t.Helper()
+		req, err := http.NewRequest(method, base+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if user != "" || pass != "" {
+			req.SetBasicAuth(user, pass)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusUnauthorized && resp.Header.Get("WWW-Authenticate") == "" {
+			t.Errorf("%s %s: 401 without a challenge", method, path)
+		}
+		return resp.StatusCode
+	}
+	upgrade := func(user, pass string) int {
+		t.Helper()
+		header := http.Header{}
+		if user != "" || pass != "" {
+			header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(user+":"+pass)))
+		}
+		ws, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(base, "http")+localWSPath, header)
+		if err != nil {
+			if resp == nil {
+				t.Fatal(err)
+			}
+			return resp.StatusCode
+		}
+		ws.Close()
+		return http.StatusSwitchingProtocols
+	}
+
+	for _, creds := range [][2]string{{"", ""}, {"bob", "s3cret"}, {"alice", "wrong"}, {"Alice", "s3cret"}} {
+		for _, path := range []string{"/", "/stats", "/proxy.pac"} {
+			if code := send(http.MethodGet, path, creds[0], creds[1]); code != http.StatusUnauthorized {
+				t.Errorf("GET %s as %q/%q: status %d, want 401", path, creds[0], creds[1], code)
+			}
+		}
+		if code := send(http.MethodPost, "/pause", creds[0], creds[1]); code != http.StatusUnauthorized {
+			t.Errorf("POST /pause as %q/%q: status %d, want 401", creds[0], creds[1], code)
+		}
+		if code := upgrade(creds[0], creds[1]); code != http.StatusUnauthorized {
+			t.Errorf("%s as %q/%q: status %d, want 401", localWSPath, creds[0], creds[1], code)
+		}
+	}
+
+	for _, path := range []string{"/", "/stats", "/proxy.pac"} {
+		if code := send(http.MethodGet, path, "alice", "s3cret"); code != http.StatusOK {
+			t.Errorf("GET %s logged in: status %d, want 200", path, code)
+		}
+	}
+	if code := upgrade("alice", "s3cret"); code != http.StatusSwitchingProtocols {
+		t.Errorf("%s logged in: status %d, want 101", localWSPath, code)
+	}
+	if code := send(http.MethodPost, "/pause", "alice", "s3cret"); code != http.StatusOK {
+		t.Errorf("POST /pause logged in: status %d, want 200", code)
+	}
+}
@@ -0,0 +1,85 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+
+	"github.com/hashicorp/yamux"
+
+	"github.com/jtolio/netpump-go/private/protocol"
+)
+
+// errNoSession means there's no tunnel session to ask the server over.
+var errNoSession = errors.New("no tunnel session")
+
+// ServerCapabilities returns the server's policy as last fetched, and
+// whether it was fetched at all. It's fetched whenever a session is set
+// up, and by FetchCapabilities.
+func (c *Client) ServerCapabilities() (protocol.Capabilities, bool) {
+	caps := c.caps.Load()
+	if caps == nil {
+		return protocol.Capabilities{}, false
+	}
+	return *caps, true
+}
+
+// FetchCapabilities asks the server for its policy as it stands, such as
+// after its configuration changed, over the current session, and keeps it
+// for ServerCapabilities and for refusing denied targets without asking.
+// It fails with protocol.ErrNoCapabilities if the server is too old to
+// say.
+func (c *Client) FetchCapabilities(ctx context.Context) (protocol.Capabilities, error) {
+	c.muxMu.Lock()
+	session := c.muxSession
+	c.muxMu.Unlock()
+	if session == nil {
+		return protocol.Capabilities{}, errNoSession
+	}
+	return c.fetchCapabilities(ctx, session)
+}
+
+func (c *Client) fetchCapabilities(ctx context.Context, session *yamux.Session) (protocol.Capabilities, error) {
+	stream, err := session.OpenStream()
+	if err != nil {
+		return protocol.Capabilities{}, fmt.Errorf("failed to open stream: %w", err)
+	}
+	defer stream.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		stream.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() { stream.Close() })
+	defer stop()
+
+	if err := protocol.WriteRequest(stream, protocol.Request{Capabilities: true}); err != nil {
+		return protocol.Capabilities{}, err
+	}
+	caps, err := protocol.ReadCapabilities(stream)
+	if err != nil {
+		if errors.Is(err, protocol.ErrNoCapabilities) {
+			// Such as after migrating to an older server.
+			c.caps.Store(nil)
+		}
+		if ctx.Err() != nil {
+			return protocol.Capabilities{}, ctx.Err()
+		}
+		return protocol.Capabilities{}, err
+	}
+	if old := c.caps.Swap(&caps); old == nil || !reflect.DeepEqual(*old, caps) {
+		c.log.Info("server capabilities", "max_streams", caps.MaxStreams, "rate_limit", caps.RateLimit,
+			"host_rate_limit", caps.HostRateLimit, "idle_probe", caps.IdleProbe, "deny_targets", caps.DenyTargets)
+	}
+	return caps, nil
+}
+
+// refreshCapabilities fetches the server's policy over a new session.
+// Older servers don't say, which is fine.
+func (c *Client) refreshCapabilities(session *yamux.Session) {
+	defer c.wg.Done()
+	ctx, cancel := withTimeout(c.ctx, c.handshakeTimeout)
+	defer cancel()
+	if _, err := c.fetchCapabilities(ctx, session); err != nil {
+		c.log.Debug("couldn't fetch server capabilities", "error", err)
+	}
+}
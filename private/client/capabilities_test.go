@@ -0,0 +1,76 @@
+package client
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/jtolio/netpump-go/private/server"
+)
+
+// socksConnect asks the SOCKS5 proxy at proxyAddr to connect to target,
+// an IPv4 address or a host name and port, and returns the reply's REP
+// byte.
+func socksConnect(t *testing.T, proxyAddr, target string) byte {
+	t.Helper()
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := []byte{socks5Version, 1, 0, socks5Version, 1, 0}
+	if ip := net.ParseIP(host).To4(); ip != nil {
+		req = append(append(req, 1), ip...)
+	} else {
+		req = append(append(req, 3, byte(len(host))), host...)
+	}
+	req = binary.BigEndian.AppendUint16(req, uint16(port))
+	if _, err := conn.Write(req); err != nil {
+		t.Fatal(err)
+	}
+	// The method selection, then the reply up to REP.
+	reply := make([]byte, 4)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatal(err)
+	}
+	return reply[3]
+}
+
+func TestCapabilitiesDenialRepliesRuleset(t *testing.T) {
+	streams := &streamCounter{}
+	tn := startTunnel(t, nil, server.WithDenyTargets("127.0.0.0/8"), server.WithMetricsSink(streams))
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if _, ok := tn.client.ServerCapabilities(); ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("capabilities weren't fetched")
+		}
+	}
+	target, accepted := countingTarget(t)
+
+	if rep := socksConnect(t, tn.socksAddr, target); rep != socksRuleFailure {
+		t.Fatalf("REP = %#x, want %#x", rep, socksRuleFailure)
+	}
+	if n := streams.n.Load(); n != 0 {
+		t.Fatalf("%d streams relayed by the server, want the client to refuse", n)
+	}
+	select {
+	case <-accepted:
+		t.Fatal("target was reached")
+	default:
+	}
+}
@@ -2,56 +2,276 @@ package client
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
-	"io"
+	"hash/fnv"
+	"html/template"
 	"log/slog"
 	"net"
 	"net/http"
+	"net/url"
+	"runtime/debug"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/armon/go-socks5"
 	"github.com/gorilla/websocket"
 	"github.com/hashicorp/yamux"
+
+	"github.com/jtolio/netpump-go/private/eventlog"
+	"github.com/jtolio/netpump-go/private/protocol"
+	"github.com/jtolio/netpump-go/private/wsconn"
 )
 
 type Client struct {
 	host        string
 	port        int
+	proxyHost   string
 	proxyPort   int
-	serverURL   string
+	serverToken string
 	log         *slog.Logger
-	server      *http.Server
-	socksServer *socks5.Server
-	ctx         context.Context
-	cancel      context.CancelFunc
+	sharedPort  bool
+
+	// How to bind the web interface's port while it's taken; see
+	// WithWebBindRetry.
+	webBindWait     time.Duration
+	webBindFallback bool
+
+	banner       string
+	bannerIsHTML bool
+	webDir       string
+	labelRules   []LabelRule
+	labels       labels
+	page         *template.Template
+	maxSocks     int
+	socksTLS     *tls.Config
+	socksUsers   map[string]string
+	socksRules   atomic.Pointer[[]socks5.RuleSet]
+	onStreamEnd  func(StreamEnd)
+	sendSource   bool
+	wantReasons  bool
+	webUser      string
+	webPass      string
+	events       *eventlog.Ring
+	dashboard    bool
+	logSampler   *logSampler
+	maxFrame     int
+	streamWindow int
+	subSessions  int
+
+	hostOverrides map[string]string // lower case host names, without a trailing dot
+	pacDirect     []string          // hosts /proxy.pac sends DIRECT
+	retry         RetryPolicy
+
+	shutdownTimeout time.Duration
+	writeTimeout    time.Duration
+	server          *http.Server
+	socksServer     *socks5.Server
+	socksLn         net.Listener
+	ctx             context.Context
+	cancel          context.CancelFunc
 
-	// Multiplexing
+	// More timeouts, set by WithTimeouts. Zero means off.
+	browserWait      time.Duration
+	reconnectGrace   time.Duration
+	handshakeTimeout time.Duration
+	keepAlive        time.Duration
+
+	// Teardown tracking
+	wg         sync.WaitGroup
+	socksWG    sync.WaitGroup
+	trackMu    sync.Mutex
+	stopping   bool
+	stopped    chan struct{} // closed once the first Shutdown returns
+	socksConns map[net.Conn]struct{}
+	handshakes sync.Map // remote address -> *socksConn still in its SOCKS5 handshake
+
+	// Multiplexing. muxGen counts the sessions installed so far, so that
+	// a dial or a handler exiting can tell its session was superseded.
 	muxSession *yamux.Session
-	muxMu      sync.Mutex
-	wsConn     *websocket.Conn
+	// muxSessions are all of the websocket's sub-sessions, starting with
+	// muxSession.
+	muxSessions []*yamux.Session
+	muxGen      uint64
+	muxMu       sync.Mutex
+	wsConn      *websocket.Conn
+	rtt         time.Duration // last measured for muxSession, 0 if none yet
+	// connectedSince is when muxSession was installed, zero if none.
+	connectedSince time.Time
+	// muxReady is closed, and replaced, whenever a session is installed
+	// or the tunnel paused, so waiting dials can react right away.
+	muxReady chan struct{}
+	// openStreams maps a streamKey to the *streamInfo of every tunneled
+	// stream not yet closed.
+	openStreams sync.Map
+
+	// serverURL changes when the server migrates, which the session's
+	// reader learns of. Closing the session waits for that reader, so
+	// serverURL has a lock of its own rather than muxMu.
+	urlMu     sync.Mutex
+	serverURL string
+
+	// Pausing, guarded by muxMu
+	paused          bool
+	pauseDisconnect bool
+
+	// throttle refuses browsers that keep sending invalid data.
+	throttle browserThrottle
+
+	// caps is the server's policy as last fetched, nil if never.
+	caps atomic.Pointer[protocol.Capabilities]
+
+	// parked is set while the browser is kept from reconnecting after the
+	// server closed the tunnel for being idle, until a dial needs it
+	// again. It's set from the session's reader, which closing the
+	// session waits for, so it can't be guarded by muxMu.
+	parked atomic.Bool
 }
 
-func New(host string, port int, proxyPort int, serverURL string) *Client {
+// rttInterval is how often the round trip time to the server is measured.
+const rttInterval = 5 * time.Second
+
+// ErrPaused is returned for SOCKS5 dials while the tunnel is paused.
+var ErrPaused = errors.New("tunnel is paused")
+
+// ErrDenied is wrapped by dial errors for targets the server's policy
+// refuses.
+var ErrDenied = errors.New("target denied by server policy")
+
+// ErrInvalidConfig is wrapped by Start's errors for options that can't
+// be used as given, as opposed to failures while running.
+var ErrInvalidConfig = errors.New("invalid configuration")
+
+func New(host string, port int, proxyPort int, serverURL string, opts ...Option) *Client {
 	ctx, cancel := context.WithCancel(context.Background())
-	return &Client{
+	c := &Client{
 		host:      host,
 		port:      port,
+		proxyHost: "127.0.0.1",
 		proxyPort: proxyPort,
 		serverURL: serverURL,
 		log:       slog.Default().With("component", "client"),
 		ctx:       ctx,
 		cancel:    cancel,
+
+		socksConns:   make(map[net.Conn]struct{}),
+		stopped:      make(chan struct{}),
+		muxReady:     make(chan struct{}),
+		writeTimeout: wsconn.DefaultWriteTimeout,
+		retry:        DefaultRetryPolicy,
+
+		browserWait:      defaultBrowserWait,
+		reconnectGrace:   defaultReconnectGrace,
+		handshakeTimeout: defaultHandshake,
+		keepAlive:        yamux.DefaultConfig().KeepAliveInterval,
+
+		throttle: browserThrottle{limit: defaultInvalidDataLimit, cooldown: defaultInvalidDataCooldown},
+	}
+	for _, opt := range opts {
+		opt(c)
 	}
+	if c.sharedPort {
+		c.proxyHost = c.host
+		c.proxyPort = c.port
+	}
+	if c.events != nil {
+		c.log = slog.New(c.events.Handler(slog.Default().Handler())).With("component", "client")
+	}
+	return c
+}
+
+// NormalizeServerURL checks that raw is a usable server URL and returns it
+// without trailing slashes. The browser connects to it, so it must be a
+// ws:// or wss:// URL with a host and no query; tokens are passed with
+// WithServerToken.
+func NormalizeServerURL(raw string) (string, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", fmt.Errorf("invalid server URL: %w", err)
+	}
+	switch u.Scheme {
+	case "ws", "wss":
+	case "http", "https":
+		return "", fmt.Errorf("invalid server URL %q: use ws:// or wss:// instead of %s://", raw, u.Scheme)
+	default:
+		return "", fmt.Errorf("invalid server URL %q: scheme must be ws:// or wss://", raw)
+	}
+	if u.Host == "" {
+		return "", fmt.Errorf("invalid server URL %q: missing host", raw)
+	}
+	if u.RawQuery != "" || u.Fragment != "" {
+		return "", fmt.Errorf("invalid server URL %q: no query or fragment allowed", raw)
+	}
+	u.Path = strings.TrimRight(u.Path, "/")
+	u.RawPath = ""
+	return u.String(), nil
+}
+
+// migrate follows a server going away to the one at serverURL, as it
+// asked. The browser page reconnects there by itself; this points pages
+// served from now on there too.
+func (c *Client) migrate(serverURL string) {
+	u, err := NormalizeServerURL(serverURL)
+	if err != nil {
+		c.log.Warn("server asked to migrate to a bad URL", "error", err)
+		return
+	}
+	c.urlMu.Lock()
+	c.serverURL = u
+	c.urlMu.Unlock()
+	c.log.Info("server is going away, migrating to another", "server", u)
+}
+
+// park keeps the browser from reconnecting once the server closes the
+// tunnel for being idle, until a dial needs it. The browser keeps trying
+// every second meanwhile, so that's how soon it's back.
+func (c *Client) park() {
+	c.parked.Store(true)
+	c.log.Info("server is closing the idle tunnel, reconnecting when needed")
+}
+
+// proxyAddr is the address the SOCKS5 proxy listens on.
+func (c *Client) proxyAddr() string {
+	return net.JoinHostPort(c.proxyHost, strconv.Itoa(c.proxyPort))
+}
+
+// webAddr is the address the web interface listens on.
+func (c *Client) webAddr() string {
+	return net.JoinHostPort(c.host, strconv.Itoa(c.port))
 }
 
 func (c *Client) Start() error {
 	c.log.Info("netpump client starting")
 
-	// Configure SOCKS5 server with custom dialer
+	serverURL, err := NormalizeServerURL(c.serverURL)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidConfig, err)
+	}
+	c.serverURL = serverURL
+	if c.subSessions > wsconn.MaxDemux {
+		return fmt.Errorf("%w: at most %d sub-sessions are supported", ErrInvalidConfig, wsconn.MaxDemux)
+	}
+	if c.streamWindow != 0 && (c.streamWindow < minStreamWindow || c.streamWindow > maxStreamWindow) {
+		return fmt.Errorf("%w: stream window must be between %d and %d bytes", ErrInvalidConfig, minStreamWindow, maxStreamWindow)
+	}
+
+	// Configure SOCKS5 server with custom dialer. Only CONNECT is served:
+	// go-socks5 answers UDP ASSOCIATE with "command not supported", and
+	// the tunnel carries TCP streams only, so UDP datagrams (and their
+	// FRAG byte) never reach us.
 	conf := &socks5.Config{
-		Dial: c.dialThroughTunnel,
+		Dial:     c.dialThroughTunnel,
+		Resolver: remoteResolver{},
 	}
+	if c.socksUsers != nil {
+		conf.Credentials = socks5.StaticCredentials(c.socksUsers)
+	}
+	conf.Rules = socksRule{c}
 
 	socksServer, err := socks5.New(conf)
 	if err != nil {
@@ -59,17 +279,28 @@ func (c *Client) Start() error {
 	}
 	c.socksServer = socksServer
 
-	// Start SOCKS5 proxy
-	proxyAddr := fmt.Sprintf("127.0.0.1:%d", c.proxyPort)
-	go func() {
-		c.log.Info("SOCKS5 proxy ready", "addr", proxyAddr)
-		if err := c.socksServer.ListenAndServe("tcp", proxyAddr); err != nil {
-			c.log.Error("SOCKS5 server error", "error", err)
+	// Start SOCKS5 proxy, unless it shares the web interface's port
+	if !c.sharedPort {
+		proxyAddr := c.proxyAddr()
+		socksLn, err := net.Listen("tcp", proxyAddr)
+		if err != nil {
+			return fmt.Errorf("failed to listen for SOCKS5: %w", err)
 		}
-	}()
+		if c.socksTLS != nil {
+			socksLn = tls.NewListener(socksLn, c.socksTLS)
+		}
+		c.socksLn = socksLn
+		c.log.Info("SOCKS5 proxy ready", "addr", proxyAddr, "tls", c.socksTLS != nil)
+		if c.track() {
+			go c.serveSocks()
+		}
+	}
 
 	// Start web interface (browser will connect to server)
 	if err := c.startWebInterface(); err != nil {
+		if c.socksLn != nil {
+			c.socksLn.Close()
+		}
 		return fmt.Errorf("failed to start web interface: %w", err)
 	}
 
@@ -77,88 +308,801 @@ func (c *Client) Start() error {
 	return nil
 }
 
-func (c *Client) Stop() {
+// Stop shuts the client down and waits until its listeners, the mux
+// session and all of its goroutines are gone, so the ports are free again
+// once it returns.
+func (c *Client) Stop() error {
+	return c.Shutdown(context.Background())
+}
+
+// Shutdown is like Stop, but gives up waiting for teardown once ctx is
+// done, returning ctx.Err() along with any errors from closing.
+//
+// New SOCKS5 connections are refused right away. Connections already in
+// flight get up to the shutdown timeout to finish before the tunnel is
+// forcibly closed underneath them.
+//
+// It's safe to call more than once, and concurrently: later calls wait for
+// the first one's teardown, or for their own ctx, and return nil.
+func (c *Client) Shutdown(ctx context.Context) error {
+	c.trackMu.Lock()
+	if c.stopping {
+		c.trackMu.Unlock()
+		select {
+		case <-c.stopped:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	c.stopping = true
+	c.trackMu.Unlock()
+	defer close(c.stopped)
+
+	var errs []error
+	if c.socksLn != nil {
+		if err := c.socksLn.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+			errs = append(errs, err)
+		}
+	}
+	if c.server != nil {
+		if err := c.server.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if !waitTimeout(ctx, &c.socksWG, c.shutdownTimeout) {
+		c.log.Warn("shutdown timeout reached, closing remaining connections")
+	}
 	c.cancel()
+
+	c.muxMu.Lock()
 	if c.muxSession != nil {
-		c.muxSession.Close()
+		if err := c.muxSession.Close(); err != nil {
+			errs = append(errs, err)
+		}
 	}
 	if c.wsConn != nil {
 		c.wsConn.Close()
 	}
-	if c.server != nil {
-		c.server.Close()
+	c.muxMu.Unlock()
+
+	c.trackMu.Lock()
+	for conn := range c.socksConns {
+		conn.Close()
+	}
+	c.trackMu.Unlock()
+
+	if !waitTimeout(ctx, &c.wg, -1) {
+		errs = append(errs, ctx.Err())
+	}
+	return errors.Join(errs...)
+}
+
+// Pause stops tunneling new connections until Resume. Dials fail with
+// ErrPaused, while connections already open carry on unless disconnect is
+// set, in which case the browser's session is closed and refused until
+// Resume.
+func (c *Client) Pause(disconnect bool) {
+	c.muxMu.Lock()
+	defer c.muxMu.Unlock()
+	c.paused = true
+	c.pauseDisconnect = disconnect
+	if disconnect && c.muxSession != nil {
+		for _, s := range c.muxSessions {
+			s.Close()
+		}
+		c.muxSession = nil
+		c.muxSessions = nil
+	}
+	c.wakeDials()
+	c.log.Info("tunnel paused", "disconnect", disconnect)
+}
+
+// Resume lifts a previous Pause. If the session was closed, the browser
+// reconnects on its own.
+func (c *Client) Resume() {
+	c.muxMu.Lock()
+	defer c.muxMu.Unlock()
+	if !c.paused {
+		return
+	}
+	c.paused = false
+	c.pauseDisconnect = false
+	c.log.Info("tunnel resumed")
+}
+
+// Paused reports whether the tunnel is paused.
+func (c *Client) Paused() bool {
+	c.muxMu.Lock()
+	defer c.muxMu.Unlock()
+	return c.paused
+}
+
+// waitTimeout waits for wg, giving up when ctx is done or, if timeout is
+// not negative, once timeout has passed. It reports whether wg finished.
+func waitTimeout(ctx context.Context, wg *sync.WaitGroup, timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	var expired <-chan time.Time
+	if timeout >= 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	select {
+	case <-done:
+		return true
+	case <-expired:
+	case <-ctx.Done():
+	}
+	return false
+}
+
+// track registers a goroutine with the client's WaitGroup. It refuses once
+// shutdown has begun so that Add never races with Wait.
+func (c *Client) track() bool {
+	c.trackMu.Lock()
+	defer c.trackMu.Unlock()
+	if c.stopping {
+		return false
+	}
+	c.wg.Add(1)
+	return true
+}
+
+func (c *Client) serveSocks() {
+	defer c.wg.Done()
+	for {
+		conn, err := c.socksLn.Accept()
+		if err != nil {
+			// Shutdown closes the listener before cancelling c.ctx, so
+			// check stopping too.
+			c.trackMu.Lock()
+			stopping := c.stopping
+			c.trackMu.Unlock()
+			if !stopping && c.ctx.Err() == nil {
+				c.log.Error("SOCKS5 server error", "error", err)
+			}
+			return
+		}
+		go c.handleSocks(conn)
+	}
+}
+
+func (c *Client) handleSocks(conn net.Conn) {
+	c.trackMu.Lock()
+	if c.stopping {
+		c.trackMu.Unlock()
+		conn.Close()
+		return
+	}
+	if c.maxSocks > 0 && len(c.socksConns) >= c.maxSocks {
+		c.trackMu.Unlock()
+		conn.Close()
+		c.log.Warn("too many SOCKS5 connections, refusing", "remote", conn.RemoteAddr().String(), "max", c.maxSocks)
+		return
+	}
+	c.wg.Add(1)
+	c.socksWG.Add(1)
+	c.socksConns[conn] = struct{}{}
+	c.trackMu.Unlock()
+	defer c.wg.Done()
+	defer c.socksWG.Done()
+	defer func() {
+		c.trackMu.Lock()
+		delete(c.socksConns, conn)
+		c.trackMu.Unlock()
+	}()
+	defer conn.Close()
+	defer func() {
+		if r := recover(); r != nil {
+			c.log.Error("panic serving SOCKS5 connection", "remote", conn.RemoteAddr().String(), "panic", r, "stack", string(debug.Stack()))
+		}
+	}()
+
+	if tc, ok := conn.(*tls.Conn); ok {
+		ctx, cancel := withTimeout(c.ctx, c.handshakeTimeout)
+		err := tc.HandshakeContext(ctx)
+		cancel()
+		if err != nil {
+			c.log.Warn("SOCKS5 TLS handshake failed", "remote", conn.RemoteAddr().String(), "error", err)
+			return
+		}
+	}
+
+	// Connections that don't get through the handshake in time, say
+	// because they aren't speaking SOCKS5 at all, are dropped rather than
+	// held open.
+	remote := conn.RemoteAddr().String()
+	var deadline time.Time
+	if c.handshakeTimeout > 0 {
+		deadline = time.Now().Add(c.handshakeTimeout)
+	}
+	conn.SetDeadline(deadline)
+	sc := newSocksConn(conn)
+	key := handshakeKey(conn.RemoteAddr())
+	c.handshakes.Store(key, sc)
+	err := c.socksServer.ServeConn(sc)
+	if _, pending := c.handshakes.LoadAndDelete(key); pending && err != nil {
+		// go-socks5 flattens errors into strings, so go by the clock.
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			c.log.Warn("SOCKS5 handshake timed out", "remote", remote)
+		} else {
+			c.log.Warn("malformed SOCKS5 handshake", "remote", remote, "error", err)
+		}
+	}
+}
+
+// handshakeKey is the key in c.handshakes for a SOCKS5 client at addr. It
+// leaves out the zone of an IPv6 address, as go-socks5 does with the
+// address it hands socksRule.
+func handshakeKey(addr net.Addr) string {
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		return net.JoinHostPort(tcp.IP.String(), strconv.Itoa(tcp.Port))
+	}
+	return addr.String()
+}
+
+// socksRuleFailure is the SOCKS5 reply for a connection not allowed by
+// ruleset.
+const socksRuleFailure = 0x02
+
+// socksConn wraps a local SOCKS5 connection so that a reset of the tunneled
+// stream reaches the application as a TCP reset instead of a clean close.
+// The tunneled stream calls reset as soon as either of go-socks5's copies
+// runs into the reset, as go-socks5 would otherwise close the connection,
+// or send a FIN via CloseWrite, ahead of it.
+//
+// It also turns go-socks5's failure reply into "connection not allowed by
+// ruleset" once the server has denied the target, as go-socks5 only sends
+// that for its own rules.
+type socksConn struct {
+	net.Conn
+	tcp    *net.TCPConn
+	tls    *tls.Conn
+	denied atomic.Bool
+}
+
+func newSocksConn(conn net.Conn) *socksConn {
+	s := &socksConn{Conn: conn}
+	inner := conn
+	if sc, ok := conn.(*sniffConn); ok {
+		inner = sc.Conn
+	}
+	if tc, ok := inner.(*tls.Conn); ok {
+		s.tls = tc
+		inner = tc.NetConn()
+	}
+	s.tcp, _ = inner.(*net.TCPConn)
+	return s
+}
+
+func (s *socksConn) Write(p []byte) (int, error) {
+	if s.denied.CompareAndSwap(true, false) && len(p) >= 2 && p[0] == socks5Version {
+		reply := append([]byte(nil), p...)
+		reply[1] = socksRuleFailure
+		return s.Conn.Write(reply)
+	}
+	return s.Conn.Write(p)
+}
+
+// reset closes the connection with a TCP reset, or just closes it if it
+// isn't TCP.
+func (s *socksConn) reset() {
+	if s.tcp != nil {
+		s.tcp.SetLinger(0)
+	}
+	s.Close()
+}
+
+func (s *socksConn) CloseWrite() error {
+	if s.tls != nil {
+		return s.tls.CloseWrite()
+	}
+	if s.tcp == nil {
+		return nil
+	}
+	return s.tcp.CloseWrite()
+}
+
+// SetSocksRules replaces the rules of WithSocksRules, as for a
+// configuration reload. They apply to SOCKS5 requests from then on. No
+// rules let every request through.
+func (c *Client) SetSocksRules(rules ...socks5.RuleSet) {
+	rules = append([]socks5.RuleSet(nil), rules...)
+	c.socksRules.Store(&rules)
+	c.log.Info("SOCKS5 rules changed", "rules", len(rules))
+}
+
+// remoteResolver leaves hostnames for the server to resolve, so lookups
+// happen on the server's network and the server sees which host was
+// asked for.
+type remoteResolver struct{}
+
+func (remoteResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	return ctx, nil, nil
+}
+
+type sourceKey struct{}
+
+// socksConnKey holds the *socksConn a dial is for in its context.
+type socksConnKey struct{}
+
+// socksRule permits SOCKS5 requests that the WithSocksRules rules, if
+// any, all do. go-socks5 consults it once a request has been read, which
+// ends the connection's handshake phase. It passes the connection on to
+// dialThroughTunnel in the context, and with WithSendSource also notes
+// the address of the SOCKS5 client in the context handed to
+// dialThroughTunnel.
+type socksRule struct{ c *Client }
+
+func (r socksRule) Allow(ctx context.Context, req *socks5.Request) (context.Context, bool) {
+	if req.RemoteAddr != nil {
+		key := handshakeKey(&net.TCPAddr{IP: req.RemoteAddr.IP, Port: req.RemoteAddr.Port})
+		if conn, ok := r.c.handshakes.LoadAndDelete(key); ok {
+			conn.(*socksConn).SetDeadline(time.Time{})
+			ctx = context.WithValue(ctx, socksConnKey{}, conn)
+		}
+		if r.c.sendSource {
+			ctx = context.WithValue(ctx, sourceKey{}, req.RemoteAddr.Address())
+		}
+	}
+	rules := r.c.socksRules.Load()
+	if rules == nil {
+		return ctx, true
+	}
+	for _, rule := range *rules {
+		var ok bool
+		if ctx, ok = rule.Allow(ctx, req); !ok {
+			return ctx, false
+		}
 	}
+	return ctx, true
 }
 
 // dialThroughTunnel is called by the SOCKS5 server for each connection
-func (c *Client) dialThroughTunnel(ctx context.Context, network, addr string) (net.Conn, error) {
-	// Wait for mux session if not ready (browser not connected yet)
-	var stream net.Conn
-	var err error
-	for retries := 0; retries < 30; retries++ { // Wait up to 30 seconds
+func (c *Client) dialThroughTunnel(ctx context.Context, network, addr string) (_ net.Conn, err error) {
+	// DialContext exposes this to other code, so turn a panic into an error
+	// rather than crashing the caller.
+	defer func() {
+		if r := recover(); r != nil {
+			c.log.Error("panic dialing through tunnel", "target", addr, "panic", r, "stack", string(debug.Stack()))
+			err = fmt.Errorf("internal error dialing %s: %v", addr, r)
+		}
+	}()
+
+	req := protocol.Request{Addr: c.overrideHost(addr), Label: c.label(ctx, addr), WantReason: c.wantReasons}
+	if c.sendSource {
+		req.Source, _ = ctx.Value(sourceKey{}).(string)
+	}
+	// Asking for fields takes the extended request format, which servers
+	// that predate extensions refuse, so only ask when the request needs
+	// that format anyway, or the server answered for its capabilities and
+	// so knows extensions. Only fields carry the bound address. Servers
+	// that don't know fields answer as before.
+	req.WantFields = req.Label != "" || req.Source != "" || req.WantReason || c.caps.Load() != nil
+	// Check what goes to the server, which an override may have made
+	// invalid.
+	if err := protocol.ValidateAddr(req.Addr); err != nil {
+		if req.Addr != addr {
+			return nil, fmt.Errorf("%s, overridden: %w", addr, err)
+		}
+		return nil, err
+	}
+	if caps := c.caps.Load(); caps != nil && caps.Denies(req.Addr) {
+		if sc, ok := ctx.Value(socksConnKey{}).(*socksConn); ok {
+			sc.denied.Store(true)
+		}
+		return nil, fmt.Errorf("%s: %w", addr, ErrDenied)
+	}
+
+	// Setup timings, for finding where a slow connection's time goes. The
+	// server logs its side under the same stream ID.
+	var timing *setupTiming
+	if c.log.Enabled(ctx, slog.LevelDebug) {
+		timing = &setupTiming{start: time.Now()}
+	}
+
+	// Wait for mux session if not ready (browser not connected yet), and
+	// retry failed attempts as the retry policy says, such as on the next
+	// session if the browser reconnects mid-dial.
+	deadline := time.Now().Add(c.browserWait)
+	var dropErr error
+	for logged, attempt := false, 0; ; {
 		c.muxMu.Lock()
-		if c.muxSession != nil {
-			stream, err = c.muxSession.Open()
+		if c.paused {
 			c.muxMu.Unlock()
+			return nil, ErrPaused
+		}
+		session, gen, ready := c.pickSession(req.Label), c.muxGen, c.muxReady
+		if (session == nil || session.IsClosed()) && c.parked.CompareAndSwap(true, false) {
+			c.log.Info("tunnel needed again, letting the browser reconnect")
+		}
+		c.muxMu.Unlock()
+
+		if session != nil && !session.IsClosed() {
+			attempt++
+			if timing != nil {
+				timing.session = time.Now()
+			}
+			stream, resp, err := c.request(session, req, timing)
+			if err == nil && resp.Status == protocol.StatusOK {
+				tc := &tunnelConn{Conn: stream, session: session, local: resp.Bound, maxFrame: c.maxFrame,
+					info: &streamInfo{target: addr, label: req.Label, start: time.Now()}}
+				tc.info.last.Store(tc.info.start.UnixNano())
+				if sc, ok := ctx.Value(socksConnKey{}).(*socksConn); ok {
+					tc.onReset = sc.reset
+				}
+				if timing != nil {
+					c.logSetup(stream.StreamID(), addr, timing, tc)
+				}
+				c.trackStream(session, stream, tc)
+				if req.Label != "" {
+					tc.counter = c.labels.counter(req.Label)
+					tc.counter.streams.Add(1)
+				}
+				if c.logSampler.sample() {
+					attrs := []any{"target", addr}
+					if req.Addr != addr {
+						attrs = append(attrs, "override", req.Addr)
+					}
+					if req.Label != "" {
+						attrs = append(attrs, "label", req.Label)
+					}
+					c.log.Info("connected", attrs...)
+				}
+				return tc, nil
+			}
 			if err == nil {
-				break
+				stream.Close()
+				// Failures are logged whatever the sampling.
+				attrs := []any{"target", addr}
+				if resp.Reason != "" {
+					attrs = append(attrs, "reason", resp.Reason)
+				}
+				c.log.Warn("server couldn't connect", attrs...)
+				err = statusError(resp, addr)
+			} else if c.stale(session, gen) {
+				err = fmt.Errorf("%w: %w", ErrSessionLost, err)
+			}
+			if !c.retry.retry(attempt, err) {
+				if sc, ok := ctx.Value(socksConnKey{}).(*socksConn); ok && resp.Status == protocol.StatusDenied {
+					sc.denied.Store(true)
+				}
+				return nil, err
+			}
+			if errors.Is(err, ErrSessionLost) && dropErr == nil {
+				dropErr = err
+				if grace := time.Now().Add(c.reconnectGrace); grace.Before(deadline) {
+					deadline = grace
+				}
 			}
-			return nil, fmt.Errorf("failed to open stream: %w", err)
+
+			wait := c.retry.delay(attempt)
+			c.log.Info("dial failed, retrying", "target", addr, "attempt", attempt, "delay", wait, "error", err)
+			timer := time.NewTimer(wait)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return nil, ctx.Err()
+			case <-timer.C:
+			}
+			continue
 		}
-		c.muxMu.Unlock()
 
-		if retries == 0 {
+		if !logged && dropErr == nil {
 			c.log.Info("waiting for browser connection...")
+			logged = true
 		}
 
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			if dropErr != nil {
+				return nil, fmt.Errorf("browser didn't reconnect in time: %w", dropErr)
+			}
+			break
+		}
+		timer := time.NewTimer(wait)
 		select {
 		case <-ctx.Done():
+			timer.Stop()
 			return nil, ctx.Err()
-		case <-time.After(1 * time.Second):
+		case <-ready:
+		case <-timer.C:
 		}
+		timer.Stop()
+	}
+
+	return nil, fmt.Errorf("timeout waiting for browser connection")
+}
+
+// statusError describes a failed response from the server, with the
+// server's reason if it gave one. go-socks5 picks its reply by looking for
+// "refused" in the error, and otherwise reports the host unreachable.
+func statusError(resp protocol.Response, addr string) error {
+	var err error
+	switch resp.Status {
+	case protocol.StatusUnresolved:
+		err = fmt.Errorf("server couldn't resolve %s", addr)
+	case protocol.StatusRefused:
+		err = fmt.Errorf("connection to %s refused", addr)
+	case protocol.StatusTimeout:
+		err = fmt.Errorf("server timed out connecting to %s", addr)
+	case protocol.StatusDenied:
+		err = fmt.Errorf("%s: %w", addr, ErrDenied)
+	default:
+		err = fmt.Errorf("server failed to connect to %s", addr)
 	}
+	if resp.Reason != "" {
+		err = fmt.Errorf("%w: %s", err, resp.Reason)
+	}
+	return err
+}
 
-	if stream == nil {
-		return nil, fmt.Errorf("timeout waiting for browser connection")
+// request opens a stream on session and asks the server to connect it as
+// req says, noting the times it got through each step in timing if it's
+// not nil.
+func (c *Client) request(session *yamux.Session, req protocol.Request, timing *setupTiming) (*yamux.Stream, protocol.Response, error) {
+	stream, err := session.OpenStream()
+	if err != nil {
+		return nil, protocol.Response{}, fmt.Errorf("failed to open stream: %w", err)
+	}
+	if timing != nil {
+		timing.opened = time.Now()
 	}
 
 	// Send target address
-	header := []byte{byte(len(addr))}
-	header = append(header, []byte(addr)...)
-	if _, err := stream.Write(header); err != nil {
+	if err := protocol.WriteRequest(stream, req); err != nil {
 		stream.Close()
-		return nil, fmt.Errorf("failed to send target: %w", err)
+		return nil, protocol.Response{}, fmt.Errorf("failed to send target: %w", err)
 	}
 
 	// Read connection status
-	status := make([]byte, 1)
-	if _, err := io.ReadFull(stream, status); err != nil {
+	resp, err := protocol.ReadResponse(stream)
+	if err != nil {
 		stream.Close()
-		return nil, fmt.Errorf("failed to read status: %w", err)
+		return nil, protocol.Response{}, fmt.Errorf("failed to read status: %w", err)
 	}
+	if timing != nil {
+		timing.answered = time.Now()
+	}
+	return stream, resp, nil
+}
 
-	if status[0] != 0x00 {
-		stream.Close()
-		return nil, fmt.Errorf("server failed to connect to %s", addr)
+// setupTiming is when each step of setting up a tunneled stream was done.
+type setupTiming struct {
+	start    time.Time // the dial began
+	session  time.Time // a session was there to open the stream on
+	opened   time.Time // the stream was opened
+	answered time.Time // the server answered, having dialed the target
+}
+
+// logSetup logs how long setting up stream id took at each step, and,
+// once it comes, how long the first byte from the server took after that.
+func (c *Client) logSetup(id uint32, target string, timing *setupTiming, tc *tunnelConn) {
+	c.log.Debug("stream setup", "stream", id, "target", target,
+		"mux_wait", timing.session.Sub(timing.start),
+		"open", timing.opened.Sub(timing.session),
+		"server", timing.answered.Sub(timing.opened))
+	tc.onFirstByte = func() {
+		now := time.Now()
+		c.log.Debug("first byte from server", "stream", id, "target", target,
+			"wait", now.Sub(timing.answered), "total", now.Sub(timing.start))
 	}
+}
+
+// measureRTT pings the server over session every rttInterval until the
+// session closes, keeping c.rtt up to date while it's the current one. A
+// ping that goes unanswered closes the session.
+func (c *Client) measureRTT(session *yamux.Session, gen uint64) {
+	defer c.wg.Done()
+	ticker := time.NewTicker(rttInterval)
+	defer ticker.Stop()
+	for {
+		rtt, err := session.Ping()
+		if err == nil {
+			c.muxMu.Lock()
+			if c.muxGen == gen {
+				c.rtt = rtt
+			}
+			c.muxMu.Unlock()
+		} else if errors.Is(err, yamux.ErrTimeout) {
+			// Typically the device switched networks and the browser's
+			// socket to the server is dead without either end noticing.
+			// Dropping the session makes the browser reconnect now rather
+			// than once TCP gives up.
+			c.log.Warn("server stopped answering pings, dropping session", "generation", gen)
+			session.Close()
+			return
+		}
+		select {
+		case <-ticker.C:
+		case <-session.CloseChan():
+			return
+		}
+	}
+}
+
+// pickSession returns the sub-session for a new connection, or nil if
+// there is no session. Labeled connections always share the same one, so
+// that, say, bulk transfers can be kept apart from interactive traffic;
+// the rest go to the one with the fewest open streams. A sub-session that
+// failed is passed over. muxMu must be held.
+func (c *Client) pickSession(label string) *yamux.Session {
+	if label != "" && len(c.muxSessions) > 1 {
+		h := fnv.New32a()
+		h.Write([]byte(label))
+		if s := c.muxSessions[h.Sum32()%uint32(len(c.muxSessions))]; !s.IsClosed() {
+			return s
+		}
+	}
+	var best *yamux.Session
+	for _, s := range c.muxSessions {
+		if s.IsClosed() {
+			continue
+		}
+		if best == nil || s.NumStreams() < best.NumStreams() {
+			best = s
+		}
+	}
+	if best == nil {
+		return c.muxSession
+	}
+	return best
+}
+
+// wakeDials wakes up the dials waiting for a session. muxMu must be held.
+func (c *Client) wakeDials() {
+	close(c.muxReady)
+	c.muxReady = make(chan struct{})
+}
+
+// stale reports whether session, installed as generation gen, has closed
+// or been replaced by a newer one.
+func (c *Client) stale(session *yamux.Session, gen uint64) bool {
+	c.muxMu.Lock()
+	defer c.muxMu.Unlock()
+	return session.IsClosed() || c.muxGen != gen
+}
+
+// tunnelConn is a tunneled stream whose LocalAddr is the server's end of
+// the connection to the target, which go-socks5 reports as BND.ADDR.
+// Labeled connections count their traffic.
+type tunnelConn struct {
+	net.Conn
+	session  *yamux.Session
+	local    *net.TCPAddr
+	info     *streamInfo
+	counter  *labelCounter
+	onClose  func()
+	maxFrame int
+	// onFirstByte, if set, is called when the first data is read.
+	onFirstByte func()
+	// onReset, if set, is called when reading or writing finds the server
+	// reset the stream.
+	onReset func()
+
+	closed  atomic.Bool
+	failure atomic.Pointer[error] // the first, for StreamEnd
+}
+
+func (t *tunnelConn) LocalAddr() net.Addr {
+	return t.local
+}
+
+func (t *tunnelConn) Close() error {
+	t.closed.Store(true)
+	if t.onClose != nil {
+		t.onClose()
+	}
+	return t.Conn.Close()
+}
 
-	c.log.Info("connected", "target", addr)
-	return stream, nil
+func (t *tunnelConn) Read(b []byte) (int, error) {
+	n, err := t.Conn.Read(b)
+	if n > 0 {
+		t.info.received.Add(int64(n))
+		t.info.last.Store(time.Now().UnixNano())
+		if t.onFirstByte != nil {
+			t.onFirstByte()
+			t.onFirstByte = nil
+		}
+	}
+	if t.counter != nil {
+		t.counter.received.Add(int64(n))
+	}
+	return n, t.failed(err)
+}
+
+func (t *tunnelConn) Write(b []byte) (int, error) {
+	if t.maxFrame > 0 && len(b) > t.maxFrame {
+		// Each write is one yamux frame; see WithMaxFrameBytes.
+		var written int
+		for len(b) > 0 {
+			n, err := t.Write(b[:min(len(b), t.maxFrame)])
+			written += n
+			if err != nil {
+				return written, err
+			}
+			b = b[n:]
+		}
+		return written, nil
+	}
+	n, err := t.Conn.Write(b)
+	if n > 0 {
+		t.info.sent.Add(int64(n))
+		t.info.last.Store(time.Now().UnixNano())
+	}
+	if t.counter != nil {
+		t.counter.sent.Add(int64(n))
+	}
+	return n, t.failed(err)
 }
 
 func (c *Client) startWebInterface() error {
+	web := c.webFS()
+	page, err := template.ParseFS(web, "index.html")
+	if err != nil {
+		return fmt.Errorf("failed to load web interface template: %w", err)
+	}
+	c.page = page
+
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", c.serveHTML)
-	mux.HandleFunc("/ws/local", c.handleLocalWebSocket)
+	mux.Handle("/static/", http.FileServer(http.FS(web)))
+	mux.Handle("/favicon.ico", faviconHandler(web))
+	mux.HandleFunc(localWSPath, c.handleLocalWebSocket)
+	mux.HandleFunc("/stats", c.handleStats)
+	mux.HandleFunc("/proxy.pac", c.handlePAC)
+	mux.HandleFunc("/pause", c.handlePause)
+	mux.HandleFunc("/resume", c.handleResume)
+	if c.dashboard {
+		mux.HandleFunc("/streams", c.handleStreams)
+	}
+	if c.events != nil {
+		mux.Handle("/events", c.events)
+	}
 
+	var handler http.Handler = mux
+	if c.webUser != "" {
+		handler = c.requireLogin(mux)
+	}
+
+	ln, err := c.listenWeb()
+	if err != nil {
+		if c.ctx.Err() != nil {
+			// Shut down while waiting for the port.
+			return nil
+		}
+		return err
+	}
 	c.server = &http.Server{
-		Addr:    fmt.Sprintf("%s:%d", c.host, c.port),
-		Handler: mux,
+		Addr:    c.webAddr(),
+		Handler: handler,
+	}
+	if c.sharedPort {
+		loopbackOnly := c.socksUsers == nil
+		ln = newSniffListener(ln, c.handleSocks, loopbackOnly, c.log)
+		c.log.Info("SOCKS5 proxy ready", "addr", c.server.Addr, "loopback_only", loopbackOnly)
+		if loopbackOnly && !isLoopbackHost(c.host) {
+			c.log.Warn("the shared port is reachable beyond loopback, but SOCKS5 is served only to loopback without logins", "host", c.host)
+		}
 	}
 
+	if !c.track() {
+		ln.Close()
+		return nil
+	}
 	go func() {
-		c.log.Info("web interface ready", "url", fmt.Sprintf("http://%s:%d", c.host, c.port))
-		if err := c.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		defer c.wg.Done()
+		c.log.Info("web interface ready", "url", (&url.URL{Scheme: "http", Host: c.server.Addr}).String())
+		if err := c.server.Serve(ln); err != nil && err != http.ErrServerClosed {
 			c.log.Error("web server error", "error", err)
 		}
 	}()
@@ -166,9 +1110,84 @@ func (c *Client) startWebInterface() error {
 	return nil
 }
 
+// listenWeb binds the web interface's address. While another process has
+// it, it retries for up to c.webBindWait, and then binds another port if
+// c.webBindFallback is set, updating c.port to it.
+func (c *Client) listenWeb() (net.Listener, error) {
+	addr := c.webAddr()
+	ln, err := net.Listen("tcp", addr)
+	if err == nil || !errors.Is(err, syscall.EADDRINUSE) {
+		return ln, err
+	}
+	if c.webBindWait > 0 {
+		c.log.Warn("web interface address in use, retrying", "addr", addr, "wait", c.webBindWait)
+		backoff := RetryPolicy{BaseDelay: 100 * time.Millisecond, MaxDelay: 2 * time.Second, Jitter: 0.2}
+		deadline := time.Now().Add(c.webBindWait)
+		for attempt := 1; err != nil && errors.Is(err, syscall.EADDRINUSE) && time.Now().Before(deadline); attempt++ {
+			t := time.NewTimer(min(backoff.delay(attempt), time.Until(deadline)))
+			select {
+			case <-t.C:
+			case <-c.ctx.Done():
+				t.Stop()
+				return nil, err
+			}
+			ln, err = net.Listen("tcp", addr)
+		}
+		if err == nil {
+			return ln, nil
+		}
+	}
+	if !c.webBindFallback {
+		return nil, err
+	}
+	ln, err = net.Listen("tcp", net.JoinHostPort(c.host, "0"))
+	if err != nil {
+		return nil, err
+	}
+	c.port = ln.Addr().(*net.TCPAddr).Port
+	if c.sharedPort {
+		c.proxyPort = c.port
+	}
+	c.log.Warn("web interface address in use, using another port", "addr", addr, "port", c.port)
+	return ln, nil
+}
+
 func (c *Client) handleLocalWebSocket(w http.ResponseWriter, r *http.Request) {
+	// The http.Server doesn't wait for hijacked connections on Close, so
+	// track this handler ourselves.
+	if !c.track() {
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	defer c.wg.Done()
+
+	// The browser retries every second, so don't log these.
+	c.muxMu.Lock()
+	refuse := c.paused && c.pauseDisconnect
+	c.muxMu.Unlock()
+	if refuse {
+		http.Error(w, ErrPaused.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if c.parked.Load() {
+		http.Error(w, "tunnel idle until a connection needs it", http.StatusServiceUnavailable)
+		return
+	}
+	addr := browserAddr(r.RemoteAddr)
+	if c.throttle.refused(addr, time.Now()) {
+		http.Error(w, "too many invalid sessions, try again later", http.StatusTooManyRequests)
+		return
+	}
+
+	// Only the page the web interface serves may carry the tunnel, not
+	// any other site open in the browser.
+	if !sameOrigin(r) {
+		c.log.Warn("rejected websocket from another origin", "browser", addr, "origin", r.Header.Get("Origin"))
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
 	upgrader := websocket.Upgrader{
-		CheckOrigin: func(r *http.Request) bool { return true },
+		CheckOrigin: func(r *http.Request) bool { return true }, // checked above
 	}
 
 	ws, err := upgrader.Upgrade(w, r, nil)
@@ -182,78 +1201,85 @@ func (c *Client) handleLocalWebSocket(w http.ResponseWriter, r *http.Request) {
 
 	// Store the websocket connection for yamux
 	c.muxMu.Lock()
+	if c.ctx.Err() != nil {
+		c.muxMu.Unlock()
+		return
+	}
+	if c.paused && c.pauseDisconnect || c.parked.Load() {
+		c.muxMu.Unlock()
+		return
+	}
+	// A previous browser connection may still be around, e.g. if the page
+	// reloaded before the old socket noticed. Retire it for good.
+	if c.muxSession != nil {
+		c.muxSession.Close()
+	}
 	if c.wsConn != nil {
 		c.wsConn.Close()
 	}
 	c.wsConn = ws
 
-	// Setup yamux session
-	conn := &wsAdapter{ws: ws}
-	session, err := yamux.Server(conn, nil) // Server side of yamux since browser is client
-	if err != nil {
-		c.muxMu.Unlock()
-		c.log.Error("yamux setup failed", "error", err)
-		return
+	// Setup yamux sessions, Server side since browser is client
+	conns := []*wsconn.Conn{wsconn.New(ws)}
+	if c.subSessions > 1 {
+		conns = wsconn.Demux(ws, c.subSessions)
 	}
+	conns[0].OnMigrate(c.migrate)
+	conns[0].OnIdle(c.park)
+	sessions := make([]*yamux.Session, len(conns))
+	for i, conn := range conns {
+		conn.SetWriteTimeout(c.writeTimeout)
+		var err error
+		if sessions[i], err = yamux.Server(conn, c.muxConfig()); err != nil {
+			c.muxMu.Unlock()
+			c.log.Error("yamux setup failed", "error", err)
+			ws.Close()
+			return
+		}
+	}
+	session := sessions[0]
 	c.muxSession = session
+	c.muxSessions = sessions
+	c.muxGen++
+	c.connectedSince = time.Now()
+	c.wakeDials()
+	gen := c.muxGen
 	c.muxMu.Unlock()
 
-	c.log.Info("yamux session established with browser")
-
-	// Keep connection alive
-	<-session.CloseChan()
-
-	c.muxMu.Lock()
-	c.muxSession = nil
-	c.wsConn = nil
-	c.muxMu.Unlock()
+	c.log.Info("yamux session established with browser", "generation", gen)
 
-	c.log.Info("browser disconnected")
-}
-
-// wsAdapter adapts websocket to net.Conn for yamux
-type wsAdapter struct {
-	ws     *websocket.Conn
-	reader io.Reader
-	mu     sync.Mutex
-}
-
-func (w *wsAdapter) Read(b []byte) (int, error) {
-	w.mu.Lock()
-	defer w.mu.Unlock()
-
-	if w.reader == nil {
-		_, r, err := w.ws.NextReader()
-		if err != nil {
-			return 0, err
-		}
-		w.reader = r
+	// They all end with their sessions. The handler is tracked, so
+	// Shutdown can't have started waiting on c.wg yet.
+	c.wg.Add(2 + len(sessions))
+	go c.measureRTT(session, gen)
+	go c.refreshCapabilities(session)
+	for _, session := range sessions {
+		go c.serveControl(session)
 	}
 
-	n, err := w.reader.Read(b)
-	if err == io.EOF {
-		w.reader = nil
-		return n, nil
+	// Keep connection alive. The other sub-sessions can fail on their own,
+	// but go when the primary one does.
+	<-session.CloseChan()
+	for _, s := range sessions[1:] {
+		s.Close()
 	}
-	return n, err
-}
-
-func (w *wsAdapter) Write(b []byte) (int, error) {
-	err := w.ws.WriteMessage(websocket.BinaryMessage, b)
-	if err != nil {
-		return 0, err
+	for _, s := range sessions {
+		if err := sessionErr(s); isInvalidData(err) {
+			c.invalidData(addr, err)
+			break
+		}
 	}
-	return len(b), nil
-}
 
-func (w *wsAdapter) Close() error {
-	return w.ws.Close()
-}
-
-func (w *wsAdapter) LocalAddr() net.Addr {
-	return w.ws.LocalAddr()
-}
+	// Only clear the session if a newer one hasn't taken its place.
+	c.muxMu.Lock()
+	if c.muxGen == gen {
+		c.muxSession = nil
+		c.muxSessions = nil
+		c.wsConn = nil
+		c.rtt = 0
+		c.connectedSince = time.Time{}
+	}
+	c.muxMu.Unlock()
 
-func (w *wsAdapter) RemoteAddr() net.Addr {
-	return w.ws.RemoteAddr()
+	c.log.Info("browser disconnected")
 }
@@ -0,0 +1,901 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"golang.org/x/net/proxy"
+
+	"github.com/jtolio/netpump-go/private/protocol"
+	"github.com/jtolio/netpump-go/private/server"
+	"github.com/jtolio/netpump-go/private/wsconn"
+)
+
+// freePort returns a loopback port nothing is listening on.
+func freePort(t *testing.T) int {
+	t.Helper()
+	return freePortOn(t, "127.0.0.1")
+}
+
+// freePortOn returns a port nothing is listening on at host.
+func freePortOn(t *testing.T, host string) int {
+	t.Helper()
+	ln, err := net.Listen("tcp", net.JoinHostPort(host, "0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+// waitListening waits for something to listen on addr.
+func waitListening(t *testing.T, addr string) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if conn, err := net.Dial("tcp", addr); err == nil {
+			conn.Close()
+			return
+		}
+	}
+	t.Fatalf("nothing listening on %s", addr)
+}
+
+// tunnel is a client and server connected the way the browser page
+// connects them.
+type tunnel struct {
+	client    *Client
+	server    *server.Server
+	socksAddr string
+	serverURL string
+	localURL  string
+	// stalled, while set, has the relay drop messages as a dead network
+	// would, without closing either websocket.
+	stalled atomic.Bool
+}
+
+// startTunnel starts a server with sopts and a client with copts, and
+// relays between them like the browser page, reconnecting whenever the
+// client's websocket goes away. It returns once the tunnel is up.
+func startTunnel(t *testing.T, copts []Option, sopts ...server.Option) *tunnel {
+	t.Helper()
+	return startTunnelOn(t, "127.0.0.1", copts, sopts...)
+}
+
+// startTunnelOn is startTunnel with the server, the client's web interface
+// and its SOCKS5 proxy all listening on host.
+func startTunnelOn(t *testing.T, host string, copts []Option, sopts ...server.Option) *tunnel {
+	t.Helper()
+	tn := &tunnel{}
+
+	serverAddr := net.JoinHostPort(host, strconv.Itoa(freePortOn(t, host)))
+	tn.serverURL = "ws://" + serverAddr
+	tn.server = server.New(host, mustPort(serverAddr), sopts...)
+	go tn.server.Start()
+	t.Cleanup(func() { tn.server.Stop() })
+	waitListening(t, serverAddr)
+
+	tn.socksAddr = net.JoinHostPort(host, strconv.Itoa(freePortOn(t, host)))
+	copts = append([]Option{WithProxyHost(host)}, copts...)
+	tn.client = New(host, 0, mustPort(tn.socksAddr), tn.serverURL, copts...)
+	go tn.client.Start()
+	waitListening(t, tn.socksAddr)
+
+	local := httptest.NewServer(http.HandlerFunc(tn.client.handleLocalWebSocket))
+	tn.localURL = "ws" + strings.TrimPrefix(local.URL, "http")
+
+	done := make(chan struct{})
+	relayed := make(chan struct{})
+	go func() {
+		defer close(relayed)
+		relay(tn.localURL, tn.serverURL+"/ws", &tn.stalled, done)
+	}()
+	// Cleanups run last first: the client stops before its relay and the
+	// server.
+	t.Cleanup(func() {
+		close(done)
+		<-relayed
+		local.Close()
+	})
+	t.Cleanup(func() { tn.client.Stop() })
+
+	tn.waitSession(t)
+	return tn
+}
+
+func mustPort(addr string) int {
+	_, port, _ := net.SplitHostPort(addr)
+	n, _ := strconv.Atoi(port)
+	return n
+}
+
+// waitSession waits for the client to have a session with the server.
+func (tn *tunnel) waitSession(t *testing.T) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		tn.client.muxMu.Lock()
+		up := tn.client.muxSession != nil
+		tn.client.muxMu.Unlock()
+		if up {
+			return
+		}
+	}
+	t.Fatal("tunnel didn't come up")
+}
+
+// relay forwards messages between the client's and the server's
+// websockets as the browser page does, reconnecting every so often while
+// the client refuses it or after either side goes away, until done is
+// closed. Messages are dropped while stalled is set. Like the page, it
+// moves to the server a migrate message names, right away.
+func relay(localURL, serverURL string, stalled *atomic.Bool, done <-chan struct{}) {
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		if next := relayOnce(localURL, serverURL, stalled, done); next != "" {
+			serverURL = next
+			continue
+		}
+		select {
+		case <-done:
+			return
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
+
+// relayOnce relays over one pair of websockets until either goes away,
+// returning the websocket URL of the server to move to if the server
+// named one.
+func relayOnce(localURL, serverURL string, stalled *atomic.Bool, done <-chan struct{}) string {
+	local, _, err := websocket.DefaultDialer.Dial(localURL, nil)
+	if err != nil {
+		return ""
+	}
+	defer local.Close()
+	remote, _, err := websocket.DefaultDialer.Dial(serverURL, nil)
+	if err != nil {
+		return ""
+	}
+	defer remote.Close()
+
+	ended := make(chan struct{}, 2)
+	migrate := make(chan string, 1)
+	pipe := func(dst, src *websocket.Conn) {
+		defer func() { ended <- struct{}{} }()
+		for {
+			typ, msg, err := src.ReadMessage()
+			if err != nil {
+				return
+			}
+			if stalled.Load() {
+				continue
+			}
+			if err := dst.WriteMessage(typ, msg); err != nil {
+				return
+			}
+			if typ == websocket.TextMessage && src == remote {
+				if next := migrateURL(serverURL, string(msg)); next != "" {
+					migrate <- next
+					return
+				}
+			}
+		}
+	}
+	go pipe(remote, local)
+	go pipe(local, remote)
+	select {
+	case <-ended:
+	case <-done:
+	}
+	select {
+	case next := <-migrate:
+		return next
+	default:
+	}
+	return ""
+}
+
+// migrateURL returns the websocket URL msg tells the page connected to
+// serverURL to move to, keeping serverURL's query as the page does, or ""
+// if msg isn't a migrate message with a usable URL.
+func migrateURL(serverURL, msg string) string {
+	target, ok := strings.CutPrefix(msg, wsconn.MigrateMessage+" ")
+	if !ok {
+		return ""
+	}
+	next, err := url.Parse(strings.TrimRight(strings.TrimSpace(target), "/") + "/ws")
+	if err != nil || (next.Scheme != "ws" && next.Scheme != "wss") {
+		return ""
+	}
+	if cur, err := url.Parse(serverURL); err == nil {
+		next.RawQuery = cur.RawQuery
+	}
+	return next.String()
+}
+
+// streamCounter is a server.MetricsSink counting the streams the server
+// relays.
+type streamCounter struct{ n atomic.Int64 }
+
+func (c *streamCounter) IncCounter(name string, _ map[string]string, delta float64) {
+	if name == server.MetricStreams {
+		c.n.Add(int64(delta))
+	}
+}
+func (*streamCounter) SetGauge(string, map[string]string, float64)         {}
+func (*streamCounter) ObserveHistogram(string, map[string]string, float64) {}
+
+// dial connects to target through the tunnel's SOCKS5 proxy.
+func (tn *tunnel) dial(target string) (net.Conn, error) {
+	d, err := proxy.SOCKS5("tcp", tn.socksAddr, nil, proxy.Direct)
+	if err != nil {
+		return nil, err
+	}
+	return d.Dial("tcp", target)
+}
+
+// echoTarget listens on loopback, echoing whatever is sent until the
+// test ends, and returns its address.
+func echoTarget(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestTunnel(t *testing.T) {
+	tn := startTunnel(t, nil)
+	conn, err := tn.dial(echoTarget(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, 5)
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "hello" {
+		t.Fatalf("echo = %q, want %q", got, "hello")
+	}
+}
+
+func TestStopWaitsForSessionGoroutines(t *testing.T) {
+	tn := startTunnel(t, nil, server.WithIdleStreamProbe(time.Minute))
+	if err := tn.client.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1<<20)
+	stacks := string(buf[:runtime.Stack(buf, true)])
+	for _, fn := range []string{"measureRTT", "refreshCapabilities", "serveControl"} {
+		if strings.Contains(stacks, "client.(*Client)."+fn) {
+			t.Errorf("%s still running after Stop", fn)
+		}
+	}
+}
+
+func TestStopFreesPorts(t *testing.T) {
+	webAddr := net.JoinHostPort("127.0.0.1", strconv.Itoa(freePort(t)))
+	socksAddr := net.JoinHostPort("127.0.0.1", strconv.Itoa(freePort(t)))
+	c := New("127.0.0.1", mustPort(webAddr), mustPort(socksAddr), "ws://127.0.0.1:1")
+	started := make(chan error, 1)
+	go func() { started <- c.Start() }()
+	waitListening(t, webAddr)
+	waitListening(t, socksAddr)
+
+	// A SOCKS5 client still in its handshake, and a web request, are
+	// open when Stop is called.
+	socks, err := net.Dial("tcp", socksAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer socks.Close()
+	socks.Write([]byte{socks5Version})
+	web, err := net.Dial("tcp", webAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer web.Close()
+
+	if err := c.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	for _, addr := range []string{webAddr, socksAddr} {
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			t.Errorf("binding %s right after Stop: %v", addr, err)
+			continue
+		}
+		ln.Close()
+	}
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Error("Start didn't return after Stop")
+	}
+}
+
+// TestConcurrentStop checks Stop and Shutdown racing each other, with a
+// connection open, tear the client down once and all return cleanly.
+func TestConcurrentStop(t *testing.T) {
+	tn := startTunnel(t, nil)
+	conn, err := tn.dial(echoTarget(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(conn, make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+
+	errs := make(chan error, 4)
+	for i := 0; i < 2; i++ {
+		go func() { errs <- tn.client.Stop() }()
+		go func() { errs <- tn.client.Shutdown(context.Background()) }()
+	}
+	for i := 0; i < 4; i++ {
+		select {
+		case err := <-errs:
+			if err != nil {
+				t.Errorf("call %d: %v", i+1, err)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatal("concurrent Stop calls never returned")
+		}
+	}
+	if err := tn.client.Stop(); err != nil {
+		t.Errorf("Stop after teardown: %v", err)
+	}
+	if ln, err := net.Listen("tcp", tn.socksAddr); err != nil {
+		t.Errorf("binding %s after Stop: %v", tn.socksAddr, err)
+	} else {
+		ln.Close()
+	}
+}
+
+func TestShutdownTimeoutClosesStuckConns(t *testing.T) {
+	// The target holds its connections open without reading or closing
+	// them.
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+		}
+	}()
+
+	const timeout = 200 * time.Millisecond
+	tn := startTunnel(t, []Option{WithShutdownTimeout(timeout)})
+	conn, err := tn.dial(target.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	start := time.Now()
+	if err := tn.client.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if took := time.Since(start); took < timeout || took > timeout+2*time.Second {
+		t.Errorf("Stop took %v with a stuck connection, want about %v", took, timeout)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Error("SOCKS5 connection still readable after Stop")
+	} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Error("SOCKS5 connection still open after Stop")
+	}
+	tn.client.muxMu.Lock()
+	session := tn.client.muxSession
+	tn.client.muxMu.Unlock()
+	if session != nil && !session.IsClosed() {
+		t.Error("tunnel session still open after Stop")
+	}
+}
+
+// TestShutdownStopsAccepting checks Shutdown closes the SOCKS5 listener
+// straight away, while it's still waiting on connections already open.
+func TestShutdownStopsAccepting(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	held := make(chan net.Conn, 1)
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			held <- conn
+		}
+	}()
+
+	tn := startTunnel(t, []Option{WithShutdownTimeout(10 * time.Second)})
+	conn, err := tn.dial(target.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	stuck := <-held
+
+	stopped := make(chan error, 1)
+	start := time.Now()
+	go func() { stopped <- tn.client.Stop() }()
+	for {
+		c, err := net.DialTimeout("tcp", tn.socksAddr, time.Second)
+		if err != nil {
+			break
+		}
+		c.Close()
+		if time.Since(start) > 2*time.Second {
+			t.Fatal("SOCKS5 listener still accepting during Shutdown")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Once the open connection ends at both ends, Shutdown returns
+	// without waiting out the timeout.
+	stuck.Close()
+	conn.Close()
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stop still waiting after the last connection ended")
+	}
+}
+
+// TestStatusSocksReplies checks each reason the server gives for a failed
+// dial turns into the matching SOCKS5 reply.
+func TestStatusSocksReplies(t *testing.T) {
+	const (
+		hostUnreachable = 0x04
+		connRefused     = 0x05
+	)
+	for _, tc := range []struct {
+		name   string
+		sopts  []server.Option
+		target string
+		want   byte
+	}{
+		{"unresolved", nil, "nonexistent.invalid:80", hostUnreachable},
+		{"refused", nil, "", connRefused}, // a port freed just before
+		{"timeout", []server.Option{server.WithTimeouts(server.Timeouts{Dial: time.Nanosecond})}, echoTarget(t), hostUnreachable},
+		{"denied", []server.Option{server.WithDenyTargets("127.0.0.0/8")}, echoTarget(t), socksRuleFailure},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tn := startTunnel(t, nil, tc.sopts...)
+			if tc.target == "" {
+				// Chosen here, so the tunnel can't have taken it since.
+				tc.target = "127.0.0.1:" + strconv.Itoa(freePort(t))
+			}
+			if rep := socksConnect(t, tn.socksAddr, tc.target); rep != tc.want {
+				t.Errorf("REP = %#x, want %#x", rep, tc.want)
+			}
+		})
+	}
+}
+
+// TestFailureReason checks the reason the server gives for a failed dial
+// ends up in the error the dial returns and in the client's log, and only
+// when the client asked for it.
+func TestFailureReason(t *testing.T) {
+	for _, want := range []bool{true, false} {
+		opts := []Option{WithEventLog(100)}
+		if want {
+			opts = append(opts, WithFailureReasons())
+		}
+		tn := startTunnel(t, opts)
+		refused := "127.0.0.1:" + strconv.Itoa(freePort(t))
+		_, err := tn.client.dialThroughTunnel(context.Background(), "tcp", refused)
+		if err == nil || !strings.Contains(err.Error(), "connection to "+refused+" refused") {
+			t.Fatalf("dial to %s: %v", refused, err)
+		}
+
+		var reason string
+		for _, e := range tn.client.events.Events() {
+			if e.Message == "server couldn't connect" && e.Attrs["target"] == refused {
+				reason = e.Attrs["reason"]
+			}
+		}
+		if !want {
+			if reason != "" || strings.Count(err.Error(), "refused") != 1 {
+				t.Errorf("reason %q and error %q without asking", reason, err)
+			}
+			continue
+		}
+		if !strings.Contains(reason, "refused") || len(reason) > protocol.MaxReasonLen {
+			t.Errorf("logged reason %q", reason)
+		}
+		if !strings.HasSuffix(err.Error(), ": "+reason) {
+			t.Errorf("error %q doesn't end with the reason %q", err, reason)
+		}
+	}
+}
+
+// TestStreamEndOnAbruptDisconnect checks the bytes a connection moved are
+// reported exactly when the tunnel goes away under it mid-transfer.
+func TestStreamEndOnAbruptDisconnect(t *testing.T) {
+	ends := make(chan StreamEnd, 1)
+	tn := startTunnel(t, []Option{WithStreamEnd(func(e StreamEnd) { ends <- e })})
+	target := echoTarget(t)
+	conn, err := tn.dial(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	msg := strings.Repeat("x", 100000)
+	if _, err := conn.Write([]byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(conn, make([]byte, len(msg))); err != nil {
+		t.Fatal(err)
+	}
+
+	// The tunnel drops, with the connection still open at both ends.
+	tn.client.muxMu.Lock()
+	tn.client.muxSession.Close()
+	tn.client.muxMu.Unlock()
+
+	select {
+	case end := <-ends:
+		if end.Target != target {
+			t.Errorf("target = %q, want %q", end.Target, target)
+		}
+		if end.Sent != int64(len(msg)) || end.Received != int64(len(msg)) {
+			t.Errorf("sent %d and received %d, want %d each", end.Sent, end.Received, len(msg))
+		}
+		if !errors.Is(end.Err, ErrSessionLost) {
+			t.Errorf("ended with %v, want %v", end.Err, ErrSessionLost)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("connection's end wasn't reported")
+	}
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Error("local connection still open after the tunnel went away")
+	}
+}
+
+func TestTunnelIPv6(t *testing.T) {
+	target, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skipf("no IPv6 loopback: %v", err)
+	}
+	defer target.Close()
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	tn := startTunnelOn(t, "::1", nil)
+	if !strings.HasPrefix(tn.socksAddr, "[::1]:") || !strings.HasPrefix(tn.serverURL, "ws://[::1]:") {
+		t.Fatalf("tunnel at %s and %s, want IPv6 loopback", tn.socksAddr, tn.serverURL)
+	}
+	conn, err := tn.dial(target.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, 5)
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "hello" {
+		t.Errorf("echo = %q, want %q", got, "hello")
+	}
+}
+
+// TestDialsAcrossReconnect checks dials in flight while the browser's
+// session is replaced, again and again, land on the new session. Run it
+// with -race.
+func TestDialsAcrossReconnect(t *testing.T) {
+	tn := startTunnel(t, nil)
+	// The target greets and hangs up, so connections don't outlive the
+	// dials.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte("x"))
+			conn.Close()
+		}
+	}()
+	target := ln.Addr().String()
+
+	stop := make(chan struct{})
+	drops := make(chan int)
+	go func() {
+		n := 0
+		defer func() { drops <- n }()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(100 * time.Millisecond):
+			}
+			tn.client.muxMu.Lock()
+			if s := tn.client.muxSession; s != nil && !s.IsClosed() {
+				s.Close()
+				n++
+			}
+			tn.client.muxMu.Unlock()
+		}
+	}()
+
+	const dialers = 8
+	var dialed atomic.Int64
+	var wg sync.WaitGroup
+	for i := 0; i < dialers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for end := time.Now().Add(time.Second); time.Now().Before(end); {
+				conn, err := tn.dial(target)
+				if err != nil {
+					t.Errorf("dial: %v", err)
+					return
+				}
+				conn.SetDeadline(time.Now().Add(10 * time.Second))
+				if _, err := io.ReadFull(conn, make([]byte, 1)); err == nil {
+					dialed.Add(1)
+				}
+				conn.Close()
+			}
+		}()
+	}
+	wg.Wait()
+	close(stop)
+	if n := <-drops; n < 3 {
+		t.Errorf("session replaced only %d times", n)
+	}
+	if dialed.Load() == 0 {
+		t.Error("no connection reached the target")
+	}
+}
+
+// TestReconnectAfterCarrierDrop checks that once the websocket carrying
+// the tunnel dies, the browser's next session takes over: a dial made
+// meanwhile waits for it and gets through, and it's counted as a
+// reconnect.
+func TestReconnectAfterCarrierDrop(t *testing.T) {
+	tn := startTunnel(t, nil)
+	target := echoTarget(t)
+	if st := tn.client.Stats(); st.Reconnects != 0 {
+		t.Fatalf("%d reconnects before any drop", st.Reconnects)
+	}
+
+	tn.client.muxMu.Lock()
+	old := tn.client.muxSession
+	tn.client.wsConn.Close()
+	tn.client.muxMu.Unlock()
+	<-old.CloseChan()
+
+	conn, err := tn.dial(target)
+	if err != nil {
+		t.Fatalf("dial after the drop: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(conn, make([]byte, 5)); err != nil {
+		t.Fatalf("echo after the drop: %v", err)
+	}
+	st := tn.client.Stats()
+	if st.Reconnects != 1 || !st.Connected {
+		t.Errorf("connected %v with %d reconnects, want connected with 1", st.Connected, st.Reconnects)
+	}
+}
+
+// TestReconnectAfterSilentCarrier checks a carrier that goes quiet, as
+// when a device switches networks, is dropped once a keepalive goes
+// unanswered, and that the browser's reconnect brings the tunnel back.
+func TestReconnectAfterSilentCarrier(t *testing.T) {
+	const keepAlive = 200 * time.Millisecond
+	tn := startTunnel(t, []Option{WithTimeouts(Timeouts{KeepAlive: keepAlive})})
+	target := echoTarget(t)
+
+	tn.client.muxMu.Lock()
+	old := tn.client.muxSession
+	tn.client.muxMu.Unlock()
+	tn.stalled.Store(true)
+	start := time.Now()
+	select {
+	case <-old.CloseChan():
+	case <-time.After(5 * time.Second):
+		t.Fatal("silent session not dropped")
+	}
+	if took := time.Since(start); took > 4*keepAlive {
+		t.Errorf("silent session dropped after %v, want within %v", took, 4*keepAlive)
+	}
+	tn.stalled.Store(false)
+
+	conn, err := tn.dial(target)
+	if err != nil {
+		t.Fatalf("dial after the network change: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(conn, make([]byte, 5)); err != nil {
+		t.Fatalf("echo after the network change: %v", err)
+	}
+	if st := tn.client.Stats(); st.Reconnects != 1 {
+		t.Errorf("%d reconnects, want 1", st.Reconnects)
+	}
+}
+
+func TestMaxSocksConns(t *testing.T) {
+	const max = 2
+	tn := startTunnel(t, []Option{WithMaxSocksConns(max)})
+	// The relay only ends once the target hangs up, so this one echoes
+	// until it reads a q.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				b := make([]byte, 1)
+				for {
+					if _, err := conn.Read(b); err != nil || b[0] == 'q' {
+						return
+					}
+					conn.Write(b)
+				}
+			}()
+		}
+	}()
+	target := ln.Addr().String()
+	echoes := func(conn net.Conn) bool {
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+		if _, err := conn.Write([]byte("x")); err != nil {
+			return false
+		}
+		_, err := io.ReadFull(conn, make([]byte, 1))
+		return err == nil
+	}
+
+	var open []net.Conn
+	for i := 0; i < max; i++ {
+		conn, err := tn.dial(target)
+		if err != nil {
+			t.Fatalf("connection %d: %v", i+1, err)
+		}
+		defer conn.Close()
+		if !echoes(conn) {
+			t.Fatalf("connection %d doesn't echo", i+1)
+		}
+		open = append(open, conn)
+	}
+	if conn, err := tn.dial(target); err == nil {
+		conn.Close()
+		t.Fatal("connection over the cap accepted")
+	}
+
+	// Once one closes there's room again.
+	open[0].Write([]byte("q"))
+	open[0].Close()
+	for deadline := time.Now().Add(5 * time.Second); tn.client.Stats().Connections >= max; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("closed connection still counted")
+		}
+	}
+	conn, err := tn.dial(target)
+	if err != nil {
+		t.Fatalf("connection after one closed: %v", err)
+	}
+	defer conn.Close()
+	if !echoes(conn) || !echoes(open[1]) {
+		t.Error("connections don't echo after one closed")
+	}
+}
+
+func TestNormalizeServerURL(t *testing.T) {
+	for _, tc := range []struct {
+		raw, want, err string
+	}{
+		{"ws://example.com", "ws://example.com", ""},
+		{"wss://example.com:8443/", "wss://example.com:8443", ""},
+		{"wss://example.com/tunnel//", "wss://example.com/tunnel", ""},
+		{"ws://[::1]:8080/", "ws://[::1]:8080", ""},
+		{"http://example.com", "", "use ws:// or wss:// instead of http://"},
+		{"https://example.com", "", "use ws:// or wss:// instead of https://"},
+		{"ftp://example.com", "", "scheme must be ws:// or wss://"},
+		{"example.com:8080", "", "scheme must be ws:// or wss://"},
+		{"", "", "scheme must be ws:// or wss://"},
+		{"ws://", "", "missing host"},
+		{"ws:///path", "", "missing host"},
+		{"ws://example.com/?token=x", "", "no query or fragment allowed"},
+		{"ws://example.com/#frag", "", "no query or fragment allowed"},
+		{"ws://exa mple.com", "", "invalid server URL"},
+		{"ws://example.com:port", "", "invalid server URL"},
+	} {
+		got, err := NormalizeServerURL(tc.raw)
+		if tc.err == "" {
+			if err != nil || got != tc.want {
+				t.Errorf("NormalizeServerURL(%q) = %q, %v, want %q", tc.raw, got, err, tc.want)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("NormalizeServerURL(%q) = %q, %v, want an error containing %q", tc.raw, got, err, tc.err)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package client
+
+import (
+	"sync"
+
+	"github.com/hashicorp/yamux"
+
+	"github.com/jtolio/netpump-go/private/protocol"
+)
+
+// streamKey identifies a tunneled stream. Stream IDs are only unique
+// within a session.
+type streamKey struct {
+	session *yamux.Session
+	id      uint32
+}
+
+// serveControl opens the session's control stream and answers the
+// server's questions about idle streams until either side closes it.
+// Servers that don't probe streams turn the request down.
+func (c *Client) serveControl(session *yamux.Session) {
+	defer c.wg.Done()
+	stream, resp, err := c.request(session, protocol.Request{Control: true}, nil)
+	if err != nil {
+		return
+	}
+	defer stream.Close()
+	if resp.Status != protocol.StatusOK {
+		return
+	}
+
+	for {
+		typ, ids, err := protocol.ReadControl(stream)
+		if err != nil {
+			return
+		}
+		if typ != protocol.ControlProbe {
+			c.log.Warn("unexpected control message", "type", typ)
+			return
+		}
+		alive := ids[:0]
+		for _, id := range ids {
+			if _, ok := c.openStreams.Load(streamKey{session, id}); ok {
+				alive = append(alive, id)
+			}
+		}
+		if err := protocol.WriteControl(stream, protocol.ControlAlive, alive); err != nil {
+			return
+		}
+	}
+}
+
+// trackStream records tc as open until it's closed, for serveControl and
+// Streams.
+func (c *Client) trackStream(session *yamux.Session, stream *yamux.Stream, tc *tunnelConn) {
+	key := streamKey{session, stream.StreamID()}
+	c.openStreams.Store(key, tc.info)
+	var once sync.Once
+	tc.onClose = func() {
+		once.Do(func() {
+			c.openStreams.Delete(key)
+			c.streamEnded(tc)
+		})
+	}
+}
@@ -0,0 +1,65 @@
+package client
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// streamIdle is how long a stream goes without data before the dashboard
+// shows it as idle.
+const streamIdle = 30 * time.Second
+
+// streamInfo is what's known about a tunneled stream while it's open.
+type streamInfo struct {
+	target   string
+	label    string
+	start    time.Time
+	sent     atomic.Int64
+	received atomic.Int64
+	last     atomic.Int64 // UnixNano of the last data either way
+}
+
+// StreamInfo describes a tunneled connection, as served on /streams.
+type StreamInfo struct {
+	Target   string    `json:"target"`
+	Label    string    `json:"label,omitempty"`
+	Start    time.Time `json:"start"`
+	Sent     int64     `json:"sent"`
+	Received int64     `json:"received"`
+	// State is "active", or "idle" if no data went either way for 30
+	// seconds.
+	State string `json:"state"`
+}
+
+// Streams lists the tunneled connections open right now, oldest first.
+func (c *Client) Streams() []StreamInfo {
+	idleSince := time.Now().Add(-streamIdle).UnixNano()
+	streams := []StreamInfo{}
+	c.openStreams.Range(func(_, v any) bool {
+		info := v.(*streamInfo)
+		st := StreamInfo{
+			Target:   info.target,
+			Label:    info.label,
+			Start:    info.start,
+			Sent:     info.sent.Load(),
+			Received: info.received.Load(),
+			State:    "active",
+		}
+		if info.last.Load() < idleSince {
+			st.State = "idle"
+		}
+		streams = append(streams, st)
+		return true
+	})
+	sort.Slice(streams, func(i, j int) bool { return streams[i].Start.Before(streams[j].Start) })
+	return streams
+}
+
+func (c *Client) handleStreams(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(c.Streams())
+}
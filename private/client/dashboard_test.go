@@ -0,0 +1,107 @@
+package client
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jtolio/netpump-go/private/eventlog"
+)
+
+// getJSON serves path from h and decodes its JSON body into v.
+func getJSON(t *testing.T, h http.Handler, path string, v any) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://127.0.0.1:8080"+path, nil))
+	if ct := w.Header().Get("Content-Type"); w.Code != http.StatusOK || ct != "application/json" {
+		t.Fatalf("%s: status %d, content type %q", path, w.Code, ct)
+	}
+	if err := json.NewDecoder(w.Body).Decode(v); err != nil {
+		t.Fatalf("%s: %v", path, err)
+	}
+}
+
+func TestDashboardEndpoints(t *testing.T) {
+	tn := startTunnel(t, []Option{WithDashboard(), WithEventLog(100), WithLabelRules(LabelRule{Label: "local", Hosts: []string{"127.0.0.1"}})})
+	streams := http.HandlerFunc(tn.client.handleStreams)
+	var list []StreamInfo
+	if getJSON(t, streams, "/streams", &list); len(list) != 0 {
+		t.Fatalf("streams before any connection: %+v", list)
+	}
+
+	target := echoTarget(t)
+	conn, err := tn.dial(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(conn, make([]byte, 5)); err != nil {
+		t.Fatal(err)
+	}
+	// The counts catch up once the writes they count return.
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		getJSON(t, streams, "/streams", &list)
+		if len(list) == 1 && list[0].Received == 5 || time.Now().After(deadline) {
+			break
+		}
+	}
+	if len(list) != 1 {
+		t.Fatalf("streams %+v, want one", list)
+	}
+	if s := list[0]; s.Target != target || s.Label != "local" || s.Sent != 5 || s.Received != 5 ||
+		s.State != "active" || time.Since(s.Start) > time.Minute {
+		t.Errorf("stream %+v", s)
+	}
+
+	refused := "127.0.0.1:" + strconv.Itoa(freePort(t))
+	if conn, err := tn.dial(refused); err == nil {
+		conn.Close()
+		t.Fatalf("connection to %s succeeded", refused)
+	}
+	var events []eventlog.Event
+	getJSON(t, tn.client.events, "/events", &events)
+	failed := false
+	for _, e := range events {
+		failed = failed || e.Message == "server couldn't connect" && e.Level == "WARN" && e.Attrs["target"] == refused
+	}
+	if !failed {
+		t.Errorf("no failure for %s in %+v", refused, events)
+	}
+}
+
+func TestDashboardRoutes(t *testing.T) {
+	for _, tc := range []struct {
+		name              string
+		opts              []Option
+		dashboard, events bool
+	}{
+		{"neither", nil, false, false},
+		{"dashboard", []Option{WithDashboard()}, true, false},
+		{"event log", []Option{WithEventLog(10)}, false, true},
+		{"both", []Option{WithDashboard(), WithEventLog(10)}, true, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, base := startClient(t, tc.opts...)
+			for path, served := range map[string]bool{"/streams": tc.dashboard, "/events": tc.events} {
+				code, body := get(t, base+path)
+				if served && (code != http.StatusOK || !strings.HasPrefix(body, "[")) {
+					t.Errorf("%s: %d %q", path, code, body)
+				}
+				if !served && code != http.StatusNotFound {
+					t.Errorf("%s served without its option: %d", path, code)
+				}
+			}
+			if _, page := get(t, base+"/"); strings.Contains(page, `class="dashboard"`) != tc.dashboard {
+				t.Errorf("dashboard on the page: %v, want %v", !tc.dashboard, tc.dashboard)
+			}
+		})
+	}
+}
@@ -1,143 +1,129 @@
 package client
 
 import (
-	"fmt"
+	"bytes"
+	"embed"
+	"errors"
+	"html/template"
+	"io/fs"
 	"net/http"
+	"net/url"
+	"os"
+	"strconv"
 )
 
-func (c *Client) serveHTML(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "text/html")
-	fmt.Fprintf(w, `<!doctype html>
-<html>
-<head>
-  <meta charset="utf-8" />
-  <title>netpump-go</title>
-  <style>
-    body {
-      font-family: sans-serif;
-      display: flex;
-      align-items: center;
-      justify-content: center;
-      height: 100vh;
-      margin: 0;
-    }
-    .container { text-align: center; }
-    h1 { font-size: 3em; margin: 0.5em 0; }
-    .status { font-size: 1.2em; margin: 1em 0; }
-    .info { margin: 2em 0; line-height: 1.8; }
-    .connected { color: #4f4; }
-    .disconnected { color: #f44; }
-  </style>
-</head>
-<body>
-  <div class="container">
-    <h1>netpump-go</h1>
-    <div class="status">
-      Local: <span id="localStatus" class="disconnected">Connecting...</span><br>
-      Server: <span id="serverStatus" class="disconnected">Waiting...</span>
-    </div>
-    <div class="info">
-      <div>SOCKS5: 127.0.0.1:%d</div>
-      <div>Sent: <span id="bytesSent">0 B</span></div>
-      <div>Received: <span id="bytesReceived">0 B</span></div>
-      <div>Total: <span id="bytesTotal">0 B</span></div>
-    </div>
-  </div>
-
-  <script>
-    const serverURL = '%s';
-    let localWS = null;
-    let serverWS = null;
-    let bytesSent = 0;
-    let bytesReceived = 0;
-
-    function formatBytes(bytes) {
-      if (bytes === 0) return '0 B';
-      const k = 1024;
-      const sizes = ['B', 'KB', 'MB', 'GB', 'TB'];
-      const i = Math.floor(Math.log(bytes) / Math.log(k));
-      return (bytes / Math.pow(k, i)).toFixed(2) + ' ' + sizes[i];
-    }
-
-    function updateBytes() {
-      document.getElementById('bytesSent').textContent = formatBytes(bytesSent);
-      document.getElementById('bytesReceived').textContent = formatBytes(bytesReceived);
-      document.getElementById('bytesTotal').textContent = formatBytes(bytesSent + bytesReceived);
-    }
-
-    function updateStatus(element, connected) {
-      element.textContent = connected ? 'Connected' : 'Disconnected';
-      element.className = connected ? 'connected' : 'disconnected';
-    }
-
-    function connect() {
-      // Connect to local client
-      localWS = new WebSocket('ws://' + location.host + '/ws/local');
-      localWS.binaryType = 'arraybuffer';
-
-      localWS.onopen = function() {
-        console.log('[+] Connected to local client');
-        updateStatus(document.getElementById('localStatus'), true);
-
-        // Connect to server
-        serverWS = new WebSocket(serverURL + '/ws');
-        serverWS.binaryType = 'arraybuffer';
-
-        serverWS.onopen = function() {
-          console.log('[+] Connected to server');
-          updateStatus(document.getElementById('serverStatus'), true);
+//go:embed web
+var embeddedWeb embed.FS
+
+// localWSPath is where the browser connects to the client.
+const localWSPath = "/ws/local"
+
+// pageData is what the web interface's index.html template is rendered
+// with.
+type pageData struct {
+	ProxyAddr     string
+	ProxyPort     int
+	ServerURL     string
+	Banner        template.HTML
+	WebSocketPath string
+	// Dashboard shows the diagnostics dashboard, with recent errors if
+	// Events is set.
+	Dashboard bool
+	Events    bool
+}
 
-          // Relay all data between connections
-          localWS.onmessage = function(event) {
-            if (serverWS.readyState === WebSocket.OPEN) {
-              serverWS.send(event.data);
-              // Data from local client going to server (upload/sent)
-              bytesSent += event.data.byteLength || event.data.length || 0;
-              updateBytes();
-            }
-          };
+// webFS returns the web interface's files: index.html and everything
+// under static/. Files in the directory set by WithWebDir take precedence
+// over the built-in ones.
+func (c *Client) webFS() fs.FS {
+	base, err := fs.Sub(embeddedWeb, "web")
+	if err != nil {
+		panic(err)
+	}
+	if c.webDir == "" {
+		return base
+	}
+	return overlayFS{top: os.DirFS(c.webDir), base: base}
+}
 
-          serverWS.onmessage = function(event) {
-            if (localWS.readyState === WebSocket.OPEN) {
-              localWS.send(event.data);
-              // Data from server going to local client (download/received)
-              bytesReceived += event.data.byteLength || event.data.length || 0;
-              updateBytes();
-            }
-          };
-        };
+// overlayFS serves files from top, falling back to base for those top
+// doesn't have.
+type overlayFS struct {
+	top, base fs.FS
+}
 
-        serverWS.onerror = function(error) {
-          console.error('[!] Server error:', error);
-          updateStatus(document.getElementById('serverStatus'), false);
-        };
+func (o overlayFS) Open(name string) (fs.File, error) {
+	f, err := o.top.Open(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return o.base.Open(name)
+	}
+	return f, err
+}
 
-        serverWS.onclose = function() {
-          console.log('[-] Server disconnected');
-          updateStatus(document.getElementById('serverStatus'), false);
-          if (localWS.readyState === WebSocket.OPEN) {
-            localWS.close();
-          }
-        };
-      };
+// serverWSURL is the URL the browser uses to reach the server's websocket.
+func (c *Client) serverWSURL() string {
+	q := url.Values{}
+	if c.serverToken != "" {
+		q.Set("token", c.serverToken)
+	}
+	if c.subSessions > 1 {
+		q.Set("sessions", strconv.Itoa(c.subSessions))
+	}
+	c.urlMu.Lock()
+	u := c.serverURL + "/ws"
+	c.urlMu.Unlock()
+	if len(q) > 0 {
+		u += "?" + q.Encode()
+	}
+	return u
+}
 
-      localWS.onerror = function(error) {
-        console.error('[!] Local error:', error);
-        updateStatus(document.getElementById('localStatus'), false);
-      };
+func (c *Client) serveHTML(w http.ResponseWriter, r *http.Request) {
+	// "/" matches every path nothing else claimed.
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+
+	data := pageData{
+		ProxyAddr:     c.proxyAddr(),
+		ProxyPort:     c.proxyPort,
+		ServerURL:     c.serverWSURL(),
+		Banner:        c.bannerHTML(),
+		WebSocketPath: localWSPath,
+		Dashboard:     c.dashboard,
+		Events:        c.events != nil,
+	}
+
+	var buf bytes.Buffer
+	if err := c.page.Execute(&buf, data); err != nil {
+		c.log.Error("failed to render web interface", "error", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(buf.Bytes())
+}
 
-      localWS.onclose = function() {
-        console.log('[-] Local disconnected');
-        updateStatus(document.getElementById('localStatus'), false);
-        updateStatus(document.getElementById('serverStatus'), false);
-        // Reconnect after 1 second
-        setTimeout(connect, 1000);
-      };
-    }
+// faviconHandler serves favicon.ico for browsers that ask for it despite
+// the icon the page links to. A web directory may provide one; otherwise
+// there's no content.
+func faviconHandler(web fs.FS) http.Handler {
+	files := http.FileServer(http.FS(web))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := fs.Stat(web, "favicon.ico"); err != nil {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		files.ServeHTTP(w, r)
+	})
+}
 
-    // Start connection
-    connect();
-  </script>
-</body>
-</html>`, c.proxyPort, c.serverURL)
+// bannerHTML renders the operator's banner, escaping it unless it was
+// given as HTML.
+func (c *Client) bannerHTML() template.HTML {
+	if c.bannerIsHTML {
+		return template.HTML(c.banner)
+	}
+	return template.HTML(template.HTMLEscapeString(c.banner))
 }
@@ -0,0 +1,139 @@
+package client
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// startClient starts a client with opts, its server never reached, and
+// returns it with the base URL of its web interface.
+func startClient(t *testing.T, opts ...Option) (*Client, string) {
+	t.Helper()
+	webAddr := net.JoinHostPort("127.0.0.1", strconv.Itoa(freePort(t)))
+	c := New("127.0.0.1", mustPort(webAddr), freePort(t), "ws://127.0.0.1:1", opts...)
+	go c.Start()
+	t.Cleanup(func() { c.Stop() })
+	waitListening(t, webAddr)
+	return c, "http://" + webAddr
+}
+
+// get fetches url, returning the status and body.
+func get(t *testing.T, url string) (int, string) {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(body)
+}
+
+func TestBanner(t *testing.T) {
+	const banner = `Call <b>ops</b> <script>alert("x")</script>`
+	for _, tc := range []struct {
+		name    string
+		opt     Option
+		want    string
+		notWant string
+	}{
+		{"text", WithBanner(banner), `Call &lt;b&gt;ops&lt;/b&gt; &lt;script&gt;alert(&#34;x&#34;)&lt;/script&gt;`, "<script>alert"},
+		{"html", WithBannerHTML(banner), banner, "&lt;"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, base := startClient(t, tc.opt)
+			code, body := get(t, base+"/")
+			if code != http.StatusOK {
+				t.Fatalf("status %d", code)
+			}
+			if !strings.Contains(body, `<div class="banner">`+tc.want+`</div>`) {
+				t.Errorf("page doesn't show the banner as %q:\n%s", tc.want, body)
+			}
+			if strings.Contains(body, tc.notWant) {
+				t.Errorf("page contains %q", tc.notWant)
+			}
+		})
+	}
+
+	_, base := startClient(t)
+	if _, body := get(t, base+"/"); strings.Contains(body, `class="banner"`) {
+		t.Error("page shows a banner without one set")
+	}
+}
+
+func TestPageRender(t *testing.T) {
+	c, base := startClient(t, WithServerToken("tok"))
+	code, body := get(t, base+"/")
+	if code != http.StatusOK {
+		t.Fatalf("status %d", code)
+	}
+	// The script gets the URLs as quoted JavaScript strings.
+	for _, want := range []string{
+		"SOCKS5: " + c.proxyAddr(),
+		`serverWSURL: "ws://127.0.0.1:1/ws?token=tok"`,
+		`localWSPath: "/ws/local"`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("page doesn't contain %q:\n%s", want, body)
+		}
+	}
+}
+
+func TestPageRenderWebDir(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "index.html"),
+		[]byte("<p>{{.ProxyAddr}} {{.ServerURL}} {{.WebSocketPath}}</p>"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "static"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "static", "netpump.css"), []byte("body{}"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	c, base := startClient(t, WithWebDir(dir))
+	if _, body := get(t, base+"/"); body != "<p>"+c.proxyAddr()+" ws://127.0.0.1:1/ws /ws/local</p>" {
+		t.Errorf("page from the web dir = %q", body)
+	}
+	if _, body := get(t, base+"/static/netpump.css"); body != "body{}" {
+		t.Errorf("static file from the web dir = %q", body)
+	}
+	// What the web dir lacks comes from the built-in files.
+	if code, body := get(t, base+"/static/netpump.js"); code != http.StatusOK || body == "" {
+		t.Errorf("built-in static file: status %d, %d bytes", code, len(body))
+	}
+}
+
+func TestFavicon(t *testing.T) {
+	_, base := startClient(t)
+	if code, body := get(t, base+"/favicon.ico"); code != http.StatusNoContent || body != "" {
+		t.Errorf("built-in favicon.ico: status %d, %q", code, body)
+	}
+	if code, body := get(t, base+"/static/favicon.svg"); code != http.StatusOK || !strings.Contains(body, "<svg") {
+		t.Errorf("linked icon: status %d, %q", code, body)
+	}
+	for _, path := range []string{"/nope", "/favicon.png", "/index.html.bak"} {
+		if code, _ := get(t, base+path); code != http.StatusNotFound {
+			t.Errorf("%s: status %d, want 404", path, code)
+		}
+	}
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "favicon.ico"), []byte("icon"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	_, base = startClient(t, WithWebDir(dir))
+	if code, body := get(t, base+"/favicon.ico"); code != http.StatusOK || body != "icon" {
+		t.Errorf("favicon.ico from the web dir: status %d, %q", code, body)
+	}
+}
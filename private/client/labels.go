@@ -0,0 +1,102 @@
+package client
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// LabelRule tags connections to matching targets with Label, so the
+// server's stats and logs can tell applications apart.
+type LabelRule struct {
+	Label string
+	// Hosts are target host names. A "*." prefix matches any subdomain.
+	Hosts []string
+}
+
+type labelKey struct{}
+
+// ContextWithLabel returns a context that makes DialContext tag its
+// connection with label, taking precedence over any LabelRule.
+func ContextWithLabel(ctx context.Context, label string) context.Context {
+	return context.WithValue(ctx, labelKey{}, label)
+}
+
+// label picks the label for a connection to addr.
+func (c *Client) label(ctx context.Context, addr string) string {
+	if label, ok := ctx.Value(labelKey{}).(string); ok {
+		return label
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return ""
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	for _, rule := range c.labelRules {
+		for _, pattern := range rule.Hosts {
+			pattern = strings.ToLower(pattern)
+			if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+				if strings.HasSuffix(host, "."+suffix) {
+					return rule.Label
+				}
+			} else if host == pattern {
+				return rule.Label
+			}
+		}
+	}
+	return ""
+}
+
+// LabelStats is the traffic of connections tagged with a label.
+type LabelStats struct {
+	// Streams counts the connections made so far.
+	Streams int64 `json:"streams"`
+	// Sent and Received are bytes to and from targets.
+	Sent     int64 `json:"sent"`
+	Received int64 `json:"received"`
+}
+
+type labelCounter struct {
+	streams  atomic.Int64
+	sent     atomic.Int64
+	received atomic.Int64
+}
+
+// labels accounts traffic per connection label.
+type labels struct {
+	mu       sync.Mutex
+	counters map[string]*labelCounter
+}
+
+func (l *labels) counter(label string) *labelCounter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.counters == nil {
+		l.counters = make(map[string]*labelCounter)
+	}
+	c, ok := l.counters[label]
+	if !ok {
+		c = &labelCounter{}
+		l.counters[label] = c
+	}
+	return c
+}
+
+func (l *labels) stats() map[string]LabelStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.counters) == 0 {
+		return nil
+	}
+	stats := make(map[string]LabelStats, len(l.counters))
+	for label, c := range l.counters {
+		stats[label] = LabelStats{
+			Streams:  c.streams.Load(),
+			Sent:     c.sent.Load(),
+			Received: c.received.Load(),
+		}
+	}
+	return stats
+}
@@ -0,0 +1,74 @@
+package client
+
+import (
+	"context"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/jtolio/netpump-go/private/server"
+)
+
+// echoOnce sends msg over conn and reads the echo back.
+func echoOnce(t *testing.T, conn net.Conn, msg string) {
+	t.Helper()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := io.WriteString(conn, msg); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(conn, make([]byte, len(msg))); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestLabelsPropagate checks labels, picked by rule or given with the
+// dial, reach the server and are counted on both sides.
+func TestLabelsPropagate(t *testing.T) {
+	tn := startTunnel(t, []Option{WithLabelRules(LabelRule{Label: "video", Hosts: []string{"*.localhost", "localhost"}})})
+	target := echoTarget(t)
+	_, port, _ := net.SplitHostPort(target)
+
+	// By rule, through the SOCKS5 proxy.
+	conn, err := tn.dial(net.JoinHostPort("localhost", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	echoOnce(t, conn, "hello")
+	conn.Close()
+	// By context, which wins over the rules.
+	conn, err = tn.client.DialContext(ContextWithLabel(context.Background(), "backup"), "tcp", net.JoinHostPort("localhost", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	echoOnce(t, conn, "hi")
+	conn.Close()
+	// Unlabeled.
+	conn, err = tn.dial(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	echoOnce(t, conn, "unlabeled")
+	conn.Close()
+
+	wantClient := map[string]LabelStats{
+		"video":  {Streams: 1, Sent: 5, Received: 5},
+		"backup": {Streams: 1, Sent: 2, Received: 2},
+	}
+	wantServer := map[string]server.LabelStats{
+		"video":  {Streams: 1, Sent: 5, Received: 5},
+		"backup": {Streams: 1, Sent: 2, Received: 2},
+	}
+	// The server counts what it relays as it goes, so give it a moment.
+	var gotClient map[string]LabelStats
+	var gotServer map[string]server.LabelStats
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		gotClient, gotServer = tn.client.Stats().Labels, tn.server.LabelStats()
+		if reflect.DeepEqual(gotClient, wantClient) && reflect.DeepEqual(gotServer, wantServer) {
+			return
+		}
+	}
+	t.Errorf("client label stats %+v, want %+v", gotClient, wantClient)
+	t.Errorf("server label stats %+v, want %+v", gotServer, wantServer)
+}
@@ -0,0 +1,62 @@
+package client
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"testing"
+)
+
+// TestLogSampling checks only one in n connections is logged, while every
+// failure is.
+func TestLogSampling(t *testing.T) {
+	tn := startTunnel(t, []Option{WithLogSampling(3), WithEventLog(100)})
+	// The target greets and hangs up, so the relays don't linger.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte("x"))
+			conn.Close()
+		}
+	}()
+
+	for i := 0; i < 6; i++ {
+		conn, err := tn.dial(ln.Addr().String())
+		if err != nil {
+			t.Fatalf("connection %d: %v", i+1, err)
+		}
+		io.ReadAll(conn)
+		conn.Close()
+	}
+	refused := "127.0.0.1:" + strconv.Itoa(freePort(t))
+	for i := 0; i < 2; i++ {
+		if conn, err := tn.dial(refused); err == nil {
+			conn.Close()
+			t.Fatalf("connection to %s succeeded", refused)
+		}
+	}
+
+	count := func(msg string) int {
+		n := 0
+		for _, e := range tn.client.events.Events() {
+			if e.Message == msg {
+				n++
+			}
+		}
+		return n
+	}
+	if got := count("connected"); got != 2 {
+		t.Errorf("%d connected lines for 6 connections, want 2", got)
+	}
+	if got := count("server couldn't connect"); got != 2 {
+		t.Errorf("%d failures logged, want 2", got)
+	}
+}
@@ -0,0 +1,79 @@
+package client
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/jtolio/netpump-go/private/server"
+)
+
+// TestMigrate checks a server shutting down with WithMigrateTo sends the
+// page to the other server, and the tunnel comes back up through it.
+func TestMigrate(t *testing.T) {
+	nextStreams := &streamCounter{}
+	nextAddr := net.JoinHostPort("127.0.0.1", strconv.Itoa(freePort(t)))
+	next := server.New("127.0.0.1", mustPort(nextAddr), server.WithMetricsSink(nextStreams))
+	go next.Start()
+	t.Cleanup(func() { next.Stop() })
+	waitListening(t, nextAddr)
+
+	firstStreams := &streamCounter{}
+	tn := startTunnel(t, []Option{WithEventLog(100)},
+		server.WithMigrateTo("ws://"+nextAddr), server.WithMetricsSink(firstStreams))
+	target := echoTarget(t)
+	roundTrip := func() error {
+		conn, err := tn.dial(target)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err := conn.Write([]byte("hello")); err != nil {
+			return err
+		}
+		_, err = io.ReadFull(conn, make([]byte, 5))
+		return err
+	}
+	if err := roundTrip(); err != nil {
+		t.Fatal(err)
+	}
+	if n := firstStreams.n.Load(); n != 1 {
+		t.Fatalf("first server relayed %d streams, want 1", n)
+	}
+
+	if err := tn.server.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	// Pages served from now on connect to the other server too.
+	for deadline := time.Now().Add(5 * time.Second); tn.client.serverWSURL() != "ws://"+nextAddr+"/ws"; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("page connects to %s after the migration", tn.client.serverWSURL())
+		}
+	}
+	migrated := false
+	for _, e := range tn.client.events.Events() {
+		migrated = migrated || e.Message == "server is going away, migrating to another" && e.Attrs["server"] == "ws://"+nextAddr
+	}
+	if !migrated {
+		t.Error("migration not logged")
+	}
+
+	var err error
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+		if err = roundTrip(); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		t.Fatalf("tunnel didn't come back up: %v", err)
+	}
+	if n := nextStreams.n.Load(); n != 1 {
+		t.Errorf("other server relayed %d streams, want 1", n)
+	}
+	if n := firstStreams.n.Load(); n != 1 {
+		t.Errorf("first server relayed %d streams after shutting down", n-1)
+	}
+}
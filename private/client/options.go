@@ -0,0 +1,301 @@
+package client
+
+import (
+	"crypto/tls"
+	"strings"
+	"time"
+
+	"github.com/armon/go-socks5"
+
+	"github.com/jtolio/netpump-go/private/eventlog"
+)
+
+// Option configures optional Client behavior.
+type Option func(*Client)
+
+// WithSharedPort serves the SOCKS5 proxy on the web interface's port
+// instead of a separate loopback port, telling the two apart by the first
+// byte of each connection. The web interface's host may reach beyond
+// loopback, but SOCKS5 clients from elsewhere are dropped unless
+// WithSocksAuth requires logins, so as not to run an open proxy on the
+// network. Both are served in plaintext only: TLS connections, whether
+// HTTPS or SOCKS5 over TLS, are dropped, and WithSocksTLS doesn't apply.
+func WithSharedPort() Option {
+	return func(c *Client) {
+		c.sharedPort = true
+	}
+}
+
+// WithWebBindRetry makes Start wait, for up to wait, for the web
+// interface's port to come free if another process has it, such as the
+// client's previous run still letting go of it. If it's still taken then,
+// or wait is zero, fallback has the web interface listen on a port the
+// system picks instead, which is logged. Without this option Start fails
+// right away.
+func WithWebBindRetry(wait time.Duration, fallback bool) Option {
+	return func(c *Client) {
+		c.webBindWait = wait
+		c.webBindFallback = fallback
+	}
+}
+
+// WithProxyHost sets the host the SOCKS5 proxy listens on, 127.0.0.1 by
+// default. IPv6 literals, including ones with a zone such as fe80::1%eth0,
+// are given without brackets. It has no effect with WithSharedPort.
+func WithProxyHost(host string) Option {
+	return func(c *Client) {
+		c.proxyHost = host
+	}
+}
+
+// WithShutdownTimeout bounds how long Shutdown lets in-flight SOCKS5
+// connections run before forcibly closing them. The default of zero closes
+// them right away.
+func WithShutdownTimeout(d time.Duration) Option {
+	return func(c *Client) {
+		c.shutdownTimeout = d
+	}
+}
+
+// WithServerToken sets the token the browser presents to a server that
+// restricts access to known tenants.
+func WithServerToken(token string) Option {
+	return func(c *Client) {
+		c.serverToken = token
+	}
+}
+
+// WithWriteTimeout bounds how long a single write to the websocket may
+// take before the session is torn down. It defaults to
+// wsconn.DefaultWriteTimeout; zero disables it.
+func WithWriteTimeout(d time.Duration) Option {
+	return func(c *Client) {
+		c.writeTimeout = d
+	}
+}
+
+// WithBanner shows a message, such as a support contact or usage policy,
+// on the web interface. The text is escaped; see WithBannerHTML for markup.
+func WithBanner(text string) Option {
+	return func(c *Client) {
+		c.banner = text
+		c.bannerIsHTML = false
+	}
+}
+
+// WithBannerHTML is like WithBanner, but inserts html into the page as is.
+// It must come from a trusted source.
+func WithBannerHTML(html string) Option {
+	return func(c *Client) {
+		c.banner = html
+		c.bannerIsHTML = true
+	}
+}
+
+// WithWebDir serves the web interface's files from dir where it has them,
+// falling back to the built-in ones. index.html is a html/template
+// rendered with the proxy address, server URL and banner; other assets go
+// under static/, except for an optional favicon.ico.
+func WithWebDir(dir string) Option {
+	return func(c *Client) {
+		c.webDir = dir
+	}
+}
+
+// WithLabelRules tags connections to targets matching a rule with its
+// label. The first matching rule wins.
+func WithLabelRules(rules ...LabelRule) Option {
+	return func(c *Client) {
+		c.labelRules = append(c.labelRules, rules...)
+	}
+}
+
+// WithMaxSocksConns caps how many SOCKS5 connections the client serves at
+// once. Connections beyond that are closed as soon as they're accepted.
+// Zero, the default, means no cap.
+func WithMaxSocksConns(n int) Option {
+	return func(c *Client) {
+		c.maxSocks = n
+	}
+}
+
+// WithSocksTLS serves the SOCKS5 proxy over TLS with config, which must
+// have a certificate. It doesn't apply with WithSharedPort.
+func WithSocksTLS(config *tls.Config) Option {
+	return func(c *Client) {
+		c.socksTLS = config
+	}
+}
+
+// WithSocksAuth requires SOCKS5 clients to log in with one of the given
+// usernames and its password. Unless the proxy is served over TLS, the
+// password crosses the network in the clear.
+func WithSocksAuth(users map[string]string) Option {
+	return func(c *Client) {
+		c.socksUsers = users
+	}
+}
+
+// WithSocksRules checks each SOCKS5 request against rules, such as
+// DenyTargetsRule or socks5.PermitCommand, before it reaches the tunnel.
+// A request any of them refuses is answered "not allowed by ruleset"
+// without the server hearing of it.
+func WithSocksRules(rules ...socks5.RuleSet) Option {
+	return func(c *Client) {
+		var all []socks5.RuleSet
+		if old := c.socksRules.Load(); old != nil {
+			all = append(all, *old...)
+		}
+		all = append(all, rules...)
+		c.socksRules.Store(&all)
+	}
+}
+
+// WithStreamEnd calls f as each tunneled connection closes, with how much
+// went through it and why it ended, such as the tunnel going away
+// mid-transfer. f runs on the goroutine closing the connection.
+func WithStreamEnd(f func(StreamEnd)) Option {
+	return func(c *Client) {
+		c.onStreamEnd = f
+	}
+}
+
+// WithSendSource tells the server the address of the SOCKS5 client behind
+// each connection, for its logs. This reveals local addresses to the
+// server, so it's off by default.
+func WithSendSource() Option {
+	return func(c *Client) {
+		c.sendSource = true
+	}
+}
+
+// WithEventLog keeps the last size log records at Info level and above in
+// memory, served as JSON on the web interface's /events.
+func WithEventLog(size int) Option {
+	return func(c *Client) {
+		c.events = eventlog.NewRing(size)
+	}
+}
+
+// WithDashboard adds a diagnostics dashboard to the web interface, listing
+// every tunneled connection with its target, traffic and age, and with
+// WithEventLog the latest warnings and errors. The connections are also
+// served as JSON on /streams. Anyone who can reach the web interface sees
+// the targets, so consider WithWebAuth.
+func WithDashboard() Option {
+	return func(c *Client) {
+		c.dashboard = true
+	}
+}
+
+// WithLogSampling logs only one in every n successful connections, to keep
+// logs readable under heavy use. Failures are always logged.
+func WithLogSampling(n int) Option {
+	return func(c *Client) {
+		c.logSampler = &logSampler{n: uint64(n)}
+	}
+}
+
+// WithWebAuth requires HTTP basic auth with user and password for the web
+// interface, including its admin endpoints and the browser's websocket.
+// Unless it is only reachable locally, the password crosses the network
+// in the clear.
+func WithWebAuth(user, password string) Option {
+	return func(c *Client) {
+		c.webUser = user
+		c.webPass = password
+	}
+}
+
+// WithHostOverrides makes connections to a host in hosts go to the host
+// or IP it maps to instead, on the same port, as if the name resolved to
+// it. The server is asked for the replacement, so it never sees the
+// original name. Host names match regardless of case. Labels are still
+// picked by the original name.
+func WithHostOverrides(hosts map[string]string) Option {
+	return func(c *Client) {
+		if c.hostOverrides == nil {
+			c.hostOverrides = make(map[string]string, len(hosts))
+		}
+		for from, to := range hosts {
+			c.hostOverrides[strings.TrimSuffix(strings.ToLower(from), ".")] = to
+		}
+	}
+}
+
+// WithPACDirect has the proxy auto-config file served on /proxy.pac send
+// browsers straight to hosts, rather than through the tunnel. A "*."
+// prefix matches any subdomain. The server and the web interface always
+// go direct.
+func WithPACDirect(hosts ...string) Option {
+	return func(c *Client) {
+		c.pacDirect = append(c.pacDirect, hosts...)
+	}
+}
+
+// WithRetryPolicy sets how dials through the tunnel are retried, in
+// place of DefaultRetryPolicy. NoRetry turns retries off.
+func WithRetryPolicy(p RetryPolicy) Option {
+	return func(c *Client) {
+		c.retry = p
+	}
+}
+
+// WithFailureReasons asks the server to say why a connection failed,
+// e.g. "name resolution failed: no such host". Reasons are logged and
+// added to the error the dial returns. Servers too old to know request
+// extensions reject every connection, so it's off by default.
+func WithFailureReasons() Option {
+	return func(c *Client) {
+		c.wantReasons = true
+	}
+}
+
+// WithInvalidDataThrottle refuses a browser, by address, for cooldown
+// once failures of its sessions have ended on data that isn't the tunnel
+// protocol, such as from a page that isn't netpump's, rather than set up a
+// session for every reconnect. Failures further apart than cooldown don't
+// add up. It's on by default, refusing for a minute after 5 failures;
+// failures of 0 turns it off, and a cooldown of 0 means a minute.
+func WithInvalidDataThrottle(failures int, cooldown time.Duration) Option {
+	return func(c *Client) {
+		if cooldown <= 0 {
+			cooldown = defaultInvalidDataCooldown
+		}
+		c.throttle.limit = failures
+		c.throttle.cooldown = cooldown
+	}
+}
+
+// WithSubSessions splits the websocket into n independent yamux sessions,
+// up to wsconn.MaxDemux, and spreads new connections across them, so a
+// connection that clogs its session can only hold up the ones sharing it.
+// Connections with the same label always share a sub-session, and the
+// rest go to the least busy one.
+// The server must support sub-sessions; it learns the count from the URL
+// the browser connects to.
+func WithSubSessions(n int) Option {
+	return func(c *Client) {
+		c.subSessions = n
+	}
+}
+
+// WithMaxFrameBytes caps the data the client sends to the server in one
+// yamux frame, so a bulk upload can't hold up other streams for long on
+// the shared websocket. Without a cap frames are up to 32 KiB.
+func WithMaxFrameBytes(n int) Option {
+	return func(c *Client) {
+		c.maxFrame = n
+	}
+}
+
+// WithStreamWindow lets each stream have up to n bytes from the server in
+// flight, rather than yamux's 256 KiB, the least it accepts. A larger
+// window raises a single stream's download throughput over links with a
+// high bandwidth-delay product, at the cost of up to n bytes of memory per
+// stream whose application reads slowly.
+func WithStreamWindow(n int) Option {
+	return func(c *Client) {
+		c.streamWindow = n
+	}
+}
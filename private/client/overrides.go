@@ -0,0 +1,23 @@
+package client
+
+import (
+	"net"
+	"strings"
+)
+
+// overrideHost rewrites addr's host as WithHostOverrides says, keeping
+// its port.
+func (c *Client) overrideHost(addr string) string {
+	if len(c.hostOverrides) == 0 {
+		return addr
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	to, ok := c.hostOverrides[strings.TrimSuffix(strings.ToLower(host), ".")]
+	if !ok {
+		return addr
+	}
+	return net.JoinHostPort(to, port)
+}
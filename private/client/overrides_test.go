@@ -0,0 +1,40 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/jtolio/netpump-go/private/protocol"
+)
+
+func TestOverrideHost(t *testing.T) {
+	c := New("127.0.0.1", 0, 0, "ws://example.com", WithHostOverrides(map[string]string{
+		"Internal.Example.com.": "10.0.0.5",
+		"v6.example.com":        "2001:db8::1",
+	}))
+	for _, tc := range []struct{ addr, want string }{
+		{"internal.example.com:443", "10.0.0.5:443"},
+		{"INTERNAL.example.com.:80", "10.0.0.5:80"},
+		{"v6.example.com:22", "[2001:db8::1]:22"},
+		{"other.example.com:443", "other.example.com:443"},
+		{"sub.internal.example.com:443", "sub.internal.example.com:443"},
+		{"no-port", "no-port"},
+	} {
+		if got := c.overrideHost(tc.addr); got != tc.want {
+			t.Errorf("overrideHost(%q) = %q, want %q", tc.addr, got, tc.want)
+		}
+	}
+}
+
+func TestDialValidatesOverride(t *testing.T) {
+	c := New("127.0.0.1", 0, 0, "ws://example.com", WithHostOverrides(map[string]string{
+		"broken.example.com": "",
+	}))
+	// No browser ever connects, so a request that got past validation
+	// would fail some other way once it gave up waiting for a session.
+	_, err := c.dialThroughTunnel(context.Background(), "tcp", "broken.example.com:443")
+	if !errors.Is(err, protocol.ErrInvalidAddr) {
+		t.Fatalf("dial overridden to an empty host: %v, want %v", err, protocol.ErrInvalidAddr)
+	}
+}
@@ -0,0 +1,56 @@
+package client
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// handlePAC serves a proxy auto-config file that sends browsers through
+// the SOCKS5 proxy. The server and the web interface, which the browser
+// page reaches directly, go DIRECT, as do the hosts WithPACDirect lists.
+func (c *Client) handlePAC(w http.ResponseWriter, r *http.Request) {
+	if c.socksTLS != nil {
+		http.Error(w, "the SOCKS5 proxy is served over TLS, which a PAC file can't point browsers at", http.StatusNotFound)
+		return
+	}
+	webHost := hostOnly(r.Host)
+	proxyHost := c.proxyHost
+	if ip := net.ParseIP(proxyHost); proxyHost == "" || ip != nil && ip.IsUnspecified() {
+		// Listening everywhere, so use the address the browser found us at.
+		proxyHost = webHost
+	}
+
+	direct := []string{webHost}
+	c.urlMu.Lock()
+	serverURL := c.serverURL
+	c.urlMu.Unlock()
+	if u, err := url.Parse(serverURL); err == nil {
+		direct = append(direct, u.Hostname())
+	}
+	direct = append(direct, c.pacDirect...)
+
+	w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+	w.Header().Set("Cache-Control", "no-store")
+	fmt.Fprint(w, "function FindProxyForURL(url, host) {\n  host = host.toLowerCase();\n")
+	for _, pattern := range direct {
+		pattern = strings.TrimSuffix(strings.ToLower(pattern), ".")
+		if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+			fmt.Fprintf(w, "  if (dnsDomainIs(host, %s)) return \"DIRECT\";\n", strconv.Quote("."+suffix))
+		} else if pattern != "" {
+			fmt.Fprintf(w, "  if (host == %s) return \"DIRECT\";\n", strconv.Quote(pattern))
+		}
+	}
+	fmt.Fprintf(w, "  return %s;\n}\n", strconv.Quote("SOCKS5 "+net.JoinHostPort(proxyHost, strconv.Itoa(c.proxyPort))))
+}
+
+// hostOnly is the host of a host[:port] address, without brackets.
+func hostOnly(hostport string) string {
+	if host, _, err := net.SplitHostPort(hostport); err == nil {
+		return host
+	}
+	return strings.Trim(hostport, "[]")
+}
@@ -0,0 +1,90 @@
+package client
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPAC(t *testing.T) {
+	const serverURL = "wss://relay.example.com:9999"
+	for _, tc := range []struct {
+		name      string
+		proxyHost string
+		direct    []string
+		host      string // as the browser reached the web interface
+		want      string
+	}{
+		{
+			name: "loopback", proxyHost: "127.0.0.1", host: "127.0.0.1:8080",
+			direct: []string{"*.corp.example", "Intranet.", ""},
+			want: `function FindProxyForURL(url, host) {
+  host = host.toLowerCase();
+  if (host == "127.0.0.1") return "DIRECT";
+  if (host == "relay.example.com") return "DIRECT";
+  if (dnsDomainIs(host, ".corp.example")) return "DIRECT";
+  if (host == "intranet") return "DIRECT";
+  return "SOCKS5 127.0.0.1:1080";
+}
+`,
+		},
+		{
+			// Listening everywhere, the proxy is where the browser found
+			// the web interface.
+			name: "unspecified", proxyHost: "0.0.0.0", host: "192.168.1.5:8080",
+			want: `function FindProxyForURL(url, host) {
+  host = host.toLowerCase();
+  if (host == "192.168.1.5") return "DIRECT";
+  if (host == "relay.example.com") return "DIRECT";
+  return "SOCKS5 192.168.1.5:1080";
+}
+`,
+		},
+		{
+			name: "ipv6", proxyHost: "::", host: "[fd00::5]:8080",
+			want: `function FindProxyForURL(url, host) {
+  host = host.toLowerCase();
+  if (host == "fd00::5") return "DIRECT";
+  if (host == "relay.example.com") return "DIRECT";
+  return "SOCKS5 [fd00::5]:1080";
+}
+`,
+		},
+		{
+			name: "ipv6 proxy host", proxyHost: "::1", host: "localhost:8080",
+			want: `function FindProxyForURL(url, host) {
+  host = host.toLowerCase();
+  if (host == "localhost") return "DIRECT";
+  if (host == "relay.example.com") return "DIRECT";
+  return "SOCKS5 [::1]:1080";
+}
+`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := New("0.0.0.0", 8080, 1080, serverURL, WithProxyHost(tc.proxyHost), WithPACDirect(tc.direct...))
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, "/proxy.pac", nil)
+			r.Host = tc.host
+			c.handlePAC(w, r)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status %d", w.Code)
+			}
+			if ct := w.Header().Get("Content-Type"); ct != "application/x-ns-proxy-autoconfig" {
+				t.Errorf("content type %q", ct)
+			}
+			if got := w.Body.String(); got != tc.want {
+				t.Errorf("got:\n%s\nwant:\n%s", got, tc.want)
+			}
+		})
+	}
+
+	// Browsers can't be pointed at SOCKS5 over TLS.
+	c := New("127.0.0.1", 8080, 1080, serverURL, WithSocksTLS(&tls.Config{}))
+	w := httptest.NewRecorder()
+	c.handlePAC(w, httptest.NewRequest(http.MethodGet, "/proxy.pac", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("with SOCKS5 over TLS: status %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,62 @@
+package client
+
+import (
+	"errors"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// resettingTarget listens on loopback. For each connection it sends
+// "hello", waits for a byte back, and then resets the connection, until
+// the test ends. It returns its address.
+func resettingTarget(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if _, err := conn.Write([]byte("hello")); err != nil {
+					return
+				}
+				if _, err := conn.Read(make([]byte, 1)); err != nil {
+					return
+				}
+				conn.(*net.TCPConn).SetLinger(0)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestTargetResetReachesClient(t *testing.T) {
+	tn := startTunnel(t, nil)
+	conn, err := tn.dial(resettingTarget(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	got := make([]byte, 5)
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write([]byte{1}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.Copy(io.Discard, conn); !errors.Is(err, syscall.ECONNRESET) {
+		t.Fatalf("read error = %v, want a connection reset", err)
+	}
+}
@@ -0,0 +1,80 @@
+package client
+
+import (
+	"errors"
+	"math/rand"
+	"time"
+)
+
+// ErrSessionLost means the tunnel session went away while a dial was
+// asking the server for its connection. Nothing reached the target, so
+// the dial is safe to retry.
+var ErrSessionLost = errors.New("tunnel session went away")
+
+// RetryPolicy decides whether and when a dial through the tunnel is tried
+// again after an attempt fails. Waiting for the browser to connect in the
+// first place isn't an attempt; a dial waits up to Timeouts.BrowserWait
+// for that.
+type RetryPolicy struct {
+	// MaxAttempts is how many times a dial is tried in all. 1, or less,
+	// never retries.
+	MaxAttempts int
+	// BaseDelay is the wait before the first retry, doubling for each one
+	// after it up to MaxDelay.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// Jitter takes up to this fraction, between 0 and 1, off each wait at
+	// random, so dials that failed together don't retry together.
+	Jitter float64
+	// Retryable says whether an attempt that failed with err is worth
+	// another, given the errors DialContext returns, such as
+	// ErrSessionLost or ErrDenied. Nil means RetrySessionLost.
+	Retryable func(err error) bool
+}
+
+// DefaultRetryPolicy retries dials whose session went away, a few times,
+// while the browser reconnects. Failures the server reports aren't
+// retried.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 5,
+	BaseDelay:   100 * time.Millisecond,
+	MaxDelay:    2 * time.Second,
+	Jitter:      0.2,
+	Retryable:   RetrySessionLost,
+}
+
+// NoRetry fails a dial as soon as its first attempt does.
+var NoRetry = RetryPolicy{MaxAttempts: 1}
+
+// RetrySessionLost retries attempts whose session went away.
+func RetrySessionLost(err error) bool {
+	return errors.Is(err, ErrSessionLost)
+}
+
+// retry reports whether a dial should be tried again after its attempt'th
+// attempt failed with err.
+func (p RetryPolicy) retry(attempt int, err error) bool {
+	if attempt >= p.MaxAttempts {
+		return false
+	}
+	if p.Retryable == nil {
+		return RetrySessionLost(err)
+	}
+	return p.Retryable(err)
+}
+
+// delay is how long to wait before the retry following the attempt'th
+// attempt.
+func (p RetryPolicy) delay(attempt int) time.Duration {
+	d := p.BaseDelay
+	for i := 1; i < attempt && d < p.MaxDelay; i++ {
+		d *= 2
+	}
+	if p.MaxDelay > 0 && d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	if p.Jitter > 0 {
+		d -= time.Duration(rand.Float64() * min(p.Jitter, 1) * float64(d))
+	}
+	return d
+}
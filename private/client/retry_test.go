@@ -0,0 +1,71 @@
+package client
+
+import (
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// TestRetryUntilSuccess checks a dial is tried again after each failed
+// attempt and succeeds once the target comes up, on the last attempt the
+// policy allows, and fails when the policy allows one fewer.
+func TestRetryUntilSuccess(t *testing.T) {
+	const attempts = 3
+	for _, limit := range []int{attempts, attempts - 1} {
+		target := "127.0.0.1:" + strconv.Itoa(freePort(t))
+		failures := 0
+		policy := RetryPolicy{
+			MaxAttempts: limit,
+			BaseDelay:   10 * time.Millisecond,
+			Retryable: func(err error) bool {
+				failures++
+				if failures == attempts-1 {
+					// The target comes up in time for the next attempt.
+					ln, err := net.Listen("tcp", target)
+					if err != nil {
+						t.Error(err)
+						return false
+					}
+					t.Cleanup(func() { ln.Close() })
+					go func() {
+						for {
+							conn, err := ln.Accept()
+							if err != nil {
+								return
+							}
+							conn.Write([]byte("x"))
+							conn.Close()
+						}
+					}()
+				}
+				return true
+			},
+		}
+		tn := startTunnel(t, []Option{WithRetryPolicy(policy)})
+		conn, err := tn.client.dialThroughTunnel(context.Background(), "tcp", target)
+		if limit < attempts {
+			if err == nil {
+				conn.Close()
+				t.Errorf("%d attempts: dial succeeded", limit)
+			}
+			if failures != limit-1 {
+				t.Errorf("%d attempts: %d retries, want %d", limit, failures, limit-1)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%d attempts: %v", limit, err)
+		}
+		got, err := io.ReadAll(conn)
+		conn.Close()
+		if err != nil || string(got) != "x" {
+			t.Errorf("read %q, %v", got, err)
+		}
+		if failures != attempts-1 {
+			t.Errorf("%d failed attempts, want %d", failures, attempts-1)
+		}
+	}
+}
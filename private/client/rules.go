@@ -0,0 +1,38 @@
+package client
+
+import (
+	"context"
+
+	"github.com/armon/go-socks5"
+
+	"github.com/jtolio/netpump-go/private/protocol"
+)
+
+// DenyTargetsRule is a SOCKS5 rule, for WithSocksRules, refusing targets
+// matching any of patterns: host names, where "*." matches any
+// subdomain, or IPs and CIDR ranges. Names aren't resolved locally, so
+// an IP pattern only catches targets given as that IP. To refuse SOCKS5
+// commands, use socks5.PermitCommand.
+func DenyTargetsRule(patterns ...string) socks5.RuleSet {
+	return targetRule{match: protocol.Capabilities{DenyTargets: patterns}}
+}
+
+// AllowTargetsRule is a SOCKS5 rule, for WithSocksRules, refusing every
+// target except those matching patterns, as for DenyTargetsRule.
+func AllowTargetsRule(patterns ...string) socks5.RuleSet {
+	return targetRule{match: protocol.Capabilities{DenyTargets: patterns}, allow: true}
+}
+
+// targetRule matches targets as the server's deny policy does, permitting
+// matches if allow is set and refusing them otherwise.
+type targetRule struct {
+	match protocol.Capabilities
+	allow bool
+}
+
+func (r targetRule) Allow(ctx context.Context, req *socks5.Request) (context.Context, bool) {
+	if req.DestAddr == nil {
+		return ctx, false
+	}
+	return ctx, r.match.Denies(req.DestAddr.Address()) == r.allow
+}
@@ -0,0 +1,87 @@
+package client
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/armon/go-socks5"
+
+	"github.com/jtolio/netpump-go/private/server"
+)
+
+// countingTarget listens on loopback and counts the connections it
+// accepts, returning its address.
+func countingTarget(t *testing.T) (string, <-chan struct{}) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	accepted := make(chan struct{}, 16)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+			accepted <- struct{}{}
+		}
+	}()
+	return ln.Addr().String(), accepted
+}
+
+func TestSocksRulesRefuseLocally(t *testing.T) {
+	for name, rule := range map[string]socks5.RuleSet{
+		"deny target":   DenyTargetsRule("127.0.0.0/8"),
+		"allow targets": AllowTargetsRule("*.example.com"),
+		"deny connect":  &socks5.PermitCommand{EnableConnect: false},
+	} {
+		t.Run(name, func(t *testing.T) {
+			streams := &streamCounter{}
+			tn := startTunnel(t, []Option{WithSocksRules(rule)}, server.WithMetricsSink(streams))
+			target, accepted := countingTarget(t)
+
+			_, err := tn.dial(target)
+			if err == nil || !strings.Contains(err.Error(), "not allowed by ruleset") {
+				t.Fatalf("dial error = %v, want not allowed by ruleset", err)
+			}
+			if n := streams.n.Load(); n != 0 {
+				t.Fatalf("%d streams relayed by the server", n)
+			}
+			select {
+			case <-accepted:
+				t.Fatal("target was reached")
+			case <-time.After(100 * time.Millisecond):
+			}
+		})
+	}
+}
+
+func TestSocksRulesPermit(t *testing.T) {
+	tn := startTunnel(t, []Option{WithSocksRules(AllowTargetsRule("127.0.0.1"))})
+	target, accepted := countingTarget(t)
+
+	conn, err := tn.dial(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	select {
+	case <-accepted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("target wasn't reached")
+	}
+}
+
+func TestHandshakeKeyIgnoresZone(t *testing.T) {
+	conn := &net.TCPAddr{IP: net.ParseIP("fe80::1"), Port: 5555, Zone: "eth0"}
+	// go-socks5 hands rules the address without its zone.
+	req := &socks5.AddrSpec{IP: conn.IP, Port: conn.Port}
+	if a, b := handshakeKey(conn), handshakeKey(&net.TCPAddr{IP: req.IP, Port: req.Port}); a != b {
+		t.Fatalf("keys differ: %q and %q", a, b)
+	}
+}
@@ -0,0 +1,166 @@
+package client
+
+import (
+	"bufio"
+	"log/slog"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+const (
+	socks5Version    = 0x05
+	tlsHandshakeType = 0x16 // first byte of a TLS ClientHello record
+	sniffTimeout     = 10 * time.Second
+)
+
+// sniffListener splits one listener between the SOCKS5 proxy and the web
+// interface. SOCKS5 connections are handed to the socks callback; anything
+// else is returned from Accept for the HTTP server, except TLS
+// connections: both are plaintext there, so those are dropped.
+//
+// The web interface may listen beyond loopback, but unless loopbackOnly is
+// false, SOCKS5 from anywhere else is dropped too, so the port doesn't
+// become an open proxy.
+type sniffListener struct {
+	net.Listener
+	socks        func(net.Conn)
+	loopbackOnly bool
+	log          *slog.Logger
+
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+
+	// connections still being sniffed, closed by Close
+	mu       sync.Mutex
+	sniffing map[net.Conn]struct{}
+	wg       sync.WaitGroup
+	runDone  chan struct{}
+}
+
+func newSniffListener(ln net.Listener, socks func(net.Conn), loopbackOnly bool, log *slog.Logger) *sniffListener {
+	l := &sniffListener{
+		Listener:     ln,
+		socks:        socks,
+		loopbackOnly: loopbackOnly,
+		log:          log,
+		conns:        make(chan net.Conn),
+		done:         make(chan struct{}),
+		sniffing:     make(map[net.Conn]struct{}),
+		runDone:      make(chan struct{}),
+	}
+	go l.run()
+	return l
+}
+
+func (l *sniffListener) run() {
+	defer close(l.runDone)
+	defer l.closeOnce.Do(func() { close(l.done) })
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return
+		}
+		l.mu.Lock()
+		l.sniffing[conn] = struct{}{}
+		l.mu.Unlock()
+		l.wg.Add(1)
+		go l.route(conn)
+	}
+}
+
+func (l *sniffListener) route(conn net.Conn) {
+	// Peek without consuming, so whichever handler gets the connection
+	// still sees the first byte.
+	br := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(sniffTimeout))
+	first, err := br.Peek(1)
+	conn.SetReadDeadline(time.Time{})
+
+	l.mu.Lock()
+	delete(l.sniffing, conn)
+	l.mu.Unlock()
+	l.wg.Done()
+
+	if err != nil {
+		l.log.Debug("dropping connection before protocol detection", "remote", conn.RemoteAddr(), "error", err)
+		conn.Close()
+		return
+	}
+
+	sc := &sniffConn{Conn: conn, r: br}
+	switch first[0] {
+	case socks5Version:
+		if l.loopbackOnly && !isLoopback(conn.RemoteAddr()) {
+			l.log.Warn("dropping SOCKS5 connection from beyond loopback on the shared port, which needs logins for that", "remote", conn.RemoteAddr())
+			conn.Close()
+			return
+		}
+		l.socks(sc)
+		return
+	case tlsHandshakeType:
+		l.log.Warn("dropping TLS connection on the shared port, which serves SOCKS5 and HTTP in plaintext only", "remote", conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+
+	select {
+	case l.conns <- sc:
+	case <-l.done:
+		sc.Close()
+	}
+}
+
+func (l *sniffListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops the listener and waits for any connections still being
+// sniffed to be dropped.
+func (l *sniffListener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	err := l.Listener.Close()
+	<-l.runDone
+
+	l.mu.Lock()
+	for conn := range l.sniffing {
+		conn.Close()
+	}
+	l.mu.Unlock()
+	l.wg.Wait()
+	return err
+}
+
+// isLoopback reports whether addr is a loopback address.
+func isLoopback(addr net.Addr) bool {
+	tcp, ok := addr.(*net.TCPAddr)
+	return ok && tcp.IP.IsLoopback()
+}
+
+// isLoopbackHost reports whether host, as given to listen on, is only
+// reachable from this machine.
+func isLoopbackHost(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip, err := netip.ParseAddr(host)
+	return err == nil && ip.IsLoopback()
+}
+
+// sniffConn is a connection whose leading bytes may be sitting in a
+// buffer after protocol sniffing.
+type sniffConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (s *sniffConn) Read(b []byte) (int, error) {
+	return s.r.Read(b)
+}
@@ -0,0 +1,177 @@
+package client
+
+import (
+	"io"
+	"log/slog"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSniffRouting(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		first []byte // nil to close before sending anything
+		want  string
+	}{
+		{"socks5", []byte{socks5Version, 1, 0}, "socks"},
+		{"http", []byte("GET / HTTP/1.1\r\n\r\n"), "http"},
+		{"tls", []byte{tlsHandshakeType, 3, 1}, "dropped"},
+		{"eof", nil, "dropped"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			routed := make(chan string, 2)
+			firstBytes := make(chan []byte, 2)
+			take := func(route string, conn net.Conn) {
+				defer conn.Close()
+				b := make([]byte, len(tc.first))
+				io.ReadFull(conn, b)
+				firstBytes <- b
+				routed <- route
+			}
+			sl := newSniffListener(ln, func(conn net.Conn) { take("socks", conn) }, true, slog.New(slog.NewTextHandler(io.Discard, nil)))
+			defer sl.Close()
+			go func() {
+				for {
+					conn, err := sl.Accept()
+					if err != nil {
+						return
+					}
+					go take("http", conn)
+				}
+			}()
+
+			conn, err := net.Dial("tcp", ln.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			if tc.first == nil {
+				conn.(*net.TCPConn).CloseWrite()
+			} else if _, err := conn.Write(tc.first); err != nil {
+				t.Fatal(err)
+			}
+
+			if tc.want == "dropped" {
+				conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+				if _, err := conn.Read(make([]byte, 1)); err == nil {
+					t.Fatal("connection got an answer, want it dropped")
+				} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+					t.Fatal("connection left open, want it dropped")
+				}
+				select {
+				case route := <-routed:
+					t.Fatalf("routed to %s, want dropped", route)
+				default:
+				}
+				return
+			}
+			select {
+			case route := <-routed:
+				if route != tc.want {
+					t.Fatalf("routed to %s, want %s", route, tc.want)
+				}
+			case <-time.After(10 * time.Second):
+				t.Fatalf("not routed, want %s", tc.want)
+			}
+			// The handler still sees the byte routing peeked at.
+			if got := <-firstBytes; string(got) != string(tc.first) {
+				t.Errorf("handler read %q, want %q", got, tc.first)
+			}
+		})
+	}
+}
+
+// remoteListener makes every connection it accepts look like it came from
+// remote.
+type remoteListener struct {
+	net.Listener
+	remote net.Addr
+}
+
+func (l remoteListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return remoteConn{conn, l.remote}, nil
+}
+
+type remoteConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c remoteConn) RemoteAddr() net.Addr { return c.remote }
+
+// TestSniffSocksLoopbackOnly checks SOCKS5 from beyond loopback is dropped
+// unless the proxy requires logins, while HTTP still gets through.
+func TestSniffSocksLoopbackOnly(t *testing.T) {
+	lan := &net.TCPAddr{IP: net.ParseIP("192.168.1.20"), Port: 50000}
+	for _, tc := range []struct {
+		name         string
+		remote       net.Addr // nil for the real, loopback, one
+		loopbackOnly bool
+		first        []byte
+		want         string
+	}{
+		{"loopback socks5", nil, true, []byte{socks5Version, 1, 0}, "socks"},
+		{"lan socks5", lan, true, []byte{socks5Version, 1, 0}, "dropped"},
+		{"lan socks5 with logins", lan, false, []byte{socks5Version, 1, 0}, "socks"},
+		{"lan http", lan, true, []byte("GET / HTTP/1.1\r\n\r\n"), "http"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tcp, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var ln net.Listener = tcp
+			if tc.remote != nil {
+				ln = remoteListener{tcp, tc.remote}
+			}
+			routed := make(chan string, 1)
+			sl := newSniffListener(ln, func(conn net.Conn) {
+				conn.Close()
+				routed <- "socks"
+			}, tc.loopbackOnly, slog.New(slog.NewTextHandler(io.Discard, nil)))
+			defer sl.Close()
+			go func() {
+				for {
+					conn, err := sl.Accept()
+					if err != nil {
+						return
+					}
+					conn.Close()
+					routed <- "http"
+				}
+			}()
+
+			conn, err := net.Dial("tcp", tcp.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			if _, err := conn.Write(tc.first); err != nil {
+				t.Fatal(err)
+			}
+			conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+			if _, err := conn.Read(make([]byte, 1)); err == nil {
+				t.Fatal("connection got an answer")
+			} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				t.Fatal("connection left open")
+			}
+			got := "dropped"
+			select {
+			case got = <-routed:
+			case <-time.After(100 * time.Millisecond):
+			}
+			if got != tc.want {
+				t.Errorf("routed to %s, want %s", got, tc.want)
+			}
+		})
+	}
+}
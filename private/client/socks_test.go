@@ -0,0 +1,217 @@
+package client
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/proxy"
+
+	"github.com/jtolio/netpump-go/private/eventlog"
+	"github.com/jtolio/netpump-go/private/server"
+)
+
+// testTLS returns a server config with a certificate for 127.0.0.1, and a
+// client config trusting it.
+func testTLS(t *testing.T) (server, client *tls.Config) {
+	t.Helper()
+	hs := httptest.NewTLSServer(nil)
+	defer hs.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(hs.Certificate())
+	return hs.TLS.Clone(), &tls.Config{RootCAs: roots}
+}
+
+// tlsDialer dials TLS connections for proxy.SOCKS5.
+type tlsDialer struct{ config *tls.Config }
+
+func (d tlsDialer) Dial(network, addr string) (net.Conn, error) {
+	return tls.Dial(network, addr, d.config)
+}
+
+// waitClosed waits up to within for the far end to close conn, reporting
+// whether it did.
+func waitClosed(conn net.Conn, within time.Duration) bool {
+	conn.SetReadDeadline(time.Now().Add(within))
+	_, err := io.Copy(io.Discard, conn)
+	ne, ok := err.(net.Error)
+	return !(ok && ne.Timeout())
+}
+
+func TestSocksTLS(t *testing.T) {
+	serverTLS, clientTLS := testTLS(t)
+	tn := startTunnel(t, []Option{
+		WithSocksTLS(serverTLS),
+		WithSocksAuth(map[string]string{"alice": "s3cret"}),
+		// A plaintext greeting is too short for a TLS record header, so
+		// the server waits out the handshake for the rest.
+		WithTimeouts(Timeouts{Handshake: 500 * time.Millisecond}),
+	})
+	target := echoTarget(t)
+
+	d, err := proxy.SOCKS5("tcp", tn.socksAddr, &proxy.Auth{User: "alice", Password: "s3cret"}, tlsDialer{clientTLS})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := d.Dial("tcp", target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, 5)
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "hello" {
+		t.Errorf("echo = %q, want %q", got, "hello")
+	}
+
+	// A wrong password is refused, as is SOCKS5 in plaintext.
+	d, err = proxy.SOCKS5("tcp", tn.socksAddr, &proxy.Auth{User: "alice", Password: "guess"}, tlsDialer{clientTLS})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn, err := d.Dial("tcp", target); err == nil {
+		conn.Close()
+		t.Error("dial with a wrong password went through")
+	}
+	d, err = proxy.SOCKS5("tcp", tn.socksAddr, &proxy.Auth{User: "alice", Password: "s3cret"}, proxy.Direct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn, err := d.Dial("tcp", target); err == nil {
+		conn.Close()
+		t.Error("dial without TLS went through")
+	}
+}
+
+// TestSocksTLSHandshakeTimeout checks a connection that never starts its
+// TLS handshake is dropped once the handshake timeout passes.
+func TestSocksTLSHandshakeTimeout(t *testing.T) {
+	const timeout = 200 * time.Millisecond
+	serverTLS, _ := testTLS(t)
+	tn := startTunnel(t, []Option{WithSocksTLS(serverTLS), WithTimeouts(Timeouts{Handshake: timeout})})
+
+	conn, err := net.Dial("tcp", tn.socksAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	start := time.Now()
+	if !waitClosed(conn, 10*time.Second) {
+		t.Fatal("silent connection still open")
+	}
+	if took := time.Since(start); took < timeout/2 || took > timeout+2*time.Second {
+		t.Errorf("dropped after %v, want about %v", took, timeout)
+	}
+}
+
+// TestSocksBadHandshake checks connections that don't speak SOCKS5, or
+// stop partway through the handshake, are dropped and logged, and that the
+// proxy carries on.
+func TestSocksBadHandshake(t *testing.T) {
+	const timeout = 300 * time.Millisecond
+	tn := startTunnel(t, []Option{WithTimeouts(Timeouts{Handshake: timeout}), WithEventLog(50)})
+	logged := func(msg string) int {
+		n := 0
+		for _, e := range tn.client.events.Events() {
+			if e.Message == msg {
+				n++
+			}
+		}
+		return n
+	}
+
+	for _, tc := range []struct {
+		name string
+		send string
+		msg  string
+	}{
+		{"http", "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n", "malformed SOCKS5 handshake"},
+		{"socks4", "\x04\x01\x00\x50\x7f\x00\x00\x01\x00", "malformed SOCKS5 handshake"},
+		{"partial greeting", "\x05\x02\x00", "SOCKS5 handshake timed out"},
+		{"partial request", "\x05\x01\x00\x05\x01\x00\x01\x7f", "SOCKS5 handshake timed out"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			before := logged(tc.msg)
+			conn, err := net.Dial("tcp", tn.socksAddr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			start := time.Now()
+			if _, err := conn.Write([]byte(tc.send)); err != nil {
+				t.Fatal(err)
+			}
+			if !waitClosed(conn, 10*time.Second) {
+				t.Fatal("connection still open")
+			}
+			if took := time.Since(start); took > timeout+2*time.Second {
+				t.Errorf("dropped after %v, want within %v", took, timeout)
+			}
+			for deadline := time.Now().Add(5 * time.Second); logged(tc.msg) == before; time.Sleep(10 * time.Millisecond) {
+				if time.Now().After(deadline) {
+					t.Fatalf("%q not logged", tc.msg)
+				}
+			}
+		})
+	}
+
+	conn, err := tn.dial(echoTarget(t))
+	if err != nil {
+		t.Fatalf("dial after bad handshakes: %v", err)
+	}
+	conn.Close()
+}
+
+func TestSendSource(t *testing.T) {
+	for _, send := range []bool{false, true} {
+		var copts []Option
+		if send {
+			copts = append(copts, WithSendSource())
+		}
+		tn := startTunnel(t, copts, server.WithEventLog(50), server.WithAdminToken("admin"))
+		conn, err := tn.dial(echoTarget(t))
+		if err != nil {
+			t.Fatal(err)
+		}
+		source := conn.LocalAddr().String()
+		conn.Close()
+
+		req, err := http.NewRequest(http.MethodGet, "http"+strings.TrimPrefix(tn.serverURL, "ws")+"/events", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer admin")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var events []eventlog.Event
+		err = json.NewDecoder(resp.Body).Decode(&events)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		logged := ""
+		for _, e := range events {
+			if e.Message == "proxying" {
+				logged = e.Attrs["source"]
+			}
+		}
+		if want := map[bool]string{false: "", true: source}[send]; logged != want {
+			t.Errorf("sending the source %v: server logged %q, want %q", send, logged, want)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package client
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/yamux"
+
+	"github.com/jtolio/netpump-go/private/wsconn"
+)
+
+const (
+	defaultInvalidDataLimit    = 5
+	defaultInvalidDataCooldown = time.Minute
+)
+
+// browserThrottle refuses browsers, by address, whose sessions keep
+// failing on invalid tunnel data, so a broken or hostile page can't have
+// the client set up session after session as fast as it reconnects.
+type browserThrottle struct {
+	limit    int // failures before refusing, 0 for never
+	cooldown time.Duration
+
+	mu    sync.Mutex
+	addrs map[string]*throttledAddr
+}
+
+type throttledAddr struct {
+	failures int
+	last     time.Time // of the last failure
+	until    time.Time // refused until then
+}
+
+// refused reports whether addr is cooling down.
+func (t *browserThrottle) refused(addr string, now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	a := t.addrs[addr]
+	return a != nil && now.Before(a.until)
+}
+
+// fail records a session from addr failing on invalid data, and reports
+// whether addr is now refused. Failures further apart than the cooldown
+// don't add up.
+func (t *browserThrottle) fail(addr string, now time.Time) (failures int, refused bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for k, a := range t.addrs {
+		if now.Sub(a.last) > t.cooldown && !now.Before(a.until) {
+			delete(t.addrs, k)
+		}
+	}
+	a := t.addrs[addr]
+	if a == nil {
+		if t.addrs == nil {
+			t.addrs = make(map[string]*throttledAddr)
+		}
+		a = &throttledAddr{}
+		t.addrs[addr] = a
+	}
+	a.failures++
+	a.last = now
+	if t.limit <= 0 || a.failures < t.limit {
+		return a.failures, false
+	}
+	a.failures = 0
+	a.until = now.Add(t.cooldown)
+	return t.limit, true
+}
+
+// invalidData logs that the browser at addr sent invalid data, and
+// starts refusing it if it keeps doing so.
+func (c *Client) invalidData(addr string, err error) {
+	failures, refused := c.throttle.fail(addr, time.Now())
+	c.log.Warn("browser sent invalid tunnel data", "browser", addr, "error", err, "failures", failures)
+	if refused {
+		c.log.Warn("refusing browser that keeps sending invalid tunnel data", "browser", addr,
+			"failures", failures, "cooldown", c.throttle.cooldown)
+	}
+}
+
+// isInvalidData reports whether a session ended with err because the
+// browser sent something that isn't the tunnel protocol.
+func isInvalidData(err error) bool {
+	return errors.Is(err, yamux.ErrInvalidVersion) ||
+		errors.Is(err, yamux.ErrInvalidMsgType) ||
+		errors.Is(err, yamux.ErrRecvWindowExceeded) ||
+		errors.Is(err, yamux.ErrUnexpectedFlag) ||
+		errors.Is(err, wsconn.ErrUnknownConn)
+}
+
+// sessionErr returns why session, which has closed, did so.
+func sessionErr(session *yamux.Session) error {
+	// A closed session's AcceptStream returns its shutdown error, unless
+	// a stream was still waiting to be accepted.
+	stream, err := session.AcceptStream()
+	if stream != nil {
+		stream.Close()
+	}
+	return err
+}
+
+// browserAddr is the address a browser connects from, without its port.
+func browserAddr(remote string) string {
+	host, _, err := net.SplitHostPort(remote)
+	if err != nil {
+		return remote
+	}
+	return host
+}
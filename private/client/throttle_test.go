@@ -0,0 +1,109 @@
+package client
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// localStatus connects to the web interface at base as the browser page
+// would, with header, and returns the status of the upgrade along with
+// the websocket if it went through.
+func localStatus(t *testing.T, base string, header http.Header) (int, *websocket.Conn) {
+	t.Helper()
+	ws, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(base, "http")+localWSPath, header)
+	if err != nil {
+		if resp == nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, nil
+	}
+	t.Cleanup(func() { ws.Close() })
+	return http.StatusSwitchingProtocols, ws
+}
+
+func TestLocalWebSocketOrigin(t *testing.T) {
+	c, base := startClient(t, WithEventLog(10))
+	for _, tc := range []struct {
+		origin string
+		want   int
+	}{
+		{base, http.StatusSwitchingProtocols},
+		{"", http.StatusSwitchingProtocols},
+		{"http://evil.example", http.StatusForbidden},
+		{"http://127.0.0.1:1", http.StatusForbidden},
+		{"::not a url", http.StatusForbidden},
+	} {
+		header := http.Header{}
+		if tc.origin != "" {
+			header.Set("Origin", tc.origin)
+		}
+		if got, ws := localStatus(t, base, header); got != tc.want {
+			t.Errorf("origin %q: status %d, want %d", tc.origin, got, tc.want)
+		} else if ws != nil {
+			ws.Close()
+		}
+	}
+	rejected := 0
+	for _, e := range c.events.Events() {
+		if e.Message == "rejected websocket from another origin" {
+			rejected++
+		}
+	}
+	if rejected != 3 {
+		t.Errorf("%d rejections logged, want 3", rejected)
+	}
+}
+
+// TestInvalidDataThrottle checks a browser whose sessions keep ending on
+// data that isn't the tunnel protocol is refused for the cooldown, and
+// let back in after it.
+func TestInvalidDataThrottle(t *testing.T) {
+	const (
+		failures = 3
+		cooldown = 500 * time.Millisecond
+	)
+	c, base := startClient(t, WithInvalidDataThrottle(failures, cooldown), WithEventLog(100))
+	invalid := func() int {
+		n := 0
+		for _, e := range c.events.Events() {
+			if e.Message == "browser sent invalid tunnel data" {
+				n++
+			}
+		}
+		return n
+	}
+	for i := 1; i <= failures; i++ {
+		code, ws := localStatus(t, base, nil)
+		if code != http.StatusSwitchingProtocols {
+			t.Fatalf("session %d: status %d", i, code)
+		}
+		// Not a yamux header: the version byte is wrong.
+		if err := ws.WriteMessage(websocket.BinaryMessage, []byte("GET / HTTP/1.1\r\n")); err != nil {
+			t.Fatal(err)
+		}
+		ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+		for {
+			if _, _, err := ws.ReadMessage(); err != nil {
+				break
+			}
+		}
+		for deadline := time.Now().Add(5 * time.Second); invalid() < i; time.Sleep(10 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("session %d: invalid data not recorded", i)
+			}
+		}
+	}
+	refusedAt := time.Now()
+	if code, _ := localStatus(t, base, nil); code != http.StatusTooManyRequests {
+		t.Fatalf("after %d failures: status %d, want %d", failures, code, http.StatusTooManyRequests)
+	}
+
+	time.Sleep(time.Until(refusedAt.Add(cooldown)))
+	if code, _ := localStatus(t, base, nil); code != http.StatusSwitchingProtocols {
+		t.Errorf("after the cooldown: status %d", code)
+	}
+}
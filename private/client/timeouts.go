@@ -0,0 +1,99 @@
+package client
+
+import (
+	"context"
+	"time"
+
+	"github.com/hashicorp/yamux"
+)
+
+// Timeouts gathers the client's timeouts in one place. Zero fields keep
+// their defaults; negative ones turn the timeout off, as described for
+// each field.
+type Timeouts struct {
+	// BrowserWait is how long a dial waits for the browser to connect
+	// before failing, 30 seconds by default. Off, dials fail right away
+	// while no browser is connected.
+	BrowserWait time.Duration
+	// ReconnectGrace is how long a dial whose session went away waits for
+	// the browser to reconnect, 3 seconds by default, within BrowserWait.
+	// Off, such dials fail unless a session is left.
+	ReconnectGrace time.Duration
+	// Handshake bounds the SOCKS5 handshake of each connection, and its
+	// TLS handshake before that with WithSocksTLS, 10 seconds by default.
+	// Off, handshakes may take as long as they like.
+	Handshake time.Duration
+	// Write is as for WithWriteTimeout.
+	Write time.Duration
+	// Shutdown is as for WithShutdownTimeout. Off is the same as the
+	// default, closing connections right away.
+	Shutdown time.Duration
+	// KeepAlive is how often the tunnel session is pinged to notice a
+	// link that went dead, 30 seconds by default. A ping unanswered for
+	// that long, or 10 seconds if that's shorter, drops the session so the
+	// browser reconnects. Off, a dead link is only noticed when a write
+	// fails.
+	KeepAlive time.Duration
+}
+
+const (
+	defaultBrowserWait = 30 * time.Second
+	// defaultReconnectGrace is short, as nothing has been sent to the
+	// target yet and the dial is safe to retry.
+	defaultReconnectGrace = 3 * time.Second
+	defaultHandshake      = 10 * time.Second
+)
+
+// WithTimeouts sets any of the client's timeouts at once. Fields left zero
+// keep their defaults, or what an earlier option set.
+func WithTimeouts(t Timeouts) Option {
+	return func(c *Client) {
+		setTimeout(&c.browserWait, t.BrowserWait)
+		setTimeout(&c.reconnectGrace, t.ReconnectGrace)
+		setTimeout(&c.handshakeTimeout, t.Handshake)
+		setTimeout(&c.writeTimeout, t.Write)
+		setTimeout(&c.shutdownTimeout, t.Shutdown)
+		setTimeout(&c.keepAlive, t.KeepAlive)
+	}
+}
+
+// setTimeout stores d in field unless it's zero, turning negative
+// durations into zero, which is how the client's fields say a timeout is
+// off.
+func setTimeout(field *time.Duration, d time.Duration) {
+	if d != 0 {
+		*field = max(d, 0)
+	}
+}
+
+// The stream windows WithStreamWindow accepts: yamux won't go below its
+// initial window, and more than a GiB per stream is surely a mistake.
+const (
+	minStreamWindow = 256 * 1024
+	maxStreamWindow = 1 << 30
+)
+
+// muxConfig is the yamux configuration for tunnel sessions.
+func (c *Client) muxConfig() *yamux.Config {
+	conf := yamux.DefaultConfig()
+	if c.keepAlive > 0 {
+		conf.KeepAliveInterval = c.keepAlive
+		// yamux gives up on a ping after the write timeout.
+		conf.ConnectionWriteTimeout = min(conf.ConnectionWriteTimeout, c.keepAlive)
+	} else {
+		conf.EnableKeepAlive = false
+	}
+	if c.streamWindow > 0 {
+		conf.MaxStreamWindowSize = uint32(c.streamWindow)
+	}
+	return conf
+}
+
+// withTimeout is context.WithTimeout, but without a deadline if timeout is
+// zero.
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
@@ -0,0 +1,155 @@
+package client
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// debugRecorder is a slog handler that keeps every record, debug ones
+// included, with its attributes by key.
+type debugRecorder struct {
+	mu      sync.Mutex
+	records []recorded
+}
+
+type recorded struct {
+	message string
+	attrs   map[string]slog.Value
+}
+
+func (r *debugRecorder) Enabled(context.Context, slog.Level) bool { return true }
+func (r *debugRecorder) WithAttrs([]slog.Attr) slog.Handler       { return r }
+func (r *debugRecorder) WithGroup(string) slog.Handler            { return r }
+
+func (r *debugRecorder) Handle(_ context.Context, rec slog.Record) error {
+	attrs := make(map[string]slog.Value)
+	rec.Attrs(func(a slog.Attr) bool {
+		attrs[a.Key] = a.Value
+		return true
+	})
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.records = append(r.records, recorded{rec.Message, attrs})
+	return nil
+}
+
+// find returns the attributes of the records with message.
+func (r *debugRecorder) find(message string) []map[string]slog.Value {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var found []map[string]slog.Value
+	for _, rec := range r.records {
+		if rec.message == message {
+			found = append(found, rec.attrs)
+		}
+	}
+	return found
+}
+
+// TestSetupTimings checks both ends log a stream's setup phases under the
+// same stream ID, and that they're nonzero and add up.
+func TestSetupTimings(t *testing.T) {
+	// The client and the server take their loggers from the default when
+	// they're made.
+	rec := &debugRecorder{}
+	old := slog.Default()
+	slog.SetDefault(slog.New(rec))
+	t.Cleanup(func() { slog.SetDefault(old) })
+	tn := startTunnel(t, nil)
+
+	// The target takes a while to say anything, as a slow one would.
+	const greeting = 20 * time.Millisecond
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			time.Sleep(greeting)
+			conn.Write([]byte("x"))
+			conn.Close()
+		}
+	}()
+	conn, err := tn.dial(ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := io.ReadFull(conn, make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+
+	// The server logs its side before answering, the client its first
+	// byte once it's read.
+	var clientSetup, clientFirst, serverSetup, serverFirst map[string]slog.Value
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		setup, client, server := rec.find("stream setup"), rec.find("first byte from server"), rec.find("first byte from target")
+		if len(setup) == 2 && len(client) == 1 && len(server) == 1 {
+			clientSetup, serverSetup = setup[0], setup[1]
+			if _, ok := clientSetup["mux_wait"]; !ok {
+				clientSetup, serverSetup = serverSetup, clientSetup
+			}
+			clientFirst, serverFirst = client[0], server[0]
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d setup lines, %d first byte lines from the client and %d from the server",
+				len(setup), len(client), len(server))
+		}
+	}
+
+	d := func(attrs map[string]slog.Value, key string) time.Duration {
+		t.Helper()
+		v, ok := attrs[key]
+		if !ok || v.Kind() != slog.KindDuration {
+			t.Fatalf("%s: %v in %v", key, v, attrs)
+		}
+		if v.Duration() < 0 {
+			t.Errorf("%s = %v, negative", key, v.Duration())
+		}
+		return v.Duration()
+	}
+	muxWait, open, answer := d(clientSetup, "mux_wait"), d(clientSetup, "open"), d(clientSetup, "server")
+	wait, total := d(clientFirst, "wait"), d(clientFirst, "total")
+	request, dial, targetWait := d(serverSetup, "request"), d(serverSetup, "dial"), d(serverFirst, "wait")
+
+	for _, tc := range []struct {
+		name string
+		d    time.Duration
+	}{{"client connect", answer}, {"client first byte", wait}, {"server dial", dial}, {"server first byte", targetWait}} {
+		if tc.d <= 0 {
+			t.Errorf("%s took %v", tc.name, tc.d)
+		}
+	}
+	// The client's phases follow one another, and the server's happen
+	// within them.
+	if sum := muxWait + open + answer + wait; sum != total {
+		t.Errorf("client phases add up to %v, total %v", sum, total)
+	}
+	if answer < request+dial {
+		t.Errorf("client waited %v for the answer, the server took %v to read the request and %v to dial", answer, request, dial)
+	}
+	if targetWait > total {
+		t.Errorf("the target's first byte took %v, after the client's total of %v", targetWait, total)
+	}
+	if total < greeting {
+		t.Errorf("first byte after %v, before the target sent it", total)
+	}
+
+	if c, s := clientSetup["stream"].Uint64(), serverSetup["stream"].Uint64(); c != s {
+		t.Errorf("client logged stream %d, server %d", c, s)
+	}
+	if c := clientFirst["stream"].Uint64(); c != serverSetup["stream"].Uint64() {
+		t.Errorf("client's first byte logged for stream %d", c)
+	}
+}
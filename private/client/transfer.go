@@ -0,0 +1,91 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/hashicorp/yamux"
+)
+
+// StreamEnd describes a tunneled connection as it closes, for
+// WithStreamEnd, so a higher layer can pick up a transfer the tunnel cut
+// short where it left off, such as with an HTTP range request.
+type StreamEnd struct {
+	Target string
+	Label  string
+	Start  time.Time
+	End    time.Time
+	// Sent counts the bytes written to the connection, all of which were
+	// handed to the tunnel. Those the server hadn't passed on yet when
+	// the tunnel went away are lost, so it's only an upper bound on what
+	// reached the target.
+	Sent int64
+	// Received counts the bytes read from the connection: exactly how much
+	// of what the target sent got through.
+	Received int64
+	// Err is the first error reading or writing the connection hit, nil
+	// if it was only closed. It wraps ErrSessionLost if the tunnel went
+	// away under the connection.
+	Err error
+}
+
+// failed notes err as the connection's first failure, unless it's the
+// target closing the connection or it was closed already, and returns
+// the error the caller should see. A session going away ends its streams
+// as if their targets closed them, so an EOF then is a failure too:
+// ErrSessionLost wrapping io.ErrUnexpectedEOF.
+func (t *tunnelConn) failed(err error) error {
+	if err == nil {
+		return err
+	}
+	if t.onReset != nil && errors.Is(err, yamux.ErrConnectionReset) {
+		t.onReset()
+	}
+	if t.closed.Load() {
+		return err
+	}
+	if t.session != nil && t.session.IsClosed() {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if !errors.Is(err, ErrSessionLost) {
+			err = fmt.Errorf("%w: %w", ErrSessionLost, err)
+		}
+	} else if err == io.EOF || isTimeout(err) {
+		return err
+	}
+	t.failure.CompareAndSwap(nil, &err)
+	return err
+}
+
+// isTimeout reports whether err is a deadline passing, which callers may
+// retry after.
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// streamEnded reports a tunneled connection that was just closed.
+func (c *Client) streamEnded(tc *tunnelConn) {
+	end := StreamEnd{
+		Target:   tc.info.target,
+		Label:    tc.info.label,
+		Start:    tc.info.start,
+		End:      time.Now(),
+		Sent:     tc.info.sent.Load(),
+		Received: tc.info.received.Load(),
+	}
+	if err := tc.failure.Load(); err != nil {
+		end.Err = *err
+	}
+	if errors.Is(end.Err, ErrSessionLost) {
+		c.log.Info("connection cut off by the tunnel going away", "target", end.Target,
+			"sent", end.Sent, "received", end.Received)
+	}
+	if c.onStreamEnd != nil {
+		c.onStreamEnd(end)
+	}
+}
@@ -0,0 +1,36 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// DialContext connects to addr through the tunnel, the same way the
+// SOCKS5 proxy does. Only TCP networks are supported. The target's name is
+// resolved by the server.
+func (c *Client) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("unsupported network %q", network)
+	}
+	return c.dialThroughTunnel(ctx, network, addr)
+}
+
+// Transport returns an http.Transport that makes its connections through
+// the tunnel, for Go programs that would rather not go through SOCKS5. It
+// starts from http.DefaultTransport's settings, so connections are pooled
+// and reused as usual, but ignores proxy environment variables.
+//
+// HTTPS is end-to-end: the TLS handshake happens between the transport and
+// the real target, so certificates are verified against the target's name
+// and the tunnel only ever carries ciphertext. Set TLSClientConfig on the
+// result to change how targets are verified.
+func (c *Client) Transport() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Proxy = nil
+	t.DialContext = c.DialContext
+	return t
+}
@@ -0,0 +1,61 @@
+package client
+
+import (
+	"crypto/x509"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/jtolio/netpump-go/private/server"
+)
+
+func TestTransportHTTPS(t *testing.T) {
+	target := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil {
+			http.Error(w, "not over TLS", http.StatusBadRequest)
+			return
+		}
+		io.WriteString(w, "hello over "+r.Proto)
+	}))
+	defer target.Close()
+	streams := &streamCounter{}
+	tn := startTunnel(t, nil, server.WithMetricsSink(streams))
+
+	tr := tn.client.Transport()
+	defer tr.CloseIdleConnections()
+	// Trust the test server's certificate, which is verified against
+	// the target itself: the tunnel only carries the TLS connection.
+	tr.TLSClientConfig = target.Client().Transport.(*http.Transport).TLSClientConfig.Clone()
+	client := &http.Client{Transport: tr}
+	for i := 0; i < 3; i++ {
+		resp, err := client.Get(target.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusOK || string(body) != "hello over HTTP/1.1" {
+			t.Fatalf("got %d %q", resp.StatusCode, body)
+		}
+	}
+	if n := streams.n.Load(); n != 1 {
+		t.Errorf("%d streams through the tunnel for 3 requests, want 1 reused", n)
+	}
+
+	// Without trusting the test server's certificate, it's refused.
+	untrusting := &http.Client{Transport: tn.client.Transport()}
+	resp, err := untrusting.Get(target.URL)
+	if err == nil {
+		resp.Body.Close()
+		t.Fatal("request to a target with an untrusted certificate succeeded")
+	}
+	var unknownAuthority x509.UnknownAuthorityError
+	if !errors.As(err, &unknownAuthority) {
+		t.Fatalf("got %v, want an unknown authority error", err)
+	}
+}
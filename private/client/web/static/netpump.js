@@ -0,0 +1,281 @@
+let localWS = null;
+let serverWS = null;
+let bytesSent = 0;
+let bytesReceived = 0;
+
+function formatBytes(bytes) {
+  if (bytes === 0) return '0 B';
+  const k = 1024;
+  const sizes = ['B', 'KB', 'MB', 'GB', 'TB'];
+  const i = Math.floor(Math.log(bytes) / Math.log(k));
+  return (bytes / Math.pow(k, i)).toFixed(2) + ' ' + sizes[i];
+}
+
+function updateBytes() {
+  document.getElementById('bytesSent').textContent = formatBytes(bytesSent);
+  document.getElementById('bytesReceived').textContent = formatBytes(bytesReceived);
+  document.getElementById('bytesTotal').textContent = formatBytes(bytesSent + bytesReceived);
+}
+
+// Backpressure: when the destination socket can't keep up, ask the
+// source to pause writing until the backlog drains. The Go side stops
+// writing, which stalls yamux and in turn the proxied connections.
+const highWater = 4 * 1024 * 1024;
+const lowWater = 1024 * 1024;
+
+function relay(from, to, count) {
+  let paused = false;
+
+  function drain() {
+    if (to.readyState !== WebSocket.OPEN || from.readyState !== WebSocket.OPEN) {
+      return;
+    }
+    if (to.bufferedAmount > lowWater) {
+      setTimeout(drain, 10);
+      return;
+    }
+    paused = false;
+    from.send('resume');
+  }
+
+  from.onmessage = function(event) {
+    if (to.readyState !== WebSocket.OPEN) {
+      return;
+    }
+    to.send(event.data);
+    count(event.data.byteLength || event.data.length || 0);
+    updateBytes();
+    if (!paused && to.bufferedAmount > highWater) {
+      paused = true;
+      from.send('pause');
+      drain();
+    }
+  };
+}
+
+function updateStatus(element, connected) {
+  element.textContent = connected ? 'Connected' : 'Disconnected';
+  element.className = connected ? 'connected' : 'disconnected';
+}
+
+function connect() {
+  // Connect to local client
+  localWS = new WebSocket('ws://' + location.host + config.localWSPath);
+  localWS.binaryType = 'arraybuffer';
+
+  localWS.onopen = function() {
+    console.log('[+] Connected to local client');
+    updateStatus(document.getElementById('localStatus'), true);
+
+    // Connect to server
+    serverWS = new WebSocket(config.serverWSURL);
+    serverWS.binaryType = 'arraybuffer';
+
+    serverWS.onopen = function() {
+      console.log('[+] Connected to server');
+      updateStatus(document.getElementById('serverStatus'), true);
+
+      // Relay all data between connections. Data from local client
+      // going to server is sent, data from server going to local client
+      // is received.
+      relay(localWS, serverWS, function(n) { bytesSent += n; });
+      relay(serverWS, localWS, function(n) { bytesReceived += n; });
+
+      // A server going away may name another to move to. The message
+      // still goes on to the local client, which notes it too.
+      const forward = serverWS.onmessage;
+      serverWS.onmessage = function(event) {
+        forward(event);
+        if (typeof event.data === 'string' && event.data.startsWith('migrate ')) {
+          migrate(event.data.slice('migrate '.length).trim());
+        }
+      };
+    };
+
+    serverWS.onerror = function(error) {
+      console.error('[!] Server error:', error);
+      updateStatus(document.getElementById('serverStatus'), false);
+    };
+
+    serverWS.onclose = function() {
+      console.log('[-] Server disconnected');
+      updateStatus(document.getElementById('serverStatus'), false);
+      if (localWS.readyState === WebSocket.OPEN) {
+        localWS.close();
+      }
+    };
+  };
+
+  localWS.onerror = function(error) {
+    console.error('[!] Local error:', error);
+    updateStatus(document.getElementById('localStatus'), false);
+  };
+
+  localWS.onclose = function() {
+    console.log('[-] Local disconnected');
+    updateStatus(document.getElementById('localStatus'), false);
+    updateStatus(document.getElementById('serverStatus'), false);
+    if (serverWS && serverWS.readyState !== WebSocket.CLOSED) {
+      serverWS.close();
+    }
+    // Reconnect after 1 second, or right away after a network change
+    setTimeout(connect, reconnectDelay);
+    reconnectDelay = 1000;
+  };
+}
+
+let reconnectDelay = 1000;
+
+// Reconnect to the server at url from now on, right away, keeping the
+// token and other parameters of the current server's URL.
+function migrate(url) {
+  let next;
+  try {
+    next = new URL(url.replace(/\/+$/, '') + '/ws');
+  } catch (e) {
+    next = null;
+  }
+  if (!next || (next.protocol !== 'ws:' && next.protocol !== 'wss:')) {
+    console.error('[!] Server asked to migrate to a bad URL:', url);
+    return;
+  }
+  next.search = new URL(config.serverWSURL).search;
+  config.serverWSURL = next.toString();
+  console.log('[*] Server going away, migrating to', url);
+  serverWS.onclose = null;
+  serverWS.onmessage = null;
+  serverWS.close();
+  reconnectDelay = 0;
+  localWS.close();
+}
+
+// After a network change the socket to the server is usually dead, but
+// neither end notices until TCP gives up. Start over right away instead.
+function networkChanged() {
+  if (!localWS || localWS.readyState !== WebSocket.OPEN) {
+    return;
+  }
+  console.log('[*] Network changed, reconnecting');
+  if (serverWS) {
+    serverWS.onclose = null;
+    serverWS.onmessage = null;
+    serverWS.close();
+  }
+  reconnectDelay = 0;
+  localWS.close();
+}
+
+window.addEventListener('online', networkChanged);
+if (navigator.connection) {
+  navigator.connection.addEventListener('change', networkChanged);
+}
+
+let paused = false;
+
+function showStats(stats) {
+  paused = stats.paused;
+  const el = document.getElementById('tunnelStatus');
+  el.textContent = paused ? 'Paused' : 'Active';
+  el.className = paused ? 'disconnected' : 'connected';
+  document.getElementById('pauseButton').textContent = paused ? 'Resume' : 'Pause';
+  document.getElementById('rtt').textContent =
+    stats.connected && stats.rtt_ms > 0 ? stats.rtt_ms.toFixed(1) + ' ms' : '-';
+  if (config.dashboard) {
+    document.getElementById('sessions').textContent = stats.connected ? stats.sessions : '-';
+    document.getElementById('uptime').textContent =
+      stats.connected ? formatDuration(Date.now() - Date.parse(stats.connected_since)) : '-';
+    document.getElementById('reconnects').textContent = stats.reconnects;
+  }
+}
+
+function formatDuration(ms) {
+  const s = Math.max(0, Math.floor(ms / 1000));
+  if (s < 60) return s + 's';
+  if (s < 3600) return Math.floor(s / 60) + 'm ' + (s % 60) + 's';
+  return Math.floor(s / 3600) + 'h ' + Math.floor(s % 3600 / 60) + 'm';
+}
+
+// The dashboard shows at most this many connections, the newest ones.
+const maxStreamRows = 200;
+
+function cell(row, text, className) {
+  const td = document.createElement('td');
+  td.textContent = text;
+  if (className) td.className = className;
+  row.appendChild(td);
+}
+
+function showStreams(streams) {
+  document.getElementById('streamCount').textContent = streams.length;
+  const body = document.getElementById('streams');
+  const now = Date.now();
+  body.replaceChildren();
+  streams.slice(-maxStreamRows).reverse().forEach(function(st) {
+    const row = document.createElement('tr');
+    if (st.state === 'idle') row.className = 'idle';
+    cell(row, st.target);
+    cell(row, st.label || '');
+    cell(row, formatBytes(st.sent), 'num');
+    cell(row, formatBytes(st.received), 'num');
+    cell(row, formatDuration(now - Date.parse(st.start)), 'num');
+    cell(row, st.state);
+    body.appendChild(row);
+  });
+}
+
+function pollStreams() {
+  fetch('/streams')
+    .then(function(resp) { return resp.json(); })
+    .then(showStreams)
+    .catch(function() {})
+    .finally(function() { setTimeout(pollStreams, 2000); });
+}
+
+// The dashboard lists this many of the latest warnings and errors.
+const maxProblems = 10;
+
+function showProblems(events) {
+  const list = document.getElementById('problems');
+  list.replaceChildren();
+  events.filter(function(e) { return e.level === 'WARN' || e.level === 'ERROR'; })
+    .slice(-maxProblems).reverse().forEach(function(e) {
+      const li = document.createElement('li');
+      let text = new Date(e.time).toLocaleTimeString() + ' ' + e.level + ' ' + e.message;
+      for (const k in e.attrs || {}) {
+        if (k !== 'component') text += ' ' + k + '=' + e.attrs[k];
+      }
+      li.textContent = text;
+      list.appendChild(li);
+    });
+}
+
+function pollEvents() {
+  fetch('/events')
+    .then(function(resp) { return resp.json(); })
+    .then(showProblems)
+    .catch(function() {})
+    .finally(function() { setTimeout(pollEvents, 5000); });
+}
+
+function pollStats() {
+  fetch('/stats')
+    .then(function(resp) { return resp.json(); })
+    .then(showStats)
+    .catch(function() {})
+    .finally(function() { setTimeout(pollStats, 2000); });
+}
+
+function togglePause() {
+  fetch(paused ? '/resume' : '/pause', { method: 'POST' })
+    .then(function(resp) { return resp.json(); })
+    .then(showStats)
+    .catch(function(error) { console.error('[!] Pause failed:', error); });
+}
+
+// Start connection
+connect();
+pollStats();
+if (config.dashboard) {
+  pollStreams();
+  if (config.events) pollEvents();
+}
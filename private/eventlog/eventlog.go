@@ -0,0 +1,138 @@
+// Package eventlog keeps the most recent log records in memory, so that
+// what just happened can be looked at without a log pipeline.
+package eventlog
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Event is a log record as kept by a Ring.
+type Event struct {
+	Time    time.Time         `json:"time"`
+	Level   string            `json:"level"`
+	Message string            `json:"message"`
+	Attrs   map[string]string `json:"attrs,omitempty"`
+}
+
+// Ring holds the last records logged at Info level or above through its
+// handlers, dropping the oldest once full.
+type Ring struct {
+	mu     sync.Mutex
+	events []Event
+	next   int
+	full   bool
+}
+
+// NewRing returns a Ring that holds up to size events.
+func NewRing(size int) *Ring {
+	if size < 1 {
+		size = 1
+	}
+	return &Ring{events: make([]Event, size)}
+}
+
+func (r *Ring) add(e Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events[r.next] = e
+	r.next++
+	if r.next == len(r.events) {
+		r.next = 0
+		r.full = true
+	}
+}
+
+// Events returns the events held, oldest first.
+func (r *Ring) Events() []Event {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.full {
+		return append([]Event(nil), r.events[:r.next]...)
+	}
+	return append(append([]Event(nil), r.events[r.next:]...), r.events[:r.next]...)
+}
+
+// ServeHTTP serves the events as JSON.
+func (r *Ring) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(r.Events())
+}
+
+// Handler returns a slog.Handler that records into r and passes records
+// on to next.
+func (r *Ring) Handler(next slog.Handler) slog.Handler {
+	return &handler{ring: r, next: next}
+}
+
+type handler struct {
+	ring   *Ring
+	next   slog.Handler
+	attrs  []slog.Attr
+	prefix string
+}
+
+func (h *handler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= slog.LevelInfo || h.next.Enabled(ctx, level)
+}
+
+func (h *handler) Handle(ctx context.Context, rec slog.Record) error {
+	if rec.Level >= slog.LevelInfo {
+		e := Event{Time: rec.Time, Level: rec.Level.String(), Message: rec.Message}
+		if len(h.attrs) > 0 || rec.NumAttrs() > 0 {
+			e.Attrs = make(map[string]string, len(h.attrs)+rec.NumAttrs())
+			for _, a := range h.attrs {
+				addAttr(e.Attrs, "", a)
+			}
+			rec.Attrs(func(a slog.Attr) bool {
+				addAttr(e.Attrs, h.prefix, a)
+				return true
+			})
+		}
+		h.ring.add(e)
+	}
+	if !h.next.Enabled(ctx, rec.Level) {
+		return nil
+	}
+	return h.next.Handle(ctx, rec)
+}
+
+func (h *handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	h2 := *h
+	h2.next = h.next.WithAttrs(attrs)
+	h2.attrs = append([]slog.Attr(nil), h.attrs...)
+	for _, a := range attrs {
+		a.Key = h.prefix + a.Key
+		h2.attrs = append(h2.attrs, a)
+	}
+	return &h2
+}
+
+func (h *handler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	h2 := *h
+	h2.next = h.next.WithGroup(name)
+	h2.prefix = h.prefix + name + "."
+	return &h2
+}
+
+func addAttr(m map[string]string, prefix string, a slog.Attr) {
+	a.Value = a.Value.Resolve()
+	if a.Value.Kind() == slog.KindGroup {
+		for _, ga := range a.Value.Group() {
+			addAttr(m, prefix+a.Key+".", ga)
+		}
+		return
+	}
+	if a.Key == "" {
+		return
+	}
+	m[prefix+a.Key] = a.Value.String()
+}
@@ -0,0 +1,50 @@
+package eventlog
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestRingKeepsMostRecent(t *testing.T) {
+	const size = 5
+	ring := NewRing(size)
+	log := slog.New(ring.Handler(slog.NewTextHandler(io.Discard, nil))).With("component", "test")
+	for i := 0; i < 2*size+2; i++ {
+		log.Info("event", "n", i)
+	}
+	log.Debug("too quiet to keep")
+
+	rec := httptest.NewRecorder()
+	ring.ServeHTTP(rec, httptest.NewRequest("GET", "/events", nil))
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", ct)
+	}
+	var events []Event
+	if err := json.Unmarshal(rec.Body.Bytes(), &events); err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != size {
+		t.Fatalf("got %d events, want %d", len(events), size)
+	}
+	for i, e := range events {
+		want := strconv.Itoa(size + 2 + i)
+		if e.Message != "event" || e.Level != "INFO" || e.Attrs["n"] != want || e.Attrs["component"] != "test" {
+			t.Errorf("event %d = %+v, want n=%s", i, e, want)
+		}
+	}
+}
+
+func TestRingBeforeFull(t *testing.T) {
+	ring := NewRing(5)
+	log := slog.New(ring.Handler(slog.NewTextHandler(io.Discard, nil)))
+	log.Info("first")
+	log.Warn("second")
+	events := ring.Events()
+	if len(events) != 2 || events[0].Message != "first" || events[1].Message != "second" || events[1].Level != "WARN" {
+		t.Errorf("events = %+v, want first then second", events)
+	}
+}
@@ -0,0 +1,162 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// A request with the capabilities extension and no address asks the
+// server what its current policy is, at any time during a session. The
+// server answers with a status byte and, if it's StatusOK, a message of
+// entries: each a type byte, a two byte length and a value, ended by a
+// zero type byte. Numbers are eight bytes, big endian, and lists repeat
+// their entry. Unknown entries are skipped, so later versions can add
+// to it. Servers that predate the extension answer with a failure status.
+
+// ErrNoCapabilities means the server doesn't answer capabilities
+// requests.
+var ErrNoCapabilities = errors.New("server doesn't report capabilities")
+
+// Capabilities entry types.
+const (
+	capEnd           byte = 0x00
+	capMaxStreams    byte = 0x01
+	capRateLimit     byte = 0x02
+	capHostRateLimit byte = 0x03
+	capIdleProbe     byte = 0x04
+	capDenyTarget    byte = 0x05
+)
+
+// Capabilities is the server's current policy as it applies to a session.
+type Capabilities struct {
+	// MaxStreams caps the concurrent streams of the client's tenant, 0 for
+	// no cap.
+	MaxStreams int64
+	// RateLimit caps the server's total throughput, and HostRateLimit
+	// that to each target host, in bytes per second, 0 for no cap.
+	RateLimit     int64
+	HostRateLimit int64
+	// IdleProbe is how long streams may be idle before the server asks
+	// whether the client still has them open, 0 if it doesn't ask.
+	IdleProbe time.Duration
+	// DenyTargets are the patterns of targets the server refuses: host
+	// names, where "*." matches any subdomain, or IPs and CIDR ranges.
+	DenyTargets []string
+}
+
+// Denies reports whether target is refused by c.DenyTargets, going by its
+// host name or IP. The server also refuses names that resolve to denied
+// addresses, which only it can tell.
+func (c *Capabilities) Denies(target string) bool {
+	host, _, err := net.SplitHostPort(target)
+	if err != nil {
+		return false
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	ip := net.ParseIP(host)
+	if i := strings.LastIndexByte(host, '%'); i >= 0 {
+		ip = net.ParseIP(host[:i])
+	}
+	for _, pat := range c.DenyTargets {
+		if ip != nil {
+			if _, n, err := net.ParseCIDR(pat); err == nil {
+				if ones, bits := n.Mask.Size(); bits == 128 && ones >= 96 && n.IP.To4() != nil {
+					// A range of IPv4-mapped addresses, which Contains
+					// would only match against IPv6 ones.
+					n = &net.IPNet{IP: n.IP.To4(), Mask: net.CIDRMask(ones-96, 32)}
+				}
+				if n.Contains(ip) {
+					return true
+				}
+			}
+			if pip := net.ParseIP(pat); pip != nil && pip.Equal(ip) {
+				return true
+			}
+			continue
+		}
+		pat = strings.ToLower(pat)
+		if suffix, ok := strings.CutPrefix(pat, "*."); ok {
+			if strings.HasSuffix(host, "."+suffix) {
+				return true
+			}
+		} else if host == pat {
+			return true
+		}
+	}
+	return false
+}
+
+// WriteCapabilities answers a capabilities request.
+func WriteCapabilities(w io.Writer, c Capabilities) error {
+	buf := []byte{StatusOK}
+	number := func(typ byte, v int64) {
+		if v != 0 {
+			buf = append(buf, typ, 0, 8)
+			buf = binary.BigEndian.AppendUint64(buf, uint64(v))
+		}
+	}
+	number(capMaxStreams, c.MaxStreams)
+	number(capRateLimit, c.RateLimit)
+	number(capHostRateLimit, c.HostRateLimit)
+	number(capIdleProbe, c.IdleProbe.Milliseconds())
+	for _, pat := range c.DenyTargets {
+		if len(pat) > MaxAddrLen {
+			return fmt.Errorf("deny pattern too long: %q", pat)
+		}
+		buf = append(buf, capDenyTarget)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(len(pat)))
+		buf = append(buf, pat...)
+	}
+	buf = append(buf, capEnd)
+	_, err := w.Write(buf)
+	return err
+}
+
+// ReadCapabilities reads the server's answer to a capabilities request.
+func ReadCapabilities(r io.Reader) (Capabilities, error) {
+	var status [1]byte
+	if _, err := io.ReadFull(r, status[:]); err != nil {
+		return Capabilities{}, err
+	}
+	if status[0] != StatusOK {
+		return Capabilities{}, ErrNoCapabilities
+	}
+	var c Capabilities
+	for {
+		var hdr [3]byte
+		if _, err := io.ReadFull(r, hdr[:1]); err != nil {
+			return Capabilities{}, err
+		}
+		if hdr[0] == capEnd {
+			return c, nil
+		}
+		if _, err := io.ReadFull(r, hdr[1:]); err != nil {
+			return Capabilities{}, err
+		}
+		val := make([]byte, binary.BigEndian.Uint16(hdr[1:]))
+		if _, err := io.ReadFull(r, val); err != nil {
+			return Capabilities{}, err
+		}
+		var n int64
+		if len(val) == 8 {
+			n = int64(binary.BigEndian.Uint64(val))
+		}
+		switch hdr[0] {
+		case capMaxStreams:
+			c.MaxStreams = n
+		case capRateLimit:
+			c.RateLimit = n
+		case capHostRateLimit:
+			c.HostRateLimit = n
+		case capIdleProbe:
+			c.IdleProbe = time.Duration(n) * time.Millisecond
+		case capDenyTarget:
+			c.DenyTargets = append(c.DenyTargets, string(val))
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCapabilitiesRoundTrip(t *testing.T) {
+	want := Capabilities{
+		MaxStreams:    16,
+		RateLimit:     1 << 20,
+		HostRateLimit: 1 << 16,
+		IdleProbe:     30 * time.Second,
+		DenyTargets:   []string{"10.0.0.0/8", "*.internal.example.com"},
+	}
+	var buf bytes.Buffer
+	if err := WriteCapabilities(&buf, want); err != nil {
+		t.Fatal(err)
+	}
+	buf.WriteString("next")
+	got, err := ReadCapabilities(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+	if rest := buf.String(); rest != "next" {
+		t.Fatalf("left %q unread, want %q", rest, "next")
+	}
+}
+
+func TestReadCapabilitiesSkipsUnknown(t *testing.T) {
+	// An entry from a later version, with a value of a length no known
+	// entry has, between two known ones.
+	msg := []byte{StatusOK, capMaxStreams, 0, 8, 0, 0, 0, 0, 0, 0, 0, 4}
+	msg = append(msg, 0x7f, 0, 3, 'a', 'b', 'c')
+	msg = append(msg, capDenyTarget, 0, 9, '1', '0', '.', '0', '.', '0', '.', '1', '1')
+	msg = append(msg, capEnd)
+	got, err := ReadCapabilities(bytes.NewReader(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Capabilities{MaxStreams: 4, DenyTargets: []string{"10.0.0.11"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestReadCapabilitiesOldServer(t *testing.T) {
+	if _, err := ReadCapabilities(bytes.NewReader([]byte{StatusFailed})); !errors.Is(err, ErrNoCapabilities) {
+		t.Fatalf("error = %v, want ErrNoCapabilities", err)
+	}
+}
+
+func TestCapabilitiesDenies(t *testing.T) {
+	c := &Capabilities{DenyTargets: []string{"10.0.0.0/8", "192.0.2.1", "*.corp.example", "db.example.com", "::ffff:172.16.0.0/108"}}
+	for target, want := range map[string]bool{
+		"10.1.2.3:80":            true,
+		"11.0.0.1:80":            false,
+		"192.0.2.1:443":          true,
+		"192.0.2.2:443":          false,
+		"[::ffff:10.0.0.1]:80":   true,
+		"[fe80::1%eth0]:80":      false,
+		"172.16.5.5:22":          true,
+		"mail.corp.example:25":   true,
+		"MAIL.Corp.Example.:25":  true,
+		"corp.example:25":        false,
+		"db.example.com:5432":    true,
+		"www.db.example.com:443": false,
+		"no port":                false,
+	} {
+		if got := c.Denies(target); got != want {
+			t.Errorf("Denies(%q) = %v, want %v", target, got, want)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// The control stream carries messages about the session's other streams.
+// The server asks about streams that have been idle for a while with
+// ControlProbe, and the client answers with ControlAlive listing those it
+// still has open, so the server can close the ones the client forgot.
+//
+// A message is a type byte, a two byte count and that many four byte
+// stream IDs, all big endian.
+const (
+	ControlProbe byte = 0x01
+	ControlAlive byte = 0x02
+)
+
+// MaxControlIDs is the most stream IDs a control message carries.
+const MaxControlIDs = 0xffff
+
+// WriteControl sends a control message about the given streams.
+func WriteControl(w io.Writer, typ byte, ids []uint32) error {
+	if len(ids) > MaxControlIDs {
+		return fmt.Errorf("too many stream IDs: %d", len(ids))
+	}
+	buf := make([]byte, 3, 3+4*len(ids))
+	buf[0] = typ
+	binary.BigEndian.PutUint16(buf[1:], uint16(len(ids)))
+	for _, id := range ids {
+		buf = binary.BigEndian.AppendUint32(buf, id)
+	}
+	_, err := w.Write(buf)
+	return err
+}
+
+// ReadControl reads a control message.
+func ReadControl(r io.Reader) (typ byte, ids []uint32, err error) {
+	var hdr [3]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+	buf := make([]byte, 4*int(binary.BigEndian.Uint16(hdr[1:])))
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return 0, nil, err
+	}
+	ids = make([]uint32, len(buf)/4)
+	for i := range ids {
+		ids[i] = binary.BigEndian.Uint32(buf[4*i:])
+	}
+	return hdr[0], ids, nil
+}
@@ -0,0 +1,377 @@
+// Package protocol defines the framing netpump speaks at the start of each
+// yamux stream, before the stream turns into a raw relay.
+//
+// The client opens a stream and sends the target address as a length
+// prefixed string. The server dials it and answers with a status byte,
+// and nothing more unless the request asked for more: on success the
+// relay starts with the next byte. Any other status is a failure; clients
+// that don't know a status treat it as StatusFailed.
+// If the request asked for it, a failure status may have its top bit set
+// and be followed by a length prefixed reason for the failure, meant for
+// people. Servers that don't know the extension never set the bit, and
+// clients that don't ask are never sent a reason.
+//
+// A request may instead ask for fields. The server then sets the status
+// byte's second highest bit and follows it with fields in place of the
+// reason: each a type byte, a length byte and a value, including the
+// address the server's connection to the target is bound to on success,
+// ended by a zero type byte, so later versions can add to a response
+// without breaking clients, which skip fields they don't know. Servers
+// that don't know the extension answer as before.
+//
+// A request that carries more than the address starts with a zero byte,
+// which older servers reject as an empty address, followed by the length
+// prefixed address and a list of extensions. Each extension is a type
+// byte, a length byte and a value; a zero type byte ends the list.
+// Unknown extensions are skipped.
+//
+// A request with the control extension and no address opens the control
+// stream instead, described in control.go, and one with the capabilities
+// extension asks for the server's policy, described in capabilities.go.
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const (
+	StatusOK     byte = 0x00
+	StatusFailed byte = 0x01
+	// StatusUnresolved means the target's host name didn't resolve.
+	StatusUnresolved byte = 0x02
+	// StatusRefused means the target refused the connection.
+	StatusRefused byte = 0x03
+	// StatusTimeout means connecting to the target timed out.
+	StatusTimeout byte = 0x04
+	// StatusDenied means the server's policy doesn't allow the target.
+	StatusDenied byte = 0x05
+)
+
+// MaxAddrLen is the longest address that fits in the length prefix.
+const MaxAddrLen = 255
+
+// MaxReasonLen is the longest failure reason a server sends. Longer ones
+// are cut short.
+const MaxReasonLen = 128
+
+// statusReason flags a failure status that is followed by a reason.
+const statusReason byte = 0x80
+
+// statusFields flags a status that is followed by fields.
+const statusFields byte = 0x40
+
+// Response field types.
+const (
+	fieldEnd    byte = 0x00
+	fieldBound  byte = 0x01
+	fieldReason byte = 0x02
+)
+
+var (
+	ErrAddrTooLong = errors.New("address too long")
+	ErrInvalidAddr = errors.New("invalid address")
+)
+
+// ValidateAddr checks that addr is a host:port pair with a non-empty host
+// and a port in 1-65535.
+func ValidateAddr(addr string) error {
+	if addr == "" {
+		return fmt.Errorf("%w: empty", ErrInvalidAddr)
+	}
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("%w %q: %v", ErrInvalidAddr, addr, err)
+	}
+	if host == "" {
+		return fmt.Errorf("%w %q: missing host", ErrInvalidAddr, addr)
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil || port == 0 {
+		return fmt.Errorf("%w %q: bad port", ErrInvalidAddr, addr)
+	}
+	return nil
+}
+
+func writeString(w io.Writer, s string) error {
+	if len(s) > MaxAddrLen {
+		return ErrAddrTooLong
+	}
+	buf := make([]byte, 0, 1+len(s))
+	buf = append(buf, byte(len(s)))
+	buf = append(buf, s...)
+	_, err := w.Write(buf)
+	return err
+}
+
+func readString(r io.Reader) (string, error) {
+	var lenBuf [1]byte
+	if _, err := io.ReadFull(r, lenBuf[:]); err != nil {
+		return "", err
+	}
+	buf := make([]byte, lenBuf[0])
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+// Request extension types.
+const (
+	extEnd     byte = 0x00
+	extLabel   byte = 0x01
+	extSource  byte = 0x02
+	extControl byte = 0x03
+	extReason  byte = 0x04
+	extFields  byte = 0x05
+	extCaps    byte = 0x06
+)
+
+// Request asks the server to connect a stream to a target.
+type Request struct {
+	// Addr is the target's host:port.
+	Addr string
+	// Label optionally tags the connection, e.g. with the application it
+	// belongs to, for the server's stats and logs.
+	Label string
+	// Source optionally names who asked for the connection on the client's
+	// side, such as the address of the local SOCKS5 client.
+	Source string
+	// Control asks for the session's control stream rather than a
+	// connection. Addr is empty then.
+	Control bool
+	// WantReason asks the server to say why, should the connection fail.
+	WantReason bool
+	// WantFields asks for the server's answer as fields; see WriteFields.
+	WantFields bool
+	// Capabilities asks for the server's policy rather than a connection.
+	// Addr is empty then.
+	Capabilities bool
+}
+
+// WriteRequest sends the request a stream should be connected with. A
+// request with just an address uses the original framing, so it still
+// works with servers that predate extensions.
+func WriteRequest(w io.Writer, req Request) error {
+	if req.Control {
+		_, err := w.Write([]byte{0, 0, extControl, 0, extEnd})
+		return err
+	}
+	if req.Capabilities {
+		_, err := w.Write([]byte{0, 0, extCaps, 0, extEnd})
+		return err
+	}
+	if err := ValidateAddr(req.Addr); err != nil {
+		return err
+	}
+	if req.Label == "" && req.Source == "" && !req.WantReason && !req.WantFields {
+		return writeString(w, req.Addr)
+	}
+	if len(req.Label) > MaxAddrLen {
+		return fmt.Errorf("label too long")
+	}
+	if len(req.Source) > MaxAddrLen {
+		return fmt.Errorf("source too long")
+	}
+
+	buf := []byte{0, byte(len(req.Addr))}
+	buf = append(buf, req.Addr...)
+	if req.Label != "" {
+		buf = append(buf, extLabel, byte(len(req.Label)))
+		buf = append(buf, req.Label...)
+	}
+	if req.Source != "" {
+		buf = append(buf, extSource, byte(len(req.Source)))
+		buf = append(buf, req.Source...)
+	}
+	if req.WantReason {
+		buf = append(buf, extReason, 0)
+	}
+	if req.WantFields {
+		buf = append(buf, extFields, 0)
+	}
+	buf = append(buf, extEnd)
+	_, err := w.Write(buf)
+	return err
+}
+
+// ReadRequest reads a request sent by WriteRequest. A malformed address
+// is returned along with an error wrapping ErrInvalidAddr.
+func ReadRequest(r io.Reader) (Request, error) {
+	addr, err := readString(r)
+	if err != nil {
+		return Request{}, err
+	}
+	if addr != "" {
+		return Request{Addr: addr}, ValidateAddr(addr)
+	}
+
+	// Extended request
+	var req Request
+	if req.Addr, err = readString(r); err != nil {
+		return Request{}, err
+	}
+	for {
+		var typ [1]byte
+		if _, err := io.ReadFull(r, typ[:]); err != nil {
+			return Request{}, err
+		}
+		if typ[0] == extEnd {
+			break
+		}
+		val, err := readString(r)
+		if err != nil {
+			return Request{}, err
+		}
+		switch typ[0] {
+		case extLabel:
+			req.Label = val
+		case extSource:
+			req.Source = val
+		case extControl:
+			req.Control = true
+		case extReason:
+			req.WantReason = true
+		case extFields:
+			req.WantFields = true
+		case extCaps:
+			req.Capabilities = true
+		}
+	}
+	if req.Control || req.Capabilities {
+		return req, nil
+	}
+	return req, ValidateAddr(req.Addr)
+}
+
+// WriteSuccess reports a successful dial as the single status byte every
+// client understands. Only WriteFields says which address the server's
+// connection to the target is bound to.
+func WriteSuccess(w io.Writer) error {
+	_, err := w.Write([]byte{StatusOK})
+	return err
+}
+
+// WriteFailure reports that the server couldn't connect to the target.
+func WriteFailure(w io.Writer, status byte) error {
+	_, err := w.Write([]byte{status})
+	return err
+}
+
+// WriteFailureReason reports a failure like WriteFailure, along with a
+// short reason for it. Only send it in answer to a request that asked
+// for a reason. The reason is cut to MaxReasonLen bytes.
+func WriteFailureReason(w io.Writer, status byte, reason string) error {
+	if reason == "" {
+		return WriteFailure(w, status)
+	}
+	if len(reason) > MaxReasonLen {
+		reason = strings.ToValidUTF8(reason[:MaxReasonLen], "")
+	}
+	buf := append([]byte{status | statusReason, byte(len(reason))}, reason...)
+	_, err := w.Write(buf)
+	return err
+}
+
+// WriteFields answers a request that asked for fields: with the bound
+// address on success, and the reason, if not empty, on failure. Only send
+// a reason to a request that asked for one. The reason is cut to
+// MaxReasonLen bytes.
+func WriteFields(w io.Writer, status byte, bound net.Addr, reason string) error {
+	buf := []byte{status | statusFields}
+	if status == StatusOK && bound != nil {
+		boundStr := bound.String()
+		buf = append(buf, fieldBound, byte(len(boundStr)))
+		buf = append(buf, boundStr...)
+	}
+	if status != StatusOK && reason != "" {
+		if len(reason) > MaxReasonLen {
+			reason = strings.ToValidUTF8(reason[:MaxReasonLen], "")
+		}
+		buf = append(buf, fieldReason, byte(len(reason)))
+		buf = append(buf, reason...)
+	}
+	buf = append(buf, fieldEnd)
+	_, err := w.Write(buf)
+	return err
+}
+
+// Response is the server's answer to a request.
+type Response struct {
+	Status byte
+	// Bound is the server side address of the connection to the target.
+	// It is the unspecified address if the server didn't report one.
+	Bound *net.TCPAddr
+	// Reason is why the connection failed, if the request asked and the
+	// server said.
+	Reason string
+}
+
+// ReadResponse reads the server's answer to a request.
+func ReadResponse(r io.Reader) (Response, error) {
+	var status [1]byte
+	if _, err := io.ReadFull(r, status[:]); err != nil {
+		return Response{}, err
+	}
+	resp := Response{Status: status[0], Bound: &net.TCPAddr{IP: net.IPv4zero}}
+	if resp.Status&statusFields != 0 {
+		resp.Status &^= statusFields
+		return resp, readFields(r, &resp)
+	}
+	if resp.Status&statusReason != 0 {
+		resp.Status &^= statusReason
+		reason, err := readString(r)
+		if err != nil {
+			return Response{}, fmt.Errorf("failed to read failure reason: %w", err)
+		}
+		resp.Reason = reason
+	}
+	return resp, nil
+}
+
+// readFields reads the fields following a status into resp.
+func readFields(r io.Reader, resp *Response) error {
+	for {
+		var typ [1]byte
+		if _, err := io.ReadFull(r, typ[:]); err != nil {
+			return fmt.Errorf("failed to read response field: %w", err)
+		}
+		if typ[0] == fieldEnd {
+			return nil
+		}
+		val, err := readString(r)
+		if err != nil {
+			return fmt.Errorf("failed to read response field: %w", err)
+		}
+		switch typ[0] {
+		case fieldBound:
+			if addr, err := parseTCPAddr(val); err == nil {
+				resp.Bound = addr
+			}
+		case fieldReason:
+			resp.Reason = val
+		}
+	}
+}
+
+func parseTCPAddr(s string) (*net.TCPAddr, error) {
+	host, portStr, err := net.SplitHostPort(s)
+	if err != nil {
+		return nil, err
+	}
+	// Link-local IPv6 addresses carry a zone, e.g. fe80::1%eth0.
+	host, zone, _ := strings.Cut(host, "%")
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid IP %q", host)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, err
+	}
+	return &net.TCPAddr{IP: ip, Port: port, Zone: zone}, nil
+}
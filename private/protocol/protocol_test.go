@@ -0,0 +1,195 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+// readLegacyResponse reads a response the way clients that predate
+// extensions do: one status byte, with the relay starting right after.
+func readLegacyResponse(t *testing.T, r io.Reader) byte {
+	t.Helper()
+	var status [1]byte
+	if _, err := io.ReadFull(r, status[:]); err != nil {
+		t.Fatal(err)
+	}
+	return status[0]
+}
+
+func TestWriteSuccessLegacyReader(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteSuccess(&buf); err != nil {
+		t.Fatal(err)
+	}
+	buf.WriteString("target data")
+
+	if status := readLegacyResponse(t, &buf); status != StatusOK {
+		t.Fatalf("status = %#x, want %#x", status, StatusOK)
+	}
+	if rest := buf.String(); rest != "target data" {
+		t.Fatalf("relay starts with %q, want %q", rest, "target data")
+	}
+}
+
+func TestReadResponseLegacyWriter(t *testing.T) {
+	// Servers that predate extensions answer a plain request with a single
+	// byte, then relay.
+	buf := bytes.NewBufferString("\x00target data")
+	resp, err := ReadResponse(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status != StatusOK {
+		t.Fatalf("status = %#x, want %#x", resp.Status, StatusOK)
+	}
+	if !resp.Bound.IP.IsUnspecified() {
+		t.Fatalf("bound = %v, want unspecified", resp.Bound)
+	}
+	if rest := buf.String(); rest != "target data" {
+		t.Fatalf("relay starts with %q, want %q", rest, "target data")
+	}
+}
+
+func TestFieldsRoundTrip(t *testing.T) {
+	bound := &net.TCPAddr{IP: net.ParseIP("192.0.2.7"), Port: 40000}
+	var buf bytes.Buffer
+	if err := WriteFields(&buf, StatusOK, bound, ""); err != nil {
+		t.Fatal(err)
+	}
+	buf.WriteString("target data")
+
+	resp, err := ReadResponse(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status != StatusOK || resp.Bound.String() != bound.String() {
+		t.Fatalf("got status %#x bound %v, want %#x %v", resp.Status, resp.Bound, StatusOK, bound)
+	}
+	if rest := buf.String(); rest != "target data" {
+		t.Fatalf("relay starts with %q, want %q", rest, "target data")
+	}
+}
+
+func TestBoundIPv6RoundTrip(t *testing.T) {
+	for _, bound := range []*net.TCPAddr{
+		{IP: net.ParseIP("::1"), Port: 40000},
+		{IP: net.ParseIP("2001:db8::7"), Port: 443},
+		{IP: net.ParseIP("fe80::1"), Port: 8080, Zone: "eth0"},
+	} {
+		var buf bytes.Buffer
+		if err := WriteFields(&buf, StatusOK, bound, ""); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := ReadResponse(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Bound.String() != bound.String() || resp.Bound.Zone != bound.Zone {
+			t.Errorf("bound %v came back as %v", bound, resp.Bound)
+		}
+	}
+}
+
+func TestFieldsLegacyReaderSeesStatus(t *testing.T) {
+	// A failure answered with fields still reads as a failure to clients
+	// that only look at the first byte.
+	var buf bytes.Buffer
+	if err := WriteFields(&buf, StatusRefused, nil, "connection refused"); err != nil {
+		t.Fatal(err)
+	}
+	if status := readLegacyResponse(t, &buf); status == StatusOK {
+		t.Fatal("failure read as success")
+	}
+}
+
+func TestPlainRequestIsLegacy(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteRequest(&buf, Request{Addr: "example.com:443"}); err != nil {
+		t.Fatal(err)
+	}
+	want := "\x0fexample.com:443"
+	if buf.String() != want {
+		t.Fatalf("request = %q, want %q", buf.String(), want)
+	}
+}
+
+func TestRequestRoundTrip(t *testing.T) {
+	want := Request{Addr: "example.com:443", Label: "web", Source: "127.0.0.1:5555", WantReason: true, WantFields: true}
+	var buf bytes.Buffer
+	if err := WriteRequest(&buf, want); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadRequest(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestValidateAddr(t *testing.T) {
+	for _, tc := range []struct {
+		addr string
+		ok   bool
+	}{
+		{"example.com:443", true},
+		{"10.0.0.1:80", true},
+		{"[2001:db8::1]:22", true},
+		{"", false},
+		{"example.com", false},
+		{"example.com:", false},
+		{"2001:db8::1", false},
+		{":443", false},
+		{"example.com:0", false},
+		{"example.com:65536", false},
+		{"example.com:http", false},
+	} {
+		err := ValidateAddr(tc.addr)
+		if tc.ok && err != nil {
+			t.Errorf("ValidateAddr(%q) = %v, want nil", tc.addr, err)
+		}
+		if !tc.ok && !errors.Is(err, ErrInvalidAddr) {
+			t.Errorf("ValidateAddr(%q) = %v, want %v", tc.addr, err, ErrInvalidAddr)
+		}
+	}
+}
+
+func TestRequestZeroLengthAddr(t *testing.T) {
+	if err := WriteRequest(io.Discard, Request{Addr: ""}); !errors.Is(err, ErrInvalidAddr) {
+		t.Errorf("WriteRequest with no address = %v, want %v", err, ErrInvalidAddr)
+	}
+	// An extended request, which starts with a zero length, whose own
+	// address is empty too.
+	_, err := ReadRequest(bytes.NewReader([]byte{0, 0, extEnd}))
+	if !errors.Is(err, ErrInvalidAddr) {
+		t.Errorf("ReadRequest with a zero-length address = %v, want %v", err, ErrInvalidAddr)
+	}
+}
+
+func TestControlRoundTrip(t *testing.T) {
+	for _, ids := range [][]uint32{nil, {1}, {3, 0xffffffff, 7}} {
+		var buf bytes.Buffer
+		if err := WriteControl(&buf, ControlAlive, ids); err != nil {
+			t.Fatal(err)
+		}
+		typ, got, err := ReadControl(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if typ != ControlAlive || len(got) != len(ids) {
+			t.Fatalf("got %#x %v, want %#x %v", typ, got, ControlAlive, ids)
+		}
+		for i := range ids {
+			if got[i] != ids[i] {
+				t.Fatalf("got %v, want %v", got, ids)
+			}
+		}
+	}
+	if err := WriteControl(io.Discard, ControlProbe, make([]uint32, MaxControlIDs+1)); err == nil {
+		t.Error("wrote more IDs than a message carries")
+	}
+}
@@ -0,0 +1,234 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jtolio/netpump-go/private/protocol"
+)
+
+// AccessLogFormat is a standard access log format, for feeding relayed
+// connections to existing log analysis tools.
+type AccessLogFormat int
+
+const (
+	// AccessLogCommon is the Common Log Format. The request is logged as
+	// a CONNECT to the target and the size is the bytes sent back to the
+	// client.
+	AccessLogCommon AccessLogFormat = iota
+	// AccessLogW3C is the W3C Extended Log File Format, with both byte
+	// counts and the connection's duration.
+	AccessLogW3C
+)
+
+// accessRecord is one relayed connection, logged once it ends.
+type accessRecord struct {
+	start  time.Time
+	ip     string
+	user   string
+	target string
+	status int
+
+	sent     atomic.Int64 // to the target
+	received atomic.Int64 // from the target
+}
+
+type accessLog struct {
+	format AccessLogFormat
+
+	mu     sync.Mutex
+	w      io.Writer
+	header bool
+	buffer *accessBuffer // nil to write each line right away
+}
+
+// accessBuffer holds access log lines until they're flushed, for
+// WithAccessLogBuffer. Its fields are guarded by the access log's mu.
+type accessBuffer struct {
+	size  int
+	every time.Duration
+	drop  bool
+
+	lines   []byte
+	dropped int64
+	room    *sync.Cond    // broadcast whenever lines are taken to be written
+	kick    chan struct{} // asks for a flush before the next tick
+	stopped bool          // lines are written right away from now on
+}
+
+const w3cFields = "date time c-ip cs-username cs-method cs-uri s-status sc-bytes cs-bytes time-taken"
+
+func (a *accessLog) write(r *accessRecord) {
+	end := time.Now()
+	var line string
+	switch a.format {
+	case AccessLogW3C:
+		t := r.start.UTC()
+		line = fmt.Sprintf("%s %s %s %s CONNECT %s %d %d %d %.3f\n",
+			t.Format("2006-01-02"), t.Format("15:04:05"), accessField(r.ip),
+			accessField(r.user), accessField(r.target), r.status,
+			r.received.Load(), r.sent.Load(), end.Sub(r.start).Seconds())
+	default:
+		size := "-"
+		if n := r.received.Load(); n > 0 {
+			size = fmt.Sprint(n)
+		}
+		line = fmt.Sprintf("%s - %s [%s] \"CONNECT %s HTTP/1.1\" %d %s\n",
+			accessField(r.ip), accessField(r.user),
+			r.start.Format("02/Jan/2006:15:04:05 -0700"), accessField(r.target),
+			r.status, size)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.format == AccessLogW3C && !a.header {
+		a.header = true
+		line = w3cHeader(end) + line
+	}
+	if a.buffer != nil && a.buffer.add(line) {
+		return
+	}
+	io.WriteString(a.w, line)
+}
+
+// w3cHeader starts a W3C access log written at t.
+func w3cHeader(t time.Time) string {
+	return fmt.Sprintf("#Software: netpump\n#Version: 1.0\n#Date: %s\n#Fields: %s\n",
+		t.UTC().Format("2006-01-02 15:04:05"), w3cFields)
+}
+
+// ReopenAccessLog calls reopen, which points the WithAccessLog writer at
+// a fresh file, such as after log rotation, while no line is being
+// written. Lines still buffered go to the old file first, and with
+// AccessLogW3C the new file starts with the header.
+func (s *Server) ReopenAccessLog(reopen func() error) error {
+	a := s.accessLog
+	if a == nil {
+		return reopen()
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if b := a.buffer; b != nil && len(b.lines) > 0 {
+		a.w.Write(b.lines)
+		b.lines = nil
+		b.room.Broadcast()
+	}
+	if err := reopen(); err != nil {
+		return err
+	}
+	if a.format == AccessLogW3C {
+		io.WriteString(a.w, w3cHeader(time.Now()))
+		a.header = true
+	}
+	return nil
+}
+
+// add buffers line, waiting for room, or dropping it if the buffer drops
+// lines when full. It reports false if the buffer has stopped and line is
+// to be written right away. The caller must hold the access log's mu.
+func (b *accessBuffer) add(line string) bool {
+	for !b.stopped && len(b.lines) > 0 && len(b.lines)+len(line) > b.size {
+		if b.drop {
+			b.dropped++
+			return true
+		}
+		b.flushSoon()
+		b.room.Wait()
+	}
+	if b.stopped {
+		return false
+	}
+	b.lines = append(b.lines, line...)
+	if len(b.lines) >= b.size {
+		b.flushSoon()
+	}
+	return true
+}
+
+func (b *accessBuffer) flushSoon() {
+	select {
+	case b.kick <- struct{}{}:
+	default:
+	}
+}
+
+// flushAccessLog writes out the buffered access log lines every flush
+// interval, or sooner once the buffer fills, until the server stops. It
+// then writes what's left, and lines are written as they come from then
+// on, so the streams still finishing aren't lost.
+func (s *Server) flushAccessLog() {
+	defer s.wg.Done()
+	a := s.accessLog
+	b := a.buffer
+	ticker := time.NewTicker(b.every)
+	defer ticker.Stop()
+	for {
+		stop := false
+		select {
+		case <-ticker.C:
+		case <-b.kick:
+		case <-s.ctx.Done():
+			stop = true
+		}
+
+		a.mu.Lock()
+		lines, dropped := b.lines, b.dropped
+		b.lines, b.dropped = nil, 0
+		b.room.Broadcast()
+		if stop {
+			// Written holding mu, so the last lines go out before any
+			// written right away.
+			b.stopped = true
+			if len(lines) > 0 {
+				a.w.Write(lines)
+			}
+			a.mu.Unlock()
+		} else {
+			a.mu.Unlock()
+			if len(lines) > 0 {
+				a.w.Write(lines)
+			}
+		}
+		if dropped > 0 {
+			s.log.Warn("access log buffer full, dropped lines", "dropped", dropped)
+		}
+		if stop {
+			return
+		}
+	}
+}
+
+// accessField makes v safe to put in a space-separated log line.
+func accessField(v string) string {
+	if v == "" {
+		return "-"
+	}
+	return strings.Map(func(r rune) rune {
+		if r == ' ' {
+			return '+'
+		}
+		if r < 0x20 || r == '"' || r == 0x7f {
+			return '_'
+		}
+		return r
+	}, v)
+}
+
+// accessStatus maps a stream's status to the HTTP status a proxy would
+// have answered the CONNECT with.
+func accessStatus(status byte) int {
+	switch status {
+	case protocol.StatusOK:
+		return 200
+	case protocol.StatusTimeout:
+		return 504
+	case protocol.StatusDenied:
+		return 403
+	default:
+		return 502
+	}
+}
@@ -0,0 +1,195 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jtolio/netpump-go/private/protocol"
+)
+
+// lockedBuffer is a bytes.Buffer safe to read while the server writes.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestAccessLogLines(t *testing.T) {
+	start := time.Date(2024, 3, 5, 14, 7, 9, 0, time.FixedZone("", -7*3600))
+	record := func(user string, received int64) *accessRecord {
+		r := &accessRecord{start: start, ip: "192.0.2.1", user: user, target: "example.com:443", status: 200}
+		r.received.Store(received)
+		r.sent.Store(56)
+		return r
+	}
+	// The duration, and the date the W3C header is written, vary.
+	now := regexp.MustCompile(`#Date: [0-9-]+ [0-9:]+\n|[0-9]+\.[0-9]{3}\n`)
+
+	for _, tc := range []struct {
+		name   string
+		format AccessLogFormat
+		record *accessRecord
+		want   string
+	}{
+		{"clf", AccessLogCommon, record("", 1234),
+			`192.0.2.1 - - [05/Mar/2024:14:07:09 -0700] "CONNECT example.com:443 HTTP/1.1" 200 1234` + "\n"},
+		{"clf user no bytes", AccessLogCommon, record(`team "a"`, 0),
+			`192.0.2.1 - team+_a_ [05/Mar/2024:14:07:09 -0700] "CONNECT example.com:443 HTTP/1.1" 200 -` + "\n"},
+		{"w3c", AccessLogW3C, record("team a", 1234),
+			"#Software: netpump\n#Version: 1.0\n#Fields: " + w3cFields + "\n" +
+				"2024-03-05 21:07:09 192.0.2.1 team+a CONNECT example.com:443 200 1234 56 "},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			a := &accessLog{format: tc.format, w: &buf}
+			a.write(tc.record)
+			if got := now.ReplaceAllString(buf.String(), ""); got != tc.want {
+				t.Errorf("got\n%q\nwant\n%q", got, tc.want)
+			}
+		})
+	}
+
+	// The W3C header is written once.
+	var buf bytes.Buffer
+	a := &accessLog{format: AccessLogW3C, w: &buf}
+	a.write(record("", 1))
+	a.write(record("", 2))
+	if n := strings.Count(buf.String(), "#Fields:"); n != 1 {
+		t.Errorf("%d W3C headers in\n%s", n, buf.String())
+	}
+}
+
+func TestAccessLogRelayed(t *testing.T) {
+	var buf lockedBuffer
+	_, url := startServer(t, WithAccessLog(&buf, AccessLogCommon))
+	session := dialSession(t, url)
+
+	stream, resp := request(t, session, protocol.Request{Addr: echoTarget(t)})
+	if resp.Status != protocol.StatusOK {
+		t.Fatalf("status %#x", resp.Status)
+	}
+	if _, err := stream.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(stream, make([]byte, 5)); err != nil {
+		t.Fatal(err)
+	}
+	stream.Close()
+	refused := closedAddr(t)
+	request(t, session, protocol.Request{Addr: refused})
+
+	// The lines come as the connections end, in either order.
+	relayed := regexp.MustCompile(`(?m)^127\.0\.0\.1 - - \[[^]]+\] "CONNECT 127\.0\.0\.1:[0-9]+ HTTP/1\.1" 200 5$`)
+	failed := regexp.MustCompile(`(?m)^127\.0\.0\.1 - - \[[^]]+\] "CONNECT ` + regexp.QuoteMeta(refused) + ` HTTP/1\.1" 502 -$`)
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		log := buf.String()
+		if relayed.MatchString(log) && failed.MatchString(log) && strings.Count(log, "\n") == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("access log:\n%s", log)
+		}
+	}
+}
+
+// writeCounter is a lockedBuffer that counts the writes made to it.
+type writeCounter struct {
+	lockedBuffer
+	writes atomic.Int64
+}
+
+func (w *writeCounter) Write(p []byte) (int, error) {
+	w.writes.Add(1)
+	return w.lockedBuffer.Write(p)
+}
+
+func (w *writeCounter) lines() int { return strings.Count(w.String(), "\n") }
+
+// failedRequests makes n requests for a target that refuses them, each
+// logged as it's answered.
+func failedRequests(t *testing.T, url string, n int) {
+	t.Helper()
+	session := dialSession(t, url)
+	refused := closedAddr(t)
+	for i := 0; i < n; i++ {
+		if _, resp := request(t, session, protocol.Request{Addr: refused}); resp.Status != protocol.StatusRefused {
+			t.Fatalf("status %#x", resp.Status)
+		}
+	}
+}
+
+func TestAccessLogBufferInterval(t *testing.T) {
+	const (
+		n     = 5
+		every = 200 * time.Millisecond
+	)
+	var w writeCounter
+	_, url := startServer(t, WithAccessLog(&w, AccessLogCommon), WithAccessLogBuffer(1<<20, every, false))
+	start := time.Now()
+	failedRequests(t, url, n)
+	for w.lines() < n {
+		if time.Since(start) > 5*every {
+			t.Fatalf("%d of %d lines written after %v", w.lines(), n, time.Since(start))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// The lines went out together, a tick or two's worth at a time, not
+	// as each came.
+	if writes := w.writes.Load(); writes > 2 {
+		t.Errorf("%d lines in %d writes", n, writes)
+	}
+}
+
+func TestAccessLogBufferShutdown(t *testing.T) {
+	const n = 5
+	var w writeCounter
+	s, url := startServer(t, WithAccessLog(&w, AccessLogCommon), WithAccessLogBuffer(1<<20, time.Hour, false))
+	failedRequests(t, url, n)
+	time.Sleep(100 * time.Millisecond)
+	if got := w.lines(); got != 0 {
+		t.Fatalf("%d lines written before the buffer filled or the interval passed", got)
+	}
+	if err := s.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if got := w.lines(); got != n {
+		t.Errorf("%d lines written on shutdown, want %d:\n%s", got, n, w.String())
+	}
+}
+
+// TestAccessLogBufferBlocks checks a full buffer that doesn't drop lines
+// holds them back until there's room, losing none.
+func TestAccessLogBufferBlocks(t *testing.T) {
+	const n = 20
+	var w writeCounter
+	s, url := startServer(t, WithAccessLog(&w, AccessLogCommon),
+		WithAccessLogBuffer(1, time.Hour, false), WithEventLog(100))
+	failedRequests(t, url, n)
+	for deadline := time.Now().Add(5 * time.Second); w.lines() < n; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d of %d lines written", w.lines(), n)
+		}
+	}
+	for _, e := range s.events.Events() {
+		if e.Message == "access log buffer full, dropped lines" {
+			t.Errorf("dropped %s lines", e.Attrs["dropped"])
+		}
+	}
+}
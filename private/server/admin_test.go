@@ -0,0 +1,170 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jtolio/netpump-go/private/protocol"
+)
+
+// adminGet fetches path from the server with websocket URL url, bearing
+// token if it isn't empty, and returns the response with its body.
+func adminGet(t *testing.T, url, path, token string) (*http.Response, string) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, httpURL(url, path), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, string(body)
+}
+
+func TestConnsEndpoint(t *testing.T) {
+	target := echoTarget(t)
+	_, url := startServer(t, WithAdminToken("admin-secret"))
+	stream, resp := request(t, dialSession(t, url), protocol.Request{Addr: target, Label: "video"})
+	if resp.Status != protocol.StatusOK {
+		t.Fatalf("status %#x", resp.Status)
+	}
+	if _, err := stream.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(stream, make([]byte, 5)); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, token := range []string{"", "wrong"} {
+		if resp, body := adminGet(t, url, "/conns", token); resp.StatusCode != http.StatusUnauthorized || strings.Contains(body, target) {
+			t.Errorf("token %q: status %d, %q", token, resp.StatusCode, body)
+		}
+	}
+
+	// The byte counts catch up once the writes they count return.
+	var c map[string]any
+	var body string
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		var resp *http.Response
+		resp, body = adminGet(t, url, "/conns", "admin-secret")
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/json" {
+			t.Fatalf("status %d, content type %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+		}
+		var conns []map[string]any
+		if err := json.Unmarshal([]byte(body), &conns); err != nil {
+			t.Fatalf("%v in %s", err, body)
+		}
+		if len(conns) != 1 {
+			t.Fatalf("%d connections, want 1: %s", len(conns), body)
+		}
+		c = conns[0]
+		if c["received"] == 5.0 || time.Now().After(deadline) {
+			break
+		}
+	}
+	for _, key := range []string{"session", "stream", "client_ip", "label", "target", "start", "state", "sent", "received", "window_wait", "link_wait"} {
+		if _, ok := c[key]; !ok {
+			t.Errorf("no %q in %s", key, body)
+		}
+	}
+	if _, ok := c["tenant"]; ok {
+		t.Errorf("tenant without tenants in %s", body)
+	}
+	if c["target"] != target || c["client_ip"] != "127.0.0.1" || c["label"] != "video" ||
+		c["state"] != connRelaying || c["sent"] != 5.0 || c["received"] != 5.0 {
+		t.Errorf("connection %v", c)
+	}
+
+	_, text := adminGet(t, url, "/conns?format=text", "admin-secret")
+	if lines := strings.Split(strings.TrimSpace(text), "\n"); len(lines) != 2 ||
+		!strings.HasPrefix(lines[0], "SESSION") || !strings.Contains(lines[1], target) {
+		t.Errorf("text table:\n%s", text)
+	}
+
+	// Without an admin token there's no table at all.
+	_, url = startServer(t)
+	if _, body := adminGet(t, url, "/conns", ""); strings.Contains(body, "[") {
+		t.Errorf("/conns without an admin token served %q", body)
+	}
+}
+
+func TestSnapshotEndpoint(t *testing.T) {
+	target := echoTarget(t)
+	_, url := startServer(t,
+		WithAdminToken("admin-secret"),
+		WithInstanceID("snap-1"),
+		WithGlobalRateLimit(1<<20),
+		WithMaxSessions(5),
+		WithMaxPendingStreams(7))
+	stream, resp := request(t, dialSession(t, url), protocol.Request{Addr: target, Label: "video"})
+	if resp.Status != protocol.StatusOK {
+		t.Fatalf("status %#x", resp.Status)
+	}
+	if _, err := stream.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(stream, make([]byte, 5)); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, token := range []string{"", "wrong"} {
+		if resp, body := adminGet(t, url, "/snapshot", token); resp.StatusCode != http.StatusUnauthorized || strings.Contains(body, target) {
+			t.Errorf("token %q: status %d, %q", token, resp.StatusCode, body)
+		}
+	}
+
+	// The byte counts catch up once the writes they count return.
+	var snap Snapshot
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		resp, body := adminGet(t, url, "/snapshot", "admin-secret")
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/json" {
+			t.Fatalf("status %d, content type %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+		}
+		snap = Snapshot{}
+		if err := json.Unmarshal([]byte(body), &snap); err != nil {
+			t.Fatalf("%v in %s", err, body)
+		}
+		if snap.Received == 5 || time.Now().After(deadline) {
+			break
+		}
+	}
+	if snap.Instance != "snap-1" || snap.Started.IsZero() || snap.Time.Before(snap.Started) {
+		t.Errorf("instance %q started %v at %v", snap.Instance, snap.Started, snap.Time)
+	}
+	if c := snap.Config; c.GlobalRateLimit != 1<<20 || c.MaxSessions != 5 || c.MaxPendingStreams != 7 ||
+		c.CopyBufferBytes != defaultCopyBufferSize || c.TLS {
+		t.Errorf("config %+v", c)
+	}
+	if len(snap.Sessions) != 1 || snap.Sessions[0].ClientIP != "127.0.0.1" || snap.Sessions[0].Streams != 1 {
+		t.Errorf("sessions %+v", snap.Sessions)
+	}
+	if len(snap.Connections) != 1 || snap.Connections[0].Target != target || snap.Connections[0].Label != "video" {
+		t.Errorf("connections %+v", snap.Connections)
+	}
+	if snap.Labels["video"].Streams != 1 {
+		t.Errorf("labels %+v", snap.Labels)
+	}
+	if snap.TotalSessions != 1 || snap.TotalStreams != 1 || snap.ActiveStreams != 1 || snap.Sent != 5 || snap.Received != 5 {
+		t.Errorf("sessions %d, streams %d, active %d, sent %d, received %d, want 1, 1, 1, 5, 5",
+			snap.TotalSessions, snap.TotalStreams, snap.ActiveStreams, snap.Sent, snap.Received)
+	}
+
+	// Without an admin token there's no snapshot.
+	_, url = startServer(t)
+	if _, body := adminGet(t, url, "/snapshot", ""); strings.Contains(body, "{") {
+		t.Errorf("/snapshot without an admin token served %q", body)
+	}
+}
@@ -0,0 +1,264 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/hashicorp/yamux"
+
+	"github.com/jtolio/netpump-go/private/protocol"
+	"github.com/jtolio/netpump-go/private/wsconn"
+)
+
+// pipeListener hands the server in-memory connections, which buffer
+// nothing: a write waits for the other end to read it. Over a socket the
+// kernel would take megabytes the server wrote before the reader could
+// ask it to stop.
+type pipeListener struct {
+	conns  chan net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newPipeListener() *pipeListener {
+	return &pipeListener{conns: make(chan net.Conn), closed: make(chan struct{})}
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *pipeListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr { return pipeAddr{} }
+
+func (l *pipeListener) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	client, server := net.Pipe()
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "pipe" }
+
+// slowBrowser stands in for the browser page, relaying between a client
+// and the server, but forwards what the server sends at only rate bytes
+// per second, queueing the rest the way a browser's websocket buffers
+// unsent data. Like the page, it asks the server to pause while more
+// than highWater bytes are queued, until they drain to lowWater.
+type slowBrowser struct {
+	server    *websocket.Dialer
+	serverURL string
+	rate      int
+	highWater int
+	lowWater  int
+
+	mu        sync.Mutex
+	maxQueued int
+	pauses    int
+}
+
+type relayedMessage struct {
+	typ  int
+	data []byte
+}
+
+// ServeHTTP accepts the client's websocket and relays it to the server.
+func (b *slowBrowser) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	local, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer local.Close()
+	remote, _, err := b.server.Dial(b.serverURL, nil)
+	if err != nil {
+		return
+	}
+	defer remote.Close()
+	var remoteMu sync.Mutex
+	writeRemote := func(typ int, data []byte) error {
+		remoteMu.Lock()
+		defer remoteMu.Unlock()
+		return remote.WriteMessage(typ, data)
+	}
+
+	var (
+		qmu    sync.Mutex
+		cond   = sync.NewCond(&qmu)
+		queue  []relayedMessage
+		queued int
+		paused bool
+		ended  bool
+	)
+	end := func() {
+		qmu.Lock()
+		ended = true
+		cond.Broadcast()
+		qmu.Unlock()
+	}
+
+	go func() {
+		defer end()
+		for {
+			typ, msg, err := local.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err := writeRemote(typ, msg); err != nil {
+				return
+			}
+		}
+	}()
+	go func() {
+		defer end()
+		for {
+			typ, msg, err := remote.ReadMessage()
+			if err != nil {
+				return
+			}
+			qmu.Lock()
+			queue = append(queue, relayedMessage{typ, msg})
+			queued += len(msg)
+			pause := !paused && queued > b.highWater
+			paused = paused || pause
+			b.mu.Lock()
+			b.maxQueued = max(b.maxQueued, queued)
+			if pause {
+				b.pauses++
+			}
+			b.mu.Unlock()
+			cond.Broadcast()
+			qmu.Unlock()
+			if pause && writeRemote(websocket.TextMessage, []byte(wsconn.PauseMessage)) != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		qmu.Lock()
+		for len(queue) == 0 && !ended {
+			cond.Wait()
+		}
+		if ended {
+			qmu.Unlock()
+			return
+		}
+		msg := queue[0]
+		queue = queue[1:]
+		qmu.Unlock()
+
+		time.Sleep(time.Duration(len(msg.data)) * time.Second / time.Duration(b.rate))
+		if err := local.WriteMessage(msg.typ, msg.data); err != nil {
+			return
+		}
+
+		qmu.Lock()
+		queued -= len(msg.data)
+		resume := paused && queued <= b.lowWater
+		paused = paused && !resume
+		qmu.Unlock()
+		if resume && writeRemote(websocket.TextMessage, []byte(wsconn.ResumeMessage)) != nil {
+			return
+		}
+	}
+}
+
+// TestBrowserBackpressure checks that a browser relay that can't keep up
+// with the server holds only a bounded backlog, though the client's stream
+// windows would let the server send it everything at once.
+func TestBrowserBackpressure(t *testing.T) {
+	const (
+		streams = 2
+		size    = 4 << 20
+	)
+	s := New("127.0.0.1", 0)
+	if err := s.setup(); err != nil {
+		t.Fatal(err)
+	}
+	ln := newPipeListener()
+	hs := httptest.NewUnstartedServer(s.server.Handler)
+	hs.Listener = ln
+	hs.Start()
+	t.Cleanup(func() {
+		s.Stop()
+		hs.Close()
+	})
+
+	browser := &slowBrowser{
+		server:    &websocket.Dialer{NetDialContext: ln.dial},
+		serverURL: "ws://pipe/ws",
+		rate:      16 << 20,
+		highWater: 256 << 10,
+		lowWater:  64 << 10,
+	}
+	relay := httptest.NewServer(browser)
+	t.Cleanup(relay.Close)
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(relay.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := yamux.DefaultConfig()
+	config.MaxStreamWindowSize = 2 * size
+	config.LogOutput = io.Discard
+	session, err := yamux.Client(wsconn.New(ws), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { session.Close() })
+
+	target := sourceTarget(t)
+	var wg sync.WaitGroup
+	for i := 0; i < streams; i++ {
+		stream, resp := request(t, session, protocol.Request{Addr: target})
+		if resp.Status != protocol.StatusOK {
+			t.Fatalf("status = %#x, want OK", resp.Status)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer stream.Close()
+			stream.SetDeadline(time.Now().Add(30 * time.Second))
+			if n, err := io.CopyN(io.Discard, stream, size); err != nil {
+				t.Errorf("received %d bytes: %v", n, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	browser.mu.Lock()
+	defer browser.mu.Unlock()
+	if browser.pauses == 0 {
+		t.Fatal("the relay never had to pause the server")
+	}
+	// Messages the server was already writing when it got the pause still
+	// arrive, but no more.
+	if limit := browser.highWater + 2*wsconn.MaxMessageSize; browser.maxQueued > limit {
+		t.Errorf("relay queued up to %d bytes, want at most %d", browser.maxQueued, limit)
+	}
+}
@@ -0,0 +1,337 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http/httptest"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/hashicorp/yamux"
+
+	"github.com/jtolio/netpump-go/private/protocol"
+	"github.com/jtolio/netpump-go/private/wsconn"
+)
+
+// delayConn delivers what's written to it delay later, however much there
+// is, like a link with latency but bandwidth to spare.
+type delayConn struct {
+	net.Conn
+	delay  time.Duration
+	queue  chan delayed
+	closed chan struct{}
+	once   sync.Once
+}
+
+type delayed struct {
+	b   []byte
+	due time.Time
+}
+
+func newDelayConn(conn net.Conn, delay time.Duration) *delayConn {
+	d := &delayConn{Conn: conn, delay: delay, queue: make(chan delayed, 4096), closed: make(chan struct{})}
+	go d.deliver()
+	return d
+}
+
+func (d *delayConn) Write(p []byte) (int, error) {
+	select {
+	case d.queue <- delayed{b: append([]byte(nil), p...), due: time.Now().Add(d.delay)}:
+		return len(p), nil
+	case <-d.closed:
+		return 0, net.ErrClosed
+	}
+}
+
+func (d *delayConn) deliver() {
+	for {
+		select {
+		case m := <-d.queue:
+			time.Sleep(time.Until(m.due))
+			if _, err := d.Conn.Write(m.b); err != nil {
+				return
+			}
+		case <-d.closed:
+			return
+		}
+	}
+}
+
+func (d *delayConn) Close() error {
+	d.once.Do(func() { close(d.closed) })
+	return d.Conn.Close()
+}
+
+// pipeSession starts a server with opts, reached over an in-memory
+// carrier that delays what the client sends by delay, and returns a
+// session to it.
+func pipeSession(tb testing.TB, delay time.Duration, opts ...Option) *yamux.Session {
+	tb.Helper()
+	s := New("127.0.0.1", 0, opts...)
+	if err := s.setup(); err != nil {
+		tb.Fatal(err)
+	}
+	ln := newPipeListener()
+	hs := httptest.NewUnstartedServer(s.server.Handler)
+	hs.Listener = ln
+	hs.Start()
+	tb.Cleanup(func() {
+		s.Stop()
+		hs.Close()
+	})
+	dialer := &websocket.Dialer{NetDialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := ln.dial(ctx, network, addr)
+		if err != nil || delay <= 0 {
+			return conn, err
+		}
+		return newDelayConn(conn, delay), nil
+	}}
+	ws, _, err := dialer.Dial("ws://pipe/ws", nil)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	config := yamux.DefaultConfig()
+	config.LogOutput = io.Discard
+	session, err := yamux.Client(wsconn.New(ws), config)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { session.Close() })
+	return session
+}
+
+// openStream asks session for a stream to target, without the deadline
+// request sets.
+func openStream(tb testing.TB, session *yamux.Session, target string) net.Conn {
+	tb.Helper()
+	stream, resp := request(tb, session, protocol.Request{Addr: target})
+	if resp.Status != protocol.StatusOK {
+		tb.Fatalf("status = %#x, want OK", resp.Status)
+	}
+	stream.SetDeadline(time.Time{})
+	return stream
+}
+
+// sinkTarget listens on loopback, reading and counting whatever is sent,
+// and returns its address with the count.
+func sinkTarget(tb testing.TB) (string, *atomic.Int64) {
+	tb.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { ln.Close() })
+	var n atomic.Int64
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				buf := make([]byte, 64*1024)
+				for {
+					m, err := conn.Read(buf)
+					n.Add(int64(m))
+					if err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String(), &n
+}
+
+// upload writes size bytes to stream and waits until sunk has them all,
+// past what it had before.
+func upload(tb testing.TB, stream net.Conn, sunk *atomic.Int64, size int) {
+	tb.Helper()
+	want := sunk.Load() + int64(size)
+	if _, err := stream.Write(make([]byte, size)); err != nil {
+		tb.Fatal(err)
+	}
+	for deadline := time.Now().Add(30 * time.Second); sunk.Load() < want; time.Sleep(100 * time.Microsecond) {
+		if time.Now().After(deadline) {
+			tb.Fatalf("target got %d of %d bytes", sunk.Load(), want)
+		}
+	}
+}
+
+const benchChunk = 1 << 20
+
+func BenchmarkRelayDownload(b *testing.B) {
+	for _, size := range []int{8 << 10, defaultCopyBufferSize, 128 << 10} {
+		b.Run("copybuf="+strconv.Itoa(size>>10)+"K", func(b *testing.B) {
+			stream := openStream(b, pipeSession(b, 0, WithCopyBufferBytes(size)), sourceTarget(b))
+			b.SetBytes(benchChunk)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := io.CopyN(io.Discard, stream, benchChunk); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkRelayUpload(b *testing.B) {
+	// Over a link with latency, the window bounds a stream's throughput.
+	const delay = 5 * time.Millisecond
+	for _, window := range []int{minStreamWindow, 1 << 20, 4 << 20} {
+		b.Run("window="+strconv.Itoa(window>>10)+"K", func(b *testing.B) {
+			target, sunk := sinkTarget(b)
+			stream := openStream(b, pipeSession(b, delay, WithStreamWindow(window)), target)
+			b.SetBytes(benchChunk)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				upload(b, stream, sunk, benchChunk)
+			}
+		})
+	}
+}
+
+func BenchmarkRelayConcurrentStreams(b *testing.B) {
+	const (
+		streams = 8
+		chunk   = benchChunk / streams
+	)
+	session := pipeSession(b, 0)
+	target := sourceTarget(b)
+	var conns []net.Conn
+	for i := 0; i < streams; i++ {
+		conns = append(conns, openStream(b, session, target))
+	}
+	b.SetBytes(benchChunk)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var wg sync.WaitGroup
+		for _, conn := range conns {
+			wg.Add(1)
+			go func(conn net.Conn) {
+				defer wg.Done()
+				if _, err := io.CopyN(io.Discard, conn, chunk); err != nil {
+					b.Error(err)
+				}
+			}(conn)
+		}
+		wg.Wait()
+	}
+}
+
+// BenchmarkRelaySetup measures a stream's setup: the request, the dial
+// and the target's first byte.
+func BenchmarkRelaySetup(b *testing.B) {
+	// The target greets and hangs up, so the relays don't linger.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte("x"))
+			conn.Close()
+		}
+	}()
+	session := pipeSession(b, 0)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		stream := openStream(b, session, ln.Addr().String())
+		if _, err := io.ReadFull(stream, make([]byte, 1)); err != nil {
+			b.Fatal(err)
+		}
+		stream.Close()
+	}
+}
+
+// BenchmarkRelaySmallMessages measures round trips of small messages on
+// one stream, where the per-frame overhead shows.
+func BenchmarkRelaySmallMessages(b *testing.B) {
+	const size = 64
+	stream := openStream(b, pipeSession(b, 0), echoTarget(b))
+	msg := make([]byte, size)
+	b.SetBytes(size)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := stream.Write(msg); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := io.ReadFull(stream, msg); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// The tests below hold the tunables to what they're for, in terms that
+// don't depend on how fast the machine is.
+
+// TestStreamWindowThroughput checks a larger WithStreamWindow lets an
+// upload over a link with latency go faster.
+func TestStreamWindowThroughput(t *testing.T) {
+	const (
+		delay = 50 * time.Millisecond
+		size  = 4 << 20
+	)
+	took := func(window int) time.Duration {
+		target, sunk := sinkTarget(t)
+		stream := openStream(t, pipeSession(t, delay, WithStreamWindow(window)), target)
+		start := time.Now()
+		upload(t, stream, sunk, size)
+		return time.Since(start)
+	}
+	small, large := took(minStreamWindow), took(4*size)
+	// The small window takes a round trip for every minStreamWindow
+	// bytes, the large one only the first.
+	if floor := size / minStreamWindow * delay; small < floor/2 {
+		t.Errorf("%d bytes took %v with a %d byte window, faster than its window allows", size, small, minStreamWindow)
+	}
+	if large > small/2 {
+		t.Errorf("%d bytes took %v with a %d byte window, and %v with %d", size, large, 4*size, small, minStreamWindow)
+	}
+}
+
+// TestCopyBufferAllocs checks a download's allocations go down as
+// WithCopyBufferBytes goes up, and stay under a ceiling at the default.
+func TestCopyBufferAllocs(t *testing.T) {
+	const size = 4 << 20
+	allocs := func(buf int) uint64 {
+		stream := openStream(t, pipeSession(t, 0, WithCopyBufferBytes(buf)), sourceTarget(t))
+		// Warm up, so the pools and the windows are settled.
+		if _, err := io.CopyN(io.Discard, stream, size); err != nil {
+			t.Fatal(err)
+		}
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		if _, err := io.CopyN(io.Discard, stream, size); err != nil {
+			t.Fatal(err)
+		}
+		runtime.ReadMemStats(&after)
+		return (after.Mallocs - before.Mallocs) / (size >> 20)
+	}
+	small, def, large := allocs(8<<10), allocs(defaultCopyBufferSize), allocs(128<<10)
+	if !(large < def && def < small) {
+		t.Errorf("allocations per MiB: %d with 8 KiB buffers, %d with %d, %d with 128 KiB", small, def, defaultCopyBufferSize, large)
+	}
+	// Roughly one frame per buffer's worth, at a handful of allocations
+	// each.
+	if ceiling := uint64(16 * (1 << 20) / defaultCopyBufferSize); def > ceiling {
+		t.Errorf("%d allocations per MiB relayed, want at most %d", def, ceiling)
+	}
+}
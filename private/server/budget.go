@@ -0,0 +1,46 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"sync/atomic"
+)
+
+var errRequestBudget = errors.New("request memory budget exhausted")
+
+// requestBudget caps the bytes of stream requests being read at once
+// across the whole server, so many slow handshakes can't add up to
+// unbounded memory.
+type requestBudget struct {
+	max  int64
+	used atomic.Int64
+}
+
+func (b *requestBudget) exhausted() bool {
+	return b.used.Load() >= b.max
+}
+
+// budgetReader charges the bytes read through it to a requestBudget until
+// released.
+type budgetReader struct {
+	r io.Reader
+	b *requestBudget
+	n int64
+}
+
+func (br *budgetReader) Read(p []byte) (int, error) {
+	want := int64(len(p))
+	if br.b.used.Add(want) > br.b.max {
+		br.b.used.Add(-want)
+		return 0, errRequestBudget
+	}
+	n, err := br.r.Read(p)
+	br.b.used.Add(int64(n) - want)
+	br.n += int64(n)
+	return n, err
+}
+
+func (br *budgetReader) release() {
+	br.b.used.Add(-br.n)
+	br.n = 0
+}
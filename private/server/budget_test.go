@@ -0,0 +1,61 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jtolio/netpump-go/private/protocol"
+)
+
+func TestRequestBudgetFlood(t *testing.T) {
+	_, url := startServer(t, WithMaxRequestBytes(256))
+	session := dialSession(t, url)
+
+	// Each stream promises a 200 byte address and never sends it, so
+	// only one of them fits the budget while it waits.
+	const flood = 10
+	answers := make(chan byte, flood)
+	for i := 0; i < flood; i++ {
+		stream, err := session.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer stream.Close()
+		go func() {
+			stream.SetDeadline(time.Now().Add(time.Second))
+			if _, err := stream.Write([]byte{200}); err != nil {
+				answers <- 0xff
+				return
+			}
+			resp, err := protocol.ReadResponse(stream)
+			if err != nil {
+				answers <- 0xff
+				return
+			}
+			answers <- resp.Status
+		}()
+	}
+	rejected := 0
+	for i := 0; i < flood; i++ {
+		if <-answers == protocol.StatusFailed {
+			rejected++
+		}
+	}
+	if rejected != flood-1 {
+		t.Fatalf("%d of %d handshakes rejected, want %d", rejected, flood, flood-1)
+	}
+}
+
+func TestRequestBudgetReleasedForRelay(t *testing.T) {
+	target := echoTarget(t)
+	_, url := startServer(t, WithMaxRequestBytes(int64(4*(len(target)+1))))
+	session := dialSession(t, url)
+
+	// Relays don't hold on to the budget their requests used, so far more
+	// of them can be open than requests fit in it.
+	for i := 0; i < 10; i++ {
+		if _, resp := request(t, session, protocol.Request{Addr: target}); resp.Status != protocol.StatusOK {
+			t.Fatalf("relay %d: status = %#x, want %#x", i, resp.Status, protocol.StatusOK)
+		}
+	}
+}
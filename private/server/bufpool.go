@@ -0,0 +1,62 @@
+package server
+
+import "sync"
+
+// defaultCopyBufferSize is the default size of the relay's copy buffers,
+// io.Copy's own.
+const defaultCopyBufferSize = 32 * 1024
+
+// defaultPooledBuffers is how many idle copy buffers are kept by default,
+// 8 MiB worth.
+const defaultPooledBuffers = 256
+
+// bufferPool recycles the relay's copy buffers, of size bytes, keeping at
+// most max idle ones. Buffers returned beyond that are left to the garbage
+// collector.
+type bufferPool struct {
+	size    int
+	max     int
+	metrics MetricsSink
+
+	mu    sync.Mutex
+	free  [][]byte
+	inUse int
+}
+
+func (p *bufferPool) get() []byte {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var buf []byte
+	if n := len(p.free); n > 0 {
+		buf = p.free[n-1]
+		p.free[n-1] = nil
+		p.free = p.free[:n-1]
+	} else {
+		buf = make([]byte, p.size)
+	}
+	p.inUse++
+	p.report()
+	return buf
+}
+
+func (p *bufferPool) put(buf []byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.free) < p.max {
+		p.free = append(p.free, buf)
+	}
+	p.inUse--
+	p.report()
+}
+
+// report updates the gauges. The caller must hold mu, so updates land in
+// order.
+func (p *bufferPool) report() {
+	p.metrics.SetGauge(MetricCopyBuffers, inUseLabels, float64(p.inUse))
+	p.metrics.SetGauge(MetricCopyBuffers, pooledLabels, float64(len(p.free)))
+}
+
+var (
+	inUseLabels  = map[string]string{"state": "in_use"}
+	pooledLabels = map[string]string{"state": "pooled"}
+)
@@ -0,0 +1,47 @@
+package server
+
+import "testing"
+
+func TestBufferPoolMax(t *testing.T) {
+	const max = 3
+	sink := newRecordingSink()
+	p := &bufferPool{size: 16, max: max, metrics: sink}
+	gauge := func(labels map[string]string) float64 {
+		sink.mu.Lock()
+		defer sink.mu.Unlock()
+		values := sink.gauges[metricKey(MetricCopyBuffers, labels)]
+		return values[len(values)-1]
+	}
+
+	var held [][]byte
+	for i := 0; i < 10; i++ {
+		buf := p.get()
+		if len(buf) != 16 {
+			t.Fatalf("buffer of %d bytes, want 16", len(buf))
+		}
+		held = append(held, buf)
+	}
+	if in, pooled := gauge(inUseLabels), gauge(pooledLabels); in != 10 || pooled != 0 {
+		t.Errorf("%v in use and %v pooled, want 10 and 0", in, pooled)
+	}
+	for i, buf := range held {
+		p.put(buf)
+		if len(p.free) > max {
+			t.Fatalf("%d buffers pooled after %d returned, want at most %d", len(p.free), i+1, max)
+		}
+	}
+	if in, pooled := gauge(inUseLabels), gauge(pooledLabels); in != 0 || pooled != max {
+		t.Errorf("%v in use and %v pooled, want 0 and %d", in, pooled, max)
+	}
+
+	// The pooled ones are reused before any new one is made.
+	for i := 0; i < max; i++ {
+		buf := p.get()
+		if &buf[0] != &held[max-1-i][0] {
+			t.Errorf("get %d made a buffer with %d pooled", i, max-i)
+		}
+	}
+	if len(p.free) != 0 {
+		t.Errorf("%d buffers still pooled", len(p.free))
+	}
+}
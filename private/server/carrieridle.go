@@ -0,0 +1,71 @@
+package server
+
+import (
+	"log/slog"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/jtolio/netpump-go/private/wsconn"
+)
+
+// carrierActivity tracks the streams of a websocket's sessions, for
+// WithCarrierIdleTimeout. Keepalive pings don't count: they'd keep every
+// carrier busy.
+type carrierActivity struct {
+	streams atomic.Int64
+	last    atomic.Int64 // UnixNano when a stream last started or ended
+	closed  atomic.Bool  // whether the carrier was closed for being idle
+}
+
+func (a *carrierActivity) streamStarted() {
+	a.streams.Add(1)
+	a.last.Store(time.Now().UnixNano())
+}
+
+func (a *carrierActivity) streamEnded() {
+	a.last.Store(time.Now().UnixNano())
+	a.streams.Add(-1)
+}
+
+// idleFor returns how long the carrier has had no streams, 0 if it has
+// some.
+func (a *carrierActivity) idleFor(now time.Time) time.Duration {
+	if a.streams.Load() > 0 {
+		return 0
+	}
+	return now.Sub(time.Unix(0, a.last.Load()))
+}
+
+// closeIdleCarrier closes ws once it has carried no streams for the
+// carrier idle timeout, first telling the client over conn so it waits
+// for a connection to make before coming back. It returns when done is
+// closed.
+func (s *Server) closeIdleCarrier(ws *websocket.Conn, conn *wsconn.Conn, activity *carrierActivity, log *slog.Logger, done <-chan struct{}) {
+	defer s.wg.Done()
+	activity.last.Store(time.Now().UnixNano())
+	timer := time.NewTimer(s.carrierIdle)
+	defer timer.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-s.ctx.Done():
+			return
+		case <-timer.C:
+		}
+		idle := activity.idleFor(time.Now())
+		if idle < s.carrierIdle {
+			timer.Reset(s.carrierIdle - idle)
+			continue
+		}
+		log.Info("closing idle carrier", "idle", idle.Round(time.Second))
+		if err := conn.Idle(); err != nil {
+			log.Warn("failed to tell client the carrier is idle", "error", err)
+		}
+		activity.closed.Store(true)
+		ws.Close()
+		return
+	}
+}
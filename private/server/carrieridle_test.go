@@ -0,0 +1,78 @@
+package server
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/hashicorp/yamux"
+
+	"github.com/jtolio/netpump-go/private/protocol"
+	"github.com/jtolio/netpump-go/private/wsconn"
+)
+
+// dialIdleSession is dialSession, also returning a channel closed once
+// the server says the carrier is idle.
+func dialIdleSession(t *testing.T, url string) (*yamux.Session, <-chan struct{}) {
+	t.Helper()
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := wsconn.New(ws)
+	idle := make(chan struct{})
+	var once sync.Once
+	conn.OnIdle(func() { once.Do(func() { close(idle) }) })
+	session, err := yamux.Client(conn, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { session.Close() })
+	return session, idle
+}
+
+func waitClosed(t *testing.T, session *yamux.Session, idle <-chan struct{}, within time.Duration) {
+	t.Helper()
+	timeout := time.After(within)
+	select {
+	case <-idle:
+	case <-timeout:
+		t.Fatal("client wasn't told the carrier is idle")
+	}
+	select {
+	case <-session.CloseChan():
+	case <-timeout:
+		t.Fatal("idle carrier wasn't closed")
+	}
+}
+
+func TestCarrierIdleClosesIdleSession(t *testing.T) {
+	_, url := startServer(t, WithCarrierIdleTimeout(200*time.Millisecond), WithIdleStreamProbe(time.Minute))
+	session, idle := dialIdleSession(t, url)
+
+	// The control stream stays open with the session, but carries nothing
+	// to tunnel.
+	if _, resp := request(t, session, protocol.Request{Control: true}); resp.Status != protocol.StatusOK {
+		t.Fatalf("control status = %#x, want %#x", resp.Status, protocol.StatusOK)
+	}
+	waitClosed(t, session, idle, 5*time.Second)
+}
+
+func TestCarrierIdleWaitsForStreams(t *testing.T) {
+	target := echoTarget(t)
+	_, url := startServer(t, WithCarrierIdleTimeout(200*time.Millisecond))
+	session, idle := dialIdleSession(t, url)
+
+	stream, resp := request(t, session, protocol.Request{Addr: target})
+	if resp.Status != protocol.StatusOK {
+		t.Fatalf("status = %#x, want %#x", resp.Status, protocol.StatusOK)
+	}
+	select {
+	case <-session.CloseChan():
+		t.Fatal("carrier closed with a stream open")
+	case <-time.After(time.Second):
+	}
+	stream.Close()
+	waitClosed(t, session, idle, 5*time.Second)
+}
@@ -0,0 +1,142 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ipSet is a list of IPs and CIDR ranges.
+type ipSet []*net.IPNet
+
+// parseIPSet parses IPs and CIDR ranges.
+func parseIPSet(patterns []string) (ipSet, error) {
+	var set ipSet
+	for _, pat := range patterns {
+		pat = strings.TrimSpace(pat)
+		n := parseIPNet(pat)
+		if n == nil {
+			return nil, fmt.Errorf("%q is neither an IP nor a CIDR range", pat)
+		}
+		set = append(set, n)
+	}
+	return set, nil
+}
+
+// contains reports whether ip, which may be unparsable, is in the set.
+func (set ipSet) contains(ip string) bool {
+	parsed := canonicalIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, n := range set {
+		if n.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// canonicalIP parses an IP, dropping any zone and unmapping IPv4-mapped
+// IPv6 addresses, so ::ffff:10.0.0.1 and 10.0.0.1%eth0 both come out as
+// 10.0.0.1. It returns nil if s isn't an IP.
+func canonicalIP(s string) net.IP {
+	if i := strings.LastIndexByte(s, '%'); i >= 0 {
+		s = s[:i]
+	}
+	ip := net.ParseIP(s)
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
+
+// parseIPNet parses an IP, as a single address range, or a CIDR range.
+// Ranges within ::ffff:0:0/96 are taken as the IPv4 ranges they map, so
+// they match IPv4 addresses in either form. It returns nil if s is
+// neither.
+func parseIPNet(s string) *net.IPNet {
+	if _, n, err := net.ParseCIDR(s); err == nil {
+		ones, bits := n.Mask.Size()
+		if ip4 := n.IP.To4(); ip4 != nil && bits == 8*net.IPv6len && ones >= 96 {
+			n = &net.IPNet{IP: ip4, Mask: net.CIDRMask(ones-96, 8*net.IPv4len)}
+		}
+		return n
+	}
+	ip := canonicalIP(s)
+	if ip == nil {
+		return nil
+	}
+	bits := 8 * len(ip)
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+}
+
+// getClientIP returns the address a request came from. Behind trusted
+// proxies that's the last address in X-Forwarded-For that isn't one of
+// them; a request from anywhere else is taken at its word only while no
+// client allowlist depends on it.
+func (s *Server) getClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	xff := r.Header.Values("X-Forwarded-For")
+	switch {
+	case len(xff) == 0:
+		return host
+	case s.trustedProxies != nil:
+		if !s.trustedProxies.contains(host) {
+			return host
+		}
+		hops := strings.Split(strings.Join(xff, ","), ",")
+		for i := len(hops) - 1; i > 0; i-- {
+			if hop := strings.TrimSpace(hops[i]); !s.trustedProxies.contains(hop) {
+				return hop
+			}
+		}
+		return strings.TrimSpace(hops[0])
+	case s.allowedClients.Load() != nil:
+		return host
+	}
+	return xff[0]
+}
+
+// peerIP returns the address a request came from for keying per-client
+// limits: what getClientIP finds behind trusted proxies, and otherwise the
+// address of the connection itself. Anyone else can send whatever
+// X-Forwarded-For they like, and a fresh one for every websocket.
+func (s *Server) peerIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if s.trustedProxies != nil && s.trustedProxies.contains(host) {
+		return s.getClientIP(r)
+	}
+	return host
+}
+
+// SetAllowedClients replaces the IPs and ranges of WithAllowedClients, or
+// sets them on a server started without any, as for a configuration
+// reload. It applies to websockets from then on; clients already connected
+// stay. No patterns allow any client.
+func (s *Server) SetAllowedClients(patterns ...string) error {
+	if len(patterns) == 0 {
+		s.allowedClients.Store(nil)
+	} else {
+		set, err := parseIPSet(patterns)
+		if err != nil {
+			return fmt.Errorf("allowed clients: %w", err)
+		}
+		s.allowedClients.Store(&set)
+	}
+	s.log.Info("allowed clients changed", "patterns", patterns)
+	return nil
+}
+
+// clientAllowed reports whether a client at ip may connect.
+func (s *Server) clientAllowed(ip string) bool {
+	set := s.allowedClients.Load()
+	return set == nil || set.contains(ip)
+}
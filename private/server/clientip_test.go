@@ -0,0 +1,100 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPeerIP(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		trusted []string
+		remote  string
+		xff     string
+		want    string
+	}{
+		{"no proxies", nil, "192.0.2.1:5555", "203.0.113.9", "192.0.2.1"},
+		{"untrusted peer", []string{"10.0.0.1"}, "192.0.2.1:5555", "203.0.113.9", "192.0.2.1"},
+		{"trusted proxy", []string{"10.0.0.1"}, "10.0.0.1:5555", "203.0.113.9", "203.0.113.9"},
+		{"no header", []string{"10.0.0.1"}, "10.0.0.1:5555", "", "10.0.0.1"},
+	} {
+		s := New("127.0.0.1", 0, WithTrustedProxies(tc.trusted...))
+		if err := s.setup(); err != nil {
+			t.Fatal(err)
+		}
+		r := httptest.NewRequest("GET", "/ws", nil)
+		r.RemoteAddr = tc.remote
+		if tc.xff != "" {
+			r.Header.Set("X-Forwarded-For", tc.xff)
+		}
+		if got := s.peerIP(r); got != tc.want {
+			t.Errorf("%s: peerIP = %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestIPSetMapped(t *testing.T) {
+	set, err := parseIPSet([]string{"10.0.0.0/8", "192.0.2.1", "::ffff:198.51.100.0/120"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ip, want := range map[string]bool{
+		"10.1.2.3":             true,
+		"::ffff:10.1.2.3":      true,
+		"::ffff:a01:203":       true,
+		"::ffff:10.1.2.3%eth0": true,
+		"::ffff:192.0.2.1":     true,
+		"198.51.100.7":         true,
+		"::ffff:198.51.100.7":  true,
+		"11.0.0.1":             false,
+		"::ffff:11.0.0.1":      false,
+		"::10.1.2.3":           false,
+		"not an ip":            false,
+	} {
+		if got := set.contains(ip); got != want {
+			t.Errorf("contains(%q) = %v, want %v", ip, got, want)
+		}
+	}
+}
+
+// TestAllowedClients checks the allowlist at the websocket upgrade, with
+// X-Forwarded-For believed only from trusted proxies. The test's requests
+// all come from 127.0.0.1.
+func TestAllowedClients(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		allowed []string
+		trusted []string
+		xff     string
+		want    int
+	}{
+		{"allowed", []string{"127.0.0.0/8"}, nil, "", http.StatusSwitchingProtocols},
+		{"allowed, header ignored", []string{"127.0.0.0/8"}, nil, "198.51.100.1", http.StatusSwitchingProtocols},
+		{"denied", []string{"192.0.2.0/24"}, nil, "", http.StatusForbidden},
+		{"denied, header forged", []string{"192.0.2.0/24"}, nil, "192.0.2.1", http.StatusForbidden},
+		{"proxied, allowed", []string{"192.0.2.0/24"}, []string{"127.0.0.1"}, "192.0.2.1", http.StatusSwitchingProtocols},
+		{"proxied, denied", []string{"192.0.2.0/24"}, []string{"127.0.0.1"}, "198.51.100.1", http.StatusForbidden},
+		{"proxied, rightmost allowed", []string{"192.0.2.0/24"}, []string{"127.0.0.1"}, "198.51.100.1, 192.0.2.1", http.StatusSwitchingProtocols},
+		{"proxied, rightmost denied", []string{"192.0.2.0/24"}, []string{"127.0.0.1"}, "192.0.2.1, 198.51.100.1", http.StatusForbidden},
+		{"proxied, no header", []string{"192.0.2.0/24"}, []string{"127.0.0.1"}, "", http.StatusForbidden},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s, url := startServer(t, WithAllowedClients(tc.allowed...), WithTrustedProxies(tc.trusted...), WithEventLog(10))
+			header := http.Header{}
+			if tc.xff != "" {
+				header.Set("X-Forwarded-For", tc.xff)
+			}
+			if got := upgradeStatus(t, url, header); got != tc.want {
+				t.Fatalf("status %d, want %d", got, tc.want)
+			}
+			rejected := false
+			for _, e := range s.events.Events() {
+				rejected = rejected || e.Message == "rejected client from an address that isn't allowed"
+			}
+			if rejected != (tc.want == http.StatusForbidden) {
+				t.Errorf("rejection logged: %v", rejected)
+			}
+		})
+	}
+}
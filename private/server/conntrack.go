@@ -0,0 +1,146 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jtolio/netpump-go/private/wsconn"
+)
+
+// ConnInfo describes a stream's connection to its target, as served on
+// /conns.
+type ConnInfo struct {
+	Session  uint64    `json:"session"`
+	Stream   uint32    `json:"stream"`
+	ClientIP string    `json:"client_ip"`
+	Tenant   string    `json:"tenant,omitempty"`
+	Label    string    `json:"label,omitempty"`
+	Target   string    `json:"target"`
+	Start    time.Time `json:"start"`
+	State    string    `json:"state"`
+	Sent     int64     `json:"sent"`
+	Received int64     `json:"received"`
+
+	// Blocked is what a write to the client that has been under way for a
+	// while is waiting on: "window" if the client isn't reading the
+	// stream fast enough, "link" if the websocket can't carry more.
+	// WindowWait and LinkWait add up the seconds writes spent on each.
+	// yamux doesn't expose its windows, so these are estimates.
+	Blocked    string  `json:"blocked,omitempty"`
+	WindowWait float64 `json:"window_wait"`
+	LinkWait   float64 `json:"link_wait"`
+}
+
+// Connection states.
+const (
+	connDialing  = "dialing"
+	connRelaying = "relaying"
+)
+
+// conntrack is the table of streams with a target, kept when the admin
+// endpoints are on.
+type conntrack struct {
+	mu    sync.Mutex
+	conns map[*trackedConn]struct{}
+}
+
+type trackedConn struct {
+	info     ConnInfo // fixed once added, apart from the fields below
+	relaying atomic.Bool
+	sent     atomic.Int64
+	received atomic.Int64
+	carrier  *wsconn.Conn
+	rtt      *rttStats
+	flow     flowState
+}
+
+func newConntrack() *conntrack {
+	return &conntrack{conns: make(map[*trackedConn]struct{})}
+}
+
+// add tracks a connection until the returned function is called.
+func (ct *conntrack) add(info ConnInfo, sess *clientSession) (*trackedConn, func()) {
+	tc := &trackedConn{info: info, carrier: sess.carrier, rtt: &sess.rtt}
+	ct.mu.Lock()
+	ct.conns[tc] = struct{}{}
+	ct.mu.Unlock()
+	return tc, func() {
+		ct.mu.Lock()
+		delete(ct.conns, tc)
+		ct.mu.Unlock()
+	}
+}
+
+func (ct *conntrack) snapshot() []ConnInfo {
+	ct.mu.Lock()
+	conns := make([]ConnInfo, 0, len(ct.conns))
+	for tc := range ct.conns {
+		info := tc.info
+		info.State = connDialing
+		if tc.relaying.Load() {
+			info.State = connRelaying
+		}
+		info.Sent = tc.sent.Load()
+		info.Received = tc.received.Load()
+		// The write under way counts too.
+		window, link := time.Duration(tc.flow.window.Load()), time.Duration(tc.flow.link.Load())
+		limit, elapsed := tc.flow.blocked(tc.carrier, tc.rtt)
+		switch limit {
+		case flowWindow:
+			window += elapsed
+		case flowLink:
+			link += elapsed
+		}
+		if elapsed >= flowBlockedMin {
+			info.Blocked = limit
+		}
+		info.WindowWait = window.Seconds()
+		info.LinkWait = link.Seconds()
+		conns = append(conns, info)
+	}
+	ct.mu.Unlock()
+	sort.Slice(conns, func(i, j int) bool {
+		if !conns[i].Start.Equal(conns[j].Start) {
+			return conns[i].Start.Before(conns[j].Start)
+		}
+		return conns[i].Stream < conns[j].Stream
+	})
+	return conns
+}
+
+// Connections returns the streams currently connected or connecting to a
+// target, oldest first. It is empty unless an admin token is set.
+func (s *Server) Connections() []ConnInfo {
+	if s.conntrack == nil {
+		return nil
+	}
+	return s.conntrack.snapshot()
+}
+
+// handleConns serves the connection table as JSON, or with ?format=text as
+// a table.
+func (s *Server) handleConns(w http.ResponseWriter, r *http.Request) {
+	conns := s.Connections()
+	w.Header().Set("Cache-Control", "no-store")
+	if r.URL.Query().Get("format") != "text" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(conns)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "SESSION\tSTREAM\tCLIENT\tTENANT\tTARGET\tSTATE\tAGE\tSENT\tRECEIVED\tBLOCKED")
+	now := time.Now()
+	for _, c := range conns {
+		fmt.Fprintf(tw, "%d\t%d\t%s\t%s\t%s\t%s\t%s\t%d\t%d\t%s\n",
+			c.Session, c.Stream, c.ClientIP, accessField(c.Tenant), c.Target, c.State,
+			now.Sub(c.Start).Truncate(time.Second), c.Sent, c.Received, accessField(c.Blocked))
+	}
+	tw.Flush()
+}
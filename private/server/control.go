@@ -0,0 +1,144 @@
+package server
+
+import (
+	"context"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/yamux"
+
+	"github.com/jtolio/netpump-go/private/protocol"
+)
+
+// relayedStream is a stream being relayed, as the control stream sees it.
+type relayedStream struct {
+	last   atomic.Int64 // UnixNano of the last data relayed either way
+	cancel context.CancelFunc
+	target string
+	meter  crawlMeter
+}
+
+// touchWriter notes the time of every write in last.
+type touchWriter struct {
+	w    io.Writer
+	last *atomic.Int64
+}
+
+func (t touchWriter) Write(p []byte) (int, error) {
+	t.last.Store(time.Now().UnixNano())
+	return t.w.Write(p)
+}
+
+// addStream registers a stream being relayed, returning a function that
+// unregisters it.
+func (c *clientSession) addStream(id uint32, rs *relayedStream) func() {
+	rs.last.Store(time.Now().UnixNano())
+	c.mu.Lock()
+	c.streams[id] = rs
+	c.mu.Unlock()
+	return func() {
+		c.mu.Lock()
+		delete(c.streams, id)
+		c.mu.Unlock()
+	}
+}
+
+// idleStreams lists the streams nothing was relayed on for idle.
+func (c *clientSession) idleStreams(idle time.Duration) []uint32 {
+	cutoff := time.Now().Add(-idle).UnixNano()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var ids []uint32
+	for id, rs := range c.streams {
+		if rs.last.Load() <= cutoff && len(ids) < protocol.MaxControlIDs {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// handleControl serves the session's control stream, asking the client
+// every s.idleProbe about streams idle for that long and closing those it
+// no longer has open.
+func (s *Server) handleControl(sess *clientSession, stream *yamux.Stream) {
+	sess.mu.Lock()
+	dup := sess.hasControl
+	sess.hasControl = true
+	sess.mu.Unlock()
+	if s.idleProbe <= 0 || dup {
+		protocol.WriteFailure(stream, protocol.StatusFailed)
+		return
+	}
+	if err := protocol.WriteSuccess(stream); err != nil {
+		return
+	}
+
+	ticker := time.NewTicker(s.idleProbe)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-sess.done:
+			return
+		case <-s.drainCtx.Done():
+			return
+		}
+
+		ids := sess.idleStreams(s.idleProbe)
+		if len(ids) == 0 {
+			continue
+		}
+		if s.controlTimeout > 0 {
+			stream.SetDeadline(time.Now().Add(s.controlTimeout))
+		}
+		if err := protocol.WriteControl(stream, protocol.ControlProbe, ids); err != nil {
+			sess.log.Warn("control stream failed", "error", err)
+			return
+		}
+		typ, alive, err := protocol.ReadControl(stream)
+		if err != nil || typ != protocol.ControlAlive {
+			sess.log.Warn("control stream failed", "error", err, "type", typ)
+			return
+		}
+		stream.SetDeadline(time.Time{})
+
+		open := make(map[uint32]bool, len(alive))
+		for _, id := range alive {
+			open[id] = true
+		}
+		for _, id := range ids {
+			if open[id] {
+				continue
+			}
+			sess.mu.Lock()
+			rs := sess.streams[id]
+			sess.mu.Unlock()
+			if rs != nil {
+				sess.log.Info("closing idle stream the client no longer has", "stream", id)
+				rs.cancel()
+			}
+		}
+	}
+}
+
+// handleCapabilities tells the client the server's policy as it stands.
+func (s *Server) handleCapabilities(sess *clientSession, stream *yamux.Stream) {
+	caps := protocol.Capabilities{
+		RateLimit:     s.GlobalRateLimit(),
+		HostRateLimit: s.hostRateLimit(),
+		IdleProbe:     s.idleProbe,
+	}
+	if sess.tenant != nil {
+		caps.MaxStreams = int64(sess.tenant.MaxStreams)
+	}
+	if deny := s.deny.Load(); deny != nil {
+		caps.DenyTargets = deny.patterns
+	}
+	if s.controlTimeout > 0 {
+		stream.SetWriteDeadline(time.Now().Add(s.controlTimeout))
+	}
+	if err := protocol.WriteCapabilities(stream, caps); err != nil {
+		sess.log.Warn("failed to send capabilities", "error", err)
+	}
+}
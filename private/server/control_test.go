@@ -0,0 +1,102 @@
+package server
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/yamux"
+
+	"github.com/jtolio/netpump-go/private/protocol"
+)
+
+// TestIdleStreamReaped checks the server closes an idle stream the client
+// says it no longer has, and keeps the one it still has.
+func TestIdleStreamReaped(t *testing.T) {
+	const probe = 100 * time.Millisecond
+	// The target reports each of its connections closing.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	closed := make(chan string, 2)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				b := make([]byte, 4)
+				n, _ := io.ReadFull(conn, b)
+				io.Copy(io.Discard, conn)
+				conn.Close()
+				closed <- string(b[:n])
+			}()
+		}
+	}()
+	s, url := startServer(t, WithIdleStreamProbe(probe), WithEventLog(50))
+	session := dialSession(t, url)
+
+	control, resp := request(t, session, protocol.Request{Control: true})
+	if resp.Status != protocol.StatusOK {
+		t.Fatalf("control stream status %#x", resp.Status)
+	}
+	control.SetDeadline(time.Time{})
+	open := func(name string) *yamux.Stream {
+		conn, resp := request(t, session, protocol.Request{Addr: ln.Addr().String()})
+		if resp.Status != protocol.StatusOK {
+			t.Fatalf("status %#x", resp.Status)
+		}
+		if _, err := conn.Write([]byte(name)); err != nil {
+			t.Fatal(err)
+		}
+		return conn.(*yamux.Stream)
+	}
+	kept := open("kept")
+	open("lost")
+
+	// Answer probes as a client that only remembers kept.
+	go func() {
+		for {
+			typ, ids, err := protocol.ReadControl(control)
+			if err != nil || typ != protocol.ControlProbe {
+				return
+			}
+			var alive []uint32
+			for _, id := range ids {
+				if id == kept.StreamID() {
+					alive = append(alive, id)
+				}
+			}
+			if err := protocol.WriteControl(control, protocol.ControlAlive, alive); err != nil {
+				return
+			}
+		}
+	}()
+
+	select {
+	case name := <-closed:
+		if name != "lost" {
+			t.Fatalf("%s stream closed, want lost", name)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("idle stream the client lost wasn't closed")
+	}
+	select {
+	case name := <-closed:
+		t.Fatalf("%s stream closed too", name)
+	case <-time.After(5 * probe):
+	}
+	reaped := 0
+	for _, e := range s.events.Events() {
+		if e.Message == "closing idle stream the client no longer has" {
+			reaped++
+		}
+	}
+	if reaped != 1 {
+		t.Errorf("%d streams logged as reaped, want 1", reaped)
+	}
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// crawlMeter measures a stream's throughput for WithMinThroughput.
+type crawlMeter struct {
+	bytes atomic.Int64 // relayed either way
+	busy  atomic.Int32 // writes under way
+
+	// Used by the session's watcher alone.
+	sampled int64 // bytes at the last check
+	checked bool  // whether there was a check yet
+	flagged bool  // whether the stream was found crawling
+}
+
+// crawlWriter counts the bytes written through it, and the writes still
+// under way, in m.
+type crawlWriter struct {
+	w io.Writer
+	m *crawlMeter
+}
+
+func (c crawlWriter) Write(p []byte) (int, error) {
+	c.m.busy.Add(1)
+	n, err := c.w.Write(p)
+	c.m.bytes.Add(int64(n))
+	c.m.busy.Add(-1)
+	return n, err
+}
+
+// crawlingStream is a stream that was active over the last window but
+// relayed less than it should have.
+type crawlingStream struct {
+	id    uint32
+	rs    *relayedStream
+	bytes int64
+}
+
+// crawlingStreams returns the streams newly found crawling: that relayed
+// fewer than minBytes since the last call, yet weren't idle, as they
+// relayed something or had a write stalled.
+func (c *clientSession) crawlingStreams(minBytes int64) []crawlingStream {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var crawling []crawlingStream
+	for id, rs := range c.streams {
+		m := &rs.meter
+		bytes := m.bytes.Load()
+		delta := bytes - m.sampled
+		m.sampled = bytes
+		if !m.checked {
+			// Streams added since the last check haven't had a full
+			// window yet.
+			m.checked = true
+			continue
+		}
+		if m.flagged || delta >= minBytes || (delta == 0 && m.busy.Load() == 0) {
+			continue
+		}
+		m.flagged = true
+		crawling = append(crawling, crawlingStream{id: id, rs: rs, bytes: delta})
+	}
+	return crawling
+}
+
+// watchThroughput checks sess's streams every s.minWindow for ones that
+// crawl along, warning about them and closing them if asked to.
+func (s *Server) watchThroughput(sess *clientSession) {
+	defer s.wg.Done()
+	ticker := time.NewTicker(s.minWindow)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-sess.done:
+			return
+		}
+		for _, c := range sess.crawlingStreams(s.minBytes) {
+			sess.log.Warn("stream relayed too little for too long", "stream", c.id, "target", c.rs.target,
+				"bytes", c.bytes, "window", s.minWindow, "closing", s.minClose)
+			s.metrics.IncCounter(MetricCrawlingStreams, nil, 1)
+			if s.minClose {
+				c.rs.cancel()
+			}
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/jtolio/netpump-go/private/protocol"
+)
+
+// trickleTarget listens on loopback, sending a byte every interval to
+// whoever connects, and returns its address.
+func trickleTarget(t *testing.T, interval time.Duration) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				for {
+					if _, err := conn.Write([]byte("x")); err != nil {
+						return
+					}
+					time.Sleep(interval)
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestCrawlingStreamClosed(t *testing.T) {
+	const window = 300 * time.Millisecond
+	sink := newRecordingSink()
+	s, url := startServer(t, WithMinThroughput(100, window, true), WithMetricsSink(sink), WithEventLog(100))
+	session := dialSession(t, url)
+	crawling, resp := request(t, session, protocol.Request{Addr: trickleTarget(t, 20*time.Millisecond)})
+	if resp.Status != protocol.StatusOK {
+		t.Fatalf("status %#x", resp.Status)
+	}
+	idle, resp := request(t, session, protocol.Request{Addr: echoTarget(t)})
+	if resp.Status != protocol.StatusOK {
+		t.Fatalf("status %#x", resp.Status)
+	}
+
+	// The crawling stream is closed after its first full window, its
+	// second at the latest.
+	start := time.Now()
+	got, err := io.ReadAll(crawling)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < window || elapsed > 4*window {
+		t.Errorf("closed after %v with a %v window", elapsed, window)
+	}
+	if len(got) == 0 {
+		t.Error("nothing relayed before the stream was closed")
+	}
+	if n := sink.counter(MetricCrawlingStreams); n != 1 {
+		t.Errorf("%s = %v, want 1", MetricCrawlingStreams, n)
+	}
+	warned := false
+	for _, e := range s.events.Events() {
+		warned = warned || e.Message == "stream relayed too little for too long"
+	}
+	if !warned {
+		t.Error("crawling stream not logged")
+	}
+
+	// The idle one is left alone.
+	if _, err := idle.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(idle, make([]byte, 5)); err != nil {
+		t.Errorf("idle stream: %v", err)
+	}
+}
+
+// TestRequestByteAtATime checks a request trickled in a byte at a time is
+// answered if it's complete within the handshake timeout, and dropped if
+// not.
+func TestRequestByteAtATime(t *testing.T) {
+	const timeout = 500 * time.Millisecond
+	_, url := startServer(t, WithTimeouts(Timeouts{Handshake: timeout}))
+	session := dialSession(t, url)
+	var req bytes.Buffer
+	if err := protocol.WriteRequest(&req, protocol.Request{Addr: echoTarget(t)}); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		interval time.Duration
+		ok       bool
+	}{
+		{time.Millisecond, true},
+		{2 * timeout / time.Duration(req.Len()), false},
+	} {
+		stream, err := session.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer stream.Close()
+		stream.SetDeadline(time.Now().Add(5 * time.Second))
+		for _, b := range req.Bytes() {
+			if _, err := stream.Write([]byte{b}); err != nil {
+				break
+			}
+			time.Sleep(tc.interval)
+		}
+		resp, err := protocol.ReadResponse(stream)
+		if tc.ok && (err != nil || resp.Status != protocol.StatusOK) {
+			t.Errorf("a byte every %v: %v, status %#x", tc.interval, err, resp.Status)
+		}
+		if !tc.ok && err == nil {
+			t.Errorf("a byte every %v: answered with status %#x", tc.interval, resp.Status)
+		}
+	}
+}
+
+// TestStreamClosedMidRequest checks a stream that goes away partway
+// through its request no longer counts as pending.
+func TestStreamClosedMidRequest(t *testing.T) {
+	s, url := startServer(t, WithMaxPendingStreams(1), WithEventLog(100))
+	session := dialSession(t, url)
+	var req bytes.Buffer
+	target := echoTarget(t)
+	if err := protocol.WriteRequest(&req, protocol.Request{Addr: target}); err != nil {
+		t.Fatal(err)
+	}
+	stream, err := session.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stream.Write(req.Bytes()[:req.Len()/2]); err != nil {
+		t.Fatal(err)
+	}
+	stream.Close()
+
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		failed := false
+		for _, e := range s.events.Events() {
+			failed = failed || e.Message == "failed to read address"
+		}
+		if failed {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("half a request never failed")
+		}
+	}
+	if _, resp := request(t, session, protocol.Request{Addr: target}); resp.Status != protocol.StatusOK {
+		t.Errorf("next stream: status %#x", resp.Status)
+	}
+}
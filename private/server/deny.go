@@ -0,0 +1,145 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"syscall"
+)
+
+var errTargetDenied = errors.New("target denied by policy")
+
+// denyPolicy refuses targets by host name or address.
+type denyPolicy struct {
+	// names are host name patterns; entries starting with "*." match any
+	// subdomain.
+	names []string
+	nets  []*net.IPNet
+	// patterns are all of them, as given.
+	patterns []string
+}
+
+// parseDenyPolicy sorts patterns into IPs or CIDR ranges and host names.
+func parseDenyPolicy(patterns []string) *denyPolicy {
+	p := &denyPolicy{patterns: patterns}
+	for _, pat := range patterns {
+		if n := parseIPNet(pat); n != nil {
+			p.nets = append(p.nets, n)
+			continue
+		}
+		p.names = append(p.names, pat)
+	}
+	return p
+}
+
+// SetDenyTargets replaces the patterns of WithDenyTargets, or sets them
+// on a server started without any, as for a configuration reload. It
+// applies to connections from then on; open ones carry on. No patterns
+// lift the policy.
+func (s *Server) SetDenyTargets(patterns ...string) {
+	if len(patterns) == 0 {
+		s.deny.Store(nil)
+	} else {
+		s.deny.Store(parseDenyPolicy(patterns))
+	}
+	s.log.Info("deny targets changed", "patterns", patterns)
+}
+
+// checkName refuses target if its host is a denied name or address.
+// Names that resolve to denied addresses are caught by checkDial.
+func (p *denyPolicy) checkName(target string) error {
+	host, _, err := net.SplitHostPort(target)
+	if err != nil {
+		return err
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if ip := canonicalIP(host); ip != nil {
+		return p.checkIP(ip)
+	}
+	for _, pat := range p.names {
+		if hostMatches(pat, host) {
+			return errTargetDenied
+		}
+	}
+	return nil
+}
+
+func (p *denyPolicy) checkIP(ip net.IP) error {
+	for _, n := range p.nets {
+		if n.Contains(ip) {
+			return errTargetDenied
+		}
+	}
+	return nil
+}
+
+// checkDial is a net.Dialer Control function refusing denied addresses
+// once names have been resolved, before anything is sent to them. The
+// address may carry a zone, even for an IPv4 address given in its mapped
+// form, so it's checked as canonicalIP has it.
+func (p *denyPolicy) checkDial(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := canonicalIP(host); ip != nil {
+		return p.checkIP(ip)
+	}
+	return nil
+}
+
+// resolveChecked resolves target's host for a dial through the upstreams,
+// returning target with the host replaced by the first of its addresses
+// the deny policy allows. A SOCKS5 upstream would otherwise resolve the
+// name itself, out of sight of the policy's IPs and ranges. Without any of
+// those, or for a target given as an IP, target is returned as is.
+func (s *Server) resolveChecked(ctx context.Context, target string) (string, error) {
+	deny := s.deny.Load()
+	if deny == nil || len(deny.nets) == 0 {
+		return target, nil
+	}
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return "", err
+	}
+	if net.ParseIP(host) != nil {
+		return target, nil
+	}
+	var addrs []net.IPAddr
+	if s.lookups != nil {
+		addrs, err = s.lookups.lookup(ctx, host)
+	} else {
+		addrs, err = net.DefaultResolver.LookupIPAddr(ctx, host)
+	}
+	if err != nil {
+		return "", err
+	}
+	for _, addr := range addrs {
+		if deny.checkIP(canonicalIP(addr.String())) == nil {
+			return net.JoinHostPort(addr.String(), port), nil
+		}
+	}
+	if len(addrs) == 0 {
+		return "", &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return "", errTargetDenied
+}
+
+// targetControl returns the net.Dialer Control function for connections
+// to targets, applying the deny policy as it stands at each dial, and DSCP
+// marking as configured.
+func (s *Server) targetControl() func(network, address string, c syscall.RawConn) error {
+	dscp := s.dscpControl(s.dscp)
+	return func(network, address string, c syscall.RawConn) error {
+		if deny := s.deny.Load(); deny != nil {
+			if err := deny.checkDial(network, address, c); err != nil {
+				return err
+			}
+		}
+		if dscp != nil {
+			return dscp(network, address, c)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,139 @@
+package server
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/armon/go-socks5"
+
+	"github.com/jtolio/netpump-go/private/protocol"
+)
+
+func TestDeniedTarget(t *testing.T) {
+	target := echoTarget(t)
+	_, port, _ := net.SplitHostPort(target)
+	_, url := startServer(t, WithDenyTargets("127.0.0.0/8", "*.blocked.example"))
+	session := dialSession(t, url)
+
+	for _, addr := range []string{
+		target,
+		net.JoinHostPort("localhost", port),
+		"www.blocked.example:443",
+	} {
+		_, resp := request(t, session, protocol.Request{Addr: addr})
+		if resp.Status != protocol.StatusDenied {
+			t.Errorf("%s: status = %#x, want %#x", addr, resp.Status, protocol.StatusDenied)
+		}
+	}
+}
+
+// TestDeniedMappedTarget checks an IPv4 address can't get past an IPv4
+// range by being written as an IPv4-mapped IPv6 address, nor an IPv4
+// address past a range of mapped ones.
+func TestDeniedMappedTarget(t *testing.T) {
+	target := echoTarget(t)
+	_, port, _ := net.SplitHostPort(target)
+	for _, tc := range []struct {
+		deny string
+		addr string
+		want byte
+	}{
+		{"127.0.0.0/8", net.JoinHostPort("::ffff:127.0.0.1", port), protocol.StatusDenied},
+		{"127.0.0.0/8", net.JoinHostPort("::ffff:7f00:1", port), protocol.StatusDenied},
+		{"127.0.0.0/8", net.JoinHostPort("0:0:0:0:0:ffff:127.0.0.1", port), protocol.StatusDenied},
+		{"127.0.0.0/8", net.JoinHostPort("::ffff:127.0.0.1%lo", port), protocol.StatusDenied},
+		{"127.0.0.1", net.JoinHostPort("::ffff:127.0.0.1", port), protocol.StatusDenied},
+		{"::ffff:127.0.0.0/104", target, protocol.StatusDenied},
+		{"10.0.0.0/8", net.JoinHostPort("::ffff:127.0.0.1", port), protocol.StatusOK},
+	} {
+		_, url := startServer(t, WithDenyTargets(tc.deny))
+		_, resp := request(t, dialSession(t, url), protocol.Request{Addr: tc.addr})
+		if resp.Status != tc.want {
+			t.Errorf("%s denied: %s: status = %#x, want %#x", tc.deny, tc.addr, resp.Status, tc.want)
+		}
+	}
+}
+
+// socksUpstream runs a SOCKS5 proxy for the test, recording the targets
+// it's asked for as given, and taking delay to allow each.
+type socksUpstream struct {
+	addr string
+
+	mu      sync.Mutex
+	targets []string
+	delay   time.Duration
+}
+
+func startSocksUpstream(t *testing.T) *socksUpstream {
+	t.Helper()
+	u := &socksUpstream{}
+	srv, err := socks5.New(&socks5.Config{Rules: u})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go srv.Serve(ln)
+	u.addr = ln.Addr().String()
+	return u
+}
+
+func (u *socksUpstream) Allow(ctx context.Context, req *socks5.Request) (context.Context, bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	target := req.DestAddr.FQDN
+	if target == "" {
+		target = req.DestAddr.IP.String()
+	}
+	u.targets = append(u.targets, target)
+	time.Sleep(u.delay)
+	return ctx, true
+}
+
+func (u *socksUpstream) seen() []string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return append([]string(nil), u.targets...)
+}
+
+func TestDeniedTargetThroughUpstream(t *testing.T) {
+	target := echoTarget(t)
+	_, port, _ := net.SplitHostPort(target)
+	up := startSocksUpstream(t)
+	// The upstream itself is on a denied address; that's not the target's.
+	_, url := startServer(t,
+		WithDenyTargets("127.0.0.0/8"),
+		WithUpstreams(Upstream{Name: "proxy", URL: "socks5://" + up.addr}))
+
+	_, resp := request(t, dialSession(t, url), protocol.Request{Addr: net.JoinHostPort("localhost", port)})
+	if resp.Status != protocol.StatusDenied {
+		t.Fatalf("status = %#x, want %#x", resp.Status, protocol.StatusDenied)
+	}
+	if seen := up.seen(); len(seen) != 0 {
+		t.Fatalf("upstream was asked for %v", seen)
+	}
+}
+
+func TestUpstreamGetsCheckedAddress(t *testing.T) {
+	target := echoTarget(t)
+	_, port, _ := net.SplitHostPort(target)
+	up := startSocksUpstream(t)
+	_, url := startServer(t,
+		WithDenyTargets("10.0.0.0/8"),
+		WithUpstreams(Upstream{Name: "proxy", URL: "socks5://" + up.addr}))
+
+	_, resp := request(t, dialSession(t, url), protocol.Request{Addr: net.JoinHostPort("localhost", port)})
+	if resp.Status != protocol.StatusOK {
+		t.Fatalf("status = %#x, want %#x", resp.Status, protocol.StatusOK)
+	}
+	seen := up.seen()
+	if len(seen) != 1 || net.ParseIP(seen[0]) == nil || !net.ParseIP(seen[0]).IsLoopback() {
+		t.Fatalf("upstream was asked for %v, want localhost's address", seen)
+	}
+}
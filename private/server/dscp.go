@@ -0,0 +1,43 @@
+package server
+
+import (
+	"net"
+	"syscall"
+)
+
+// dscpControl returns a net.Dialer Control function marking connections
+// with the DSCP value, or nil if dscp is negative. Failing to mark only
+// gets logged, once; the connection goes ahead unmarked.
+func (s *Server) dscpControl(dscp int) func(network, address string, c syscall.RawConn) error {
+	if dscp < 0 {
+		return nil
+	}
+	return func(network, address string, c syscall.RawConn) error {
+		if err := setDSCP(c, dscp); err != nil {
+			s.dscpFailed.Do(func() {
+				s.log.Warn("can't set DSCP, connections won't be marked", "error", err)
+			})
+		}
+		return nil
+	}
+}
+
+// markCarrier marks the websocket connection to the client with the
+// carrier DSCP value, if there is one.
+func (s *Server) markCarrier(conn net.Conn) {
+	if s.carrierDSCP < 0 {
+		return
+	}
+	if nc, ok := conn.(interface{ NetConn() net.Conn }); ok {
+		// TLS
+		conn = nc.NetConn()
+	}
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return
+	}
+	rc, err := sc.SyscallConn()
+	if err == nil {
+		s.dscpControl(s.carrierDSCP)("", "", rc)
+	}
+}
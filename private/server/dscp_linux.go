@@ -0,0 +1,21 @@
+package server
+
+import "syscall"
+
+// setDSCP marks the socket's packets with the DSCP value. The socket may
+// be IPv4 or IPv6, and IPv6 sockets may carry IPv4 traffic, so both
+// options are tried.
+func setDSCP(c syscall.RawConn, dscp int) error {
+	var v4err, v6err error
+	err := c.Control(func(fd uintptr) {
+		v4err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS, dscp<<2)
+		v6err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS, dscp<<2)
+	})
+	if err != nil {
+		return err
+	}
+	if v4err != nil && v6err != nil {
+		return v4err
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"net"
+	"syscall"
+	"testing"
+)
+
+// tos reads the traffic class conn's packets are marked with.
+func tos(t *testing.T, conn net.Conn, level, opt int) int {
+	t.Helper()
+	rc, err := conn.(syscall.Conn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v int
+	var serr error
+	if err := rc.Control(func(fd uintptr) {
+		v, serr = syscall.GetsockoptInt(int(fd), level, opt)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if serr != nil {
+		t.Fatal(serr)
+	}
+	return v
+}
+
+func TestDSCPTarget(t *testing.T) {
+	const dscp = 46 // expedited forwarding
+	for _, tc := range []struct {
+		name, network, addr string
+		level, opt          int
+	}{
+		{"ipv4", "tcp4", "127.0.0.1:0", syscall.IPPROTO_IP, syscall.IP_TOS},
+		{"ipv6", "tcp6", "[::1]:0", syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ln, err := net.Listen(tc.network, tc.addr)
+			if err != nil {
+				t.Skipf("no %s loopback: %v", tc.name, err)
+			}
+			defer ln.Close()
+			go func() {
+				for {
+					conn, err := ln.Accept()
+					if err != nil {
+						return
+					}
+					conn.Close()
+				}
+			}()
+
+			for _, opts := range [][]Option{nil, {WithDSCP(dscp)}} {
+				s, _ := startServer(t, opts...)
+				conn, _, err := s.dialTarget(ln.Addr().String())
+				if err != nil {
+					t.Fatal(err)
+				}
+				want := 0
+				if opts != nil {
+					want = dscp << 2
+				}
+				if got := tos(t, conn, tc.level, tc.opt); got != want {
+					t.Errorf("with %d options: traffic class %#x, want %#x", len(opts), got, want)
+				}
+				conn.Close()
+			}
+		})
+	}
+}
+
+func TestDSCPCarrier(t *testing.T) {
+	const dscp = 34
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	carrier, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer carrier.Close()
+
+	s, _ := startServer(t, WithCarrierDSCP(dscp))
+	s.markCarrier(carrier)
+	if got := tos(t, carrier, syscall.IPPROTO_IP, syscall.IP_TOS); got != dscp<<2 {
+		t.Errorf("carrier traffic class %#x, want %#x", got, dscp<<2)
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package server
+
+import (
+	"errors"
+	"syscall"
+)
+
+func setDSCP(c syscall.RawConn, dscp int) error {
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,159 @@
+package server
+
+import (
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/jtolio/netpump-go/private/wsconn"
+)
+
+// yamux doesn't expose its flow control state, so flowWriter estimates
+// why writes to a client stream block. A write waits either for the
+// stream's send window, or for the websocket carrying every stream to take
+// its frame. The window runs out both when the client isn't reading and
+// when the path to it is slow, since data buffered along the way (in the
+// relay, say) counts against the window too. The two are told apart by
+// the session's round trip time: a slow path queues pings behind data,
+// while a slow reader leaves it clear.
+const (
+	// linkLimitedBusy is the share of a blocked write the websocket has
+	// to be busy for the write to count as held up by the link.
+	linkLimitedBusy = 0.9
+	// flowRTTInterval is how often sessions' round trip times are
+	// measured while flow diagnostics are on.
+	flowRTTInterval = 2 * time.Second
+	// flowQueuedRTT is how far above its best the round trip time has to
+	// be, besides doubling, for data to count as queued along the path.
+	flowQueuedRTT = 20 * time.Millisecond
+	// flowBlockedMin is how long a write has to be blocked before the
+	// connection table reports it.
+	flowBlockedMin = 100 * time.Millisecond
+)
+
+// Reasons a write to a client stream was held up.
+const (
+	flowWindow = "window"
+	flowLink   = "link"
+)
+
+var (
+	windowLabels = map[string]string{"limit": flowWindow}
+	linkLabels   = map[string]string{"limit": flowLink}
+)
+
+// rttStats is a session's latest and best round trip times, in
+// nanoseconds, or 0 before the first measurement.
+type rttStats struct {
+	last    atomic.Int64
+	best    atomic.Int64
+	pending atomic.Int64 // UnixNano the ping under way was sent, or 0
+}
+
+func (r *rttStats) record(d time.Duration) {
+	r.last.Store(int64(d))
+	for {
+		best := r.best.Load()
+		if best != 0 && best <= int64(d) {
+			return
+		}
+		if r.best.CompareAndSwap(best, int64(d)) {
+			return
+		}
+	}
+}
+
+// queued reports whether the latest round trip time says data is queued
+// along the path to the client.
+func (r *rttStats) queued() bool {
+	last, best := time.Duration(r.last.Load()), time.Duration(r.best.Load())
+	// A ping that has been out longer than the last one took says more
+	// about the path now.
+	if sent := r.pending.Load(); sent != 0 {
+		last = max(last, time.Duration(time.Now().UnixNano()-sent))
+	}
+	return best > 0 && last > 2*best && last-best > flowQueuedRTT
+}
+
+// probeRTT measures sess's round trip time until it closes.
+func (s *Server) probeRTT(sess *clientSession) {
+	defer s.wg.Done()
+	ticker := time.NewTicker(flowRTTInterval)
+	defer ticker.Stop()
+	for {
+		sess.rtt.pending.Store(time.Now().UnixNano())
+		rtt, err := sess.session.Ping()
+		sess.rtt.pending.Store(0)
+		if err == nil {
+			sess.rtt.record(rtt)
+		}
+		select {
+		case <-ticker.C:
+		case <-sess.done:
+			return
+		}
+	}
+}
+
+// flowDiagnostics reports whether anything looks at flow diagnostics.
+func (s *Server) flowDiagnostics() bool {
+	_, nop := s.metrics.(nopSink)
+	return !nop || s.conntrack != nil
+}
+
+// flowState is where a stream's writes to the client have been held up.
+type flowState struct {
+	blockedSince atomic.Int64 // UnixNano of the write under way, or 0
+	busyAtStart  atomic.Int64 // the carrier's Busy when it started
+	window       atomic.Int64 // nanoseconds blocked on the window
+	link         atomic.Int64 // nanoseconds blocked on the link
+}
+
+// flowWriter writes to a client stream, attributing the time each write
+// takes to the window or the link.
+type flowWriter struct {
+	w       io.Writer
+	carrier *wsconn.Conn
+	rtt     *rttStats
+	state   *flowState
+	sink    MetricsSink
+}
+
+func (f flowWriter) Write(p []byte) (int, error) {
+	start := time.Now()
+	busy := f.carrier.Busy()
+	f.state.busyAtStart.Store(int64(busy))
+	f.state.blockedSince.Store(start.UnixNano())
+	n, err := f.w.Write(p)
+	f.state.blockedSince.Store(0)
+
+	elapsed := time.Since(start)
+	if classifyFlow(elapsed, f.carrier.Busy()-busy, f.rtt) == flowLink {
+		f.state.link.Add(int64(elapsed))
+		f.sink.IncCounter(MetricStreamBlocked, linkLabels, elapsed.Seconds())
+	} else {
+		f.state.window.Add(int64(elapsed))
+		f.sink.IncCounter(MetricStreamBlocked, windowLabels, elapsed.Seconds())
+	}
+	return n, err
+}
+
+// classifyFlow says what held up a write that took elapsed, during which
+// the carrier was busy for busy.
+func classifyFlow(elapsed, busy time.Duration, rtt *rttStats) string {
+	if elapsed <= 0 || float64(busy) >= linkLimitedBusy*float64(elapsed) || rtt.queued() {
+		return flowLink
+	}
+	return flowWindow
+}
+
+// blocked returns how long the write under way has been going and what
+// it's waiting on, or "" if there's no write under way.
+func (f *flowState) blocked(carrier *wsconn.Conn, rtt *rttStats) (string, time.Duration) {
+	since := f.blockedSince.Load()
+	if since == 0 {
+		return "", 0
+	}
+	elapsed := time.Duration(time.Now().UnixNano() - since)
+	return classifyFlow(elapsed, carrier.Busy()-time.Duration(f.busyAtStart.Load()), rtt), elapsed
+}
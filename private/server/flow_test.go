@@ -0,0 +1,54 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/jtolio/netpump-go/private/protocol"
+)
+
+func TestWindowLimited(t *testing.T) {
+	sink := newRecordingSink()
+	_, url := startServer(t, WithAdminToken("admin-secret"), WithMetricsSink(sink))
+	stream, resp := request(t, dialSession(t, url), protocol.Request{Addr: sourceTarget(t)})
+	if resp.Status != protocol.StatusOK {
+		t.Fatalf("status %#x", resp.Status)
+	}
+
+	// The client reads nothing, so the server's writes soon wait on the
+	// stream's window while the websocket sits idle.
+	var c ConnInfo
+	for deadline := time.Now().Add(5 * time.Second); c.Blocked == ""; time.Sleep(20 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("never blocked: %+v", c)
+		}
+		_, body := adminGet(t, url, "/conns", "admin-secret")
+		var conns []ConnInfo
+		if err := json.Unmarshal([]byte(body), &conns); err != nil {
+			t.Fatalf("%v in %s", err, body)
+		}
+		if len(conns) != 1 {
+			t.Fatalf("%d connections, want 1: %s", len(conns), body)
+		}
+		c = conns[0]
+	}
+	if c.Blocked != flowWindow || c.WindowWait < flowBlockedMin.Seconds() || c.LinkWait >= c.WindowWait {
+		t.Errorf("blocked %q, window wait %v, link wait %v", c.Blocked, c.WindowWait, c.LinkWait)
+	}
+
+	// Reading lets the blocked write finish and count.
+	if _, err := io.ReadFull(stream, make([]byte, 512*1024)); err != nil {
+		t.Fatal(err)
+	}
+	window := metricKey(MetricStreamBlocked, windowLabels)
+	for deadline := time.Now().Add(5 * time.Second); sink.counter(window) < flowBlockedMin.Seconds(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%s = %v", window, sink.counter(window))
+		}
+	}
+	if link := sink.counter(metricKey(MetricStreamBlocked, linkLabels)); link >= sink.counter(window) {
+		t.Errorf("link-limited for %vs, window-limited for %vs", link, sink.counter(window))
+	}
+}
@@ -0,0 +1,115 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/yamux"
+)
+
+// deepHealthTTL is how long a deep health check result is reused, so load
+// balancers polling often don't turn the check itself into load.
+const deepHealthTTL = 5 * time.Second
+
+// deepHealth caches the last deep health check.
+type deepHealth struct {
+	mu      sync.Mutex
+	checked time.Time
+	err     error
+}
+
+// handleDeepHealth reports whether the server can actually tunnel: a
+// stream round trip over an in-memory yamux session and, if configured, a
+// dial to the canary target. It answers 503 when either fails.
+func (s *Server) handleDeepHealth(w http.ResponseWriter, r *http.Request) {
+	s.health.mu.Lock()
+	if time.Since(s.health.checked) > deepHealthTTL {
+		s.health.err = s.checkHealth()
+		s.health.checked = time.Now()
+	}
+	err := s.health.err
+	s.health.mu.Unlock()
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set(instanceHeader, s.instanceID)
+	if err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "unhealthy: %v\n", err)
+		return
+	}
+	fmt.Fprintf(w, "ok\n")
+}
+
+func (s *Server) checkHealth() error {
+	if err := loopbackStream(); err != nil {
+		return fmt.Errorf("mux: %w", err)
+	}
+	if s.healthCanary != "" {
+		// Dial only; the canary never sees any data, and tenants, labels
+		// and rate limits aren't involved.
+		conn, _, err := s.dialTarget(s.healthCanary)
+		if err != nil {
+			return fmt.Errorf("canary: %w", err)
+		}
+		conn.Close()
+	}
+	return nil
+}
+
+// loopbackStream opens a stream on an in-memory yamux session and echoes
+// a byte over it.
+func loopbackStream() error {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	a.SetDeadline(deadline)
+	b.SetDeadline(deadline)
+
+	conf := yamux.DefaultConfig()
+	conf.EnableKeepAlive = false
+	conf.LogOutput = io.Discard
+	client, err := yamux.Client(a, conf)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	server, err := yamux.Server(b, conf)
+	if err != nil {
+		return err
+	}
+	defer server.Close()
+
+	go func() {
+		stream, err := server.AcceptStream()
+		if err != nil {
+			return
+		}
+		defer stream.Close()
+		io.Copy(stream, stream)
+	}()
+
+	stream, err := client.OpenStream()
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+	stream.SetDeadline(deadline)
+	if _, err := stream.Write([]byte{1}); err != nil {
+		return err
+	}
+	var buf [1]byte
+	if _, err := io.ReadFull(stream, buf[:]); err != nil {
+		return err
+	}
+	if buf[0] != 1 {
+		return errors.New("echo mismatch")
+	}
+	return nil
+}
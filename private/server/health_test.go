@@ -0,0 +1,94 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestDeepHealth(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		canary string
+		want   int
+		body   string
+	}{
+		{"no canary", "", http.StatusOK, "ok\n"},
+		{"egress works", echoTarget(t), http.StatusOK, "ok\n"},
+		{"egress broken", closedAddr(t), http.StatusServiceUnavailable, "unhealthy: canary: "},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var opts []Option
+			if tc.canary != "" {
+				opts = append(opts, WithHealthCanary(tc.canary))
+			}
+			s, url := startServer(t, opts...)
+			resp, err := http.Get(httpURL(url, "/health/deep"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			if resp.StatusCode != tc.want || !strings.HasPrefix(string(body), tc.body) {
+				t.Errorf("got %d %q, want %d %q", resp.StatusCode, body, tc.want, tc.body)
+			}
+			if id := resp.Header.Get(instanceHeader); id != s.instanceID {
+				t.Errorf("instance header %q, want %q", id, s.instanceID)
+			}
+		})
+	}
+}
+
+func TestInstanceID(t *testing.T) {
+	s, url := startServer(t, WithInstanceID("east-1"), WithEventLog(50))
+	resp, err := http.Get(httpURL(url, "/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(body), "instance east-1\n") || resp.Header.Get(instanceHeader) != "east-1" {
+		t.Errorf("health answered %q with instance header %q", body, resp.Header.Get(instanceHeader))
+	}
+
+	ws, resp, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws.Close()
+	if id := resp.Header.Get(instanceHeader); id != "east-1" {
+		t.Errorf("upgrade instance header %q, want east-1", id)
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		events := s.events.Events()
+		found, tagged := false, true
+		for _, e := range events {
+			if e.Message == "client connected" {
+				found = true
+			}
+			if e.Attrs["instance"] != "east-1" {
+				tagged = false
+			}
+		}
+		if !tagged {
+			t.Fatalf("log lines without the instance: %+v", events)
+		}
+		if found {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("client connection not logged")
+		}
+	}
+
+	// Without one, each server picks its own, and keeps it.
+	a, _ := startServer(t)
+	b, _ := startServer(t)
+	if a.instanceID == "" || a.instanceID == b.instanceID {
+		t.Errorf("generated instance IDs %q and %q", a.instanceID, b.instanceID)
+	}
+}
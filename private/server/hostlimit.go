@@ -0,0 +1,113 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// hostLimitIdle is how long a host's limiter outlives its last stream, so
+// that a run of short connections to it shares one bucket.
+const hostLimitIdle = time.Minute
+
+// hostLimits keeps a rate limiter for each target host with streams open
+// to it, for WithPerHostRateLimit.
+type hostLimits struct {
+	mu        sync.Mutex
+	rate      int64 // bytes per second for each host
+	hosts     map[string]*hostLimit
+	lastSweep time.Time
+}
+
+type hostLimit struct {
+	l       *rateLimiter
+	streams int
+	idle    time.Time // when streams last went to 0
+}
+
+// hostRateLimit returns the per-host rate limit, 0 for none.
+func (s *Server) hostRateLimit() int64 {
+	if s.hostLimits == nil {
+		return 0
+	}
+	s.hostLimits.mu.Lock()
+	defer s.hostLimits.mu.Unlock()
+	return s.hostLimits.rate
+}
+
+// SetPerHostRateLimit changes the cap of WithPerHostRateLimit to
+// bytesPerSecond, 0 for none. Open connections keep going and are held to
+// the new rate from their next write. It only works on servers started
+// with a per-host limit.
+func (s *Server) SetPerHostRateLimit(bytesPerSecond int64) error {
+	if s.hostLimits == nil {
+		return errors.New("per-host rate limiting isn't enabled on this server")
+	}
+	if bytesPerSecond < 0 {
+		return errors.New("rate limit can't be negative")
+	}
+	h := s.hostLimits
+	h.mu.Lock()
+	old := h.rate
+	h.rate = bytesPerSecond
+	for _, hl := range h.hosts {
+		hl.l.set(bytesPerSecond)
+	}
+	h.mu.Unlock()
+	if old != bytesPerSecond {
+		s.log.Info("per-host rate limit changed", "from", old, "to", bytesPerSecond)
+	}
+	return nil
+}
+
+// acquire returns the limiter for target's host, and a function to call
+// once the stream to it is done.
+func (h *hostLimits) acquire(target string) (*rateLimiter, func()) {
+	host := targetHost(target)
+	now := time.Now()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if now.Sub(h.lastSweep) > hostLimitIdle {
+		h.sweep(now)
+	}
+	hl := h.hosts[host]
+	if hl == nil {
+		if h.hosts == nil {
+			h.hosts = make(map[string]*hostLimit)
+		}
+		hl = &hostLimit{l: newRateLimiter(h.rate)}
+		h.hosts[host] = hl
+	}
+	hl.streams++
+	return hl.l, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		hl.streams--
+		if hl.streams == 0 {
+			hl.idle = time.Now()
+		}
+	}
+}
+
+// sweep forgets the hosts that have had no streams for hostLimitIdle. The
+// caller must hold mu.
+func (h *hostLimits) sweep(now time.Time) {
+	for host, hl := range h.hosts {
+		if hl.streams == 0 && now.Sub(hl.idle) > hostLimitIdle {
+			delete(h.hosts, host)
+		}
+	}
+	h.lastSweep = now
+}
+
+// targetHost is the lower case host of a host:port target, as the client
+// named it.
+func targetHost(target string) string {
+	host, _, err := net.SplitHostPort(target)
+	if err != nil {
+		host = target
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
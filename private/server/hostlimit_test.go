@@ -0,0 +1,64 @@
+package server
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jtolio/netpump-go/private/protocol"
+)
+
+// TestPerHostRateLimit checks the streams to one host share its cap, while
+// a stream to another host has a cap of its own.
+func TestPerHostRateLimit(t *testing.T) {
+	const (
+		rate   = 256 * 1024
+		period = time.Second
+	)
+	_, url := startServer(t, WithPerHostRateLimit(rate))
+	target := sourceTarget(t)
+	_, port, _ := net.SplitHostPort(target)
+	session := dialSession(t, url)
+
+	// The same listener, named two ways, is two hosts to the limit.
+	targets := []string{target, target, net.JoinHostPort("localhost", port)}
+	got := make([]int64, len(targets))
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i, addr := range targets {
+		stream, resp := request(t, session, protocol.Request{Addr: addr})
+		if resp.Status != protocol.StatusOK {
+			t.Fatalf("%s: status %#x, want OK", addr, resp.Status)
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			stream.SetReadDeadline(start.Add(period))
+			buf := make([]byte, 32*1024)
+			for {
+				n, err := stream.Read(buf)
+				got[i] += int64(n)
+				if err != nil {
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	// Each host's bucket starts full, and each stream may have a chunk in
+	// flight.
+	limit := func(streams int) int64 { return int64(rate*elapsed.Seconds()) + rate/10 + int64(streams)*rateChunk }
+	if shared := got[0] + got[1]; shared > limit(2) {
+		t.Errorf("two streams to %s relayed %d bytes in %v, over the cap of %d", target, shared, elapsed, limit(2))
+	} else if got[0] == 0 || got[1] == 0 {
+		t.Errorf("a stream to %s starved: %d and %d bytes", target, got[0], got[1])
+	}
+	if other := got[2]; other > limit(1) {
+		t.Errorf("stream to %s relayed %d bytes in %v, over the cap of %d", targets[2], other, elapsed, limit(1))
+	} else if other < rate/2 {
+		t.Errorf("stream to %s relayed only %d bytes in %v, held back by the other host's cap", targets[2], other, elapsed)
+	}
+}
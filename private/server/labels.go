@@ -0,0 +1,73 @@
+package server
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// LabelStats is the traffic of connections the client tagged with a label.
+type LabelStats struct {
+	// Streams counts the connections made so far.
+	Streams int64 `json:"streams"`
+	// Sent and Received are bytes to and from targets.
+	Sent     int64 `json:"sent"`
+	Received int64 `json:"received"`
+}
+
+type labelCounter struct {
+	streams  atomic.Int64
+	sent     atomic.Int64 // to the target
+	received atomic.Int64 // from the target
+}
+
+// labels accounts traffic per connection label.
+type labels struct {
+	mu       sync.Mutex
+	counters map[string]*labelCounter
+}
+
+func (l *labels) counter(label string) *labelCounter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.counters == nil {
+		l.counters = make(map[string]*labelCounter)
+	}
+	c, ok := l.counters[label]
+	if !ok {
+		c = &labelCounter{}
+		l.counters[label] = c
+	}
+	return c
+}
+
+func (l *labels) stats() map[string]LabelStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	stats := make(map[string]LabelStats, len(l.counters))
+	for label, c := range l.counters {
+		stats[label] = LabelStats{
+			Streams:  c.streams.Load(),
+			Sent:     c.sent.Load(),
+			Received: c.received.Load(),
+		}
+	}
+	return stats
+}
+
+// LabelStats returns the traffic of labeled connections so far, by label.
+func (s *Server) LabelStats() map[string]LabelStats {
+	return s.labels.stats()
+}
+
+// countingWriter adds the bytes written through it to n.
+type countingWriter struct {
+	w io.Writer
+	n *atomic.Int64
+}
+
+func (c countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n.Add(int64(n))
+	return n, err
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"runtime"
+	rtmetrics "runtime/metrics"
+	"sync/atomic"
+	"time"
+)
+
+// LoadLimits are the thresholds WithLoadShedding sheds load above. Zero
+// fields aren't checked.
+type LoadLimits struct {
+	// Streams caps the streams being relayed.
+	Streams int64 `json:"streams,omitempty"`
+	// Goroutines caps the goroutines in the process.
+	Goroutines int `json:"goroutines,omitempty"`
+	// HeapBytes caps the memory taken by live and not yet collected heap
+	// objects.
+	HeapBytes uint64 `json:"heap_bytes,omitempty"`
+}
+
+// loadSampleInterval is how often goroutines and the heap are sampled.
+const loadSampleInterval = time.Second
+
+// loadRecovery is the fraction of a threshold load has to go back under
+// for shedding to stop, so it doesn't flap around the threshold.
+const loadRecovery = 0.9
+
+// loadShedder tracks whether the server is over its LoadLimits.
+type loadShedder struct {
+	limits LoadLimits
+	// over names the sampled metric that's over its threshold, or is "".
+	over atomic.Pointer[string]
+}
+
+// overloaded reports which metric the server is over its threshold on,
+// if any, checking the streams being relayed as of now and the rest as
+// last sampled.
+func (s *Server) overloaded() (string, bool) {
+	if s.load == nil {
+		return "", false
+	}
+	if max := s.load.limits.Streams; max > 0 && s.activeStreams.Load() >= max {
+		return "streams", true
+	}
+	if over := s.load.over.Load(); over != nil && *over != "" {
+		return *over, true
+	}
+	return "", false
+}
+
+// watchLoad samples the goroutines and heap until the server stops,
+// logging when shedding starts and stops.
+func (s *Server) watchLoad() {
+	defer s.wg.Done()
+	heap := []rtmetrics.Sample{{Name: "/memory/classes/heap/objects:bytes"}}
+	ticker := time.NewTicker(loadSampleInterval)
+	defer ticker.Stop()
+	var over string
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.ctx.Done():
+			return
+		}
+		goroutines := runtime.NumGoroutine()
+		rtmetrics.Read(heap)
+		heapBytes := heap[0].Value.Uint64()
+
+		// Over a threshold sheds; shedding only stops under all of them,
+		// less some headroom.
+		limits, was := s.load.limits, over
+		scale := 1.0
+		if was != "" {
+			scale = loadRecovery
+		}
+		over = ""
+		switch {
+		case limits.Goroutines > 0 && float64(goroutines) >= scale*float64(limits.Goroutines):
+			over = "goroutines"
+		case limits.HeapBytes > 0 && float64(heapBytes) >= scale*float64(limits.HeapBytes):
+			over = "heap"
+		}
+		if over == was {
+			continue
+		}
+		s.load.over.Store(&over)
+		if over != "" {
+			s.log.Warn("server overloaded, refusing new sessions and streams", "metric", over,
+				"goroutines", goroutines, "heap_bytes", heapBytes)
+		} else {
+			s.log.Info("server load back to normal, accepting new sessions and streams",
+				"goroutines", goroutines, "heap_bytes", heapBytes)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/jtolio/netpump-go/private/protocol"
+)
+
+// TestLoadSheddingStreams checks a server at its stream threshold refuses
+// new sessions and streams, and takes them again once streams end.
+func TestLoadSheddingStreams(t *testing.T) {
+	const limit = 2
+	s, url := startServer(t, WithLoadShedding(LoadLimits{Streams: limit}), WithEventLog(100))
+	target, release := holdTarget(t)
+	session := dialSession(t, url)
+	var streams []net.Conn
+	for i := 0; i < limit; i++ {
+		stream, resp := request(t, session, protocol.Request{Addr: target})
+		if resp.Status != protocol.StatusOK {
+			t.Fatalf("stream %d: status %#x", i, resp.Status)
+		}
+		streams = append(streams, stream)
+	}
+
+	if _, resp := request(t, session, protocol.Request{Addr: target}); resp.Status != protocol.StatusFailed {
+		t.Errorf("stream over the threshold: status %#x, want %#x", resp.Status, protocol.StatusFailed)
+	}
+	if code := upgradeStatus(t, url, nil); code != http.StatusServiceUnavailable {
+		t.Errorf("session over the threshold: status %d, want %d", code, http.StatusServiceUnavailable)
+	}
+	shed := 0
+	for _, e := range s.events.Events() {
+		if e.Message == "server is overloaded, rejecting stream" || e.Message == "rejected client, server is overloaded" {
+			shed++
+			if e.Attrs["metric"] != "streams" {
+				t.Errorf("%q for metric %q", e.Message, e.Attrs["metric"])
+			}
+		}
+	}
+	if shed != 2 {
+		t.Errorf("%d refusals logged, want 2", shed)
+	}
+
+	// Once the streams end, there's room again.
+	for _, stream := range streams {
+		stream.Close()
+	}
+	release()
+	for deadline := time.Now().Add(5 * time.Second); s.activeStreams.Load() >= limit; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d streams still active", s.activeStreams.Load())
+		}
+	}
+	if _, resp := request(t, session, protocol.Request{Addr: target}); resp.Status != protocol.StatusOK {
+		t.Errorf("stream after recovery: status %#x", resp.Status)
+	}
+	if code := upgradeStatus(t, url, nil); code != http.StatusSwitchingProtocols {
+		t.Errorf("session after recovery: status %d", code)
+	}
+}
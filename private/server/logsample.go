@@ -0,0 +1,17 @@
+package server
+
+import "sync/atomic"
+
+// logSampler picks which of many similar events get logged: one in every
+// n, starting with the first. A nil or zero sampler picks them all.
+type logSampler struct {
+	n     uint64
+	count atomic.Uint64
+}
+
+func (s *logSampler) sample() bool {
+	if s == nil || s.n <= 1 {
+		return true
+	}
+	return (s.count.Add(1)-1)%s.n == 0
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jtolio/netpump-go/private/protocol"
+)
+
+func TestLogSampler(t *testing.T) {
+	var picked []int
+	s := &logSampler{n: 3}
+	for i := 0; i < 9; i++ {
+		if s.sample() {
+			picked = append(picked, i)
+		}
+	}
+	if len(picked) != 3 || picked[0] != 0 || picked[1] != 3 || picked[2] != 6 {
+		t.Errorf("picked %v, want [0 3 6]", picked)
+	}
+	var none *logSampler
+	if !none.sample() || !(&logSampler{}).sample() {
+		t.Error("unset sampler skipped a record")
+	}
+}
+
+// TestLogSampling checks only one in n streams logs its progress, while
+// every failure is logged.
+func TestLogSampling(t *testing.T) {
+	s, url := startServer(t, WithLogSampling(3), WithEventLog(100))
+	target := echoTarget(t)
+	refused := closedAddr(t)
+	session := dialSession(t, url)
+
+	for i := 0; i < 6; i++ {
+		conn, resp := request(t, session, protocol.Request{Addr: target})
+		if resp.Status != protocol.StatusOK {
+			t.Fatalf("stream %d: status %#x", i, resp.Status)
+		}
+		conn.Close()
+	}
+	for i := 0; i < 2; i++ {
+		conn, resp := request(t, session, protocol.Request{Addr: refused})
+		conn.Close()
+		if resp.Status == protocol.StatusOK {
+			t.Fatalf("stream to %s succeeded", refused)
+		}
+	}
+
+	count := func(msg string) int {
+		n := 0
+		for _, e := range s.events.Events() {
+			if e.Message == msg {
+				n++
+			}
+		}
+		return n
+	}
+	if got := count("proxying"); got != 2 {
+		t.Errorf("%d proxying lines for 6 streams, want 2", got)
+	}
+	if got := count("connection failed"); got != 2 {
+		t.Errorf("%d failures logged, want 2", got)
+	}
+
+	// The sampled streams log their close too.
+	for deadline := time.Now().Add(5 * time.Second); count("connection closed") < 2; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d close lines, want 2", count("connection closed"))
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	if got := count("connection closed"); got != 2 {
+		t.Errorf("%d close lines for 6 streams, want 2", got)
+	}
+}
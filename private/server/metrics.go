@@ -0,0 +1,274 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jtolio/netpump-go/private/protocol"
+)
+
+// MetricsSink receives the server's instrumentation. Implementations must
+// be safe for concurrent use. labels may be nil.
+type MetricsSink interface {
+	IncCounter(name string, labels map[string]string, delta float64)
+	SetGauge(name string, labels map[string]string, value float64)
+	ObserveHistogram(name string, labels map[string]string, value float64)
+}
+
+// Metrics the server reports.
+const (
+	// MetricStreams counts streams that asked for a target.
+	MetricStreams = "netpump_streams_total"
+	// MetricActiveStreams is the number of streams being relayed.
+	MetricActiveStreams = "netpump_streams_active"
+	// MetricDialFailures counts failed target dials by reason: unresolved,
+	// refused, timeout, denied or failed.
+	MetricDialFailures = "netpump_dial_failures_total"
+	// MetricDialSeconds is how long target dials took.
+	MetricDialSeconds = "netpump_dial_duration_seconds"
+	// MetricBytes counts relayed bytes by direction: sent to targets or
+	// received from them.
+	MetricBytes = "netpump_bytes_total"
+	// MetricWriteWait is how long each write to a client stream took,
+	// including time queued behind other streams' frames on the shared
+	// websocket. A long tail means streams are blocking each other.
+	MetricWriteWait = "netpump_stream_write_seconds"
+	// MetricStreamBlocked counts seconds writes to client streams spent
+	// held up, by limit: window when clients weren't reading fast enough,
+	// link when the websocket couldn't carry more. The split is estimated.
+	MetricStreamBlocked = "netpump_stream_blocked_seconds_total"
+	// MetricCopyBuffers is the number of relay copy buffers by state: in
+	// use, or pooled for reuse. Each is 32 KiB.
+	MetricCopyBuffers = "netpump_copy_buffers"
+	// MetricTargetLimitExceeded counts the times a session went over the
+	// distinct target limit.
+	MetricTargetLimitExceeded = "netpump_target_limit_exceeded_total"
+	// MetricCrawlingStreams counts streams found relaying less than the
+	// minimum throughput.
+	MetricCrawlingStreams = "netpump_crawling_streams_total"
+	// MetricStreamQueueDepth is the number of streams queued for a slot
+	// under the server's stream limit.
+	MetricStreamQueueDepth = "netpump_stream_queue_depth"
+	// MetricStreamQueueSeconds is how long queued streams waited for a
+	// slot, whether they got one or gave up.
+	MetricStreamQueueSeconds = "netpump_stream_queue_seconds"
+	// MetricDNSLookups counts target lookups under WithDNSCoalescing, by
+	// whether they shared one already in flight.
+	MetricDNSLookups = "netpump_dns_lookups_total"
+)
+
+type nopSink struct{}
+
+func (nopSink) IncCounter(string, map[string]string, float64)       {}
+func (nopSink) SetGauge(string, map[string]string, float64)         {}
+func (nopSink) ObserveHistogram(string, map[string]string, float64) {}
+
+// metricsWriter counts the bytes written through it.
+type metricsWriter struct {
+	w      io.Writer
+	sink   MetricsSink
+	labels map[string]string
+}
+
+func (m metricsWriter) Write(p []byte) (int, error) {
+	n, err := m.w.Write(p)
+	if n > 0 {
+		m.sink.IncCounter(MetricBytes, m.labels, float64(n))
+	}
+	return n, err
+}
+
+// waitWriter observes how long each write takes.
+type waitWriter struct {
+	w    io.Writer
+	sink MetricsSink
+}
+
+func (m waitWriter) Write(p []byte) (int, error) {
+	start := time.Now()
+	n, err := m.w.Write(p)
+	m.sink.ObserveHistogram(MetricWriteWait, nil, time.Since(start).Seconds())
+	return n, err
+}
+
+var (
+	sentLabels     = map[string]string{"direction": "sent"}
+	receivedLabels = map[string]string{"direction": "received"}
+)
+
+// failureLabels labels MetricDialFailures for a failure status.
+func failureLabels(status byte) map[string]string {
+	reason := "failed"
+	switch status {
+	case protocol.StatusUnresolved:
+		reason = "unresolved"
+	case protocol.StatusRefused:
+		reason = "refused"
+	case protocol.StatusTimeout:
+		reason = "timeout"
+	case protocol.StatusDenied:
+		reason = "denied"
+	}
+	return map[string]string{"reason": reason}
+}
+
+// promBuckets are the upper bounds of PrometheusSink's histogram buckets.
+var promBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// PrometheusSink keeps metrics in memory and serves them in the Prometheus
+// or OpenMetrics text format. The server serves it on /metrics.
+type PrometheusSink struct {
+	mu      sync.Mutex
+	metrics map[string]*promMetric
+}
+
+type promMetric struct {
+	kind   string
+	series map[string]*promSeries
+}
+
+type promSeries struct {
+	value   float64
+	buckets []uint64
+	count   uint64
+}
+
+// NewPrometheusSink returns an empty PrometheusSink.
+func NewPrometheusSink() *PrometheusSink {
+	return &PrometheusSink{metrics: make(map[string]*promMetric)}
+}
+
+func (p *PrometheusSink) series(kind, name string, labels map[string]string) *promSeries {
+	m, ok := p.metrics[name]
+	if !ok {
+		m = &promMetric{kind: kind, series: make(map[string]*promSeries)}
+		p.metrics[name] = m
+	}
+	key := promLabels(labels)
+	s, ok := m.series[key]
+	if !ok {
+		s = &promSeries{}
+		if kind == "histogram" {
+			s.buckets = make([]uint64, len(promBuckets))
+		}
+		m.series[key] = s
+	}
+	return s
+}
+
+func (p *PrometheusSink) IncCounter(name string, labels map[string]string, delta float64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.series("counter", name, labels).value += delta
+}
+
+func (p *PrometheusSink) SetGauge(name string, labels map[string]string, value float64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.series("gauge", name, labels).value = value
+}
+
+func (p *PrometheusSink) ObserveHistogram(name string, labels map[string]string, value float64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s := p.series("histogram", name, labels)
+	for i, le := range promBuckets {
+		if value <= le {
+			s.buckets[i]++
+		}
+	}
+	s.count++
+	s.value += value
+}
+
+// ServeHTTP serves the metrics in the Prometheus text format, or in the
+// OpenMetrics text format to clients that ask for it, as Prometheus does
+// when scraping. Samples carry no exemplars: the server doesn't trace
+// streams, so there are no trace IDs to link them to.
+func (p *PrometheusSink) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	openMetrics := strings.Contains(r.Header.Get("Accept"), "application/openmetrics-text")
+	if openMetrics {
+		w.Header().Set("Content-Type", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+	} else {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	names := make([]string, 0, len(p.metrics))
+	for name := range p.metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		m := p.metrics[name]
+		family, sample := name, name
+		if openMetrics && m.kind == "counter" {
+			// OpenMetrics names counter families without the _total their
+			// samples have.
+			family = strings.TrimSuffix(name, "_total")
+			sample = family + "_total"
+		}
+		fmt.Fprintf(w, "# TYPE %s %s\n", family, m.kind)
+		keys := make([]string, 0, len(m.series))
+		for key := range m.series {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			s := m.series[key]
+			if m.kind != "histogram" {
+				fmt.Fprintf(w, "%s%s %s\n", sample, braces(key), promFloat(s.value))
+				continue
+			}
+			for i, le := range promBuckets {
+				fmt.Fprintf(w, "%s_bucket%s %d\n", name, braces(joinLabels(key, `le="`+promFloat(le)+`"`)), s.buckets[i])
+			}
+			fmt.Fprintf(w, "%s_bucket%s %d\n", name, braces(joinLabels(key, `le="+Inf"`)), s.count)
+			fmt.Fprintf(w, "%s_sum%s %s\n", name, braces(key), promFloat(s.value))
+			fmt.Fprintf(w, "%s_count%s %d\n", name, braces(key), s.count)
+		}
+	}
+	if openMetrics {
+		fmt.Fprint(w, "# EOF\n")
+	}
+}
+
+// promLabels renders labels in a stable order, without braces.
+func promLabels(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		parts[i] = k + `="` + promEscaper.Replace(labels[k]) + `"`
+	}
+	return strings.Join(parts, ",")
+}
+
+var promEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func joinLabels(a, b string) string {
+	if a == "" {
+		return b
+	}
+	return a + "," + b
+}
+
+func braces(labels string) string {
+	if labels == "" {
+		return ""
+	}
+	return "{" + labels + "}"
+}
+
+func promFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,207 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jtolio/netpump-go/private/protocol"
+)
+
+// recordingSink is a MetricsSink that remembers what it was told, keyed
+// by metric name and labels.
+type recordingSink struct {
+	mu           sync.Mutex
+	counters     map[string]float64
+	gauges       map[string][]float64
+	observations map[string]int
+}
+
+func newRecordingSink() *recordingSink {
+	return &recordingSink{
+		counters:     make(map[string]float64),
+		gauges:       make(map[string][]float64),
+		observations: make(map[string]int),
+	}
+}
+
+// metricKey writes name and labels the way Prometheus does.
+func metricKey(name string, labels map[string]string) string {
+	if len(labels) == 0 {
+		return name
+	}
+	var pairs []string
+	for k, v := range labels {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return name + "{" + strings.Join(pairs, ",") + "}"
+}
+
+func (r *recordingSink) IncCounter(name string, labels map[string]string, delta float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.counters[metricKey(name, labels)] += delta
+}
+
+func (r *recordingSink) SetGauge(name string, labels map[string]string, value float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	key := metricKey(name, labels)
+	r.gauges[key] = append(r.gauges[key], value)
+}
+
+func (r *recordingSink) ObserveHistogram(name string, labels map[string]string, _ float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.observations[metricKey(name, labels)]++
+}
+
+func (r *recordingSink) counter(key string) float64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.counters[key]
+}
+
+func TestMetricsDuringTransfer(t *testing.T) {
+	sink := newRecordingSink()
+	_, url := startServer(t, WithMetricsSink(sink))
+	target := echoTarget(t)
+	session := dialSession(t, url)
+
+	stream, resp := request(t, session, protocol.Request{Addr: target})
+	if resp.Status != protocol.StatusOK {
+		t.Fatalf("status = %#x, want OK", resp.Status)
+	}
+	msg := bytes.Repeat([]byte("x"), 10000)
+	if _, err := stream.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(stream, make([]byte, len(msg))); err != nil {
+		t.Fatal(err)
+	}
+	stream.Close()
+	if _, resp := request(t, session, protocol.Request{Addr: closedAddr(t)}); resp.Status != protocol.StatusRefused {
+		t.Fatalf("status = %#x, want refused", resp.Status)
+	}
+
+	// The relay's own goroutines count the last bytes and the stream's
+	// end after the client is done with it.
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		sink.mu.Lock()
+		active := sink.gauges[MetricActiveStreams]
+		sink.mu.Unlock()
+		if len(active) == 2 && active[1] == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s went %v, want [1 0]", MetricActiveStreams, active)
+		}
+	}
+
+	for key, want := range map[string]float64{
+		MetricStreams:                          2,
+		metricKey(MetricBytes, sentLabels):     float64(len(msg)),
+		metricKey(MetricBytes, receivedLabels): float64(len(msg)),
+		metricKey(MetricDialFailures, failureLabels(protocol.StatusRefused)): 1,
+	} {
+		if got := sink.counter(key); got != want {
+			t.Errorf("%s = %v, want %v", key, got, want)
+		}
+	}
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	if got := sink.observations[MetricDialSeconds]; got != 2 {
+		t.Errorf("%d dial durations observed, want 2", got)
+	}
+	if sink.gauges[MetricActiveStreams][0] != 1 {
+		t.Errorf("%s went %v, want [1 0]", MetricActiveStreams, sink.gauges[MetricActiveStreams])
+	}
+}
+
+func TestPrometheusFormats(t *testing.T) {
+	_, url := startServer(t, WithMetricsSink(NewPrometheusSink()))
+	session := dialSession(t, url)
+	if _, resp := request(t, session, protocol.Request{Addr: echoTarget(t)}); resp.Status != protocol.StatusOK {
+		t.Fatalf("status = %#x, want OK", resp.Status)
+	}
+	if _, resp := request(t, session, protocol.Request{Addr: closedAddr(t)}); resp.Status != protocol.StatusRefused {
+		t.Fatalf("status = %#x, want refused", resp.Status)
+	}
+
+	scrape := func(accept string) (string, string) {
+		req, err := http.NewRequest(http.MethodGet, httpURL(url, "/metrics"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.Header.Get("Content-Type"), string(body)
+	}
+
+	// What Prometheus sends when scraping.
+	ct, body := scrape("application/openmetrics-text;version=1.0.0,application/openmetrics-text;version=0.0.1;q=0.75,text/plain;version=0.0.4;q=0.5,*/*;q=0.1")
+	if !strings.HasPrefix(ct, "application/openmetrics-text; version=1.0.0") {
+		t.Errorf("content type %q", ct)
+	}
+	if !strings.HasSuffix(body, "\n# EOF\n") || strings.Count(body, "# EOF") != 1 {
+		t.Errorf("no single # EOF at the end:\n%s", body)
+	}
+	families := map[string]string{} // family to type
+	for _, line := range strings.Split(strings.TrimSuffix(body, "\n"), "\n") {
+		if f := strings.Fields(line); len(f) == 4 && f[0] == "#" && f[1] == "TYPE" {
+			families[f[2]] = f[3]
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		// Samples are a name, maybe labels and a value, with no
+		// exemplars.
+		if strings.Contains(line, " # ") {
+			t.Errorf("exemplar in %q", line)
+		}
+		name, _, _ := strings.Cut(strings.Fields(line)[0], "{")
+		if family := strings.TrimSuffix(name, "_total"); families[family] == "counter" && name != family+"_total" {
+			t.Errorf("counter sample %q without _total", line)
+		}
+	}
+	for family, typ := range families {
+		if typ == "counter" && strings.HasSuffix(family, "_total") {
+			t.Errorf("counter family %s named with _total", family)
+		}
+	}
+	for _, want := range []string{
+		"# TYPE netpump_streams counter\n",
+		"\nnetpump_streams_total 2\n",
+		"\nnetpump_dial_failures_total{reason=\"refused\"} 1\n",
+		"# TYPE netpump_dial_duration_seconds histogram\n",
+		"\nnetpump_dial_duration_seconds_count 2\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("no %q in\n%s", want, body)
+		}
+	}
+
+	// Anything else gets the Prometheus text format.
+	ct, body = scrape("")
+	if !strings.HasPrefix(ct, "text/plain; version=0.0.4") || strings.Contains(body, "# EOF") ||
+		!strings.Contains(body, "# TYPE netpump_streams_total counter\n") {
+		t.Errorf("content type %q, body:\n%s", ct, body)
+	}
+}
@@ -0,0 +1,27 @@
+package server
+
+import (
+	"fmt"
+	"net/url"
+
+	"github.com/jtolio/netpump-go/private/wsconn"
+)
+
+// checkMigrateURL checks that WithMigrateTo was given a server URL clients
+// can connect to.
+func checkMigrateURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return fmt.Errorf("migrate URL: %w", err)
+	}
+	if u.Scheme != "ws" && u.Scheme != "wss" || u.Host == "" {
+		return fmt.Errorf("migrate URL %q must be a ws:// or wss:// URL with a host", raw)
+	}
+	if u.RawQuery != "" || u.Fragment != "" {
+		return fmt.Errorf("migrate URL %q can't have a query or fragment", raw)
+	}
+	if len(raw) > wsconn.MaxMigrateURL {
+		return fmt.Errorf("migrate URL is longer than %d bytes", wsconn.MaxMigrateURL)
+	}
+	return nil
+}
@@ -0,0 +1,483 @@
+package server
+
+import (
+	"crypto/tls"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/jtolio/netpump-go/private/eventlog"
+)
+
+// Option configures optional Server behavior.
+type Option func(*Server)
+
+// WithShutdownTimeout bounds how long Shutdown lets in-flight streams run
+// before forcibly closing them. The default of zero closes them right away.
+func WithShutdownTimeout(d time.Duration) Option {
+	return func(s *Server) {
+		s.shutdownTimeout = d
+	}
+}
+
+// WithMigrateTo has Shutdown tell clients to reconnect to serverURL, the
+// ws:// or wss:// URL of another server instance, for upgrades without
+// downtime. Clients move right away, giving up the streams they still
+// have open here rather than waiting for them to finish.
+func WithMigrateTo(serverURL string) Option {
+	return func(s *Server) {
+		s.migrateTo = strings.TrimRight(serverURL, "/")
+	}
+}
+
+// WithTenants restricts the server to the given tenants, each identified by
+// its token and subject to its own limits.
+func WithTenants(tenants ...Tenant) Option {
+	return func(s *Server) {
+		for _, t := range tenants {
+			s.tenants = append(s.tenants, &tenant{Tenant: t})
+		}
+	}
+}
+
+// WithSessionPolicy sets what happens when a client connects as a tenant
+// while it already has a session as that tenant. Without tenants there is
+// no identity to go by, and sessions are always concurrent.
+func WithSessionPolicy(policy SessionPolicy) Option {
+	return func(s *Server) {
+		s.sessionPolicy = policy
+	}
+}
+
+// WithWriteTimeout bounds how long a single write to the websocket may
+// take before the session is torn down. It defaults to
+// wsconn.DefaultWriteTimeout; zero disables it.
+func WithWriteTimeout(d time.Duration) Option {
+	return func(s *Server) {
+		s.writeTimeout = d
+	}
+}
+
+// WithUpstreams spreads connections to targets over the given upstreams
+// by weight instead of dialing them directly. An upstream that can't be
+// reached is skipped for a while and the next one is tried.
+func WithUpstreams(upstreams ...Upstream) Option {
+	return func(s *Server) {
+		s.upstreamConfig = append(s.upstreamConfig, upstreams...)
+	}
+}
+
+// WithGlobalRateLimit caps the combined throughput of all relayed
+// connections, in both directions, at bytesPerSecond. Streams share the
+// limit in turns, so a busy one can't starve the rest. The limit can be
+// changed while running with SetGlobalRateLimit.
+func WithGlobalRateLimit(bytesPerSecond int64) Option {
+	return func(s *Server) {
+		if bytesPerSecond > 0 {
+			s.rateLimit.Store(newRateLimiter(bytesPerSecond))
+		}
+	}
+}
+
+// WithPerHostRateLimit caps the combined throughput of the connections to
+// each target host, in both directions, at bytesPerSecond, so small origin
+// servers aren't hammered at full speed. Hosts are as clients name them:
+// a name and the address it resolves to are limited separately. It
+// applies along with WithGlobalRateLimit.
+func WithPerHostRateLimit(bytesPerSecond int64) Option {
+	return func(s *Server) {
+		if bytesPerSecond > 0 {
+			s.hostLimits = &hostLimits{rate: bytesPerSecond}
+		}
+	}
+}
+
+// WithAllowedOrigins only accepts websockets opened by pages from the given
+// origins, such as "http://127.0.0.1:8080" for a client's web interface.
+// Connections that send no Origin, like native clients, aren't affected.
+func WithAllowedOrigins(origins ...string) Option {
+	return func(s *Server) {
+		var all []string
+		if old := s.allowedOrigins.Load(); old != nil {
+			all = append(all, *old...)
+		}
+		all = append(all, origins...)
+		s.allowedOrigins.Store(&all)
+	}
+}
+
+// WithAllowedClients only accepts websockets from clients whose IP is one
+// of, or in one of the CIDR ranges of, patterns. It's checked before any
+// token. Behind a reverse proxy, see WithTrustedProxies: without it,
+// X-Forwarded-For is ignored once an allowlist is set, so it can't be
+// used to get in.
+func WithAllowedClients(patterns ...string) Option {
+	return func(s *Server) {
+		s.clientConfig = append(s.clientConfig, patterns...)
+	}
+}
+
+// WithTrustedProxies believes X-Forwarded-For only on requests from the
+// given IPs or CIDR ranges, such as a reverse proxy in front of the
+// server, and takes the client to be the last address in it that isn't
+// one of them. The client IP is used for logs and WithAllowedClients.
+func WithTrustedProxies(patterns ...string) Option {
+	return func(s *Server) {
+		s.proxyConfig = append(s.proxyConfig, patterns...)
+	}
+}
+
+// WithSNIAllowlist only lets TLS connections through if the server name in
+// their ClientHello is one of hosts. A "*." prefix matches any subdomain.
+// Connections that don't start with a TLS handshake aren't affected.
+func WithSNIAllowlist(hosts ...string) Option {
+	return func(s *Server) {
+		if s.sni == nil {
+			s.sni = &sniPolicy{}
+		}
+		s.sni.allow = append(s.sni.allow, hosts...)
+	}
+}
+
+// WithSNIMatch blocks TLS connections whose ClientHello names a different
+// host than the one the client asked to be connected to, which is how
+// domain fronting hides the real destination.
+func WithSNIMatch() Option {
+	return func(s *Server) {
+		if s.sni == nil {
+			s.sni = &sniPolicy{}
+		}
+		s.sni.matchTarget = true
+	}
+}
+
+// WithSlowThresholds logs a warning when dialing a target takes longer
+// than dial, or when the target's first byte arrives more than firstByte
+// after the connection was made. Zero turns either warning off, which is
+// the default.
+func WithSlowThresholds(dial, firstByte time.Duration) Option {
+	return func(s *Server) {
+		s.slowDial = dial
+		s.slowFirstByte = firstByte
+	}
+}
+
+// WithDistinctTargetLimit warns when a session connects to more than
+// limit distinct targets, by host and port, within window, as a client
+// scanning or otherwise abusing the server would. If reject is true,
+// connections to new targets are refused while the session is over the
+// limit; targets it already used in the window still connect. A limit of
+// 0, the default, tracks nothing; a window of 0 means a minute.
+func WithDistinctTargetLimit(limit int, window time.Duration, reject bool) Option {
+	return func(s *Server) {
+		if window <= 0 {
+			window = time.Minute
+		}
+		s.targetLimit = limit
+		s.targetWindow = window
+		s.targetReject = reject
+	}
+}
+
+// WithTargetTLS has the server wrap connections to matching targets in
+// TLS itself. Rules are checked in order and the first match applies.
+func WithTargetTLS(rules ...TargetTLS) Option {
+	return func(s *Server) {
+		s.targetTLSRules = append(s.targetTLSRules, rules...)
+	}
+}
+
+// WithHealthCanary makes /health/deep also check that the server can dial
+// addr, through the upstreams if any. Without it, the deep check only
+// exercises the stream machinery.
+func WithHealthCanary(addr string) Option {
+	return func(s *Server) {
+		s.healthCanary = addr
+	}
+}
+
+// WithMetricsSink sends the server's metrics to sink. If sink is also an
+// http.Handler, such as a PrometheusSink, it is served on /metrics.
+func WithMetricsSink(sink MetricsSink) Option {
+	return func(s *Server) {
+		s.metrics = sink
+	}
+}
+
+// WithEventLog keeps the last size log records at Info level and above in
+// memory. With an admin token they are served as JSON on /events.
+func WithEventLog(size int) Option {
+	return func(s *Server) {
+		s.events = eventlog.NewRing(size)
+	}
+}
+
+// WithAdminToken enables the admin endpoints, such as /events, for
+// requests that present token as a bearer token. They carry targets and
+// client addresses, so they're off without one.
+func WithAdminToken(token string) Option {
+	return func(s *Server) {
+		s.adminToken = token
+	}
+}
+
+// WithLogSampling logs the progress of only one in every n streams, to keep
+// logs readable under heavy load. Warnings and errors are always logged.
+func WithLogSampling(n int) Option {
+	return func(s *Server) {
+		s.logSampler = &logSampler{n: uint64(n)}
+	}
+}
+
+// WithIdleStreamProbe has the server ask clients, every d, whether they
+// still have the streams that have been idle for d, and close those they
+// don't. Clients that predate this are never asked.
+func WithIdleStreamProbe(d time.Duration) Option {
+	return func(s *Server) {
+		s.idleProbe = d
+	}
+}
+
+// WithCarrierIdleTimeout closes a client's websocket once it has carried
+// no streams for d, to free what it holds on both ends while the client
+// has nothing to tunnel. The client is told first, and has the browser
+// reconnect when there's a connection to make; clients that predate this
+// have it reconnect right away. Keepalive pings don't count as activity.
+func WithCarrierIdleTimeout(d time.Duration) Option {
+	return func(s *Server) {
+		s.carrierIdle = d
+	}
+}
+
+// WithMaxPendingStreams caps how many streams each client may have open
+// without having sent their request yet. Further streams are turned down
+// until some of those requests arrive. Zero means no cap.
+func WithMaxPendingStreams(n int) Option {
+	return func(s *Server) {
+		s.maxPending = n
+	}
+}
+
+// WithMinThroughput flags streams that relay fewer than bytes, both ways
+// together, over a window while not idle, as a peer trickling data a byte
+// at a time to tie the stream up would. Streams with a write stalled
+// count as active, so one whose application stops reading for a whole
+// window is flagged too. Flagged streams are logged and counted, and
+// closed if closeStreams is true. Idle streams are left to
+// WithIdleStreamProbe. Zero bytes, the default, checks nothing; a window
+// of 0 means 30 seconds.
+func WithMinThroughput(bytes int64, window time.Duration, closeStreams bool) Option {
+	return func(s *Server) {
+		if window <= 0 {
+			window = 30 * time.Second
+		}
+		s.minBytes = bytes
+		s.minWindow = window
+		s.minClose = closeStreams
+	}
+}
+
+// WithMaxSessions caps how many clients the server serves at once.
+// Further websocket upgrades are refused with 503 Service Unavailable
+// until one of them leaves. A websocket counts once however many
+// sub-sessions it carries. Zero means no cap.
+func WithMaxSessions(n int) Option {
+	return func(s *Server) {
+		s.maxSessions = n
+	}
+}
+
+// WithLoadShedding refuses new sessions with 503 Service Unavailable,
+// and new streams on existing sessions, while the server is over any of
+// limits, rather than slowing down for everyone. Streams are counted as
+// they come in; goroutines and the heap are sampled every second, and
+// shedding on them stops once they're back under 90% of their limit.
+// Streams already being relayed aren't affected.
+func WithLoadShedding(limits LoadLimits) Option {
+	return func(s *Server) {
+		if limits != (LoadLimits{}) {
+			s.load = &loadShedder{limits: limits}
+		}
+	}
+}
+
+// WithMaxStreams caps the streams the server relays at once, across all
+// clients. While it's at the cap, new streams wait up to queueWait for
+// one to finish, and are refused if none does. Freed slots go to the
+// clients with streams waiting in turn, tenants by name and other
+// clients by IP, so one opening many streams can't crowd out the rest.
+// X-Forwarded-For only counts from WithTrustedProxies. A queueWait of
+// zero refuses streams over the cap right away.
+func WithMaxStreams(n int, queueWait time.Duration) Option {
+	return func(s *Server) {
+		s.maxStreams = n
+		s.streamQueue = queueWait
+	}
+}
+
+// WithInstanceID names this server in its logs, its health responses and
+// the X-Netpump-Instance header of websocket upgrades. By default a
+// random ID is picked at startup.
+func WithInstanceID(id string) Option {
+	return func(s *Server) {
+		s.instanceID = id
+	}
+}
+
+// WithTLS serves HTTPS and wss:// with config, which must have a
+// certificate. Clients that connect without TLS get a 400 explaining
+// that TLS is required.
+func WithTLS(config *tls.Config) Option {
+	return func(s *Server) {
+		s.tlsConfig = config
+	}
+}
+
+// WithHTTPSRedirect has plaintext GETs of / and /health on a WithTLS
+// server redirected to https:// instead of rejected.
+func WithHTTPSRedirect() Option {
+	return func(s *Server) {
+		s.httpsRedirect = true
+	}
+}
+
+// WithRelayBufferBytes reads up to n bytes ahead in each relay direction,
+// smoothing throughput over bursty links at the cost of latency and n
+// bytes of memory per direction per stream. It is off by default.
+func WithRelayBufferBytes(n int) Option {
+	return func(s *Server) {
+		s.relayBuffer = n
+	}
+}
+
+// WithMaxRequestBytes caps the bytes of stream requests being read at any
+// one time across all clients. Streams whose request would go over are
+// rejected, as are new streams while the budget is used up.
+func WithMaxRequestBytes(n int64) Option {
+	return func(s *Server) {
+		s.requestBudget = &requestBudget{max: n}
+	}
+}
+
+// WithDNSCoalescing has streams to the same host that are dialed at once
+// share a single lookup of it, as when a browser opens several
+// connections to a site together. Each stream still gets a connection
+// of its own. The host's addresses are then tried one at a time, without
+// racing IPv6 against IPv4. It doesn't apply with WithUpstreams.
+func WithDNSCoalescing() Option {
+	return func(s *Server) {
+		s.dnsCoalescing = true
+	}
+}
+
+// WithMaxStreamMemory caps the memory the streams being relayed may hold
+// at once, across all clients. Each stream is charged the most it can
+// hold: two copy buffers, two relay buffers with WithRelayBufferBytes,
+// and a stream window of data from the client that the target hasn't
+// taken yet. Streams that would go over are rejected.
+func WithMaxStreamMemory(n int64) Option {
+	return func(s *Server) {
+		s.streamMemory = &streamMemory{max: n}
+	}
+}
+
+// WithAccessLog writes a line in format to w for every connection the
+// server makes to a target, once the connection ends.
+func WithAccessLog(w io.Writer, format AccessLogFormat) Option {
+	return func(s *Server) {
+		s.accessLog = &accessLog{w: w, format: format}
+	}
+}
+
+// WithAccessLogBuffer collects access log lines in memory, writing them
+// out every flushEvery or once size bytes are waiting, so a slow log
+// doesn't hold up the connections being logged. While the buffer is full,
+// new lines are dropped if dropWhenFull is set, and otherwise wait for
+// room. What's buffered is written out on shutdown. It only applies along
+// with WithAccessLog.
+func WithAccessLogBuffer(size int, flushEvery time.Duration, dropWhenFull bool) Option {
+	return func(s *Server) {
+		if size > 0 && flushEvery > 0 {
+			s.accessBuffer = &accessBuffer{size: size, every: flushEvery, drop: dropWhenFull}
+		}
+	}
+}
+
+// WithMaxFrameBytes caps the data the server sends to the client in one
+// yamux frame. All streams share one websocket and each frame goes out
+// whole, so smaller frames let other streams' frames in sooner, at some
+// cost in overhead. Without a cap frames are as large as the relay's copy
+// buffer, 32 KiB by default.
+//
+// This only bounds the delay from a single frame. yamux still lets a bulk
+// stream have its whole window, 256 KiB by default, in flight ahead of
+// others, which on a slow carrier is usually the larger part;
+// MetricWriteWait shows how long writes actually wait.
+func WithMaxFrameBytes(n int) Option {
+	return func(s *Server) {
+		s.maxFrame = n
+	}
+}
+
+// WithStreamWindow lets each stream have up to n bytes from the client in
+// flight, rather than yamux's 256 KiB, the least it accepts. A larger
+// window raises a single stream's upload throughput over links with a high
+// bandwidth-delay product, at the cost of up to n bytes of memory per
+// stream whose target reads slowly. It bounds what the client sends; the
+// client's own WithStreamWindow bounds what the server sends.
+func WithStreamWindow(n int) Option {
+	return func(s *Server) {
+		s.streamWindow = n
+	}
+}
+
+// WithCopyBufferBytes sets the size of the relay's copy buffers, 32 KiB by
+// default. Each read from a target or stream is at most this large, and so
+// is each frame sent to the client unless WithMaxFrameBytes makes them
+// smaller. Each stream holds two while it's open.
+func WithCopyBufferBytes(n int) Option {
+	return func(s *Server) {
+		s.buffers.size = n
+	}
+}
+
+// WithDSCP marks the server's connections to targets, and to SOCKS5
+// upstreams, with the DSCP value (0-63), for networks that prioritize
+// traffic by it. Where the platform doesn't allow it, connections go
+// unmarked and a warning is logged.
+func WithDSCP(dscp int) Option {
+	return func(s *Server) {
+		s.dscp = dscp
+	}
+}
+
+// WithCarrierDSCP is like WithDSCP, but marks the websocket connections
+// to clients.
+func WithCarrierDSCP(dscp int) Option {
+	return func(s *Server) {
+		s.carrierDSCP = dscp
+	}
+}
+
+// WithMaxPooledBuffers caps how many idle relay copy buffers the server
+// keeps for reuse, 256 by default. Buffers needed beyond that under load
+// are allocated and freed as usual. MetricCopyBuffers reports the buffers
+// in use and pooled.
+func WithMaxPooledBuffers(n int) Option {
+	return func(s *Server) {
+		s.buffers.max = n
+	}
+}
+
+// WithDenyTargets refuses connections to targets matching any of the
+// patterns: host names, where "*." matches any subdomain, or IPs and CIDR
+// ranges, which also apply to the addresses names resolve to. With IPs or
+// ranges among the patterns, names headed for WithUpstreams are resolved
+// by the server, so the upstreams get an address already checked. Clients
+// are told the target was denied, which reaches SOCKS5 applications as
+// "connection not allowed by ruleset".
+func WithDenyTargets(patterns ...string) Option {
+	return func(s *Server) {
+		s.deny.Store(parseDenyPolicy(patterns))
+	}
+}
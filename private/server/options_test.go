@@ -0,0 +1,22 @@
+package server
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestStartRejectsBadConfig(t *testing.T) {
+	for name, opt := range map[string]Option{
+		"stream window":   WithStreamWindow(1),
+		"buffer size":     WithCopyBufferBytes(-1),
+		"migrate URL":     WithMigrateTo("ftp://example.com"),
+		"allowed clients": WithAllowedClients("not an address"),
+		"trusted proxies": WithTrustedProxies("not an address"),
+		"upstream":        WithUpstreams(Upstream{Name: "bad", URL: "http://example.com"}),
+	} {
+		err := New("127.0.0.1", 0, opt).Start()
+		if !errors.Is(err, ErrInvalidConfig) {
+			t.Errorf("%s: Start() = %v, want %v", name, err, ErrInvalidConfig)
+		}
+	}
+}
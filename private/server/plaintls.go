@@ -0,0 +1,109 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// errPlaintext fails the TLS handshake of a connection that turned out to
+// be plain HTTP, after it has been answered.
+var errPlaintext = errors.New("plaintext HTTP on a TLS listener")
+
+// plaintextTimeout bounds how long a plaintext connection on the TLS
+// listener gets to send its request before it is dropped.
+const plaintextTimeout = 10 * time.Second
+
+// tlsListener serves TLS, answering connections that speak plain HTTP
+// instead with a clear error (or a redirect) rather than a failed
+// handshake the client can't make sense of.
+type tlsListener struct {
+	net.Listener
+	config   *tls.Config
+	redirect bool
+	log      *slog.Logger
+}
+
+func (l *tlsListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	// The first byte is looked at once the http.Server starts the
+	// handshake, in the connection's own goroutine.
+	return tls.Server(&sniffConn{Conn: conn, l: l}, l.config), nil
+}
+
+// sniffConn checks that its first byte starts a TLS record, and answers
+// plaintext HTTP itself otherwise.
+type sniffConn struct {
+	net.Conn
+	l       *tlsListener
+	checked bool
+	first   []byte
+}
+
+func (c *sniffConn) Read(p []byte) (int, error) {
+	if !c.checked {
+		c.checked = true
+		var b [1]byte
+		if _, err := io.ReadFull(c.Conn, b[:]); err != nil {
+			return 0, err
+		}
+		if b[0] != tlsRecordHandshake {
+			c.l.rejectPlaintext(c.Conn, b[0])
+			return 0, errPlaintext
+		}
+		c.first = b[:]
+	}
+	if len(c.first) > 0 && len(p) > 0 {
+		n := copy(p, c.first)
+		c.first = c.first[n:]
+		return n, nil
+	}
+	return c.Conn.Read(p)
+}
+
+// rejectPlaintext reads the plaintext request on conn and tells the
+// client to use TLS. With redirects on, GETs of the root and health pages
+// are sent to the https:// URL instead.
+func (l *tlsListener) rejectPlaintext(conn net.Conn, first byte) {
+	conn.SetDeadline(time.Now().Add(plaintextTimeout))
+	ip, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	req, err := http.ReadRequest(bufio.NewReader(io.MultiReader(bytes.NewReader([]byte{first}), conn)))
+	if err != nil {
+		l.log.Warn("rejected non-TLS connection on TLS listener", "ip", ip)
+		return
+	}
+	l.log.Warn("rejected plaintext HTTP on TLS listener, client should use https:// or wss://",
+		"ip", ip, "path", req.URL.Path)
+
+	resp := &http.Response{
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		Close:      true,
+	}
+	switch path := req.URL.Path; {
+	case l.redirect && (req.Method == http.MethodGet || req.Method == http.MethodHead) &&
+		(path == "/" || path == "/health"):
+		resp.StatusCode = http.StatusPermanentRedirect
+		resp.Header.Set("Location", "https://"+req.Host+req.URL.RequestURI())
+	default:
+		msg := "this server only accepts TLS; connect with https:// or wss://\n"
+		resp.StatusCode = http.StatusBadRequest
+		resp.Header.Set("Content-Type", "text/plain; charset=utf-8")
+		resp.ContentLength = int64(len(msg))
+		resp.Body = io.NopCloser(strings.NewReader(msg))
+	}
+	resp.Status = fmt.Sprintf("%d %s", resp.StatusCode, http.StatusText(resp.StatusCode))
+	resp.Write(conn)
+}
@@ -0,0 +1,137 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// startTLSServer starts a server with WithTLS and opts on loopback,
+// returning it with its address and a pool trusting its certificate.
+func startTLSServer(t *testing.T, opts ...Option) (*Server, string, *x509.CertPool) {
+	t.Helper()
+	hs := httptest.NewTLSServer(nil)
+	cert := hs.TLS.Certificates[0]
+	roots := x509.NewCertPool()
+	roots.AddCert(hs.Certificate())
+	hs.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+	opts = append([]Option{WithTLS(&tls.Config{Certificates: []tls.Certificate{cert}})}, opts...)
+	s := New("127.0.0.1", port, opts...)
+	go s.Start()
+	t.Cleanup(func() { s.Stop() })
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if conn, err := net.Dial("tcp", addr); err == nil {
+			conn.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("server not listening on %s", addr)
+		}
+	}
+	return s, addr, roots
+}
+
+func TestPlaintextOnTLS(t *testing.T) {
+	s, addr, roots := startTLSServer(t, WithEventLog(50))
+
+	// Over TLS everything works.
+	tlsConfig := &tls.Config{RootCAs: roots}
+	hc := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+	resp, err := hc.Get("https://" + addr + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("https status %d", resp.StatusCode)
+	}
+	d := websocket.Dialer{TLSClientConfig: tlsConfig}
+	ws, _, err := d.Dial("wss://"+addr+"/ws", nil)
+	if err != nil {
+		t.Fatalf("wss: %v", err)
+	}
+	ws.Close()
+
+	// Plaintext is told to use TLS.
+	resp, err = http.Get("http://" + addr + "/health")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest || !strings.Contains(string(body), "only accepts TLS") {
+		t.Errorf("plaintext GET: %d %q", resp.StatusCode, body)
+	}
+	if _, resp, err := websocket.DefaultDialer.Dial("ws://"+addr+"/ws", nil); err == nil {
+		t.Error("ws:// upgraded on a TLS listener")
+	} else if resp == nil || resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("ws:// on a TLS listener: %v", err)
+	}
+	warned := 0
+	for _, e := range s.events.Events() {
+		if strings.HasPrefix(e.Message, "rejected plaintext HTTP on TLS listener") {
+			warned++
+		}
+	}
+	if warned != 2 {
+		t.Errorf("%d plaintext rejections logged, want 2", warned)
+	}
+
+	// Anything else is dropped.
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("\x00\x01garbage\r\n\r\n"))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, err := conn.Read(make([]byte, 64)); err == nil {
+		t.Errorf("garbage answered with %d bytes", n)
+	} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Error("garbage connection left open")
+	}
+}
+
+func TestHTTPSRedirect(t *testing.T) {
+	_, addr, _ := startTLSServer(t, WithHTTPSRedirect())
+	hc := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	for _, tc := range []struct {
+		path string
+		want int
+	}{
+		{"/health?x=1", http.StatusPermanentRedirect},
+		{"/", http.StatusPermanentRedirect},
+		{"/ws", http.StatusBadRequest},
+	} {
+		resp, err := hc.Get("http://" + addr + tc.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.want {
+			t.Errorf("%s: status %d, want %d", tc.path, resp.StatusCode, tc.want)
+		}
+		if loc := resp.Header.Get("Location"); tc.want == http.StatusPermanentRedirect && loc != "https://"+addr+tc.path {
+			t.Errorf("%s: redirected to %q", tc.path, loc)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// rateChunk is the most a single relay write takes from a rate limiter at
+// once, so that streams sharing the limiter take turns rather than one
+// large write holding up the others.
+const rateChunk = 16 * 1024
+
+// rateLimiter is a token bucket shared by every relay it applies to.
+// Waiters reserve tokens in arrival order, going into debt if need be, so
+// no stream is starved by others that keep the bucket empty. A rate of 0
+// lets everything through.
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64 // bytes per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(bytesPerSecond int64) *rateLimiter {
+	l := &rateLimiter{last: time.Now()}
+	l.set(bytesPerSecond)
+	return l
+}
+
+// set changes the rate, taking effect for every stream from its next
+// write on. Tokens gathered so far count at the old rate.
+func (l *rateLimiter) set(bytesPerSecond int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refill(time.Now())
+	wasOff := l.rate == 0
+	l.rate = float64(bytesPerSecond)
+	l.burst = max(l.rate/10, rateChunk)
+	if wasOff || l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+}
+
+// get returns the rate in bytes per second.
+func (l *rateLimiter) get() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return int64(l.rate)
+}
+
+func (l *rateLimiter) refill(now time.Time) {
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+}
+
+// wait blocks until n bytes may be sent or ctx is done.
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	l.mu.Lock()
+	if l.rate == 0 {
+		l.mu.Unlock()
+		return nil
+	}
+	l.refill(time.Now())
+	l.tokens -= float64(n)
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+
+	if delay == 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// rateWriter holds writes to w to the rate of l.
+type rateWriter struct {
+	ctx context.Context
+	w   io.Writer
+	l   *rateLimiter
+}
+
+func (r rateWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > rateChunk {
+			chunk = chunk[:rateChunk]
+		}
+		if err := r.l.wait(r.ctx, len(chunk)); err != nil {
+			return written, err
+		}
+		n, err := r.w.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// globalRateWriter holds writes to w to the global rate limit, if there
+// is one at the time of the write.
+type globalRateWriter struct {
+	ctx context.Context
+	w   io.Writer
+	l   *atomic.Pointer[rateLimiter]
+}
+
+func (g globalRateWriter) Write(p []byte) (int, error) {
+	l := g.l.Load()
+	if l == nil {
+		return g.w.Write(p)
+	}
+	return rateWriter{ctx: g.ctx, w: g.w, l: l}.Write(p)
+}
+
+// GlobalRateLimit returns the cap on the combined throughput of relayed
+// connections in bytes per second, 0 for none.
+func (s *Server) GlobalRateLimit() int64 {
+	l := s.rateLimit.Load()
+	if l == nil {
+		return 0
+	}
+	return l.get()
+}
+
+// SetGlobalRateLimit changes the cap on the combined throughput of relayed
+// connections to bytesPerSecond, 0 for none. Open connections keep going
+// and are held to the new rate from their next write.
+func (s *Server) SetGlobalRateLimit(bytesPerSecond int64) error {
+	if bytesPerSecond < 0 {
+		return errors.New("rate limit can't be negative")
+	}
+	s.rateMu.Lock()
+	defer s.rateMu.Unlock()
+	old := s.GlobalRateLimit()
+	if old == bytesPerSecond {
+		return nil
+	}
+	switch l := s.rateLimit.Load(); {
+	case bytesPerSecond == 0:
+		s.rateLimit.Store(nil)
+	case l == nil:
+		s.rateLimit.Store(newRateLimiter(bytesPerSecond))
+	default:
+		l.set(bytesPerSecond)
+	}
+	s.log.Info("global rate limit changed", "from", old, "to", bytesPerSecond)
+	return nil
+}
+
+// handleRateLimit serves the global rate limit as JSON and, for POSTs of
+// {"bytes_per_second": n}, changes it.
+func (s *Server) handleRateLimit(w http.ResponseWriter, r *http.Request) {
+	type rateLimit struct {
+		BytesPerSecond *int64 `json:"bytes_per_second"`
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+	case http.MethodPost:
+		var req rateLimit
+		if err := json.NewDecoder(io.LimitReader(r.Body, 4096)).Decode(&req); err != nil || req.BytesPerSecond == nil {
+			http.Error(w, `expected {"bytes_per_second": n}`, http.StatusBadRequest)
+			return
+		}
+		if err := s.SetGlobalRateLimit(*req.BytesPerSecond); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	current := s.GlobalRateLimit()
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rateLimit{BytesPerSecond: &current})
+}
@@ -0,0 +1,202 @@
+package server
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jtolio/netpump-go/private/protocol"
+)
+
+// sourceTarget sends data to every connection as fast as it's read, until
+// the test ends, and returns its address.
+func sourceTarget(t testing.TB) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		buf := make([]byte, 32*1024)
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				for {
+					if _, err := conn.Write(buf); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestGlobalRateLimitCapsAggregate(t *testing.T) {
+	const (
+		rate    = 512 * 1024
+		streams = 4
+		period  = time.Second
+	)
+	_, url := startServer(t, WithGlobalRateLimit(rate))
+	target := sourceTarget(t)
+	session := dialSession(t, url)
+
+	var total atomic.Int64
+	perStream := make([]int64, streams)
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < streams; i++ {
+		stream, resp := request(t, session, protocol.Request{Addr: target})
+		if resp.Status != protocol.StatusOK {
+			t.Fatalf("status %#x, want OK", resp.Status)
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			stream.SetReadDeadline(start.Add(period))
+			buf := make([]byte, 32*1024)
+			for {
+				n, err := stream.Read(buf)
+				perStream[i] += int64(n)
+				total.Add(int64(n))
+				if err != nil {
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	// The bucket starts full, and each stream may have a chunk in flight.
+	limit := int64(rate*elapsed.Seconds()) + rate/10 + streams*rateChunk
+	if got := total.Load(); got > limit {
+		t.Errorf("relayed %d bytes in %v across %d streams, over the cap of %d", got, elapsed, streams, limit)
+	} else if got < rate/2 {
+		t.Errorf("relayed only %d bytes in %v, well under the cap", got, elapsed)
+	}
+	for i, n := range perStream {
+		if n == 0 {
+			t.Errorf("stream %d starved", i)
+		}
+	}
+}
+
+func TestGlobalRateLimitOnlyWhenSet(t *testing.T) {
+	s, url := startServer(t, WithAdminToken("admin"))
+	if s.rateLimit.Load() != nil {
+		t.Fatal("rate limiter without a rate")
+	}
+
+	// It can still be turned on, for connections already open too.
+	target := sourceTarget(t)
+	stream, _ := request(t, dialSession(t, url), protocol.Request{Addr: target})
+	if err := s.SetGlobalRateLimit(64 * 1024); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.GlobalRateLimit(); got != 64*1024 {
+		t.Fatalf("GlobalRateLimit() = %d after setting it", got)
+	}
+	// Drain what was relayed before the limit, then measure.
+	stream.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	io.Copy(io.Discard, stream)
+	start := time.Now()
+	stream.SetReadDeadline(start.Add(500 * time.Millisecond))
+	n, _ := io.Copy(io.Discard, stream)
+	if limit := int64(64*1024*time.Since(start).Seconds()) + 2*rateChunk; n > limit {
+		t.Errorf("relayed %d bytes after the limit was set, over %d", n, limit)
+	}
+
+	if err := s.SetGlobalRateLimit(0); err != nil {
+		t.Fatal(err)
+	}
+	if s.rateLimit.Load() != nil {
+		t.Error("rate limiter kept after the rate went to 0")
+	}
+}
+
+// TestGlobalRateLimitChange checks a rate set through /ratelimit takes
+// effect on a stream already relaying, without dropping it.
+func TestGlobalRateLimitChange(t *testing.T) {
+	const (
+		fast   = 1 << 20
+		slow   = 64 * 1024
+		period = 500 * time.Millisecond
+	)
+	_, url := startServer(t, WithGlobalRateLimit(fast), WithAdminToken("admin"))
+	stream, resp := request(t, dialSession(t, url), protocol.Request{Addr: sourceTarget(t)})
+	if resp.Status != protocol.StatusOK {
+		t.Fatalf("status %#x, want OK", resp.Status)
+	}
+	stream.SetDeadline(time.Time{})
+	var got atomic.Int64
+	ended := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := stream.Read(buf)
+			got.Add(int64(n))
+			if err != nil {
+				ended <- err
+				return
+			}
+		}
+	}()
+	// measure waits for the rate to settle, then returns the bytes
+	// relayed over period.
+	measure := func() (int64, time.Duration) {
+		time.Sleep(200 * time.Millisecond)
+		start, before := time.Now(), got.Load()
+		time.Sleep(period)
+		return got.Load() - before, time.Since(start)
+	}
+	setRate := func(rate int64) {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodPost, httpURL(url, "/ratelimit"),
+			strings.NewReader(`{"bytes_per_second": `+strconv.FormatInt(rate, 10)+`}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer admin")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("setting the rate: status %d", resp.StatusCode)
+		}
+		if _, body := adminGet(t, url, "/ratelimit", "admin"); body != `{"bytes_per_second":`+strconv.FormatInt(rate, 10)+"}\n" {
+			t.Fatalf("rate after setting %d: %s", rate, body)
+		}
+	}
+
+	if n, d := measure(); n < fast/4 {
+		t.Fatalf("relayed only %d bytes in %v at %d bytes/s", n, d, fast)
+	}
+	setRate(slow)
+	if n, d := measure(); n > int64(slow*d.Seconds())+2*rateChunk {
+		t.Errorf("relayed %d bytes in %v after slowing to %d bytes/s", n, d, slow)
+	}
+	setRate(fast)
+	if n, d := measure(); n < fast/4 {
+		t.Errorf("relayed only %d bytes in %v after speeding back up to %d bytes/s", n, d, fast)
+	}
+	select {
+	case err := <-ended:
+		t.Fatalf("stream ended while the rate changed: %v", err)
+	default:
+	}
+}
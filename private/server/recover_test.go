@@ -0,0 +1,60 @@
+package server
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jtolio/netpump-go/private/protocol"
+)
+
+// panicSink is a MetricsSink that panics counting the first stream, as a
+// buggy sink might.
+type panicSink struct {
+	nopSink
+	panicked atomic.Bool
+}
+
+func (s *panicSink) IncCounter(name string, _ map[string]string, _ float64) {
+	if name == MetricStreams && s.panicked.CompareAndSwap(false, true) {
+		panic("sink exploded")
+	}
+}
+
+func TestStreamPanicRecovered(t *testing.T) {
+	sink := &panicSink{}
+	s, url := startServer(t, WithMetricsSink(sink), WithEventLog(50))
+	target := echoTarget(t)
+	session := dialSession(t, url)
+
+	stream, err := session.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	stream.SetDeadline(time.Now().Add(10 * time.Second))
+	if err := protocol.WriteRequest(stream, protocol.Request{Addr: target}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := protocol.ReadResponse(stream); err == nil {
+		t.Fatal("got a response from the stream whose handler panicked")
+	}
+	if !sink.panicked.Load() {
+		t.Fatal("the sink never panicked")
+	}
+
+	// The panic was logged with its stack, and the server, along with the
+	// session, carries on.
+	var logged bool
+	for _, e := range s.events.Events() {
+		if e.Message == "panic in stream handler" && e.Attrs["panic"] == "sink exploded" && e.Attrs["stack"] != "" {
+			logged = true
+		}
+	}
+	if !logged {
+		t.Error("panic not logged")
+	}
+	if _, resp := request(t, session, protocol.Request{Addr: target}); resp.Status != protocol.StatusOK {
+		t.Errorf("status %#x after the panic, want OK", resp.Status)
+	}
+}
@@ -0,0 +1,112 @@
+package server
+
+import (
+	"io"
+	"sync"
+)
+
+// relayBuffer reads ahead from src into a bounded buffer, so a relay
+// direction keeps taking data while its destination is briefly slow. It
+// holds at most len(buf) bytes.
+type relayBuffer struct {
+	src io.Reader
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	buf    []byte // ring; the filler writes only outside [start, start+size)
+	start  int
+	size   int
+	err    error // from src, returned once the buffer is drained
+	closed bool
+}
+
+func newRelayBuffer(src io.Reader, n int) *relayBuffer {
+	b := &relayBuffer{src: src, buf: make([]byte, n)}
+	b.cond = sync.NewCond(&b.mu)
+	go b.fill()
+	return b
+}
+
+// fill reads from src until it fails or the buffer is closed. A read
+// blocked in src returns once the relay closes src.
+func (b *relayBuffer) fill() {
+	for {
+		b.mu.Lock()
+		for b.size == len(b.buf) && !b.closed {
+			b.cond.Wait()
+		}
+		if b.closed {
+			b.mu.Unlock()
+			return
+		}
+		end := (b.start + b.size) % len(b.buf)
+		free := len(b.buf) - b.size
+		if end+free > len(b.buf) {
+			free = len(b.buf) - end
+		}
+		b.mu.Unlock()
+
+		n, err := b.src.Read(b.buf[end : end+free])
+
+		b.mu.Lock()
+		b.size += n
+		if err != nil {
+			b.err = err
+		}
+		b.cond.Broadcast()
+		b.mu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (b *relayBuffer) Read(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for b.size == 0 && b.err == nil && !b.closed {
+		b.cond.Wait()
+	}
+	if b.size == 0 {
+		if b.closed {
+			return 0, io.ErrClosedPipe
+		}
+		return 0, b.err
+	}
+	n := min(len(p), b.size, len(b.buf)-b.start)
+	copy(p, b.buf[b.start:b.start+n])
+	b.start = (b.start + n) % len(b.buf)
+	b.size -= n
+	b.cond.Broadcast()
+	return n, nil
+}
+
+// Close stops the filler once its current read from src returns.
+func (b *relayBuffer) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	b.cond.Broadcast()
+	return nil
+}
+
+// chunkWriter splits writes into pieces of at most max bytes. Each write
+// to a yamux stream becomes one frame, which the shared websocket carries
+// whole, so smaller frames let other streams' frames go out in between.
+type chunkWriter struct {
+	w   io.Writer
+	max int
+}
+
+func (c chunkWriter) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		n, err := c.w.Write(p[:min(len(p), c.max)])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
@@ -0,0 +1,208 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"net"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/hashicorp/yamux"
+
+	"github.com/jtolio/netpump-go/private/protocol"
+	"github.com/jtolio/netpump-go/private/wsconn"
+)
+
+// choppyReader returns what r has in pieces of random sizes.
+type choppyReader struct {
+	r   io.Reader
+	rng *rand.Rand
+}
+
+func (c choppyReader) Read(p []byte) (int, error) {
+	return c.r.Read(p[:1+c.rng.Intn(len(p))])
+}
+
+func TestRelayBufferIntegrity(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	want := make([]byte, 64*1024)
+	rng.Read(want)
+	for _, size := range []int{1, 7, 4096, 100 * 1024} {
+		b := newRelayBuffer(choppyReader{bytes.NewReader(want), rand.New(rand.NewSource(2))}, size)
+		got, err := io.ReadAll(choppyReader{b, rand.New(rand.NewSource(3))})
+		b.Close()
+		if err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("size %d: got %d bytes that differ from the %d sent", size, len(got), len(want))
+		}
+	}
+}
+
+// endlessReader counts the bytes read from it, of which there's no end.
+type endlessReader struct{ n atomic.Int64 }
+
+func (e *endlessReader) Read(p []byte) (int, error) {
+	e.n.Add(int64(len(p)))
+	return len(p), nil
+}
+
+func TestRelayBufferBound(t *testing.T) {
+	const size = 1000
+	src := &endlessReader{}
+	b := newRelayBuffer(src, size)
+	defer b.Close()
+
+	// settled waits for the filler to stop reading, returning the total.
+	settled := func() int64 {
+		last := src.n.Load()
+		for {
+			time.Sleep(50 * time.Millisecond)
+			n := src.n.Load()
+			if n == last {
+				return n
+			}
+			last = n
+		}
+	}
+	if n := settled(); n != size {
+		t.Fatalf("read %d bytes ahead with nothing taken, want %d", n, size)
+	}
+	if _, err := io.ReadFull(b, make([]byte, 300)); err != nil {
+		t.Fatal(err)
+	}
+	if n := settled(); n != size+300 {
+		t.Errorf("read %d bytes after 300 were taken, want %d", n, size+300)
+	}
+}
+
+func TestRelayBufferClose(t *testing.T) {
+	r, w := io.Pipe()
+	defer w.Close()
+	b := newRelayBuffer(r, 16)
+	read := make(chan error, 1)
+	go func() {
+		_, err := b.Read(make([]byte, 1))
+		read <- err
+	}()
+	b.Close()
+	select {
+	case err := <-read:
+		if err != io.ErrClosedPipe {
+			t.Errorf("read after Close = %v, want %v", err, io.ErrClosedPipe)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("read still blocked after Close")
+	}
+}
+
+// frameRecorder notes the size of each write.
+type frameRecorder struct {
+	bytes.Buffer
+	sizes []int
+}
+
+func (f *frameRecorder) Write(p []byte) (int, error) {
+	f.sizes = append(f.sizes, len(p))
+	return f.Buffer.Write(p)
+}
+
+func TestChunkWriter(t *testing.T) {
+	want := make([]byte, 10000)
+	rand.New(rand.NewSource(1)).Read(want)
+	var f frameRecorder
+	if n, err := (chunkWriter{w: &f, max: 4096}).Write(want); n != len(want) || err != nil {
+		t.Fatalf("wrote %d, %v", n, err)
+	}
+	if len(f.sizes) != 3 || f.sizes[0] != 4096 || f.sizes[1] != 4096 || f.sizes[2] != 10000-8192 {
+		t.Errorf("frames of %v", f.sizes)
+	}
+	if !bytes.Equal(f.Bytes(), want) {
+		t.Error("chunks don't add up to what was written")
+	}
+}
+
+// slowReadConn reads at only rate bytes per second, as a slow carrier
+// would deliver them.
+type slowReadConn struct {
+	net.Conn
+	rate int
+}
+
+func (c slowReadConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p[:min(len(p), 4096)])
+	time.Sleep(time.Duration(n) * time.Second / time.Duration(c.rate))
+	return n, err
+}
+
+// TestFrameCapHeadOfLine checks a small stream's round trips stay bounded
+// behind a bulk download over a slow carrier with WithMaxFrameBytes set.
+// A frame of the bulk stream may get ahead of each of them, and without
+// the cap that's a whole 32 KiB copy buffer.
+func TestFrameCapHeadOfLine(t *testing.T) {
+	const (
+		rate     = 256 << 10
+		maxFrame = 4096
+	)
+	s := New("127.0.0.1", 0, WithMaxFrameBytes(maxFrame))
+	if err := s.setup(); err != nil {
+		t.Fatal(err)
+	}
+	ln := newPipeListener()
+	hs := httptest.NewUnstartedServer(s.server.Handler)
+	hs.Listener = ln
+	hs.Start()
+	t.Cleanup(func() {
+		s.Stop()
+		hs.Close()
+	})
+	dialer := &websocket.Dialer{NetDialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := ln.dial(ctx, network, addr)
+		return slowReadConn{Conn: conn, rate: rate}, err
+	}}
+	ws, _, err := dialer.Dial("ws://pipe/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := yamux.DefaultConfig()
+	config.LogOutput = io.Discard
+	session, err := yamux.Client(wsconn.New(ws), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { session.Close() })
+
+	bulk, resp := request(t, session, protocol.Request{Addr: sourceTarget(t)})
+	if resp.Status != protocol.StatusOK {
+		t.Fatalf("status = %#x, want OK", resp.Status)
+	}
+	go io.Copy(io.Discard, bulk)
+	small, resp := request(t, session, protocol.Request{Addr: echoTarget(t)})
+	if resp.Status != protocol.StatusOK {
+		t.Fatalf("status = %#x, want OK", resp.Status)
+	}
+	// Let the bulk download get going first.
+	time.Sleep(200 * time.Millisecond)
+
+	limit := 4 * maxFrame * time.Second / rate
+	var worst time.Duration
+	for i := 0; i < 5; i++ {
+		start := time.Now()
+		if _, err := small.Write([]byte("x")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadFull(small, make([]byte, 1)); err != nil {
+			t.Fatal(err)
+		}
+		worst = max(worst, time.Since(start))
+	}
+	if worst > limit {
+		t.Errorf("small stream round trips took up to %v behind the bulk one, want at most %v", worst, limit)
+	}
+}
@@ -0,0 +1,83 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/hashicorp/yamux"
+
+	"github.com/jtolio/netpump-go/private/protocol"
+)
+
+// resettingTarget listens on loopback. For each connection it sends
+// "hello", waits for a byte back, and then resets the connection, until
+// the test ends. It returns its address.
+func resettingTarget(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if _, err := conn.Write([]byte("hello")); err != nil {
+					return
+				}
+				if _, err := conn.Read(make([]byte, 1)); err != nil {
+					return
+				}
+				conn.(*net.TCPConn).SetLinger(0)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestTargetResetResetsStream(t *testing.T) {
+	_, url := startServer(t)
+	session := dialSession(t, url)
+	target := resettingTarget(t)
+
+	// While the client keeps writing, the copy towards the target can be
+	// the one to see the reset, and the other copy closing the stream
+	// mustn't get a FIN to the client ahead of the RST.
+	for name, writing := range map[string]bool{"reading": false, "writing": true} {
+		t.Run(name, func(t *testing.T) {
+			for i := 0; i < 20; i++ {
+				stream, resp := request(t, session, protocol.Request{Addr: target})
+				if resp.Status != protocol.StatusOK {
+					t.Fatalf("status = %#x, want %#x", resp.Status, protocol.StatusOK)
+				}
+				got := make([]byte, 5)
+				if _, err := io.ReadFull(stream, got); err != nil {
+					t.Fatal(err)
+				}
+				if _, err := stream.Write([]byte{1}); err != nil {
+					t.Fatal(err)
+				}
+				if writing {
+					go func() {
+						chunk := make([]byte, 1024)
+						for {
+							if _, err := stream.Write(chunk); err != nil {
+								return
+							}
+						}
+					}()
+				}
+				if _, err := io.Copy(io.Discard, stream); !errors.Is(err, yamux.ErrConnectionReset) {
+					t.Fatalf("attempt %d: read error = %v, want a reset", i, err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,124 @@
+package server
+
+import (
+	"context"
+	"net"
+	"sync"
+)
+
+// lookupGroup coalesces concurrent lookups of the same host, for
+// WithDNSCoalescing: a burst of streams to one host, as browsers open
+// for parallel requests, waits on a single lookup rather than making one
+// each. Nothing is kept once a lookup is done.
+type lookupGroup struct {
+	resolver ipResolver
+	sink     MetricsSink
+
+	mu    sync.Mutex
+	calls map[string]*lookupCall
+}
+
+// ipResolver looks up a host's addresses, as net.Resolver does.
+type ipResolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+type lookupCall struct {
+	done    chan struct{}
+	addrs   []net.IPAddr
+	err     error
+	waiters int
+	cancel  context.CancelFunc
+}
+
+var (
+	lookupMade   = map[string]string{"shared": "false"}
+	lookupShared = map[string]string{"shared": "true"}
+)
+
+// lookup resolves host, joining a lookup of it already in flight if
+// there is one. The lookup is abandoned once every caller waiting on it
+// has given up.
+func (g *lookupGroup) lookup(ctx context.Context, host string) ([]net.IPAddr, error) {
+	g.mu.Lock()
+	call, ok := g.calls[host]
+	if ok {
+		g.sink.IncCounter(MetricDNSLookups, lookupShared, 1)
+	} else {
+		g.sink.IncCounter(MetricDNSLookups, lookupMade, 1)
+		lookupCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		call = &lookupCall{done: make(chan struct{}), cancel: cancel}
+		if g.calls == nil {
+			g.calls = make(map[string]*lookupCall)
+		}
+		g.calls[host] = call
+		go g.run(lookupCtx, host, call)
+	}
+	call.waiters++
+	g.mu.Unlock()
+
+	select {
+	case <-call.done:
+		return call.addrs, call.err
+	case <-ctx.Done():
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if call.waiters--; call.waiters == 0 {
+		call.cancel()
+		g.forget(host, call)
+	}
+	return nil, ctx.Err()
+}
+
+func (g *lookupGroup) run(ctx context.Context, host string, call *lookupCall) {
+	defer call.cancel()
+	call.addrs, call.err = g.resolver.LookupIPAddr(ctx, host)
+	g.mu.Lock()
+	g.forget(host, call)
+	g.mu.Unlock()
+	close(call.done)
+}
+
+// forget stops new lookups of host joining call, leaving a newer one in
+// its place alone. The caller must hold mu.
+func (g *lookupGroup) forget(host string, call *lookupCall) {
+	if g.calls[host] == call {
+		delete(g.calls, host)
+	}
+}
+
+// dialCoalesced dials target with dialer like DialContext, but resolves
+// its host through the server's lookupGroup. Its addresses are tried in
+// turn, each with whatever time is left, and the first error is returned
+// if none can be reached.
+func (s *Server) dialCoalesced(ctx context.Context, dialer *net.Dialer, target string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, err
+	}
+	if net.ParseIP(host) != nil {
+		return dialer.DialContext(ctx, "tcp", target)
+	}
+	addrs, err := s.lookups.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	var firstErr error
+	for _, addr := range addrs {
+		conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(addr.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	if firstErr == nil {
+		firstErr = &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return nil, firstErr
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jtolio/netpump-go/private/protocol"
+)
+
+// countingResolver resolves every host to loopback once release is
+// closed, counting the lookups it's asked for.
+type countingResolver struct {
+	lookups atomic.Int64
+	release chan struct{}
+}
+
+func (r *countingResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	r.lookups.Add(1)
+	select {
+	case <-r.release:
+		return []net.IPAddr{{IP: net.IPv4(127, 0, 0, 1)}}, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func TestDNSCoalescing(t *testing.T) {
+	const streams = 8
+	sink := newRecordingSink()
+	s, url := startServer(t, WithDNSCoalescing(), WithMetricsSink(sink))
+	resolver := &countingResolver{release: make(chan struct{})}
+	s.lookups.resolver = resolver
+	_, port, _ := net.SplitHostPort(echoTarget(t))
+	target := net.JoinHostPort("target.test", port)
+	session := dialSession(t, url)
+
+	var wg sync.WaitGroup
+	statuses := make(chan byte, streams)
+	for i := 0; i < streams; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			stream, err := session.Open()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer stream.Close()
+			stream.SetDeadline(time.Now().Add(10 * time.Second))
+			if err := protocol.WriteRequest(stream, protocol.Request{Addr: target}); err != nil {
+				t.Error(err)
+				return
+			}
+			resp, err := protocol.ReadResponse(stream)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			statuses <- resp.Status
+		}()
+	}
+
+	// Every stream joins the one lookup before it's allowed to finish.
+	shared := metricKey(MetricDNSLookups, lookupShared)
+	for deadline := time.Now().Add(10 * time.Second); sink.counter(shared) < streams-1; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("only %v of %d streams joined the lookup", sink.counter(shared), streams-1)
+		}
+	}
+	close(resolver.release)
+	wg.Wait()
+	close(statuses)
+	for status := range statuses {
+		if status != protocol.StatusOK {
+			t.Errorf("status = %#x, want OK", status)
+		}
+	}
+	if n := resolver.lookups.Load(); n != 1 {
+		t.Fatalf("%d lookups for %d concurrent streams, want 1", n, streams)
+	}
+
+	// Nothing is kept once the lookup is done: each later stream looks
+	// the host up again, exactly once.
+	for i := 2; i <= 3; i++ {
+		if _, resp := request(t, session, protocol.Request{Addr: target}); resp.Status != protocol.StatusOK {
+			t.Fatalf("status = %#x, want OK", resp.Status)
+		}
+		if n := resolver.lookups.Load(); n != int64(i) {
+			t.Fatalf("%d lookups after %d rounds of streams, want %d", n, i, i)
+		}
+	}
+}
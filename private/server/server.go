@@ -1,16 +1,30 @@
 package server
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"net"
 	"net/http"
+	"runtime/debug"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/hashicorp/yamux"
+
+	"github.com/jtolio/netpump-go/private/eventlog"
+	"github.com/jtolio/netpump-go/private/protocol"
+	"github.com/jtolio/netpump-go/private/wsconn"
 )
 
 type Server struct {
@@ -19,191 +33,1219 @@ type Server struct {
 	log      *slog.Logger
 	upgrader websocket.Upgrader
 	server   *http.Server
-}
+	ctx      context.Context
+	cancel   context.CancelFunc
+	// drainCtx is done once Shutdown starts, to stop accepting streams.
+	drainCtx context.Context
+	drain    context.CancelFunc
 
-func New(host string, port int) *Server {
-	return &Server{
-		host: host,
-		port: port,
-		log:  slog.Default().With("component", "server"),
-		upgrader: websocket.Upgrader{
-			CheckOrigin: func(r *http.Request) bool {
-				return true
-			},
-		},
-	}
+	shutdownTimeout time.Duration
+	writeTimeout    time.Duration
+	// More timeouts, set by WithTimeouts. Zero means off.
+	dialTimeout      time.Duration
+	handshakeTimeout time.Duration
+	controlTimeout   time.Duration
+	keepAlive        time.Duration
+
+	tenants        []*tenant
+	allowedOrigins atomic.Pointer[[]string]
+	clientConfig   []string              // allowed client IPs and ranges, parsed by Start
+	proxyConfig    []string              // trusted proxies, parsed by Start
+	allowedClients atomic.Pointer[ipSet] // nil to allow any client
+	trustedProxies ipSet
+	upstreamConfig []Upstream
+	upstreams      *upstreamPool
+	dnsCoalescing  bool
+	lookups        *lookupGroup
+	rateLimit      atomic.Pointer[rateLimiter] // nil without a global rate limit
+	rateMu         sync.Mutex                  // serializes SetGlobalRateLimit
+	hostLimits     *hostLimits
+	sni            *sniPolicy
+	targetTLSRules []TargetTLS
+	slowDial       time.Duration
+	slowFirstByte  time.Duration
+	targetLimit    int
+	targetWindow   time.Duration
+	targetReject   bool
+	labels         labels
+	healthCanary   string
+	instanceID     string
+	tlsConfig      *tls.Config
+	httpsRedirect  bool
+	sessionPolicy  SessionPolicy
+	relayBuffer    int
+	requestBudget  *requestBudget
+	streamMemory   *streamMemory
+	accessLog      *accessLog
+	accessBuffer   *accessBuffer
+	conntrack      *conntrack
+	maxFrame       int
+	streamWindow   int
+	dscp           int // -1 for none
+	carrierDSCP    int // -1 for none
+	dscpFailed     sync.Once
+	buffers        *bufferPool
+	deny           atomic.Pointer[denyPolicy]
+	nextSession    atomic.Uint64
+	health         deepHealth
+	metrics        MetricsSink
+	events         *eventlog.Ring
+	adminToken     string
+	logSampler     *logSampler
+	idleProbe      time.Duration
+	carrierIdle    time.Duration
+	maxPending     int
+	maxSessions    int
+	maxStreams     int
+	streamQueue    time.Duration
+	slots          *streamSlots
+	migrateTo      string
+	load           *loadShedder
+	minBytes       int64 // per minWindow, 0 for no minimum
+	minWindow      time.Duration
+	minClose       bool
+	carriers       atomic.Int64 // websockets being served
+	activeStreams  atomic.Int64
+	totalStreams   atomic.Uint64
+	sent           atomic.Int64 // to targets
+	received       atomic.Int64 // from targets
+	started        time.Time
+
+	// Teardown tracking
+	wg       sync.WaitGroup
+	streamWG sync.WaitGroup
+	trackMu  sync.Mutex
+	stopping bool
+	stopped  chan struct{} // closed once the first Shutdown returns
+	sessions map[*yamux.Session]*clientSession
 }
 
-func (s *Server) Start() error {
-	s.log.Info("netpump server starting", "host", s.host, "port", s.port)
+// ErrInvalidConfig is wrapped by Start's errors for options that can't
+// be used as given, as opposed to failures while serving.
+var ErrInvalidConfig = errors.New("invalid configuration")
+
+func New(host string, port int, opts ...Option) *Server {
+	ctx, cancel := context.WithCancel(context.Background())
+	drainCtx, drain := context.WithCancel(ctx)
+	s := &Server{
+		host:         host,
+		port:         port,
+		log:          slog.Default().With("component", "server"),
+		ctx:          ctx,
+		cancel:       cancel,
+		drainCtx:     drainCtx,
+		drain:        drain,
+		sessions:     make(map[*yamux.Session]*clientSession),
+		stopped:      make(chan struct{}),
+		started:      time.Now(),
+		writeTimeout: wsconn.DefaultWriteTimeout,
+
+		dialTimeout:      defaultDialTimeout,
+		handshakeTimeout: defaultHandshakeTimeout,
+		controlTimeout:   defaultControlTimeout,
+		keepAlive:        yamux.DefaultConfig().KeepAliveInterval,
+
+		metrics:     nopSink{},
+		dscp:        -1,
+		carrierDSCP: -1,
+		buffers:     &bufferPool{size: defaultCopyBufferSize, max: defaultPooledBuffers},
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.buffers.metrics = s.metrics
+	if s.events != nil {
+		s.log = slog.New(s.events.Handler(slog.Default().Handler())).With("component", "server")
+	}
+	if s.instanceID == "" {
+		s.instanceID = newInstanceID()
+	}
+	s.log = s.log.With("instance", s.instanceID)
+	s.upgrader.CheckOrigin = s.checkOrigin
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", s.handleHealth)
+	mux.HandleFunc("/health/deep", s.handleDeepHealth)
 	mux.HandleFunc("/ws", s.handleWebSocket)
+	if h, ok := s.metrics.(http.Handler); ok {
+		mux.Handle("/metrics", h)
+	}
+	if s.events != nil && s.adminToken != "" {
+		mux.Handle("/events", s.adminOnly(s.events))
+	}
+	if s.adminToken != "" {
+		s.conntrack = newConntrack()
+		mux.Handle("/conns", s.adminOnly(http.HandlerFunc(s.handleConns)))
+		mux.Handle("/ratelimit", s.adminOnly(http.HandlerFunc(s.handleRateLimit)))
+		mux.Handle("/snapshot", s.adminOnly(http.HandlerFunc(s.handleSnapshot)))
+	}
 
 	s.server = &http.Server{
-		Addr:    fmt.Sprintf("%s:%d", s.host, s.port),
+		Addr:    net.JoinHostPort(s.host, strconv.Itoa(s.port)),
 		Handler: mux,
 	}
+	return s
+}
 
-	return s.server.ListenAndServe()
+func (s *Server) Start() error {
+	s.log.Info("netpump server starting", "host", s.host, "port", s.port)
+
+	if err := s.setup(); err != nil {
+		return err
+	}
+
+	var err error
+	if s.tlsConfig != nil {
+		err = s.serveTLS()
+	} else {
+		err = s.server.ListenAndServe()
+	}
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
 }
 
-func (s *Server) Stop() error {
-	if s.server != nil {
-		return s.server.Close()
+// setup checks the configuration and starts the background work Start
+// needs before it serves.
+func (s *Server) setup() error {
+	if s.streamWindow != 0 && (s.streamWindow < minStreamWindow || s.streamWindow > maxStreamWindow) {
+		return fmt.Errorf("%w: stream window must be between %d and %d bytes", ErrInvalidConfig, minStreamWindow, maxStreamWindow)
+	}
+	if s.buffers.size <= 0 {
+		return fmt.Errorf("%w: copy buffer size must be positive", ErrInvalidConfig)
+	}
+	if s.migrateTo != "" {
+		if err := checkMigrateURL(s.migrateTo); err != nil {
+			return fmt.Errorf("%w: %w", ErrInvalidConfig, err)
+		}
+	}
+
+	var err error
+	if s.clientConfig != nil {
+		set, err := parseIPSet(s.clientConfig)
+		if err != nil {
+			return fmt.Errorf("%w: allowed clients: %w", ErrInvalidConfig, err)
+		}
+		s.allowedClients.Store(&set)
+	}
+	if s.proxyConfig != nil {
+		if s.trustedProxies, err = parseIPSet(s.proxyConfig); err != nil {
+			return fmt.Errorf("%w: trusted proxies: %w", ErrInvalidConfig, err)
+		}
+	}
+
+	if len(s.upstreamConfig) > 0 {
+		pool := &upstreamPool{}
+		for _, u := range s.upstreamConfig {
+			up, err := newUpstream(u, s.targetControl(), s.dscpControl(s.dscp))
+			if err != nil {
+				return fmt.Errorf("%w: %w", ErrInvalidConfig, err)
+			}
+			pool.upstreams = append(pool.upstreams, up)
+		}
+		s.upstreams = pool
+	}
+
+	if s.maxStreams > 0 {
+		s.slots = &streamSlots{max: s.maxStreams, wait: s.streamQueue, sink: s.metrics}
+	}
+	if s.dnsCoalescing {
+		s.lookups = &lookupGroup{resolver: net.DefaultResolver, sink: s.metrics}
+	}
+	if s.accessLog != nil && s.accessBuffer != nil && s.track() {
+		b := s.accessBuffer
+		b.room = sync.NewCond(&s.accessLog.mu)
+		b.kick = make(chan struct{}, 1)
+		s.accessLog.buffer = b
+		go s.flushAccessLog()
+	}
+	if s.load != nil && (s.load.limits.Goroutines > 0 || s.load.limits.HeapBytes > 0) && s.track() {
+		go s.watchLoad()
 	}
 	return nil
 }
 
+// serveTLS serves on a tlsListener, so plaintext clients are told to use
+// TLS instead of failing the handshake.
+func (s *Server) serveTLS() error {
+	ln, err := net.Listen("tcp", s.server.Addr)
+	if err != nil {
+		return err
+	}
+	config := s.tlsConfig.Clone()
+	if len(config.NextProtos) == 0 {
+		// Websockets need HTTP/1.1.
+		config.NextProtos = []string{"http/1.1"}
+	}
+	return s.server.Serve(&tlsListener{Listener: ln, config: config, redirect: s.httpsRedirect, log: s.log})
+}
+
+// Stop shuts the server down and waits until the listener, every session
+// and all stream goroutines are gone.
+func (s *Server) Stop() error {
+	return s.Shutdown(context.Background())
+}
+
+// Shutdown is like Stop, but gives up waiting for teardown once ctx is
+// done, returning ctx.Err() along with any errors from closing.
+//
+// New sessions and streams are refused right away. Streams already in
+// flight get up to the shutdown timeout to finish before their sessions
+// are forcibly closed. With WithMigrateTo, clients are told to move to
+// the other server.
+//
+// It's safe to call more than once, and concurrently: later calls wait for
+// the first one's teardown, or for their own ctx, and return nil.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.trackMu.Lock()
+	if s.stopping {
+		s.trackMu.Unlock()
+		select {
+		case <-s.stopped:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	s.stopping = true
+	s.trackMu.Unlock()
+	defer close(s.stopped)
+	s.drain()
+
+	var errs []error
+	if err := s.server.Close(); err != nil {
+		errs = append(errs, err)
+	}
+
+	var carriers []*wsconn.Conn
+	s.trackMu.Lock()
+	for session, sess := range s.sessions {
+		session.GoAway()
+		if s.migrateTo != "" && sess.primary {
+			carriers = append(carriers, sess.carrier)
+		}
+	}
+	s.trackMu.Unlock()
+	for _, carrier := range carriers {
+		// Clients that can't be told carry on until their streams finish.
+		carrier.Migrate(s.migrateTo)
+	}
+
+	if !waitTimeout(ctx, &s.streamWG, s.shutdownTimeout) {
+		s.log.Warn("shutdown timeout reached, closing remaining streams")
+	}
+
+	s.cancel()
+	s.trackMu.Lock()
+	for session := range s.sessions {
+		session.Close()
+	}
+	s.trackMu.Unlock()
+
+	if !waitTimeout(ctx, &s.wg, -1) {
+		errs = append(errs, ctx.Err())
+	}
+	return errors.Join(errs...)
+}
+
+// waitTimeout waits for wg, giving up when ctx is done or, if timeout is
+// not negative, once timeout has passed. It reports whether wg finished.
+func waitTimeout(ctx context.Context, wg *sync.WaitGroup, timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	var expired <-chan time.Time
+	if timeout >= 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	select {
+	case <-done:
+		return true
+	case <-expired:
+	case <-ctx.Done():
+	}
+	return false
+}
+
+// track registers a goroutine with the server's WaitGroup. It refuses once
+// shutdown has begun so that Add never races with Wait.
+func (s *Server) track() bool {
+	s.trackMu.Lock()
+	defer s.trackMu.Unlock()
+	if s.stopping {
+		return false
+	}
+	s.wg.Add(1)
+	return true
+}
+
+// trackStream is like track, but also counts the goroutine as in-flight
+// work that a graceful shutdown waits for.
+func (s *Server) trackStream() bool {
+	s.trackMu.Lock()
+	defer s.trackMu.Unlock()
+	if s.stopping {
+		return false
+	}
+	s.wg.Add(1)
+	s.streamWG.Add(1)
+	return true
+}
+
 func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set(instanceHeader, s.instanceID)
 	w.WriteHeader(http.StatusOK)
-	fmt.Fprintf(w, "netpump server v2.0.0\n")
+	fmt.Fprintf(w, "netpump server v2.0.0\ninstance %s\n", s.instanceID)
+}
+
+// instanceHeader names the server instance in health and upgrade
+// responses, so operators can tell which server behind a load balancer
+// answered.
+const instanceHeader = "X-Netpump-Instance"
+
+func newInstanceID() string {
+	var b [6]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
 }
 
 func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
-	ws, err := s.upgrader.Upgrade(w, r, nil)
+	// The http.Server doesn't wait for hijacked connections on Close, so
+	// track this handler ourselves.
+	if !s.track() {
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	defer s.wg.Done()
+
+	clientIP := s.getClientIP(r)
+	peerIP := s.peerIP(r)
+	if !s.clientAllowed(clientIP) {
+		s.log.Warn("rejected client from an address that isn't allowed", "ip", clientIP)
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	tenant, ok := s.authenticate(r)
+	if !ok {
+		s.log.Warn("rejected unauthenticated client", "ip", clientIP)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	subSessions := 1
+	if v := r.URL.Query().Get("sessions"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > wsconn.MaxDemux {
+			s.log.Warn("rejected client asking for a bad number of sub-sessions", "ip", clientIP, "sessions", v)
+			http.Error(w, fmt.Sprintf("sessions must be between 1 and %d", wsconn.MaxDemux), http.StatusBadRequest)
+			return
+		}
+		subSessions = n
+	}
+
+	if metric, over := s.overloaded(); over {
+		s.log.Warn("rejected client, server is overloaded", "ip", clientIP, "metric", metric)
+		http.Error(w, "overloaded", http.StatusServiceUnavailable)
+		return
+	}
+	if n := s.carriers.Add(1); s.maxSessions > 0 && n > int64(s.maxSessions) {
+		s.carriers.Add(-1)
+		s.log.Warn("rejected client, server is at its session limit", "ip", clientIP, "limit", s.maxSessions)
+		http.Error(w, "too many sessions", http.StatusServiceUnavailable)
+		return
+	}
+	defer s.carriers.Add(-1)
+
+	if tenant != nil {
+		client := clientKey(peerIP)
+		if !tenant.claimSession(s.sessionPolicy, client) {
+			s.log.Warn("rejected client, it already has a session as this tenant", "ip", clientIP, "tenant", tenant.Name)
+			http.Error(w, "already connected as this tenant", http.StatusConflict)
+			return
+		}
+		defer tenant.releaseSession(client)
+	}
+
+	ws, err := s.upgrader.Upgrade(w, r, http.Header{instanceHeader: {s.instanceID}})
 	if err != nil {
 		s.log.Error("websocket upgrade failed", "error", err)
 		return
 	}
 	defer ws.Close()
+	s.markCarrier(ws.UnderlyingConn())
 
-	clientIP := s.getClientIP(r)
-	s.log.Info("client connected", "ip", clientIP)
+	log := s.log.With("ip", clientIP)
+	if tenant != nil {
+		log = log.With("tenant", tenant.Name)
+	}
+	log.Info("client connected")
 
-	// Setup yamux session
-	conn := &wsAdapter{ws: ws}
-	session, err := yamux.Server(conn, nil)
+	// Setup yamux sessions, one per sub-session the client asked for.
+	conns := []*wsconn.Conn{wsconn.New(ws)}
+	if subSessions > 1 {
+		conns = wsconn.Demux(ws, subSessions)
+	}
+	var activity *carrierActivity
+	if s.carrierIdle > 0 && s.track() {
+		activity = &carrierActivity{}
+		done := make(chan struct{})
+		defer close(done)
+		go s.closeIdleCarrier(ws, conns[0], activity, log, done)
+	}
+	if len(conns) == 1 {
+		s.serveSession(conns[0], clientIP, peerIP, tenant, log, true, activity)
+		return
+	}
+	var subs sync.WaitGroup
+	for i, conn := range conns[1:] {
+		subs.Add(1)
+		go func(conn *wsconn.Conn, log *slog.Logger) {
+			defer subs.Done()
+			s.serveSession(conn, clientIP, peerIP, tenant, log, false, activity)
+		}(conn, log.With("subsession", i+1))
+	}
+	// The others go with the primary sub-session, which the client relies
+	// on and which alone counts towards the tenant's sessions.
+	s.serveSession(conns[0], clientIP, peerIP, tenant, log.With("subsession", 0), true, activity)
+	for _, conn := range conns[1:] {
+		conn.Close()
+	}
+	subs.Wait()
+}
+
+// serveSession runs a yamux session over conn, relaying its streams until
+// it closes. Only the primary one of a websocket's sub-sessions counts
+// towards the tenant's session policy. Its streams are noted in activity,
+// shared by the sub-sessions, if that's not nil.
+func (s *Server) serveSession(conn *wsconn.Conn, clientIP, peerIP string, tenant *tenant, log *slog.Logger, primary bool, activity *carrierActivity) {
+	conn.SetWriteTimeout(s.writeTimeout)
+	session, err := yamux.Server(conn, s.muxConfig())
 	if err != nil {
 		s.log.Error("yamux setup failed", "error", err)
 		return
 	}
 	defer session.Close()
 
+	sess := &clientSession{
+		id:       s.nextSession.Add(1),
+		carrier:  conn,
+		ip:       clientIP,
+		peerIP:   peerIP,
+		tenant:   tenant,
+		start:    time.Now(),
+		log:      log,
+		done:     session.CloseChan(),
+		streams:  make(map[uint32]*relayedStream),
+		session:  session,
+		primary:  primary,
+		activity: activity,
+	}
+	s.trackMu.Lock()
+	if s.stopping {
+		s.trackMu.Unlock()
+		return
+	}
+	s.sessions[session] = sess
+	s.trackMu.Unlock()
+	defer func() {
+		s.trackMu.Lock()
+		delete(s.sessions, session)
+		s.trackMu.Unlock()
+	}()
+	if s.flowDiagnostics() && s.track() {
+		go s.probeRTT(sess)
+	}
+	if s.minBytes > 0 && s.track() {
+		go s.watchThroughput(sess)
+	}
+
+	if tenant != nil && primary {
+		others := tenant.addSession(sess, clientKey(peerIP))
+		defer tenant.removeSession(sess)
+		if s.sessionPolicy == SessionsReplace {
+			for _, other := range others {
+				other.superseded.Store(true)
+				other.session.Close()
+			}
+		}
+	}
+
 	// Accept streams
 	for {
-		stream, err := session.Accept()
+		stream, err := session.AcceptStreamWithContext(s.drainCtx)
 		if err != nil {
-			if err == io.EOF {
-				s.log.Info("client disconnected", "ip", clientIP)
+			if s.drainCtx.Err() != nil {
+				// Draining; the session stays up for streams already in
+				// flight until Shutdown closes it.
+				log.Info("draining, no longer accepting streams")
+				<-session.CloseChan()
+				return
+			}
+			if sess.superseded.Load() {
+				log.Info("session superseded by a newer one from the same client and tenant")
+			} else if activity != nil && activity.closed.Load() {
+				// closeIdleCarrier said why.
+			} else if err == io.EOF {
+				log.Info("client disconnected")
 			} else {
-				s.log.Error("stream accept error", "error", err)
+				log.Error("stream accept error", "error", err)
 			}
 			return
 		}
 
-		go s.handleStream(stream)
+		if s.maxPending > 0 && sess.pending.Load() >= int64(s.maxPending) {
+			log.Warn("too many streams waiting for their request, rejecting", "max", s.maxPending)
+			protocol.WriteFailure(stream, protocol.StatusFailed)
+			stream.Close()
+			continue
+		}
+		if s.requestBudget != nil && s.requestBudget.exhausted() {
+			log.Warn("request memory budget exhausted, rejecting stream")
+			protocol.WriteFailure(stream, protocol.StatusFailed)
+			stream.Close()
+			continue
+		}
+		if metric, over := s.overloaded(); over {
+			log.Warn("server is overloaded, rejecting stream", "metric", metric)
+			protocol.WriteFailure(stream, protocol.StatusFailed)
+			stream.Close()
+			continue
+		}
+		if !s.trackStream() {
+			// Draining; the session stays up for streams already in flight.
+			stream.Close()
+			continue
+		}
+		sess.pending.Add(1)
+		if activity != nil {
+			activity.streamStarted()
+		}
+		go s.handleStream(sess, stream)
 	}
 }
 
-func (s *Server) handleStream(stream net.Conn) {
+func (s *Server) handleStream(sess *clientSession, stream *yamux.Stream) {
+	defer s.wg.Done()
+	defer s.streamWG.Done()
+	counted := sess.activity != nil
+	defer func() {
+		if counted {
+			sess.activity.streamEnded()
+		}
+	}()
 	defer stream.Close()
+	// A bug handling one stream shouldn't take down every other client.
+	defer func() {
+		if r := recover(); r != nil {
+			sess.log.Error("panic in stream handler", "stream", stream.StreamID(), "panic", r, "stack", string(debug.Stack()))
+		}
+	}()
 
-	// Read target address length
-	lenBuf := make([]byte, 1)
-	if _, err := io.ReadFull(stream, lenBuf); err != nil {
-		s.log.Error("failed to read address length", "error", err)
+	// Read target address
+	accepted := time.Now()
+	if s.handshakeTimeout > 0 {
+		// A client that opens a stream and says nothing mustn't hold it
+		// open for good.
+		stream.SetReadDeadline(accepted.Add(s.handshakeTimeout))
+	}
+	var src io.Reader = stream
+	var br *budgetReader
+	if s.requestBudget != nil {
+		br = &budgetReader{r: stream, b: s.requestBudget}
+		src = br
+	}
+	req, err := protocol.ReadRequest(src)
+	stream.SetReadDeadline(time.Time{})
+	if br != nil {
+		// The request is parsed, so its bytes are no longer held.
+		br.release()
+	}
+	requestTime := time.Since(accepted)
+	sess.pending.Add(-1)
+	if errors.Is(err, errRequestBudget) {
+		sess.log.Warn("request memory budget exhausted, rejecting stream")
+		protocol.WriteFailure(stream, protocol.StatusFailed)
 		return
 	}
-
-	// Read target address
-	addrLen := int(lenBuf[0])
-	addrBuf := make([]byte, addrLen)
-	if _, err := io.ReadFull(stream, addrBuf); err != nil {
-		s.log.Error("failed to read address", "error", err)
+	if errors.Is(err, protocol.ErrInvalidAddr) {
+		sess.log.Warn("rejecting malformed request", "error", err)
+		writeFailure(stream, req, protocol.StatusFailed, "invalid target address")
+		return
+	}
+	if errors.Is(err, yamux.ErrTimeout) {
+		sess.log.Warn("client sent no request in time, dropping stream", "timeout", s.handshakeTimeout)
+		return
+	}
+	if err != nil {
+		sess.log.Error("failed to read address", "error", err)
+		return
+	}
+	if (req.Control || req.Capabilities) && counted {
+		// These stay open with the session rather than carry traffic, so
+		// they mustn't keep the carrier from going idle.
+		sess.activity.streamEnded()
+		counted = false
+	}
+	if req.Control {
+		s.handleControl(sess, stream)
+		return
+	}
+	if req.Capabilities {
+		s.handleCapabilities(sess, stream)
 		return
 	}
 
-	target := string(addrBuf)
+	if sess.tenant != nil {
+		if !sess.tenant.acquireStream() {
+			sess.log.Warn("tenant limit reached, rejecting stream")
+			writeFailure(stream, req, protocol.StatusFailed, "too many connections for this tenant")
+			return
+		}
+		defer sess.tenant.releaseStream()
+	}
+	if s.slots != nil {
+		client := sess.peerIP
+		if sess.tenant != nil {
+			client = "tenant " + sess.tenant.Name
+		}
+		queueStart := time.Now()
+		ok, queued := s.slots.acquire(client, sess.done)
+		if queued {
+			s.metrics.ObserveHistogram(MetricStreamQueueSeconds, nil, time.Since(queueStart).Seconds())
+		}
+		if !ok {
+			sess.log.Warn("server stream limit reached, rejecting stream", "queued", queued)
+			writeFailure(stream, req, protocol.StatusFailed, "too many connections on the server")
+			return
+		}
+		defer s.slots.release()
+	}
+	if s.streamMemory != nil {
+		footprint := s.streamFootprint()
+		if !s.streamMemory.reserve(footprint) {
+			sess.log.Warn("stream memory budget exhausted, rejecting stream", "footprint", footprint)
+			writeFailure(stream, req, protocol.StatusFailed, "server is out of memory for connections")
+			return
+		}
+		defer s.streamMemory.release(footprint)
+	}
+	target := req.Addr
+	log := sess.log
+	var counter *labelCounter
+	if req.Source != "" {
+		log = log.With("source", req.Source)
+	}
+	if req.Label != "" {
+		log = log.With("label", req.Label)
+		counter = s.labels.counter(req.Label)
+		counter.streams.Add(1)
+	}
+
+	s.metrics.IncCounter(MetricStreams, nil, 1)
+	s.totalStreams.Add(1)
+	var access *accessRecord
+	if s.accessLog != nil {
+		access = &accessRecord{start: time.Now(), ip: sess.ip, target: target}
+		if sess.tenant != nil {
+			access.user = sess.tenant.Name
+		}
+		defer s.accessLog.write(access)
+	}
+	var tracked *trackedConn
+	if s.conntrack != nil {
+		info := ConnInfo{
+			Session:  sess.id,
+			Stream:   stream.StreamID(),
+			ClientIP: sess.ip,
+			Label:    req.Label,
+			Target:   target,
+			Start:    time.Now(),
+		}
+		if sess.tenant != nil {
+			info.Tenant = sess.tenant.Name
+		}
+		var untrack func()
+		tracked, untrack = s.conntrack.add(info, sess)
+		defer untrack()
+	}
+
+	if !s.checkTargetSpread(sess, target) {
+		s.metrics.IncCounter(MetricDialFailures, failureLabels(protocol.StatusDenied), 1)
+		if access != nil {
+			access.status = accessStatus(protocol.StatusDenied)
+		}
+		writeFailure(stream, req, protocol.StatusDenied, "too many distinct targets")
+		return
+	}
 
 	// Connect to target
-	conn, err := net.DialTimeout("tcp", target, 10*time.Second)
+	dialStart := time.Now()
+	conn, up, err := s.dialTarget(target)
+	dialTime := time.Since(dialStart)
+	s.metrics.ObserveHistogram(MetricDialSeconds, nil, dialTime.Seconds())
+	if up != nil {
+		log = log.With("upstream", up.Name)
+	}
+	if s.slowDial > 0 && dialTime > s.slowDial {
+		log.Warn("slow dial", "target", target, "duration", dialTime)
+	}
 	if err != nil {
-		s.log.Error("connection failed", "target", target, "error", err)
-		stream.Write([]byte{0x01}) // Send failure
+		status := dialStatus(err)
+		if status == protocol.StatusDenied {
+			log.Warn("target denied by policy", "target", target)
+		} else {
+			log.Error("connection failed", "target", target, "error", err)
+		}
+		s.metrics.IncCounter(MetricDialFailures, failureLabels(status), 1)
+		if access != nil {
+			access.status = accessStatus(status)
+		}
+		writeFailure(stream, req, status, failureReason(err))
 		return
 	}
 	defer conn.Close()
 
-	// Send success
-	stream.Write([]byte{0x00})
+	bound := conn.LocalAddr()
+	if bc, ok := conn.(interface{ BoundAddr() net.Addr }); ok {
+		// SOCKS5 upstreams report the address they connected from.
+		bound = bc.BoundAddr()
+	}
+
+	var tlsTime time.Duration
+	if rule := s.targetTLS(target); rule != nil {
+		ctx, cancel := withTimeout(s.ctx, s.handshakeTimeout)
+		tlsStart := time.Now()
+		tc, err := rule.wrapTLS(ctx, conn, target)
+		tlsTime = time.Since(tlsStart)
+		cancel()
+		if err != nil {
+			log.Error("connection failed", "target", target, "error", err)
+			if access != nil {
+				access.status = accessStatus(protocol.StatusFailed)
+			}
+			writeFailure(stream, req, protocol.StatusFailed, "TLS to target failed: "+failureReason(err))
+			return
+		}
+		conn = tc
+		defer conn.Close()
+	}
+
+	if access != nil {
+		access.status = accessStatus(protocol.StatusOK)
+	}
 
-	s.log.Info("proxying", "target", target)
+	// Send success. If the client already gave up on the stream there's
+	// nothing to relay, and the deferred closes release the target.
+	if err := writeSuccess(stream, req, bound); err != nil {
+		log.Info("client went away before the relay started", "target", target, "error", err)
+		return
+	}
+
+	if tracked != nil {
+		tracked.relaying.Store(true)
+	}
+
+	// Setup timings, for finding where a slow connection's time goes. The
+	// client logs its side under the same stream ID.
+	timings := log.Enabled(s.ctx, slog.LevelDebug)
+	if timings {
+		attrs := []any{"stream", stream.StreamID(), "target", target, "request", requestTime, "dial", dialTime}
+		if tlsTime > 0 {
+			attrs = append(attrs, "tls", tlsTime)
+		}
+		log.Debug("stream setup", attrs...)
+	}
+
+	// Per-stream lines are sampled, but all of a stream's or none.
+	verbose := s.logSampler.sample()
+	if verbose {
+		log.Info("proxying", "target", target)
+	}
+	s.metrics.SetGauge(MetricActiveStreams, nil, float64(s.activeStreams.Add(1)))
+	defer func() {
+		s.metrics.SetGauge(MetricActiveStreams, nil, float64(s.activeStreams.Add(-1)))
+	}()
+
+	// Relay data. Once either direction finishes, or the server gives up
+	// on its streams, both copies are torn down. One end is always a yamux
+	// stream, so there's no splice fast path to be had here: the kernel
+	// can only splice between sockets.
+	ctx, cancel := context.WithCancel(s.ctx)
+	defer cancel()
+	end := &streamEnd{stream: stream, carrier: sess.carrier}
+	relayed := resetConn{Conn: conn, end: end, log: log, target: target}
+	var toTarget, toClient io.Writer = relayed, stream
+	if s.flowDiagnostics() {
+		fw := flowWriter{w: toClient, carrier: sess.carrier, rtt: &sess.rtt, state: &flowState{}, sink: s.metrics}
+		if tracked != nil {
+			fw.state = &tracked.flow
+		}
+		toClient = fw
+	}
+	if _, ok := s.metrics.(nopSink); !ok {
+		toClient = waitWriter{w: toClient, sink: s.metrics}
+	}
+	if s.maxFrame > 0 {
+		toClient = chunkWriter{w: toClient, max: s.maxFrame}
+	}
+	if s.idleProbe > 0 || s.minBytes > 0 {
+		rs := &relayedStream{cancel: cancel, target: target}
+		defer sess.addStream(stream.StreamID(), rs)()
+		if s.idleProbe > 0 {
+			toTarget = touchWriter{w: toTarget, last: &rs.last}
+			toClient = touchWriter{w: toClient, last: &rs.last}
+		}
+		if s.minBytes > 0 {
+			toTarget = crawlWriter{w: toTarget, m: &rs.meter}
+			toClient = crawlWriter{w: toClient, m: &rs.meter}
+		}
+	}
+	if _, ok := s.metrics.(nopSink); !ok {
+		toTarget = metricsWriter{w: toTarget, sink: s.metrics, labels: sentLabels}
+		toClient = metricsWriter{w: toClient, sink: s.metrics, labels: receivedLabels}
+	}
+	if sess.tenant != nil {
+		toTarget = quotaWriter{w: toTarget, t: sess.tenant}
+		toClient = quotaWriter{w: toClient, t: sess.tenant}
+	}
+	toTarget = countingWriter{w: toTarget, n: &s.sent}
+	toClient = countingWriter{w: toClient, n: &s.received}
+	if tracked != nil {
+		toTarget = countingWriter{w: toTarget, n: &tracked.sent}
+		toClient = countingWriter{w: toClient, n: &tracked.received}
+	}
+	if access != nil {
+		toTarget = countingWriter{w: toTarget, n: &access.sent}
+		toClient = countingWriter{w: toClient, n: &access.received}
+	}
+	if counter != nil {
+		toTarget = countingWriter{w: toTarget, n: &counter.sent}
+		toClient = countingWriter{w: toClient, n: &counter.received}
+	}
+	toTarget = globalRateWriter{ctx: ctx, w: toTarget, l: &s.rateLimit}
+	toClient = globalRateWriter{ctx: ctx, w: toClient, l: &s.rateLimit}
+	if s.hostLimits != nil {
+		l, release := s.hostLimits.acquire(target)
+		defer release()
+		toTarget = rateWriter{ctx: ctx, w: toTarget, l: l}
+		toClient = rateWriter{ctx: ctx, w: toClient, l: l}
+	}
+	if s.slowFirstByte > 0 || timings {
+		toClient = &firstByteWriter{w: toClient, start: time.Now(), onFirst: func(d time.Duration) {
+			if s.slowFirstByte > 0 && d > s.slowFirstByte {
+				log.Warn("slow first byte", "target", target, "duration", d)
+			}
+			if timings {
+				log.Debug("first byte from target", "stream", stream.StreamID(), "target", target, "wait", d)
+			}
+		}}
+	}
 
-	// Relay data
-	done := make(chan struct{}, 2)
+	var wg sync.WaitGroup
+	wg.Add(2)
 
 	go func() {
-		io.Copy(conn, stream)
-		done <- struct{}{}
+		defer wg.Done()
+		defer cancel()
+		var src io.Reader = stream
+		if s.sni != nil {
+			r, err := s.sni.checkSNI(stream, target)
+			if err != nil {
+				log.Warn("blocking connection", "target", target, "error", err)
+				return
+			}
+			src = r
+		}
+		if s.relayBuffer > 0 {
+			buf := newRelayBuffer(src, s.relayBuffer)
+			defer buf.Close()
+			src = buf
+		}
+		buf := s.buffers.get()
+		defer s.buffers.put(buf)
+		copyContext(ctx, toTarget, src, buf, conn, end)
 	}()
 
 	go func() {
-		io.Copy(stream, conn)
-		done <- struct{}{}
+		defer wg.Done()
+		defer cancel()
+		var src io.Reader = relayed
+		if s.relayBuffer > 0 {
+			buf := newRelayBuffer(src, s.relayBuffer)
+			defer buf.Close()
+			src = buf
+		}
+		buf := s.buffers.get()
+		defer s.buffers.put(buf)
+		copyContext(ctx, toClient, src, buf, conn, end)
 	}()
 
-	<-done
-	s.log.Info("connection closed", "target", target)
+	wg.Wait()
+	if verbose {
+		log.Info("connection closed", "target", target)
+	}
 }
 
-func (s *Server) getClientIP(r *http.Request) string {
-	xff := r.Header.Get("X-Forwarded-For")
-	if xff != "" {
-		return xff
+// dialTarget connects to target, through the configured upstreams if
+// there are any.
+func (s *Server) dialTarget(target string) (net.Conn, *upstream, error) {
+	if deny := s.deny.Load(); deny != nil {
+		if err := deny.checkName(target); err != nil {
+			return nil, nil, err
+		}
+	}
+	ctx, cancel := withTimeout(s.ctx, s.dialTimeout)
+	defer cancel()
+	if s.upstreams != nil {
+		target, err := s.resolveChecked(ctx, target)
+		if err != nil {
+			return nil, nil, err
+		}
+		return s.upstreams.dial(ctx, target)
 	}
+	dialer := net.Dialer{Control: s.targetControl()}
+	if s.lookups != nil {
+		conn, err := s.dialCoalesced(ctx, &dialer, target)
+		return conn, nil, err
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", target)
+	return conn, nil, err
+}
+
+// copyContext copies from src to dst like io.CopyBuffer, but closes closers once
+// ctx is done so that a copy stuck in a read or write returns promptly.
+// It returns ctx's error if the copy ended because of it.
+func copyContext(ctx context.Context, dst io.Writer, src io.Reader, buf []byte, closers ...io.Closer) (int64, error) {
+	stop := context.AfterFunc(ctx, func() {
+		for _, c := range closers {
+			c.Close()
+		}
+	})
+	defer stop()
+	// Hide ReaderFrom and WriterTo so buf is used: they'd only fall back
+	// to allocating a buffer of their own, since nothing here can splice.
+	n, err := io.CopyBuffer(struct{ io.Writer }{dst}, struct{ io.Reader }{src}, buf)
+	if err != nil && ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	return n, err
+}
+
+// streamEnd ends a relayed stream towards the client exactly once: with a
+// FIN, which the client reads as EOF, or with a RST if the target reset
+// the connection. Both copies end the stream through it, so a FIN from
+// one can't overtake the other's RST.
+type streamEnd struct {
+	stream  *yamux.Stream
+	carrier *wsconn.Conn
+	once    sync.Once
+}
+
+// Close closes the stream for copyContext, unless it was reset. Closing a
+// yamux stream only ends our side of it, so reads waiting for the client
+// are cut short too.
+func (e *streamEnd) Close() error {
+	e.stream.SetReadDeadline(time.Now())
+	var err error
+	e.once.Do(func() { err = e.stream.Close() })
+	return err
+}
+
+// reset resets the stream, unless it was already ended, and reports
+// whether it did. yamux has no way to reset a stream, so the RST goes
+// straight to the carrier; see wsconn.Conn.ResetStream. The stream is
+// still closed afterwards, which the client ignores.
+func (e *streamEnd) reset() (bool, error) {
+	var reset bool
+	var err error
+	e.once.Do(func() {
+		reset = true
+		err = e.carrier.ResetStream(e.stream.StreamID())
+	})
+	return reset, err
+}
+
+// resetConn is the connection to the target as the copies see it. Which
+// copy learns of a reset first is down to timing, and whichever does
+// resets the client's stream right away, before the relay is torn down
+// and the stream closed.
+type resetConn struct {
+	net.Conn
+	end    *streamEnd
+	log    *slog.Logger
+	target string
+}
+
+func (c resetConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.check(err)
+	return n, err
+}
+
+func (c resetConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.check(err)
+	return n, err
+}
 
-	host, _, err := net.SplitHostPort(r.RemoteAddr)
+func (c resetConn) check(err error) {
+	if !errors.Is(err, syscall.ECONNRESET) {
+		return
+	}
+	reset, err := c.end.reset()
+	if !reset {
+		return
+	}
 	if err != nil {
-		return r.RemoteAddr
+		c.log.Error("failed to reset stream", "target", c.target, "error", err)
+		return
+	}
+	c.log.Info("target reset connection", "target", c.target)
+}
+
+// dialStatus tells the client why a dial failed, as far as err says.
+func dialStatus(err error) byte {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case errors.Is(err, errTargetDenied):
+		return protocol.StatusDenied
+	case errors.As(err, &dnsErr) && !dnsErr.IsTimeout:
+		return protocol.StatusUnresolved
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return protocol.StatusRefused
+	case errors.Is(err, context.DeadlineExceeded),
+		errors.As(err, &netErr) && netErr.Timeout():
+		return protocol.StatusTimeout
 	}
-	return host
+	return protocol.StatusFailed
 }
 
-// wsAdapter adapts websocket to net.Conn for yamux
-type wsAdapter struct {
-	ws     *websocket.Conn
-	reader io.Reader
-	mu     sync.Mutex
+// failureReason briefly says why a dial failed, for clients that ask,
+// leaving out what the client already knows, like the target's address.
+func failureReason(err error) string {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	var errno syscall.Errno
+	switch {
+	case errors.Is(err, errTargetDenied):
+		return "" // StatusDenied says it all
+	case errors.As(err, &dnsErr):
+		return "name resolution failed: " + dnsErr.Err
+	case errors.Is(err, context.DeadlineExceeded),
+		errors.As(err, &netErr) && netErr.Timeout():
+		return "connection timed out"
+	case errors.As(err, &errno):
+		return errno.Error()
+	}
+	return err.Error()
 }
 
-func (w *wsAdapter) Read(b []byte) (int, error) {
-	w.mu.Lock()
-	defer w.mu.Unlock()
+// writeSuccess answers req with success, and with the address bound to
+// the target if the client asked for fields.
+func writeSuccess(w io.Writer, req protocol.Request, bound net.Addr) error {
+	if req.WantFields {
+		return protocol.WriteFields(w, protocol.StatusOK, bound, "")
+	}
+	return protocol.WriteSuccess(w)
+}
 
-	if w.reader == nil {
-		_, r, err := w.ws.NextReader()
-		if err != nil {
-			return 0, err
+// writeFailure answers req with a failure status, along with the reason
+// for it if the client asked, in the format the client asked for.
+func writeFailure(w io.Writer, req protocol.Request, status byte, reason string) error {
+	if req.WantFields {
+		if !req.WantReason {
+			reason = ""
 		}
-		w.reader = r
+		return protocol.WriteFields(w, status, nil, reason)
 	}
-
-	n, err := w.reader.Read(b)
-	if err == io.EOF {
-		w.reader = nil
-		return n, nil
+	if req.WantReason {
+		return protocol.WriteFailureReason(w, status, reason)
 	}
-	return n, err
+	return protocol.WriteFailure(w, status)
 }
 
-func (w *wsAdapter) Write(b []byte) (int, error) {
-	err := w.ws.WriteMessage(websocket.BinaryMessage, b)
-	if err != nil {
-		return 0, err
+// firstByteWriter reports how long it took until something was first
+// written through it.
+type firstByteWriter struct {
+	w       io.Writer
+	start   time.Time
+	onFirst func(time.Duration)
+	seen    bool
+}
+
+func (f *firstByteWriter) Write(p []byte) (int, error) {
+	if !f.seen && len(p) > 0 {
+		f.seen = true
+		f.onFirst(time.Since(f.start))
 	}
-	return len(b), nil
+	return f.w.Write(p)
 }
 
-func (w *wsAdapter) Close() error {
-	return w.ws.Close()
+// clientSession is the per-websocket state shared by its streams.
+type clientSession struct {
+	id      uint64
+	carrier *wsconn.Conn
+	session *yamux.Session
+	primary bool // the first of its websocket's sub-sessions
+	ip      string
+	peerIP  string // ip as far as it can be trusted, see Server.peerIP
+	tenant  *tenant
+	start   time.Time
+	log     *slog.Logger
+	done    <-chan struct{} // closed with the session
+	pending atomic.Int64    // streams whose request hasn't been read yet
+
+	// activity notes the streams of every session on the websocket, with
+	// a carrier idle timeout.
+	activity *carrierActivity
+
+	// superseded is set when a newer session from the same client and
+	// tenant replaced this one.
+	superseded atomic.Bool
+
+	// rtt is measured while flow diagnostics are on.
+	rtt rttStats
+
+	// targets holds the distinct targets the session used lately, when
+	// there's a distinct target limit.
+	targets targetSpread
+
+	mu         sync.Mutex
+	streams    map[uint32]*relayedStream
+	hasControl bool
 }
 
-func (w *wsAdapter) LocalAddr() net.Addr {
-	return w.ws.LocalAddr()
+// SetAllowedOrigins replaces the origins of WithAllowedOrigins, or sets
+// them on a server started without any, as for a configuration reload. It
+// applies to websockets from then on. No origins allow any.
+func (s *Server) SetAllowedOrigins(origins ...string) {
+	origins = append([]string(nil), origins...)
+	s.allowedOrigins.Store(&origins)
+	s.log.Info("allowed origins changed", "origins", origins)
 }
 
-func (w *wsAdapter) RemoteAddr() net.Addr {
-	return w.ws.RemoteAddr()
+// checkOrigin lets a websocket upgrade through if its Origin is allowed.
+// Requests without an Origin don't come from a browser page, so there's
+// no cross-site risk; tenant tokens decide whether they get in.
+func (s *Server) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	allowedOrigins := s.allowedOrigins.Load()
+	if origin == "" || allowedOrigins == nil || len(*allowedOrigins) == 0 {
+		return true
+	}
+	for _, allowed := range *allowedOrigins {
+		if strings.EqualFold(origin, allowed) {
+			return true
+		}
+	}
+	s.log.Warn("rejected websocket from disallowed origin", "origin", origin, "ip", s.getClientIP(r))
+	return false
 }
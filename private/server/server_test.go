@@ -0,0 +1,529 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/hashicorp/yamux"
+
+	"github.com/jtolio/netpump-go/private/eventlog"
+	"github.com/jtolio/netpump-go/private/protocol"
+	"github.com/jtolio/netpump-go/private/wsconn"
+)
+
+// startServer sets up a Server with opts and serves it on a test HTTP
+// server, returning the server and the URL of its websocket endpoint.
+func startServer(t *testing.T, opts ...Option) (*Server, string) {
+	t.Helper()
+	s := New("127.0.0.1", 0, opts...)
+	if err := s.setup(); err != nil {
+		t.Fatal(err)
+	}
+	hs := httptest.NewServer(s.server.Handler)
+	t.Cleanup(func() {
+		s.Stop()
+		hs.Close()
+	})
+	return s, "ws" + strings.TrimPrefix(hs.URL, "http") + "/ws"
+}
+
+// httpURL is the server's URL for path, given its websocket URL.
+func httpURL(wsURL, path string) string {
+	return "http" + strings.TrimSuffix(strings.TrimPrefix(wsURL, "ws"), "/ws") + path
+}
+
+// dialSession connects to the server at url the way a client does
+// through the browser relay.
+func dialSession(t *testing.T, url string) *yamux.Session {
+	t.Helper()
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, err := yamux.Client(wsconn.New(ws), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { session.Close() })
+	return session
+}
+
+// request opens a stream on session asking for req and returns it with
+// the server's answer.
+func request(t testing.TB, session *yamux.Session, req protocol.Request) (net.Conn, protocol.Response) {
+	t.Helper()
+	stream, err := session.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { stream.Close() })
+	stream.SetDeadline(time.Now().Add(10 * time.Second))
+	if err := protocol.WriteRequest(stream, req); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := protocol.ReadResponse(stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stream, resp
+}
+
+// echoTarget listens on loopback, echoing whatever is sent until the
+// test ends, and returns its address.
+func echoTarget(t testing.TB) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestRelay(t *testing.T) {
+	_, url := startServer(t)
+	target := echoTarget(t)
+
+	stream, resp := request(t, dialSession(t, url), protocol.Request{Addr: target})
+	if resp.Status != protocol.StatusOK {
+		t.Fatalf("status = %#x, want %#x", resp.Status, protocol.StatusOK)
+	}
+	if _, err := stream.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, 5)
+	if _, err := io.ReadFull(stream, got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "hello" {
+		t.Fatalf("echo = %q, want %q", got, "hello")
+	}
+}
+
+func TestDialStatus(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		opts   []Option
+		target string
+		want   byte
+	}{
+		{"unresolved", nil, "nonexistent.invalid:80", protocol.StatusUnresolved},
+		{"refused", nil, closedAddr(t), protocol.StatusRefused},
+		{"timeout", []Option{WithTimeouts(Timeouts{Dial: time.Nanosecond})}, echoTarget(t), protocol.StatusTimeout},
+		{"denied", []Option{WithDenyTargets("127.0.0.0/8")}, echoTarget(t), protocol.StatusDenied},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, url := startServer(t, tc.opts...)
+			_, resp := request(t, dialSession(t, url), protocol.Request{Addr: tc.target})
+			if resp.Status != tc.want {
+				t.Errorf("status = %#x, want %#x", resp.Status, tc.want)
+			}
+		})
+	}
+}
+
+// TestCopyContextCancel checks a copy stuck mid-transfer, whether reading
+// or writing, ends promptly once its context is cancelled.
+func TestCopyContextCancel(t *testing.T) {
+	for _, stuck := range []string{"reading", "writing"} {
+		t.Run(stuck, func(t *testing.T) {
+			src, srcPeer := net.Pipe()
+			dst, dstPeer := net.Pipe()
+			defer srcPeer.Close()
+			defer dstPeer.Close()
+
+			// Some data gets through first, then the copy blocks: on a
+			// source with nothing more to read, or on a destination that
+			// stops reading.
+			more := stuck == "writing"
+			go func() {
+				srcPeer.Write([]byte("hello"))
+				if more {
+					srcPeer.Write([]byte("never read"))
+				}
+			}()
+			copied := make(chan string, 1)
+			go func() {
+				got := make([]byte, 5)
+				io.ReadFull(dstPeer, got)
+				copied <- string(got)
+			}()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan error, 1)
+			go func() {
+				_, err := copyContext(ctx, dst, src, make([]byte, 5), src, dst)
+				done <- err
+			}()
+			time.Sleep(50 * time.Millisecond)
+			select {
+			case err := <-done:
+				t.Fatalf("copy ended before the cancel: %v", err)
+			default:
+			}
+
+			start := time.Now()
+			cancel()
+			select {
+			case err := <-done:
+				if !errors.Is(err, context.Canceled) {
+					t.Errorf("copy ended with %v, want %v", err, context.Canceled)
+				}
+				if elapsed := time.Since(start); elapsed > time.Second {
+					t.Errorf("copy took %v to end after the cancel", elapsed)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("copy still running after the cancel")
+			}
+			if got := <-copied; got != "hello" {
+				t.Errorf("copied %q before the cancel, want %q", got, "hello")
+			}
+		})
+	}
+}
+
+func TestEventsEndpoint(t *testing.T) {
+	const size = 3
+	_, url := startServer(t, WithEventLog(size), WithAdminToken("admin-secret"))
+	session := dialSession(t, url)
+	var targets []string
+	for i := 0; i < 2*size; i++ {
+		target := closedAddr(t)
+		targets = append(targets, target)
+		if _, resp := request(t, session, protocol.Request{Addr: target}); resp.Status != protocol.StatusRefused {
+			t.Fatalf("status = %#x, want refused", resp.Status)
+		}
+	}
+
+	req, err := http.NewRequest("GET", httpURL(url, "/events"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("status without the admin token = %d, want %d", resp.StatusCode, http.StatusUnauthorized)
+	}
+	req.Header.Set("Authorization", "Bearer admin-secret")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var events []eventlog.Event
+	if err := json.NewDecoder(resp.Body).Decode(&events); err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != size {
+		t.Fatalf("got %d events, want %d", len(events), size)
+	}
+	for i, e := range events {
+		if want := targets[len(targets)-size+i]; e.Message != "connection failed" || e.Attrs["target"] != want {
+			t.Errorf("event %d = %q for %q, want the failure for %q", i, e.Message, e.Attrs["target"], want)
+		}
+	}
+}
+
+func TestListenIPv6(t *testing.T) {
+	target, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skipf("no IPv6 loopback: %v", err)
+	}
+	defer target.Close()
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	ln, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+
+	s := New("::1", port)
+	go s.Start()
+	t.Cleanup(func() { s.Stop() })
+	addr := net.JoinHostPort("::1", strconv.Itoa(port))
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if conn, err := net.Dial("tcp", addr); err == nil {
+			conn.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("server not listening on %s", addr)
+		}
+	}
+
+	stream, resp := request(t, dialSession(t, "ws://"+addr+"/ws"), protocol.Request{Addr: target.Addr().String()})
+	if resp.Status != protocol.StatusOK {
+		t.Fatalf("status = %#x, want OK", resp.Status)
+	}
+	if _, err := stream.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, 5)
+	if _, err := io.ReadFull(stream, got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "hello" {
+		t.Errorf("echo = %q, want %q", got, "hello")
+	}
+}
+
+// upgradeStatus tries to open a websocket to url with header, returning
+// the status the server answered with.
+func upgradeStatus(t *testing.T, url string, header http.Header) int {
+	t.Helper()
+	ws, resp, err := websocket.DefaultDialer.Dial(url, header)
+	if err != nil {
+		if resp == nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode
+	}
+	ws.Close()
+	return http.StatusSwitchingProtocols
+}
+
+func TestAllowedOrigins(t *testing.T) {
+	s, url := startServer(t,
+		WithAllowedOrigins("http://127.0.0.1:8080"),
+		WithTenants(Tenant{Name: "native", Token: "secret"}))
+	auth := "Bearer secret"
+	for _, tc := range []struct {
+		name   string
+		header http.Header
+		want   int
+	}{
+		{"allowed origin", http.Header{"Origin": {"http://127.0.0.1:8080"}, "Authorization": {auth}}, http.StatusSwitchingProtocols},
+		{"allowed origin in another case", http.Header{"Origin": {"HTTP://127.0.0.1:8080"}, "Authorization": {auth}}, http.StatusSwitchingProtocols},
+		{"disallowed origin", http.Header{"Origin": {"http://evil.example"}, "Authorization": {auth}}, http.StatusForbidden},
+		{"allowed origin's other port", http.Header{"Origin": {"http://127.0.0.1:8081"}, "Authorization": {auth}}, http.StatusForbidden},
+		{"native client", http.Header{"Authorization": {auth}}, http.StatusSwitchingProtocols},
+		{"native client without a token", nil, http.StatusUnauthorized},
+	} {
+		if got := upgradeStatus(t, url, tc.header); got != tc.want {
+			t.Errorf("%s: status %d, want %d", tc.name, got, tc.want)
+		}
+	}
+
+	// The list can change while the server runs.
+	s.SetAllowedOrigins("http://evil.example")
+	if got := upgradeStatus(t, url, http.Header{"Origin": {"http://evil.example"}, "Authorization": {auth}}); got != http.StatusSwitchingProtocols {
+		t.Errorf("newly allowed origin: status %d, want %d", got, http.StatusSwitchingProtocols)
+	}
+	if got := upgradeStatus(t, url, http.Header{"Origin": {"http://127.0.0.1:8080"}, "Authorization": {auth}}); got != http.StatusForbidden {
+		t.Errorf("no longer allowed origin: status %d, want %d", got, http.StatusForbidden)
+	}
+}
+
+func TestSourceLogged(t *testing.T) {
+	s, url := startServer(t, WithEventLog(50))
+	target := echoTarget(t)
+	session := dialSession(t, url)
+	if _, resp := request(t, session, protocol.Request{Addr: target, Source: "192.0.2.7:5555"}); resp.Status != protocol.StatusOK {
+		t.Fatalf("status = %#x, want OK", resp.Status)
+	}
+	if _, resp := request(t, session, protocol.Request{Addr: target}); resp.Status != protocol.StatusOK {
+		t.Fatalf("status = %#x, want OK", resp.Status)
+	}
+
+	// Streams are logged as proxying after they're answered.
+	var with, without int
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		with, without = 0, 0
+		for _, e := range s.events.Events() {
+			if e.Message != "proxying" {
+				continue
+			}
+			switch src, ok := e.Attrs["source"]; {
+			case !ok:
+				without++
+			case src == "192.0.2.7:5555":
+				with++
+			default:
+				t.Fatalf("logged source %q", src)
+			}
+		}
+		if with+without >= 2 || time.Now().After(deadline) {
+			break
+		}
+	}
+	if with != 1 || without != 1 {
+		t.Errorf("logged %d streams with the source and %d without, want 1 each", with, without)
+	}
+}
+
+// TestClientGoneBeforeSuccess checks that when the client drops before the
+// dial completes, the server releases the target without starting a
+// relay or leaving goroutines behind.
+func TestClientGoneBeforeSuccess(t *testing.T) {
+	// The target reports when its connection is closed.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	closed := make(chan struct{})
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		io.Copy(io.Discard, conn)
+		conn.Close()
+		close(closed)
+	}()
+	// The dial goes through an upstream slow enough for the client to
+	// give up first.
+	up := startSocksUpstream(t)
+	up.delay = 300 * time.Millisecond
+	s, url := startServer(t,
+		WithEventLog(50),
+		WithUpstreams(Upstream{Name: "proxy", URL: "socks5://" + up.addr}))
+
+	base := runtime.NumGoroutine()
+	session := dialSession(t, url)
+	stream, err := session.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := protocol.WriteRequest(stream, protocol.Request{Addr: ln.Addr().String()}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	session.Close()
+
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("target still open after the client went away")
+	}
+	logged := func(msg string) bool {
+		for _, e := range s.events.Events() {
+			if e.Message == msg {
+				return true
+			}
+		}
+		return false
+	}
+	for deadline := time.Now().Add(5 * time.Second); !logged("client went away before the relay started"); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("early disconnect not logged")
+		}
+	}
+	if logged("proxying") {
+		t.Error("relay started for a stream the client had dropped")
+	}
+	for deadline := time.Now().Add(5 * time.Second); runtime.NumGoroutine() > base; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d goroutines, %d before the session", runtime.NumGoroutine(), base)
+		}
+	}
+}
+
+// TestMaxPendingStreams checks streams beyond the cap on those still to
+// send their request are turned down, and that there's room again once a
+// request arrives.
+func TestMaxPendingStreams(t *testing.T) {
+	const max = 3
+	_, url := startServer(t, WithMaxPendingStreams(max))
+	target := echoTarget(t)
+	session := dialSession(t, url)
+
+	// refused reports whether a stream opened now, without a request, is
+	// turned down.
+	refused := func() (*yamux.Stream, bool) {
+		stream, err := session.OpenStream()
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { stream.Close() })
+		stream.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+		resp, err := protocol.ReadResponse(stream)
+		stream.SetReadDeadline(time.Time{})
+		return stream, err == nil && resp.Status == protocol.StatusFailed
+	}
+	var pending []*yamux.Stream
+	for i := 0; i < max; i++ {
+		stream, no := refused()
+		if no {
+			t.Fatalf("pending stream %d turned down", i+1)
+		}
+		pending = append(pending, stream)
+	}
+	if _, no := refused(); !no {
+		t.Fatal("pending stream over the cap accepted")
+	}
+
+	// Once one sends its request there's room for another.
+	if err := protocol.WriteRequest(pending[0], protocol.Request{Addr: target}); err != nil {
+		t.Fatal(err)
+	}
+	if resp, err := protocol.ReadResponse(pending[0]); err != nil || resp.Status != protocol.StatusOK {
+		t.Fatalf("request on a pending stream: %v %#x", err, resp.Status)
+	}
+	if _, no := refused(); no {
+		t.Error("pending stream turned down after one sent its request")
+	}
+}
+
+func TestMaxSessions(t *testing.T) {
+	_, url := startServer(t, WithMaxSessions(2))
+	first := dialSession(t, url)
+	dialSession(t, url)
+	if got := upgradeStatus(t, url, nil); got != http.StatusServiceUnavailable {
+		t.Fatalf("third session: status %d, want %d", got, http.StatusServiceUnavailable)
+	}
+	// The sessions that were let in still work.
+	if _, resp := request(t, first, protocol.Request{Addr: echoTarget(t)}); resp.Status != protocol.StatusOK {
+		t.Errorf("status %#x", resp.Status)
+	}
+
+	// Once one leaves, there's room for another.
+	first.Close()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		got := upgradeStatus(t, url, nil)
+		if got == http.StatusSwitchingProtocols {
+			break
+		}
+		if got != http.StatusServiceUnavailable || time.Now().After(deadline) {
+			t.Fatalf("after a session left: status %d", got)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package server
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/jtolio/netpump-go/private/protocol"
+)
+
+// stuckTarget accepts connections and holds them open, never reading or
+// closing them, until the test ends.
+func stuckTarget(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestShutdownTimeoutClosesStuckStreams(t *testing.T) {
+	const timeout = 200 * time.Millisecond
+	s, url := startServer(t, WithShutdownTimeout(timeout))
+	session := dialSession(t, url)
+	stream, resp := request(t, session, protocol.Request{Addr: stuckTarget(t)})
+	if resp.Status != protocol.StatusOK {
+		t.Fatalf("status %#x, want OK", resp.Status)
+	}
+
+	start := time.Now()
+	if err := s.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if took := time.Since(start); took < timeout || took > timeout+2*time.Second {
+		t.Errorf("Stop took %v with a stuck stream, want about %v", took, timeout)
+	}
+	select {
+	case <-session.CloseChan():
+	case <-time.After(5 * time.Second):
+		t.Fatal("session still open after Stop")
+	}
+	stream.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := stream.Read(make([]byte, 1)); err == nil {
+		t.Error("stream still readable after Stop")
+	} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Error("stream still open after Stop")
+	}
+}
+
+// TestDrainStopsAcceptingStreams checks a draining server stops taking
+// new streams at once, while those already relaying carry on.
+func TestDrainStopsAcceptingStreams(t *testing.T) {
+	s, url := startServer(t, WithShutdownTimeout(10*time.Second), WithEventLog(50))
+	target := echoTarget(t)
+	session := dialSession(t, url)
+	old, resp := request(t, session, protocol.Request{Addr: target})
+	if resp.Status != protocol.StatusOK {
+		t.Fatalf("status %#x, want OK", resp.Status)
+	}
+
+	stopped := make(chan error, 1)
+	start := time.Now()
+	go func() { stopped <- s.Stop() }()
+	for !drained(s) {
+		if time.Since(start) > 2*time.Second {
+			t.Fatal("server didn't start draining")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// A new stream is refused by the go-away, or at worst goes
+	// unanswered.
+	if stream, err := session.Open(); err == nil {
+		defer stream.Close()
+		stream.SetDeadline(time.Now().Add(300 * time.Millisecond))
+		if err := protocol.WriteRequest(stream, protocol.Request{Addr: target}); err == nil {
+			if _, err := protocol.ReadResponse(stream); err == nil {
+				t.Error("new stream answered while draining")
+			}
+		}
+	}
+
+	// The old one still echoes, and once it's done the server stops.
+	if _, err := old.Write([]byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(old, make([]byte, 2)); err != nil {
+		t.Fatalf("echo while draining: %v", err)
+	}
+	old.Close()
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Fatal(err)
+		}
+		if took := time.Since(start); took > 5*time.Second {
+			t.Errorf("Stop took %v after the last stream ended", took)
+		}
+	case <-time.After(8 * time.Second):
+		t.Fatal("Stop still waiting after the last stream ended")
+	}
+}
+
+// drained reports whether s logged that it stopped accepting streams.
+func drained(s *Server) bool {
+	for _, e := range s.events.Events() {
+		if e.Message == "draining, no longer accepting streams" {
+			return true
+		}
+	}
+	return false
+}
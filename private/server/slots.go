@@ -0,0 +1,122 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// streamSlots caps the streams being relayed across all clients, for
+// WithMaxStreams. While every slot is taken, new streams queue for one,
+// and freed slots go to the clients with streams queued in turn, so one
+// that queues many streams can't take every slot that frees up.
+type streamSlots struct {
+	max  int
+	wait time.Duration // how long a stream may queue, 0 to refuse it
+	sink MetricsSink
+
+	mu     sync.Mutex
+	used   int
+	queues map[string][]chan struct{} // waiting streams by client
+	turns  []string                   // clients with streams queued, next first
+	depth  int
+}
+
+// acquire takes a slot for a stream of client, the tenant or IP it's
+// from, queueing for up to the slots' wait if they're all taken. It
+// reports whether it got one and whether it had to queue. It gives up
+// early once done is closed.
+func (q *streamSlots) acquire(client string, done <-chan struct{}) (ok, queued bool) {
+	q.mu.Lock()
+	if q.used < q.max && q.depth == 0 {
+		q.used++
+		q.mu.Unlock()
+		return true, false
+	}
+	if q.wait <= 0 {
+		q.mu.Unlock()
+		return false, false
+	}
+	ready := make(chan struct{})
+	if len(q.queues[client]) == 0 {
+		q.turns = append(q.turns, client)
+	}
+	if q.queues == nil {
+		q.queues = make(map[string][]chan struct{})
+	}
+	q.queues[client] = append(q.queues[client], ready)
+	q.setDepth(q.depth + 1)
+	q.mu.Unlock()
+
+	timer := time.NewTimer(q.wait)
+	defer timer.Stop()
+	select {
+	case <-ready:
+		return true, true
+	case <-timer.C:
+	case <-done:
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	select {
+	case <-ready:
+		// Handed a slot just as it gave up.
+		return true, true
+	default:
+	}
+	q.remove(client, ready)
+	return false, true
+}
+
+// release frees a slot, handing it to the next client in turn if any
+// streams are queued.
+func (q *streamSlots) release() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.turns) == 0 {
+		q.used--
+		return
+	}
+	client := q.turns[0]
+	q.turns = q.turns[1:]
+	waiting := q.queues[client]
+	ready := waiting[0]
+	if len(waiting) > 1 {
+		q.queues[client] = waiting[1:]
+		q.turns = append(q.turns, client)
+	} else {
+		delete(q.queues, client)
+	}
+	q.setDepth(q.depth - 1)
+	close(ready)
+}
+
+// remove takes a stream that gave up out of client's queue. The caller
+// must hold mu.
+func (q *streamSlots) remove(client string, ready chan struct{}) {
+	waiting := q.queues[client]
+	for i, r := range waiting {
+		if r == ready {
+			waiting = append(waiting[:i:i], waiting[i+1:]...)
+			break
+		}
+	}
+	q.setDepth(q.depth - 1)
+	if len(waiting) > 0 {
+		q.queues[client] = waiting
+		return
+	}
+	delete(q.queues, client)
+	for i, c := range q.turns {
+		if c == client {
+			q.turns = append(q.turns[:i:i], q.turns[i+1:]...)
+			break
+		}
+	}
+}
+
+// setDepth records how many streams are queued. The caller must hold mu.
+func (q *streamSlots) setDepth(n int) {
+	q.depth = n
+	q.sink.SetGauge(MetricStreamQueueDepth, nil, float64(n))
+}
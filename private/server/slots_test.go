@@ -0,0 +1,52 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStreamSlotsFairAcrossClients(t *testing.T) {
+	q := &streamSlots{max: 1, wait: time.Minute, sink: nopSink{}}
+	if ok, _ := q.acquire("greedy", nil); !ok {
+		t.Fatal("first stream didn't get a slot")
+	}
+
+	// The greedy client queues three streams before the other queues its
+	// one.
+	granted := make(chan string, 4)
+	queue := func(client string) {
+		q.mu.Lock()
+		depth := q.depth
+		q.mu.Unlock()
+		go func() {
+			if ok, _ := q.acquire(client, nil); ok {
+				granted <- client
+			}
+		}()
+		for {
+			q.mu.Lock()
+			queued := q.depth > depth
+			q.mu.Unlock()
+			if queued {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		queue("greedy")
+	}
+	queue("other")
+
+	var order []string
+	for i := 0; i < 4; i++ {
+		q.release()
+		order = append(order, <-granted)
+	}
+	want := []string{"greedy", "other", "greedy", "greedy"}
+	for i := range want {
+		if order[i] != want[i] {
+			t.Fatalf("slots went to %v, want %v", order, want)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/jtolio/netpump-go/private/protocol"
+)
+
+// loggedSlow reports whether s logged msg for target.
+func loggedSlow(s *Server, msg, target string) bool {
+	for _, e := range s.events.Events() {
+		if e.Message == msg && e.Attrs["target"] == target {
+			return true
+		}
+	}
+	return false
+}
+
+func TestSlowDialWarning(t *testing.T) {
+	const threshold = 100 * time.Millisecond
+	target := echoTarget(t)
+	up := startSocksUpstream(t)
+	s, url := startServer(t,
+		WithEventLog(50),
+		WithSlowThresholds(threshold, 0),
+		WithUpstreams(Upstream{Name: "proxy", URL: "socks5://" + up.addr}))
+	session := dialSession(t, url)
+
+	// Quick dials aren't flagged.
+	if _, resp := request(t, session, protocol.Request{Addr: target}); resp.Status != protocol.StatusOK {
+		t.Fatalf("status = %#x, want OK", resp.Status)
+	}
+	if loggedSlow(s, "slow dial", target) {
+		t.Error("quick dial logged as slow")
+	}
+
+	// The upstream takes longer than the threshold to connect.
+	up.mu.Lock()
+	up.delay = 3 * threshold
+	up.mu.Unlock()
+	if _, resp := request(t, session, protocol.Request{Addr: target}); resp.Status != protocol.StatusOK {
+		t.Fatalf("status = %#x, want OK", resp.Status)
+	}
+	if !loggedSlow(s, "slow dial", target) {
+		t.Error("slow dial not logged")
+	}
+}
+
+func TestSlowFirstByteWarning(t *testing.T) {
+	const threshold = 100 * time.Millisecond
+	// The target answers only after a while.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				time.Sleep(3 * threshold)
+				conn.Write([]byte("late"))
+			}()
+		}
+	}()
+	target := ln.Addr().String()
+	s, url := startServer(t, WithEventLog(50), WithSlowThresholds(0, threshold))
+
+	stream, resp := request(t, dialSession(t, url), protocol.Request{Addr: target})
+	if resp.Status != protocol.StatusOK {
+		t.Fatalf("status = %#x, want OK", resp.Status)
+	}
+	if _, err := io.ReadFull(stream, make([]byte, 4)); err != nil {
+		t.Fatal(err)
+	}
+	// The warning is logged as the byte is relayed.
+	for deadline := time.Now().Add(5 * time.Second); !loggedSlow(s, "slow first byte", target); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("slow first byte not logged")
+		}
+	}
+	if loggedSlow(s, "slow dial", target) {
+		t.Error("dial logged as slow with its warning off")
+	}
+}
@@ -0,0 +1,178 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// Snapshot is the server's state at one moment, as served on /snapshot,
+// for debugging and capacity planning. It only holds plain data, so it
+// can be saved and loaded with encoding/json.
+type Snapshot struct {
+	Time     time.Time `json:"time"`
+	Instance string    `json:"instance"`
+	Started  time.Time `json:"started"`
+
+	Config   SnapshotConfig `json:"config"`
+	Sessions []SessionInfo  `json:"sessions"`
+	// Connections is filled in only when an admin token is set, as with
+	// Connections.
+	Connections []ConnInfo            `json:"connections,omitempty"`
+	Tenants     []TenantStats         `json:"tenants,omitempty"`
+	Labels      map[string]LabelStats `json:"labels,omitempty"`
+
+	// TotalSessions and TotalStreams count what was accepted since the
+	// server started, and ActiveStreams the streams relaying right now.
+	TotalSessions uint64 `json:"total_sessions"`
+	TotalStreams  uint64 `json:"total_streams"`
+	ActiveStreams int64  `json:"active_streams"`
+	// StreamMemory is the memory charged to the streams relaying right
+	// now, with a stream memory limit.
+	StreamMemory int64 `json:"stream_memory,omitempty"`
+	// Sent and Received are bytes relayed to and from targets so far.
+	Sent     int64 `json:"sent"`
+	Received int64 `json:"received"`
+}
+
+// SnapshotConfig is the part of the server's configuration that shapes
+// its capacity. Durations are in seconds, and 0 means no limit.
+type SnapshotConfig struct {
+	GlobalRateLimit   int64       `json:"global_rate_limit"`
+	HostRateLimit     int64       `json:"host_rate_limit,omitempty"`
+	SessionPolicy     string      `json:"session_policy"`
+	Tenants           int         `json:"tenants"`
+	Upstreams         []string    `json:"upstreams,omitempty"`
+	MaxSessions       int         `json:"max_sessions"`
+	MaxPendingStreams int         `json:"max_pending_streams"`
+	MaxStreams        int         `json:"max_streams,omitempty"`
+	StreamQueueWait   float64     `json:"stream_queue_wait,omitempty"`
+	LoadLimits        *LoadLimits `json:"load_limits,omitempty"`
+	MaxRequestBytes   int64       `json:"max_request_bytes"`
+	MaxStreamMemory   int64       `json:"max_stream_memory,omitempty"`
+	MaxFrameBytes     int         `json:"max_frame_bytes"`
+	StreamWindow      int         `json:"stream_window,omitempty"`
+	CopyBufferBytes   int         `json:"copy_buffer_bytes"`
+	RelayBufferBytes  int         `json:"relay_buffer_bytes"`
+	IdleStreamProbe   float64     `json:"idle_stream_probe"`
+	CarrierIdle       float64     `json:"carrier_idle,omitempty"`
+	WriteTimeout      float64     `json:"write_timeout"`
+	ShutdownTimeout   float64     `json:"shutdown_timeout"`
+	DialTimeout       float64     `json:"dial_timeout"`
+	DNSCoalescing     bool        `json:"dns_coalescing,omitempty"`
+	KeepAlive         float64     `json:"keepalive"`
+	TLS               bool        `json:"tls"`
+}
+
+// SessionInfo describes a client's session.
+type SessionInfo struct {
+	ID       uint64    `json:"id"`
+	ClientIP string    `json:"client_ip"`
+	Tenant   string    `json:"tenant,omitempty"`
+	Start    time.Time `json:"start"`
+	// Streams counts the session's open streams, including ones still
+	// sending their request.
+	Streams int `json:"streams"`
+	Pending int `json:"pending"`
+	// Targets counts the distinct targets the session connected to within
+	// the distinct target limit's window, if there is one.
+	Targets int `json:"targets,omitempty"`
+}
+
+// Snapshot returns the server's current state. The session table is
+// copied under the lock that guards it and the connection table under
+// its own; counters are read atomically, though not all in the same
+// instant.
+func (s *Server) Snapshot() Snapshot {
+	snap := Snapshot{
+		Time:     time.Now(),
+		Instance: s.instanceID,
+		Started:  s.started,
+		Config:   s.snapshotConfig(),
+	}
+
+	s.trackMu.Lock()
+	snap.Sessions = make([]SessionInfo, 0, len(s.sessions))
+	for session, sess := range s.sessions {
+		info := SessionInfo{
+			ID:       sess.id,
+			ClientIP: sess.ip,
+			Start:    sess.start,
+			Streams:  session.NumStreams(),
+			Pending:  int(sess.pending.Load()),
+		}
+		if sess.tenant != nil {
+			info.Tenant = sess.tenant.Name
+		}
+		if s.targetLimit > 0 {
+			info.Targets = sess.targets.count(snap.Time, s.targetWindow)
+		}
+		snap.Sessions = append(snap.Sessions, info)
+	}
+	s.trackMu.Unlock()
+	sort.Slice(snap.Sessions, func(i, j int) bool { return snap.Sessions[i].ID < snap.Sessions[j].ID })
+
+	snap.Connections = s.Connections()
+	if len(s.tenants) > 0 {
+		snap.Tenants = s.TenantStats()
+	}
+	if labels := s.LabelStats(); len(labels) > 0 {
+		snap.Labels = labels
+	}
+	snap.TotalSessions = s.nextSession.Load()
+	snap.TotalStreams = s.totalStreams.Load()
+	snap.ActiveStreams = s.activeStreams.Load()
+	if s.streamMemory != nil {
+		snap.StreamMemory = s.streamMemory.used.Load()
+	}
+	snap.Sent = s.sent.Load()
+	snap.Received = s.received.Load()
+	return snap
+}
+
+func (s *Server) snapshotConfig() SnapshotConfig {
+	cfg := SnapshotConfig{
+		GlobalRateLimit:   s.GlobalRateLimit(),
+		HostRateLimit:     s.hostRateLimit(),
+		SessionPolicy:     s.sessionPolicy.String(),
+		Tenants:           len(s.tenants),
+		MaxSessions:       s.maxSessions,
+		MaxPendingStreams: s.maxPending,
+		MaxStreams:        s.maxStreams,
+		StreamQueueWait:   s.streamQueue.Seconds(),
+		MaxFrameBytes:     s.maxFrame,
+		StreamWindow:      s.streamWindow,
+		CopyBufferBytes:   s.buffers.size,
+		RelayBufferBytes:  s.relayBuffer,
+		IdleStreamProbe:   s.idleProbe.Seconds(),
+		CarrierIdle:       s.carrierIdle.Seconds(),
+		WriteTimeout:      s.writeTimeout.Seconds(),
+		ShutdownTimeout:   s.shutdownTimeout.Seconds(),
+		DialTimeout:       s.dialTimeout.Seconds(),
+		DNSCoalescing:     s.dnsCoalescing,
+		KeepAlive:         s.keepAlive.Seconds(),
+		TLS:               s.tlsConfig != nil,
+	}
+	for _, u := range s.upstreamConfig {
+		cfg.Upstreams = append(cfg.Upstreams, u.Name)
+	}
+	if s.load != nil {
+		cfg.LoadLimits = &s.load.limits
+	}
+	if s.streamMemory != nil {
+		cfg.MaxStreamMemory = s.streamMemory.max
+	}
+	if s.requestBudget != nil {
+		cfg.MaxRequestBytes = s.requestBudget.max
+	}
+	return cfg
+}
+
+func (s *Server) handleSnapshot(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(s.Snapshot())
+}
@@ -0,0 +1,149 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/yamux"
+)
+
+const (
+	tlsRecordHandshake = 0x16
+	tlsRecordHeaderLen = 5
+	tlsMaxRecordLen    = 16384 + 2048
+
+	// sniTimeout bounds how long the rest of a ClientHello may take once
+	// its first byte has arrived.
+	sniTimeout = 10 * time.Second
+)
+
+var errSNIRejected = errors.New("rejected by SNI policy")
+
+// sniPolicy filters TLS connections by the server name in their
+// ClientHello, which is read without terminating TLS. Connections that
+// don't start with a TLS handshake aren't affected.
+type sniPolicy struct {
+	// allow lists the names TLS connections may ask for. Entries starting
+	// with "*." match any subdomain. An empty list allows any name.
+	allow []string
+	// matchTarget requires the name to be the host the stream asked to be
+	// connected to, when that host is a name rather than an IP. This stops
+	// domain fronting, where a permitted host is dialed but a different
+	// one is requested inside TLS.
+	matchTarget bool
+}
+
+func (p *sniPolicy) check(target, sni string) error {
+	sni = strings.TrimSuffix(strings.ToLower(sni), ".")
+	if len(p.allow) > 0 {
+		if sni == "" {
+			return fmt.Errorf("%w: no server name", errSNIRejected)
+		}
+		if !p.allowed(sni) {
+			return fmt.Errorf("%w: %q not allowed", errSNIRejected, sni)
+		}
+	}
+	if p.matchTarget {
+		host, _, err := net.SplitHostPort(target)
+		if err != nil {
+			return err
+		}
+		host = strings.TrimSuffix(strings.ToLower(host), ".")
+		if net.ParseIP(host) == nil && sni != host {
+			return fmt.Errorf("%w: %q doesn't match target %q", errSNIRejected, sni, host)
+		}
+	}
+	return nil
+}
+
+func (p *sniPolicy) allowed(sni string) bool {
+	for _, a := range p.allow {
+		if hostMatches(a, sni) {
+			return true
+		}
+	}
+	return false
+}
+
+// hostMatches reports whether host is pattern, or a subdomain of it if
+// pattern starts with "*.". host must already be lower case.
+func hostMatches(pattern, host string) bool {
+	pattern = strings.ToLower(pattern)
+	if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+		return strings.HasSuffix(host, "."+suffix)
+	}
+	return host == pattern
+}
+
+// checkSNI applies the policy to what the client sends on stream,
+// returning a reader that still yields everything read so far. It waits
+// for the client's first byte without a deadline, as in server-speaks-
+// first protocols the client may legitimately stay quiet for a while.
+func (p *sniPolicy) checkSNI(stream *yamux.Stream, target string) (io.Reader, error) {
+	br := bufio.NewReaderSize(stream, tlsRecordHeaderLen+tlsMaxRecordLen)
+	first, err := br.Peek(1)
+	if err != nil {
+		return br, nil
+	}
+	if first[0] != tlsRecordHandshake {
+		return br, nil
+	}
+
+	stream.SetReadDeadline(time.Now().Add(sniTimeout))
+	defer stream.SetReadDeadline(time.Time{})
+	hdr, err := br.Peek(tlsRecordHeaderLen)
+	if err != nil {
+		return nil, err
+	}
+	n := int(binary.BigEndian.Uint16(hdr[3:]))
+	if n > tlsMaxRecordLen {
+		return nil, fmt.Errorf("%w: oversized TLS record", errSNIRejected)
+	}
+	record, err := br.Peek(tlsRecordHeaderLen + n)
+	if err != nil {
+		return nil, err
+	}
+	return br, p.check(target, serverName(record))
+}
+
+// serverName extracts the SNI from a TLS record holding a ClientHello by
+// starting a server handshake on it and bailing out once crypto/tls has
+// parsed the hello. It returns "" if there is no name or the record can't
+// be parsed.
+func serverName(record []byte) string {
+	var name string
+	errDone := errors.New("done")
+	conn := tls.Server(helloConn{r: bytes.NewReader(record)}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			name = hello.ServerName
+			return nil, errDone
+		},
+	})
+	conn.Handshake()
+	return name
+}
+
+// helloConn feeds a recorded ClientHello to crypto/tls and discards
+// whatever it tries to send back.
+type helloConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c helloConn) Read(b []byte) (int, error)  { return c.r.Read(b) }
+func (c helloConn) Write(b []byte) (int, error) { return len(b), nil }
+func (c helloConn) Close() error                { return nil }
+func (c helloConn) LocalAddr() net.Addr         { return &net.TCPAddr{} }
+func (c helloConn) RemoteAddr() net.Addr        { return &net.TCPAddr{} }
+
+func (c helloConn) SetDeadline(time.Time) error      { return nil }
+func (c helloConn) SetReadDeadline(time.Time) error  { return nil }
+func (c helloConn) SetWriteDeadline(time.Time) error { return nil }
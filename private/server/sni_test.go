@@ -0,0 +1,80 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jtolio/netpump-go/private/protocol"
+)
+
+func TestSNIPolicyCheck(t *testing.T) {
+	allow := &sniPolicy{allow: []string{"allowed.example", "*.cdn.example"}}
+	match := &sniPolicy{matchTarget: true}
+	for _, tc := range []struct {
+		policy      *sniPolicy
+		target, sni string
+		ok          bool
+	}{
+		{allow, "1.2.3.4:443", "allowed.example", true},
+		{allow, "1.2.3.4:443", "ALLOWED.example.", true},
+		{allow, "1.2.3.4:443", "img.cdn.example", true},
+		{allow, "1.2.3.4:443", "cdn.example", false},
+		{allow, "1.2.3.4:443", "blocked.example", false},
+		{allow, "1.2.3.4:443", "", false},
+		{match, "front.example:443", "front.example", true},
+		{match, "front.example:443", "hidden.example", false},
+		{match, "1.2.3.4:443", "hidden.example", true},
+	} {
+		err := tc.policy.check(tc.target, tc.sni)
+		if tc.ok && err != nil {
+			t.Errorf("check(%q, %q) = %v, want nil", tc.target, tc.sni, err)
+		}
+		if !tc.ok && !errors.Is(err, errSNIRejected) {
+			t.Errorf("check(%q, %q) = %v, want %v", tc.target, tc.sni, err, errSNIRejected)
+		}
+	}
+}
+
+func TestBlockedSNIRefused(t *testing.T) {
+	var mu sync.Mutex
+	var seen []string
+	target := httptest.NewUnstartedServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	target.TLS = &tls.Config{GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		mu.Lock()
+		seen = append(seen, hello.ServerName)
+		mu.Unlock()
+		return nil, nil
+	}}
+	target.StartTLS()
+	defer target.Close()
+	addr := strings.TrimPrefix(target.URL, "https://")
+
+	_, url := startServer(t, WithSNIAllowlist("allowed.example"))
+	session := dialSession(t, url)
+	handshake := func(name string) error {
+		stream, resp := request(t, session, protocol.Request{Addr: addr})
+		if resp.Status != protocol.StatusOK {
+			t.Fatalf("status %#x, want OK", resp.Status)
+		}
+		stream.SetDeadline(time.Now().Add(10 * time.Second))
+		return tls.Client(stream, &tls.Config{ServerName: name, InsecureSkipVerify: true}).Handshake()
+	}
+
+	if err := handshake("blocked.example"); err == nil {
+		t.Error("handshake with a blocked name succeeded")
+	}
+	if err := handshake("allowed.example"); err != nil {
+		t.Errorf("handshake with an allowed name: %v", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(seen) != 1 || seen[0] != "allowed.example" {
+		t.Errorf("target saw ClientHellos for %q, want only allowed.example", seen)
+	}
+}
@@ -0,0 +1,80 @@
+package server
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// targetSpread keeps the distinct targets a session connected to lately,
+// to spot clients that scan or otherwise fan out to many hosts.
+type targetSpread struct {
+	mu   sync.Mutex
+	seen map[string]time.Time // target to when it was last asked for
+	over bool                 // whether the session is over the limit
+}
+
+// add records a connection to target at now and reports whether it may go
+// ahead, and whether the session just went over the limit: more than
+// limit distinct targets within window. Over the limit, targets the
+// session already used in the window are always let through, and new
+// ones only if reject is false.
+func (t *targetSpread) add(target string, now time.Time, limit int, window time.Duration, reject bool) (ok, exceeded bool) {
+	target = strings.ToLower(target)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.seen == nil {
+		t.seen = make(map[string]time.Time)
+	}
+	if last, ok := t.seen[target]; ok && now.Sub(last) < window {
+		t.seen[target] = now
+		return true, false
+	}
+	if len(t.seen) >= limit {
+		for k, last := range t.seen {
+			if now.Sub(last) >= window {
+				delete(t.seen, k)
+			}
+		}
+		t.over = t.over && len(t.seen) >= limit
+	}
+	if len(t.seen) < limit {
+		t.seen[target] = now
+		return true, false
+	}
+	exceeded = !t.over
+	t.over = true
+	if reject {
+		return false, exceeded
+	}
+	t.seen[target] = now
+	return true, exceeded
+}
+
+// count is how many distinct targets the session used within window.
+func (t *targetSpread) count(now time.Time, window time.Duration) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := 0
+	for _, last := range t.seen {
+		if now.Sub(last) < window {
+			n++
+		}
+	}
+	return n
+}
+
+// checkTargetSpread reports whether sess may connect to target under the
+// distinct target limit, warning when the session goes over it.
+func (s *Server) checkTargetSpread(sess *clientSession, target string) bool {
+	if s.targetLimit <= 0 {
+		return true
+	}
+	ok, exceeded := sess.targets.add(target, time.Now(), s.targetLimit, s.targetWindow, s.targetReject)
+	if exceeded {
+		sess.log.Warn("client connected to many distinct targets, it may be scanning",
+			"limit", s.targetLimit, "window", s.targetWindow, "rejecting", s.targetReject)
+		s.metrics.IncCounter(MetricTargetLimitExceeded, nil, 1)
+	}
+	return ok
+}
@@ -0,0 +1,125 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jtolio/netpump-go/private/protocol"
+)
+
+func TestTargetSpread(t *testing.T) {
+	const (
+		limit  = 3
+		window = time.Minute
+	)
+	start := time.Now()
+	for _, reject := range []bool{true, false} {
+		var ts targetSpread
+		add := func(target string, at time.Duration) (bool, bool) {
+			return ts.add(target, start.Add(at), limit, window, reject)
+		}
+		for _, target := range []string{"a:1", "b:1", "c:1", "A:1"} {
+			if ok, exceeded := add(target, 0); !ok || exceeded {
+				t.Fatalf("reject %v: %s under the limit: ok %v, exceeded %v", reject, target, ok, exceeded)
+			}
+		}
+		if n := ts.count(start, window); n != limit {
+			t.Errorf("reject %v: %d distinct targets, want %d", reject, n, limit)
+		}
+		// Going over warns once, however many more there are.
+		if ok, exceeded := add("d:1", time.Second); ok == reject || !exceeded {
+			t.Errorf("reject %v: first over the limit: ok %v, exceeded %v", reject, ok, exceeded)
+		}
+		if ok, exceeded := add("e:1", time.Second); ok == reject || exceeded {
+			t.Errorf("reject %v: second over the limit: ok %v, exceeded %v", reject, ok, exceeded)
+		}
+		// Targets already used still go through.
+		if ok, _ := add("b:1", 2*time.Second); !ok {
+			t.Errorf("reject %v: a target already used was refused", reject)
+		}
+		// Once all but b age out of the window, new targets fit again,
+		// and going over warns again.
+		later := window + 1500*time.Millisecond
+		if ok, exceeded := add("f:1", later); !ok || exceeded {
+			t.Errorf("reject %v: new target after the window: ok %v, exceeded %v", reject, ok, exceeded)
+		}
+		if n := ts.count(start.Add(later), window); n != 2 {
+			t.Errorf("reject %v: %d distinct targets after the window", reject, n)
+		}
+		add("g:1", later)
+		if _, exceeded := add("h:1", later); !exceeded {
+			t.Errorf("reject %v: going over again didn't warn", reject)
+		}
+	}
+}
+
+func TestDistinctTargetLimit(t *testing.T) {
+	sink := newRecordingSink()
+	s, url := startServer(t, WithDistinctTargetLimit(2, time.Minute, true), WithMetricsSink(sink), WithEventLog(100))
+	session := dialSession(t, url)
+	first, second, third := echoTarget(t), echoTarget(t), echoTarget(t)
+	for i, tc := range []struct {
+		target string
+		want   byte
+	}{
+		{first, protocol.StatusOK},
+		{second, protocol.StatusOK},
+		{third, protocol.StatusDenied},
+		{first, protocol.StatusOK},
+		{third, protocol.StatusDenied},
+	} {
+		_, resp := request(t, session, protocol.Request{Addr: tc.target, WantReason: true})
+		if resp.Status != tc.want {
+			t.Errorf("request %d to %s: status %#x, want %#x", i+1, tc.target, resp.Status, tc.want)
+		}
+		if tc.want == protocol.StatusDenied && resp.Reason != "too many distinct targets" {
+			t.Errorf("request %d: reason %q", i+1, resp.Reason)
+		}
+	}
+
+	// Another session has targets of its own.
+	if _, resp := request(t, dialSession(t, url), protocol.Request{Addr: third}); resp.Status != protocol.StatusOK {
+		t.Errorf("another session's first target: status %#x", resp.Status)
+	}
+
+	if n := sink.counter(MetricTargetLimitExceeded); n != 1 {
+		t.Errorf("%s = %v, want 1", MetricTargetLimitExceeded, n)
+	}
+	warnings := 0
+	for _, e := range s.events.Events() {
+		if e.Message == "client connected to many distinct targets, it may be scanning" {
+			warnings++
+		}
+	}
+	if warnings != 1 {
+		t.Errorf("%d warnings, want 1", warnings)
+	}
+}
+
+func TestHostLimitsShareByHost(t *testing.T) {
+	h := &hostLimits{rate: 1000}
+	a, doneA := h.acquire("Example.com.:443")
+	b, doneB := h.acquire("example.com:80")
+	c, doneC := h.acquire("other.example:443")
+	if a != b || a == c {
+		t.Fatal("limiters not shared by host alone")
+	}
+	if n := h.hosts["example.com"].streams; n != 2 {
+		t.Errorf("%d streams to example.com, want 2", n)
+	}
+	doneA()
+	doneB()
+	doneC()
+
+	// Idle hosts are forgotten only after hostLimitIdle.
+	h.sweep(time.Now())
+	if len(h.hosts) != 2 {
+		t.Errorf("%d hosts kept right after going idle, want 2", len(h.hosts))
+	}
+	_, done := h.acquire("example.com:443")
+	h.sweep(time.Now().Add(2 * hostLimitIdle))
+	if _, ok := h.hosts["example.com"]; !ok || len(h.hosts) != 1 {
+		t.Errorf("hosts after the sweep: %v", h.hosts)
+	}
+	done()
+}
@@ -0,0 +1,39 @@
+package server
+
+import (
+	"sync/atomic"
+
+	"github.com/hashicorp/yamux"
+)
+
+// streamMemory caps the memory held by the streams being relayed, as
+// streamFootprint estimates it, for WithMaxStreamMemory.
+type streamMemory struct {
+	max  int64
+	used atomic.Int64
+}
+
+// reserve charges n bytes to the budget, failing if that would go over.
+func (m *streamMemory) reserve(n int64) bool {
+	if m.used.Add(n) > m.max {
+		m.used.Add(-n)
+		return false
+	}
+	return true
+}
+
+func (m *streamMemory) release(n int64) {
+	m.used.Add(-n)
+}
+
+// streamFootprint estimates the most memory a relayed stream holds: its
+// two copy buffers, its two relay buffers if there are any, and its yamux
+// receive buffer, which fills up to the stream window when the target
+// reads slower than the client sends.
+func (s *Server) streamFootprint() int64 {
+	window := s.streamWindow
+	if window == 0 {
+		window = int(yamux.DefaultConfig().MaxStreamWindowSize)
+	}
+	return int64(2*s.buffers.size + 2*s.relayBuffer + window)
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jtolio/netpump-go/private/protocol"
+)
+
+// holdTarget listens on loopback, holding every connection open without
+// a word until release is called, and returns its address with release.
+func holdTarget(t *testing.T) (addr string, release func()) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	var held []net.Conn
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			held = append(held, conn)
+			mu.Unlock()
+		}
+	}()
+	release = func() {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, conn := range held {
+			conn.Close()
+		}
+		held = nil
+	}
+	t.Cleanup(func() {
+		ln.Close()
+		release()
+	})
+	return ln.Addr().String(), release
+}
+
+// TestStreamMemoryBudget checks many small streams open at once are held
+// to the streams whose footprint fits the budget, and that the
+// memory comes back as they end.
+func TestStreamMemoryBudget(t *testing.T) {
+	const (
+		fit   = 4
+		tries = 40
+	)
+	probe := New("127.0.0.1", 0, WithStreamWindow(minStreamWindow))
+	footprint := probe.streamFootprint()
+	// A little short of room for one more.
+	s, url := startServer(t, WithStreamWindow(minStreamWindow), WithMaxStreamMemory((fit+1)*footprint-1))
+	target, release := holdTarget(t)
+	session := dialSession(t, url)
+
+	// The streams stay open, as the target holds them.
+	var open []net.Conn
+	refused := 0
+	for i := 0; i < tries; i++ {
+		stream, resp := request(t, session, protocol.Request{Addr: target})
+		switch resp.Status {
+		case protocol.StatusOK:
+			open = append(open, stream)
+		case protocol.StatusFailed:
+			refused++
+		default:
+			t.Fatalf("status %#x", resp.Status)
+		}
+	}
+	if len(open) != fit || refused != tries-fit {
+		t.Errorf("%d streams relayed and %d refused, want %d and %d", len(open), refused, fit, tries-fit)
+	}
+	if used, max := s.streamMemory.used.Load(), s.streamMemory.max; used != int64(len(open))*footprint || used > max {
+		t.Errorf("%d bytes charged for %d streams of %d, budget %d", used, len(open), footprint, max)
+	}
+
+	for _, stream := range open {
+		stream.Close()
+	}
+	release()
+	for deadline := time.Now().Add(5 * time.Second); s.streamMemory.used.Load() != 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d bytes still charged after the streams ended", s.streamMemory.used.Load())
+		}
+	}
+	if _, resp := request(t, session, protocol.Request{Addr: target}); resp.Status != protocol.StatusOK {
+		t.Errorf("stream after the others ended: status %#x", resp.Status)
+	}
+}
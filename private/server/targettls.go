@@ -0,0 +1,69 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// TargetTLS makes the server itself speak TLS to matching targets, for
+// setups that terminate TLS at the egress. The client's side of the
+// stream stays plaintext. This is unlike ordinary HTTPS through the
+// tunnel, which is end-to-end between the application and the target.
+type TargetTLS struct {
+	// Hosts picks the targets to wrap, as host names or "host:port". A
+	// "*." prefix matches any subdomain.
+	Hosts []string
+	// Config is used for the handshake. If its ServerName is empty, the
+	// target's host is used for SNI and verification. nil means the
+	// defaults, which verify against the system roots.
+	Config *tls.Config
+}
+
+func (t *TargetTLS) matches(target string) bool {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return false
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	for _, pattern := range t.Hosts {
+		pHost, pPort, err := net.SplitHostPort(pattern)
+		if err != nil {
+			pHost, pPort = pattern, ""
+		}
+		if (pPort == "" || pPort == port) && hostMatches(pHost, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// targetTLS returns the rule for target, or nil if it should be relayed
+// as is. The first matching rule wins.
+func (s *Server) targetTLS(target string) *TargetTLS {
+	for i := range s.targetTLSRules {
+		if s.targetTLSRules[i].matches(target) {
+			return &s.targetTLSRules[i]
+		}
+	}
+	return nil
+}
+
+// wrapTLS performs a TLS handshake with target over conn.
+func (t *TargetTLS) wrapTLS(ctx context.Context, conn net.Conn, target string) (net.Conn, error) {
+	cfg := &tls.Config{}
+	if t.Config != nil {
+		cfg = t.Config.Clone()
+	}
+	if cfg.ServerName == "" {
+		host, _, _ := net.SplitHostPort(target)
+		cfg.ServerName = host
+	}
+	tc := tls.Client(conn, cfg)
+	if err := tc.HandshakeContext(ctx); err != nil {
+		return nil, fmt.Errorf("TLS handshake with target: %w", err)
+	}
+	return tc, nil
+}
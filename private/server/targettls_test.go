@@ -0,0 +1,72 @@
+package server
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/jtolio/netpump-go/private/protocol"
+)
+
+// tlsEchoTarget serves HTTPS on loopback, answering each request with its
+// body, and returns its address with a pool trusting its certificate.
+func tlsEchoTarget(t *testing.T) (string, *x509.CertPool) {
+	t.Helper()
+	hs := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(w, r.Body)
+	}))
+	t.Cleanup(hs.Close)
+	roots := x509.NewCertPool()
+	roots.AddCert(hs.Certificate())
+	return hs.Listener.Addr().String(), roots
+}
+
+func TestTargetTLSEcho(t *testing.T) {
+	target, roots := tlsEchoTarget(t)
+	_, url := startServer(t, WithTargetTLS(TargetTLS{
+		Hosts:  []string{"127.0.0.1"},
+		Config: &tls.Config{RootCAs: roots},
+	}))
+
+	// The client speaks plain HTTP; the server adds the TLS.
+	stream, resp := request(t, dialSession(t, url), protocol.Request{Addr: target})
+	if resp.Status != protocol.StatusOK {
+		t.Fatalf("status = %#x, want OK", resp.Status)
+	}
+	const body = "hello over TLS"
+	if _, err := io.WriteString(stream, "POST / HTTP/1.1\r\nHost: 127.0.0.1\r\nConnection: close\r\n"+
+		"Content-Length: "+strconv.Itoa(len(body))+"\r\n\r\n"+body); err != nil {
+		t.Fatal(err)
+	}
+	hr, err := http.ReadResponse(bufio.NewReader(stream), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hr.Body.Close()
+	got, err := io.ReadAll(hr.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hr.StatusCode != http.StatusOK || string(got) != body {
+		t.Errorf("got %d %q, want 200 %q", hr.StatusCode, got, body)
+	}
+}
+
+func TestTargetTLSUntrusted(t *testing.T) {
+	target, _ := tlsEchoTarget(t)
+	// The system roots don't know the test's CA.
+	_, url := startServer(t, WithTargetTLS(TargetTLS{Hosts: []string{"127.0.0.1"}}))
+	_, resp := request(t, dialSession(t, url), protocol.Request{Addr: target, WantReason: true})
+	if resp.Status != protocol.StatusFailed {
+		t.Errorf("status = %#x, want %#x", resp.Status, protocol.StatusFailed)
+	}
+	if !strings.HasPrefix(resp.Reason, "TLS to target failed") || !strings.Contains(resp.Reason, "certificate") {
+		t.Errorf("reason = %q, want a certificate failure", resp.Reason)
+	}
+}
@@ -0,0 +1,222 @@
+package server
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Tenant is a client identity allowed to use the server. Its limits apply
+// across all of its sessions combined, so tenants sharing a server can't
+// exhaust each other's resources.
+type Tenant struct {
+	Name  string
+	Token string
+
+	// MaxStreams caps concurrent streams. Zero means unlimited.
+	MaxStreams int
+	// ByteQuota caps the bytes relayed in both directions over the
+	// server's lifetime. Zero means unlimited.
+	ByteQuota int64
+}
+
+// TenantStats reports a tenant's current usage.
+type TenantStats struct {
+	Name     string `json:"name"`
+	Sessions int64  `json:"sessions"`
+	Streams  int64  `json:"streams"`
+	Bytes    int64  `json:"bytes"`
+	Rejected int64  `json:"rejected"`
+}
+
+var errQuotaExceeded = errors.New("tenant byte quota exceeded")
+
+// SessionPolicy decides what happens when a client connects as a tenant
+// while it already has a session as that tenant, such as when it
+// reconnects before the server has noticed its old connection is gone.
+// Clients are told apart by address, so clients sharing a tenant's token
+// don't displace each other.
+type SessionPolicy int
+
+const (
+	// SessionsConcurrent lets a tenant hold any number of sessions.
+	SessionsConcurrent SessionPolicy = iota
+	// SessionsReplace closes a client's existing sessions as a tenant when
+	// it opens a new one, so the last connection wins.
+	SessionsReplace
+	// SessionsReject refuses a client's new session as a tenant until its
+	// existing one is gone.
+	SessionsReject
+)
+
+func (p SessionPolicy) String() string {
+	switch p {
+	case SessionsConcurrent:
+		return "concurrent"
+	case SessionsReplace:
+		return "replace"
+	case SessionsReject:
+		return "reject"
+	}
+	return fmt.Sprintf("SessionPolicy(%d)", int(p))
+}
+
+type tenant struct {
+	Tenant
+
+	sessions atomic.Int64
+	streams  atomic.Int64
+	bytes    atomic.Int64
+	rejected atomic.Int64
+
+	mu      sync.Mutex
+	claimed map[string]int64          // sessions by client, see clientKey
+	live    map[*clientSession]string // to the client they're from
+}
+
+// clientKey identifies the client at ip for the session policy, so the
+// same address in another form counts as the same client.
+func clientKey(ip string) string {
+	if c := canonicalIP(ip); c != nil {
+		return c.String()
+	}
+	return ip
+}
+
+// claimSession counts a new session for the tenant from client. Under
+// SessionsReject it fails if that client already has one.
+func (t *tenant) claimSession(policy SessionPolicy, client string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if policy == SessionsReject && t.claimed[client] > 0 {
+		return false
+	}
+	if t.claimed == nil {
+		t.claimed = make(map[string]int64)
+	}
+	t.claimed[client]++
+	t.sessions.Add(1)
+	return true
+}
+
+// releaseSession undoes claimSession.
+func (t *tenant) releaseSession(client string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.claimed[client]--; t.claimed[client] <= 0 {
+		delete(t.claimed, client)
+	}
+	t.sessions.Add(-1)
+}
+
+// addSession registers sess, from client, as live, returning the other
+// live sessions from that client.
+func (t *tenant) addSession(sess *clientSession, client string) []*clientSession {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.live == nil {
+		t.live = make(map[*clientSession]string)
+	}
+	var others []*clientSession
+	for other, from := range t.live {
+		if from == client {
+			others = append(others, other)
+		}
+	}
+	t.live[sess] = client
+	return others
+}
+
+func (t *tenant) removeSession(sess *clientSession) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.live, sess)
+}
+
+// acquireStream reserves one of the tenant's stream slots, failing if the
+// tenant is at its stream limit or out of quota.
+func (t *tenant) acquireStream() bool {
+	if t.quotaExceeded() {
+		t.rejected.Add(1)
+		return false
+	}
+	if n := t.streams.Add(1); t.MaxStreams > 0 && n > int64(t.MaxStreams) {
+		t.streams.Add(-1)
+		t.rejected.Add(1)
+		return false
+	}
+	return true
+}
+
+func (t *tenant) releaseStream() {
+	t.streams.Add(-1)
+}
+
+func (t *tenant) quotaExceeded() bool {
+	return t.ByteQuota > 0 && t.bytes.Load() >= t.ByteQuota
+}
+
+func (t *tenant) stats() TenantStats {
+	return TenantStats{
+		Name:     t.Name,
+		Sessions: t.sessions.Load(),
+		Streams:  t.streams.Load(),
+		Bytes:    t.bytes.Load(),
+		Rejected: t.rejected.Load(),
+	}
+}
+
+// quotaWriter charges relayed bytes to a tenant, failing once the tenant's
+// quota is used up. A single write may overshoot the quota.
+type quotaWriter struct {
+	w io.Writer
+	t *tenant
+}
+
+func (q quotaWriter) Write(p []byte) (int, error) {
+	if q.t.quotaExceeded() {
+		return 0, errQuotaExceeded
+	}
+	n, err := q.w.Write(p)
+	q.t.bytes.Add(int64(n))
+	return n, err
+}
+
+// authenticate finds the tenant for a websocket upgrade. Browsers can't set
+// headers on websocket requests, so the token may also come from the
+// "token" query parameter. If no tenants are configured everyone is
+// allowed and the tenant is nil.
+func (s *Server) authenticate(r *http.Request) (*tenant, bool) {
+	if len(s.tenants) == 0 {
+		return nil, true
+	}
+
+	token := r.URL.Query().Get("token")
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token = strings.TrimPrefix(auth, "Bearer ")
+	}
+	if token == "" {
+		return nil, false
+	}
+
+	for _, t := range s.tenants {
+		if subtle.ConstantTimeCompare([]byte(t.Token), []byte(token)) == 1 {
+			return t, true
+		}
+	}
+	return nil, false
+}
+
+// TenantStats returns the current usage of every configured tenant.
+func (s *Server) TenantStats() []TenantStats {
+	stats := make([]TenantStats, 0, len(s.tenants))
+	for _, t := range s.tenants {
+		stats = append(stats, t.stats())
+	}
+	return stats
+}
@@ -0,0 +1,160 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/hashicorp/yamux"
+
+	"github.com/jtolio/netpump-go/private/protocol"
+	"github.com/jtolio/netpump-go/private/wsconn"
+)
+
+// dialAs connects to the server at url with token, through a trusted
+// proxy that says the client is at ip. It returns the status of a refused
+// upgrade instead of a session.
+func dialAs(t *testing.T, url, token, ip string) (*yamux.Session, int) {
+	t.Helper()
+	header := http.Header{
+		"Authorization":   {"Bearer " + token},
+		"X-Forwarded-For": {ip},
+	}
+	ws, resp, err := websocket.DefaultDialer.Dial(url, header)
+	if err != nil {
+		if resp == nil {
+			t.Fatal(err)
+		}
+		return nil, resp.StatusCode
+	}
+	session, err := yamux.Client(wsconn.New(ws), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { session.Close() })
+	return session, http.StatusSwitchingProtocols
+}
+
+// relays checks that session still gets streams relayed.
+func relays(t *testing.T, session *yamux.Session, target string) bool {
+	t.Helper()
+	stream, err := session.Open()
+	if err != nil {
+		return false
+	}
+	defer stream.Close()
+	stream.SetDeadline(time.Now().Add(10 * time.Second))
+	if err := protocol.WriteRequest(stream, protocol.Request{Addr: target}); err != nil {
+		return false
+	}
+	resp, err := protocol.ReadResponse(stream)
+	return err == nil && resp.Status == protocol.StatusOK
+}
+
+func TestSessionPolicyReplace(t *testing.T) {
+	_, url := startServer(t,
+		WithTenants(Tenant{Name: "shared", Token: "secret"}),
+		WithSessionPolicy(SessionsReplace),
+		WithTrustedProxies("127.0.0.1"))
+	target := echoTarget(t)
+
+	old, _ := dialAs(t, url, "secret", "10.0.0.1")
+	other, _ := dialAs(t, url, "secret", "10.0.0.2")
+	if !relays(t, old, target) || !relays(t, other, target) {
+		t.Fatal("sessions not relaying before the reconnect")
+	}
+
+	// The same client, its address written another way, reconnects.
+	current, status := dialAs(t, url, "secret", "::ffff:10.0.0.1")
+	if current == nil {
+		t.Fatalf("reconnect refused with status %d", status)
+	}
+	select {
+	case <-old.CloseChan():
+	case <-time.After(10 * time.Second):
+		t.Fatal("old session from the reconnecting client wasn't closed")
+	}
+	if !relays(t, current, target) {
+		t.Error("new session not relaying")
+	}
+	if other.IsClosed() || !relays(t, other, target) {
+		t.Error("another client's session on the tenant was closed")
+	}
+}
+
+func TestSessionPolicyReject(t *testing.T) {
+	_, url := startServer(t,
+		WithTenants(Tenant{Name: "shared", Token: "secret"}),
+		WithSessionPolicy(SessionsReject),
+		WithTrustedProxies("127.0.0.1"))
+	target := echoTarget(t)
+
+	first, _ := dialAs(t, url, "secret", "10.0.0.1")
+	if other, status := dialAs(t, url, "secret", "10.0.0.2"); other == nil {
+		t.Fatalf("another client on the tenant refused with status %d", status)
+	}
+	if again, status := dialAs(t, url, "secret", "10.0.0.1"); again != nil || status != http.StatusConflict {
+		t.Fatalf("second session from a client got status %d, want %d", status, http.StatusConflict)
+	}
+	if !relays(t, first, target) {
+		t.Error("first session stopped relaying after the refused one")
+	}
+
+	// Once the first session is gone the client may connect again.
+	first.Close()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		again, status := dialAs(t, url, "secret", "10.0.0.1")
+		if again != nil {
+			break
+		}
+		if status != http.StatusConflict || time.Now().After(deadline) {
+			t.Fatalf("reconnect after the first session closed got status %d", status)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestTenantQuotaIsolation(t *testing.T) {
+	const quota = 4096
+	s, url := startServer(t, WithTenants(
+		Tenant{Name: "greedy", Token: "greedy-token", ByteQuota: quota},
+		Tenant{Name: "modest", Token: "modest-token", ByteQuota: quota},
+	))
+	target := echoTarget(t)
+	greedy, _ := dialAs(t, url, "greedy-token", "10.0.0.1")
+	modest, _ := dialAs(t, url, "modest-token", "10.0.0.2")
+
+	// Greedy uses up its quota echoing more than it allows.
+	stream, resp := request(t, greedy, protocol.Request{Addr: target})
+	if resp.Status != protocol.StatusOK {
+		t.Fatalf("status %#x, want OK", resp.Status)
+	}
+	go stream.Write(bytes.Repeat([]byte("x"), 4*quota))
+	io.Copy(io.Discard, stream)
+	if _, resp := request(t, greedy, protocol.Request{Addr: target}); resp.Status == protocol.StatusOK {
+		t.Fatal("tenant over its quota got a new stream")
+	}
+
+	// Modest, well within its own quota, carries on.
+	stream, resp = request(t, modest, protocol.Request{Addr: target})
+	if resp.Status != protocol.StatusOK {
+		t.Fatalf("other tenant got status %#x, want OK", resp.Status)
+	}
+	msg := bytes.Repeat([]byte("y"), quota/4)
+	if _, err := stream.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(msg))
+	if _, err := io.ReadFull(stream, got); err != nil {
+		t.Fatalf("other tenant's echo: %v", err)
+	}
+	for _, st := range s.TenantStats() {
+		if st.Name == "modest" && st.Rejected != 0 {
+			t.Errorf("other tenant had %d streams rejected", st.Rejected)
+		}
+	}
+}
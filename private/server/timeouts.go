@@ -0,0 +1,101 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	"github.com/hashicorp/yamux"
+)
+
+// Timeouts gathers the server's timeouts in one place. Zero fields keep
+// their defaults; negative ones turn the timeout off, as described for
+// each field.
+type Timeouts struct {
+	// Dial bounds connecting to a target, through the upstreams if any,
+	// 10 seconds by default. Off, dials are only bounded by the system.
+	Dial time.Duration
+	// Handshake bounds how long a client may take to send the request
+	// on a stream it opened, and the TLS handshake the server makes with
+	// targets matching WithTargetTLS, 10 seconds by default. Off, both may
+	// take as long as they like.
+	Handshake time.Duration
+	// Control bounds how long a client may take to answer the server on
+	// its control stream, 30 seconds by default. Off, the server waits as
+	// long as the session lasts.
+	Control time.Duration
+	// IdleStream is as for WithIdleStreamProbe, and off by default.
+	IdleStream time.Duration
+	// CarrierIdle is as for WithCarrierIdleTimeout, and off by default.
+	CarrierIdle time.Duration
+	// Write is as for WithWriteTimeout.
+	Write time.Duration
+	// Shutdown is as for WithShutdownTimeout. Off is the same as the
+	// default, closing streams right away.
+	Shutdown time.Duration
+	// KeepAlive is how often client sessions are pinged to notice a link
+	// that went dead, 30 seconds by default. Off, it's only noticed when a
+	// write fails.
+	KeepAlive time.Duration
+}
+
+const (
+	defaultDialTimeout      = 10 * time.Second
+	defaultHandshakeTimeout = 10 * time.Second
+	// defaultControlTimeout bounds how long the client may take to answer
+	// a probe.
+	defaultControlTimeout = 30 * time.Second
+)
+
+// WithTimeouts sets any of the server's timeouts at once. Fields left zero
+// keep their defaults, or what an earlier option set.
+func WithTimeouts(t Timeouts) Option {
+	return func(s *Server) {
+		setTimeout(&s.dialTimeout, t.Dial)
+		setTimeout(&s.handshakeTimeout, t.Handshake)
+		setTimeout(&s.controlTimeout, t.Control)
+		setTimeout(&s.idleProbe, t.IdleStream)
+		setTimeout(&s.carrierIdle, t.CarrierIdle)
+		setTimeout(&s.writeTimeout, t.Write)
+		setTimeout(&s.shutdownTimeout, t.Shutdown)
+		setTimeout(&s.keepAlive, t.KeepAlive)
+	}
+}
+
+// setTimeout stores d in field unless it's zero, turning negative
+// durations into zero, which is how the server's fields say a timeout is
+// off.
+func setTimeout(field *time.Duration, d time.Duration) {
+	if d != 0 {
+		*field = max(d, 0)
+	}
+}
+
+// The stream windows WithStreamWindow accepts: yamux won't go below its
+// initial window, and more than a GiB per stream is surely a mistake.
+const (
+	minStreamWindow = 256 * 1024
+	maxStreamWindow = 1 << 30
+)
+
+// muxConfig is the yamux configuration for client sessions.
+func (s *Server) muxConfig() *yamux.Config {
+	conf := yamux.DefaultConfig()
+	if s.keepAlive > 0 {
+		conf.KeepAliveInterval = s.keepAlive
+	} else {
+		conf.EnableKeepAlive = false
+	}
+	if s.streamWindow > 0 {
+		conf.MaxStreamWindowSize = uint32(s.streamWindow)
+	}
+	return conf
+}
+
+// withTimeout is context.WithTimeout, but without a deadline if timeout is
+// zero.
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
@@ -0,0 +1,135 @@
+package server
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/jtolio/netpump-go/private/protocol"
+)
+
+func TestWithTimeouts(t *testing.T) {
+	s := New("127.0.0.1", 0, WithTimeouts(Timeouts{
+		Dial:        1 * time.Second,
+		Handshake:   2 * time.Second,
+		Control:     3 * time.Second,
+		IdleStream:  4 * time.Second,
+		CarrierIdle: 5 * time.Second,
+		Write:       6 * time.Second,
+		Shutdown:    7 * time.Second,
+		KeepAlive:   8 * time.Second,
+	}))
+	for _, tc := range []struct {
+		name      string
+		got, want time.Duration
+	}{
+		{"dial", s.dialTimeout, 1 * time.Second},
+		{"handshake", s.handshakeTimeout, 2 * time.Second},
+		{"control", s.controlTimeout, 3 * time.Second},
+		{"idle stream", s.idleProbe, 4 * time.Second},
+		{"carrier idle", s.carrierIdle, 5 * time.Second},
+		{"write", s.writeTimeout, 6 * time.Second},
+		{"shutdown", s.shutdownTimeout, 7 * time.Second},
+		{"keepalive", s.muxConfig().KeepAliveInterval, 8 * time.Second},
+	} {
+		if tc.got != tc.want {
+			t.Errorf("%s timeout %v, want %v", tc.name, tc.got, tc.want)
+		}
+	}
+
+	// The fields with options of their own set the same thing.
+	alone := New("127.0.0.1", 0,
+		WithIdleStreamProbe(4*time.Second),
+		WithCarrierIdleTimeout(5*time.Second),
+		WithWriteTimeout(6*time.Second),
+		WithShutdownTimeout(7*time.Second))
+	if alone.idleProbe != s.idleProbe || alone.carrierIdle != s.carrierIdle ||
+		alone.writeTimeout != s.writeTimeout || alone.shutdownTimeout != s.shutdownTimeout {
+		t.Error("WithTimeouts and the single options disagree")
+	}
+
+	// Zero keeps what's there; negative turns it off.
+	s = New("127.0.0.1", 0, WithTimeouts(Timeouts{Dial: -1, Handshake: -1, Control: -1, KeepAlive: -1}), WithTimeouts(Timeouts{}))
+	if s.dialTimeout != 0 || s.handshakeTimeout != 0 || s.controlTimeout != 0 || s.muxConfig().EnableKeepAlive {
+		t.Errorf("off: dial %v, handshake %v, control %v, keepalive %v",
+			s.dialTimeout, s.handshakeTimeout, s.controlTimeout, s.muxConfig().EnableKeepAlive)
+	}
+	s = New("127.0.0.1", 0, WithTimeouts(Timeouts{}))
+	if s.dialTimeout != defaultDialTimeout || s.handshakeTimeout != defaultHandshakeTimeout || s.controlTimeout != defaultControlTimeout {
+		t.Errorf("defaults: dial %v, handshake %v, control %v", s.dialTimeout, s.handshakeTimeout, s.controlTimeout)
+	}
+}
+
+// TestSilentStreamDropped checks a stream that never finishes its request
+// is dropped once the handshake timeout passes.
+func TestSilentStreamDropped(t *testing.T) {
+	const timeout = 200 * time.Millisecond
+	s, url := startServer(t, WithTimeouts(Timeouts{Handshake: timeout}), WithEventLog(100))
+	session := dialSession(t, url)
+	for _, sent := range [][]byte{nil, {5, 'h'}} {
+		stream, err := session.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer stream.Close()
+		if _, err := stream.Write(sent); err != nil {
+			t.Fatal(err)
+		}
+		stream.SetReadDeadline(time.Now().Add(5 * time.Second))
+		start := time.Now()
+		if n, err := stream.Read(make([]byte, 1)); err != io.EOF {
+			t.Fatalf("sent %q: read %d, %v, want EOF", sent, n, err)
+		}
+		if elapsed := time.Since(start); elapsed < timeout/2 {
+			t.Errorf("sent %q: dropped after %v, before the timeout", sent, elapsed)
+		}
+	}
+	dropped := 0
+	for _, e := range s.events.Events() {
+		if e.Message == "client sent no request in time, dropping stream" {
+			dropped++
+		}
+	}
+	if dropped != 2 {
+		t.Errorf("%d drops logged, want 2", dropped)
+	}
+
+	// A request made in time is answered as usual.
+	if _, resp := request(t, session, protocol.Request{Addr: echoTarget(t)}); resp.Status != protocol.StatusOK {
+		t.Errorf("status %#x", resp.Status)
+	}
+}
+
+// TestTargetHandshakeTimeout checks a target that never answers the TLS
+// handshake fails the stream once the handshake timeout passes.
+func TestTargetHandshakeTimeout(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+		}
+	}()
+
+	const timeout = 200 * time.Millisecond
+	_, url := startServer(t,
+		WithTimeouts(Timeouts{Handshake: timeout}),
+		WithTargetTLS(TargetTLS{Hosts: []string{"127.0.0.1"}, Config: &tls.Config{}}))
+	start := time.Now()
+	_, resp := request(t, dialSession(t, url), protocol.Request{Addr: ln.Addr().String()})
+	if resp.Status != protocol.StatusFailed {
+		t.Errorf("status %#x, want %#x", resp.Status, protocol.StatusFailed)
+	}
+	if elapsed := time.Since(start); elapsed < timeout/2 || elapsed > 5*time.Second {
+		t.Errorf("failed after %v with a %v timeout", elapsed, timeout)
+	}
+}
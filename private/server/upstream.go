@@ -0,0 +1,171 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// upstreamCooldown is how long an upstream that couldn't be reached is
+// skipped before it gets another chance.
+const upstreamCooldown = 30 * time.Second
+
+// Upstream is an egress path for connections to targets.
+type Upstream struct {
+	Name string
+	// URL is "direct" to dial targets from the server itself, or
+	// socks5://[user:pass@]host:port to go through a SOCKS5 proxy.
+	URL string
+	// Weight is the upstream's share of connections relative to the
+	// others. Zero counts as one.
+	Weight int
+}
+
+var errUpstreamDown = errors.New("upstream unreachable")
+
+type upstream struct {
+	Upstream
+	dialer proxy.ContextDialer
+
+	// Guarded by upstreamPool.mu
+	current   int
+	downUntil time.Time
+}
+
+// newUpstream sets up u. Direct connections to targets are dialed with
+// targetControl as the net.Dialer Control function, and connections to
+// SOCKS5 upstreams with proxyControl, which mustn't apply the deny
+// policy: the proxy's own address isn't the target's.
+func newUpstream(u Upstream, targetControl, proxyControl func(network, address string, c syscall.RawConn) error) (*upstream, error) {
+	if u.Weight <= 0 {
+		u.Weight = 1
+	}
+	up := &upstream{Upstream: u}
+	if u.URL == "direct" {
+		up.dialer = &net.Dialer{Control: targetControl}
+		return up, nil
+	}
+
+	pu, err := url.Parse(u.URL)
+	if err != nil {
+		return nil, fmt.Errorf("upstream %q: %w", u.Name, err)
+	}
+	if pu.Scheme != "socks5" {
+		return nil, fmt.Errorf("upstream %q: unsupported scheme %q", u.Name, pu.Scheme)
+	}
+	var auth *proxy.Auth
+	if pu.User != nil {
+		pass, _ := pu.User.Password()
+		auth = &proxy.Auth{User: pu.User.Username(), Password: pass}
+	}
+	d, err := proxy.SOCKS5("tcp", pu.Host, auth, upstreamForward{proxyControl})
+	if err != nil {
+		return nil, fmt.Errorf("upstream %q: %w", u.Name, err)
+	}
+	up.dialer = d.(proxy.ContextDialer)
+	return up, nil
+}
+
+// upstreamForward dials a SOCKS5 upstream itself, marking failures with
+// errUpstreamDown so they can be told apart from the target's failures.
+type upstreamForward struct {
+	control func(network, address string, c syscall.RawConn) error
+}
+
+func (f upstreamForward) Dial(network, addr string) (net.Conn, error) {
+	return f.DialContext(context.Background(), network, addr)
+}
+
+func (f upstreamForward) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	d := net.Dialer{Control: f.control}
+	conn, err := d.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errUpstreamDown, err)
+	}
+	return conn, nil
+}
+
+// upstreamPool spreads connections over upstreams using smooth weighted
+// round-robin, skipping upstreams that recently couldn't be reached.
+type upstreamPool struct {
+	mu        sync.Mutex
+	upstreams []*upstream
+}
+
+// next picks the upstream for a connection, leaving out the ones in
+// tried. Upstreams in their cooldown are only used if nothing else is
+// left. It returns nil once every upstream has been tried.
+func (p *upstreamPool) next(tried map[*upstream]bool) *upstream {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	pick := func(healthyOnly bool) *upstream {
+		var best *upstream
+		total := 0
+		for _, up := range p.upstreams {
+			if tried[up] || (healthyOnly && now.Before(up.downUntil)) {
+				continue
+			}
+			up.current += up.Weight
+			total += up.Weight
+			if best == nil || up.current > best.current {
+				best = up
+			}
+		}
+		if best != nil {
+			best.current -= total
+		}
+		return best
+	}
+
+	if up := pick(true); up != nil {
+		return up
+	}
+	return pick(false)
+}
+
+func (p *upstreamPool) markDown(up *upstream) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	up.downUntil = time.Now().Add(upstreamCooldown)
+}
+
+func (p *upstreamPool) markUp(up *upstream) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	up.downUntil = time.Time{}
+}
+
+// dial connects to target through the next upstream, moving on to the
+// following one if an upstream can't be reached. Errors from the target
+// itself are returned right away.
+func (p *upstreamPool) dial(ctx context.Context, target string) (net.Conn, *upstream, error) {
+	tried := make(map[*upstream]bool)
+	var errs []error
+	for {
+		up := p.next(tried)
+		if up == nil {
+			return nil, nil, errors.Join(errs...)
+		}
+		tried[up] = true
+
+		conn, err := up.dialer.DialContext(ctx, "tcp", target)
+		if err == nil {
+			p.markUp(up)
+			return conn, up, nil
+		}
+		if !errors.Is(err, errUpstreamDown) || ctx.Err() != nil {
+			return nil, up, err
+		}
+		p.markDown(up)
+		errs = append(errs, fmt.Errorf("%s: %w", up.Name, err))
+	}
+}
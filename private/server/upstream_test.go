@@ -0,0 +1,97 @@
+package server
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/jtolio/netpump-go/private/protocol"
+)
+
+// closedAddr returns a loopback address nothing listens on.
+func closedAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+func TestUpstreamWeights(t *testing.T) {
+	heavy := &upstream{Upstream: Upstream{Name: "heavy", Weight: 3}}
+	light := &upstream{Upstream: Upstream{Name: "light", Weight: 1}}
+	pool := &upstreamPool{upstreams: []*upstream{heavy, light}}
+
+	counts := make(map[string]int)
+	run := 0
+	for i := 0; i < 40; i++ {
+		up := pool.next(nil)
+		counts[up.Name]++
+		if up == heavy {
+			run++
+		} else {
+			run = 0
+		}
+		if run > 3 {
+			t.Fatal("heavy picked more than its weight in a row")
+		}
+	}
+	if counts["heavy"] != 30 || counts["light"] != 10 {
+		t.Errorf("picks %v, want 30 heavy and 10 light", counts)
+	}
+}
+
+func TestUpstreamSkipsDown(t *testing.T) {
+	a := &upstream{Upstream: Upstream{Name: "a", Weight: 1}}
+	b := &upstream{Upstream: Upstream{Name: "b", Weight: 1}}
+	pool := &upstreamPool{upstreams: []*upstream{a, b}}
+
+	pool.markDown(a)
+	for i := 0; i < 4; i++ {
+		if up := pool.next(nil); up != b {
+			t.Fatalf("picked %s while a is down", up.Name)
+		}
+	}
+	// An upstream in its cooldown is still better than none.
+	if up := pool.next(map[*upstream]bool{b: true}); up != a {
+		t.Errorf("with b tried, picked %v, want a", up)
+	}
+	if up := pool.next(map[*upstream]bool{a: true, b: true}); up != nil {
+		t.Errorf("with both tried, picked %s", up.Name)
+	}
+	pool.markUp(a)
+	picked := map[*upstream]bool{pool.next(nil): true, pool.next(nil): true}
+	if !picked[a] || !picked[b] {
+		t.Error("a not picked again once back up")
+	}
+}
+
+func TestUpstreamUnreachableFallsBack(t *testing.T) {
+	s, url := startServer(t, WithUpstreams(
+		Upstream{Name: "dead", URL: "socks5://" + closedAddr(t)},
+		Upstream{Name: "live", URL: "socks5://" + startSocksUpstream(t).addr},
+	))
+	target := echoTarget(t)
+	session := dialSession(t, url)
+	for i := 0; i < 4; i++ {
+		if _, resp := request(t, session, protocol.Request{Addr: target}); resp.Status != protocol.StatusOK {
+			t.Fatalf("request %d: status %#x, want OK", i, resp.Status)
+		}
+	}
+	for _, up := range s.upstreams.upstreams {
+		if up.Name == "dead" && up.downUntil.IsZero() {
+			t.Error("unreachable upstream not marked down")
+		}
+	}
+	// Connections go straight to the live upstream now.
+	conn, up, err := s.upstreams.dial(context.Background(), target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if up.Name != "live" {
+		t.Errorf("dialed through %s, want live", up.Name)
+	}
+}
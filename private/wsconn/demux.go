@@ -0,0 +1,149 @@
+package wsconn
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// MaxDemux is the most Conns Demux splits a websocket into.
+const MaxDemux = 16
+
+// demuxChunk is the most a shared websocket carries of one Conn's write
+// before the others get a turn.
+const demuxChunk = 16 * 1024
+
+// ErrUnknownConn is what demuxed Conns fail with when a message names a
+// Conn that doesn't exist, such as when the other end isn't demuxing or
+// isn't netpump at all.
+var ErrUnknownConn = errors.New("wsconn: message for unknown demuxed conn")
+
+// Demux splits ws into n Conns that each carry their own yamux session,
+// so that one session's streams can't hold up another's. Every binary
+// message starts with a byte naming the Conn it belongs to, and large
+// writes are cut up so the Conns take turns on the websocket. Both ends
+// must demux the same way; the browser relay forwards messages as they
+// are and doesn't need to know.
+//
+// The Conns fail together when the websocket does, but otherwise each can
+// be closed on its own; the websocket is closed along with the last one.
+func Demux(ws *websocket.Conn, n int) []*Conn {
+	if n < 1 || n > MaxDemux {
+		panic(fmt.Sprintf("wsconn: can't demux into %d conns", n))
+	}
+	// A message is read whole before it's sorted, so cap it at the most a
+	// Conn ever writes at once plus the id byte. gorilla fails the read,
+	// and so every Conn, if the other end sends more.
+	ws.SetReadLimit(MaxMessageSize + 1)
+	l := newLink(ws)
+	l.open = n
+	conns := make([]*Conn, n)
+	for i := range conns {
+		conns[i] = &Conn{link: l, id: i, in: newInbox()}
+	}
+	go l.demux(conns)
+	return conns
+}
+
+// demux sorts incoming messages into the Conns' inboxes until the
+// websocket fails.
+func (l *link) demux(conns []*Conn) {
+	var err error
+	for err == nil {
+		var typ int
+		var r io.Reader
+		typ, r, err = l.ws.NextReader()
+		if err != nil {
+			break
+		}
+		if typ == websocket.TextMessage {
+			l.control(r)
+			continue
+		}
+		var msg []byte
+		msg, err = io.ReadAll(r)
+		if err != nil {
+			break
+		}
+		if len(msg) == 0 || int(msg[0]) >= len(conns) {
+			err = ErrUnknownConn
+			l.ws.Close()
+			break
+		}
+		// A closed Conn's inbox drops what still arrives for it.
+		conns[msg[0]].in.put(msg[1:])
+	}
+	for _, c := range conns {
+		c.in.fail(err)
+	}
+}
+
+// inbox holds a demuxed Conn's incoming data until it's read. yamux reads
+// its connection constantly, and its windows bound how much a well-behaved
+// other end may send, so the inbox doesn't need a limit of its own; one
+// that ignores the windows gets its yamux session torn down by the reader,
+// and the websocket's read limit keeps any single message small.
+type inbox struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	bufs [][]byte
+	err  error
+}
+
+func newInbox() *inbox {
+	in := &inbox{}
+	in.cond = sync.NewCond(&in.mu)
+	return in
+}
+
+func (in *inbox) put(b []byte) {
+	if len(b) == 0 {
+		return
+	}
+	in.mu.Lock()
+	if in.err == nil {
+		in.bufs = append(in.bufs, b)
+		in.cond.Signal()
+	}
+	in.mu.Unlock()
+}
+
+// fail makes reads return err once the data already in the inbox is read.
+func (in *inbox) fail(err error) {
+	in.mu.Lock()
+	if in.err == nil {
+		in.err = err
+	}
+	in.cond.Broadcast()
+	in.mu.Unlock()
+}
+
+// close makes reads fail right away, dropping any unread data.
+func (in *inbox) close() {
+	in.mu.Lock()
+	in.bufs = nil
+	in.err = net.ErrClosed
+	in.cond.Broadcast()
+	in.mu.Unlock()
+}
+
+func (in *inbox) read(p []byte) (int, error) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	for len(in.bufs) == 0 && in.err == nil {
+		in.cond.Wait()
+	}
+	if len(in.bufs) == 0 {
+		return 0, in.err
+	}
+	n := copy(p, in.bufs[0])
+	if in.bufs[0] = in.bufs[0][n:]; len(in.bufs[0]) == 0 {
+		in.bufs[0] = nil
+		in.bufs = in.bufs[1:]
+	}
+	return n, nil
+}
@@ -0,0 +1,139 @@
+package wsconn
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/hashicorp/yamux"
+)
+
+// wsPair returns the two ends of a websocket.
+func wsPair(t *testing.T) (client, server *websocket.Conn) {
+	t.Helper()
+	accepted := make(chan *websocket.Conn, 1)
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		accepted <- ws
+	}))
+	t.Cleanup(srv.Close)
+
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server = <-accepted
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+func TestDemuxStalledSessionDoesNotBlockOthers(t *testing.T) {
+	cws, sws := wsPair(t)
+	cconns, sconns := Demux(cws, 2), Demux(sws, 2)
+
+	var clients, servers [2]*yamux.Session
+	for i := range clients {
+		var err error
+		if clients[i], err = yamux.Client(cconns[i], nil); err != nil {
+			t.Fatal(err)
+		}
+		if servers[i], err = yamux.Server(sconns[i], nil); err != nil {
+			t.Fatal(err)
+		}
+		defer clients[i].Close()
+		defer servers[i].Close()
+	}
+
+	// Fill a stream on the first session that the other end never reads,
+	// so its writer stalls on the stream window.
+	stalled, err := clients[0].Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := servers[0].Accept(); err != nil {
+		t.Fatal(err)
+	}
+	go stalled.Write(make([]byte, 4<<20))
+
+	go func() {
+		stream, err := servers[1].Accept()
+		if err != nil {
+			return
+		}
+		io.Copy(stream, stream)
+	}()
+	stream, err := clients[1].Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := stream.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, 4)
+	if _, err := io.ReadFull(stream, got); err != nil {
+		t.Fatalf("second session blocked behind the first: %v", err)
+	}
+	if string(got) != "ping" {
+		t.Fatalf("echo = %q, want %q", got, "ping")
+	}
+}
+
+func TestDemuxLargeWriteArrivesWhole(t *testing.T) {
+	cws, sws := wsPair(t)
+	cconns, sconns := Demux(cws, 2), Demux(sws, 2)
+
+	want := bytes.Repeat([]byte("0123456789"), MaxMessageSize/5)
+	go cconns[1].Write(want)
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(sconns[1], got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatal("data changed in transit")
+	}
+}
+
+func TestDemuxOversizedMessageFailsConns(t *testing.T) {
+	cws, sws := wsPair(t)
+	sconns := Demux(sws, 2)
+
+	// A peer ignoring MaxMessageSize can't make the reader buffer the
+	// whole message.
+	msg := make([]byte, MaxMessageSize+2)
+	if err := cws.WriteMessage(websocket.BinaryMessage, msg); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, len(sconns))
+	for _, c := range sconns {
+		go func(c *Conn) {
+			_, err := c.Read(make([]byte, 1))
+			done <- err
+		}(c)
+	}
+	for range sconns {
+		select {
+		case err := <-done:
+			if !errors.Is(err, websocket.ErrReadLimit) {
+				t.Fatalf("read error = %v, want %v", err, websocket.ErrReadLimit)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("oversized message didn't fail the conns")
+		}
+	}
+}
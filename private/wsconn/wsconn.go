@@ -0,0 +1,409 @@
+// Package wsconn adapts a websocket to the byte stream yamux runs over.
+package wsconn
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Control messages are sent as websocket text frames by the browser relay;
+// yamux data always travels in binary frames.
+const (
+	// PauseMessage asks the receiver to stop writing until ResumeMessage,
+	// because the relay can't forward data as fast as it arrives.
+	PauseMessage = "pause"
+	// ResumeMessage lifts a previous PauseMessage.
+	ResumeMessage = "resume"
+	// MigrateMessage, followed by a space and a server URL such as
+	// "migrate wss://b.example.com:9999", tells the client the server is
+	// going away and to reconnect to the one at that URL instead. The
+	// browser relay passes it on to the client.
+	MigrateMessage = "migrate"
+	// IdleMessage tells the client the server is closing the websocket
+	// because it carried no streams for a while, and not to reconnect
+	// until there's a connection to make. The browser relay passes it on
+	// to the client.
+	IdleMessage = "idle"
+
+	maxControlMessage = 512
+)
+
+// MaxMigrateURL is the longest URL a MigrateMessage carries.
+const MaxMigrateURL = maxControlMessage - len(MigrateMessage) - 1
+
+// DefaultWriteTimeout bounds each websocket write unless SetWriteTimeout
+// says otherwise.
+const DefaultWriteTimeout = 30 * time.Second
+
+// MaxMessageSize is the most data a websocket message carries. yamux
+// writes a frame's body in one go, up to a whole stream window, and the
+// browser relay holds each message in memory until it's forwarded, so
+// larger writes are split across messages. Reads put them back together,
+// since yamux only sees a byte stream.
+const MaxMessageSize = 64 * 1024
+
+// yamux frame layout, needed to inject stream resets. yamux doesn't
+// expose a way to reset a stream, but the RST flag is part of its wire
+// protocol, so we can write the frame ourselves between other frames.
+//
+// Finding the gaps between frames relies on yamux's sendLoop writing a
+// frame's header and body with separate Write calls, as it does as of
+// v0.1.2; see the note in go.mod before upgrading.
+const (
+	yamuxHeaderSize       = 12
+	yamuxTypeData         = 0
+	yamuxTypeWindowUpdate = 1
+	yamuxFlagRST          = 0x8
+	yamuxProtoVersion     = 0
+	yamuxLengthOffset     = 8
+	yamuxStreamIDOffset   = 4
+)
+
+// Conn adapts websocket to net.Conn for yamux. A Conn either has its
+// websocket to itself, or shares it with the others from the same Demux.
+type Conn struct {
+	*link
+	// id prefixes the Conn's messages when it shares the websocket, and
+	// is -1 otherwise.
+	id int
+
+	// Reading a websocket of its own.
+	reader io.Reader
+	rmu    sync.Mutex
+	// Reading a shared websocket, whose messages Demux sorts.
+	in *inbox
+
+	// yamux writes a data frame's header and body with separate Write
+	// calls. pending counts the body bytes still owed, and writing is set
+	// while a Write is under way, so that injected frames only go out on
+	// a frame boundary. Both are guarded by wmu.
+	pending int
+	writing bool
+	closed  bool // guarded by wmu
+}
+
+// link is the websocket and its write side, shared by the Conns on it.
+type link struct {
+	ws *websocket.Conn
+
+	wmu  sync.Mutex
+	cond *sync.Cond
+	// paused is set without wmu, which a Write holds through all of a
+	// long frame's messages, so that a pause stops it between them.
+	paused  atomic.Bool
+	open    int // Conns not yet closed
+	writers int // Write calls under way, including paused ones
+
+	// busy adds up the time some Write was under way, and busySince is
+	// when the current stretch started (UnixNano), or 0. They're updated
+	// under wmu but read without it.
+	busy      atomic.Int64
+	busySince atomic.Int64
+
+	writeTimeout time.Duration
+	msg          []byte // for prefixing messages, guarded by wmu
+
+	onMigrate func(url string) // guarded by wmu
+	onIdle    func()           // guarded by wmu
+}
+
+func newLink(ws *websocket.Conn) *link {
+	l := &link{ws: ws, open: 1, writeTimeout: DefaultWriteTimeout}
+	l.cond = sync.NewCond(&l.wmu)
+	return l
+}
+
+func New(ws *websocket.Conn) *Conn {
+	return &Conn{link: newLink(ws), id: -1}
+}
+
+// SetWriteTimeout bounds how long a single write to the websocket may
+// take. A peer that stops reading then fails the write, which tears down
+// the yamux session instead of stalling every stream on it. yamux's
+// keepalive would eventually notice too, but only after its ping times
+// out. Time spent paused by the relay doesn't count. Zero disables the
+// timeout. It applies to every Conn sharing the websocket.
+func (c *Conn) SetWriteTimeout(d time.Duration) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	c.writeTimeout = d
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	if c.in != nil {
+		return c.in.read(b)
+	}
+
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+
+	for c.reader == nil {
+		typ, r, err := c.ws.NextReader()
+		if err != nil {
+			return 0, err
+		}
+		if typ == websocket.TextMessage {
+			c.control(r)
+			continue
+		}
+		c.reader = r
+	}
+
+	n, err := c.reader.Read(b)
+	if err == io.EOF {
+		c.reader = nil
+		return n, nil
+	}
+	return n, err
+}
+
+func (l *link) control(r io.Reader) {
+	msg, err := io.ReadAll(io.LimitReader(r, maxControlMessage))
+	if err != nil {
+		return
+	}
+
+	if url, ok := strings.CutPrefix(string(msg), MigrateMessage+" "); ok {
+		l.wmu.Lock()
+		f := l.onMigrate
+		l.wmu.Unlock()
+		if f != nil {
+			f(strings.TrimSpace(url))
+		}
+		return
+	}
+	if strings.TrimSpace(string(msg)) == IdleMessage {
+		l.wmu.Lock()
+		f := l.onIdle
+		l.wmu.Unlock()
+		if f != nil {
+			f()
+		}
+		return
+	}
+
+	switch strings.TrimSpace(string(msg)) {
+	case PauseMessage:
+		l.paused.Store(true)
+	case ResumeMessage:
+		l.paused.Store(false)
+		l.wmu.Lock()
+		l.cond.Broadcast()
+		l.wmu.Unlock()
+	}
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.writers++; c.writers == 1 {
+		c.busySince.Store(time.Now().UnixNano())
+	}
+	defer func() {
+		if c.writers--; c.writers == 0 {
+			since := c.busySince.Swap(0)
+			c.busy.Add(time.Now().UnixNano() - since)
+		}
+	}()
+
+	pending := c.pending
+	if pending > 0 {
+		pending -= len(b)
+	} else if len(b) >= yamuxHeaderSize && b[1] == yamuxTypeData {
+		pending = int(binary.BigEndian.Uint32(b[yamuxLengthOffset:]))
+	}
+
+	c.writing = true
+	written, err := c.writeChunks(b)
+	c.writing = false
+	c.pending = pending
+	if err != nil || c.pending < 0 {
+		c.pending = 0
+	}
+	if c.pending == 0 {
+		c.cond.Broadcast()
+	}
+	return written, err
+}
+
+// writeChunks writes b as messages of at most MaxMessageSize bytes, or
+// on a shared websocket of at most demuxChunk bytes, letting other Conns
+// write in between. The caller must hold wmu.
+func (c *Conn) writeChunks(b []byte) (int, error) {
+	limit := MaxMessageSize
+	if c.id >= 0 {
+		limit = min(limit, demuxChunk)
+	}
+	written := 0
+	for {
+		for c.paused.Load() && !c.closed {
+			c.cond.Wait()
+		}
+		if c.closed {
+			return written, net.ErrClosed
+		}
+		chunk := b[written:]
+		if len(chunk) > limit {
+			chunk = chunk[:limit]
+		}
+		if err := c.writeMessage(c.id, chunk); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+		if written == len(b) {
+			return written, nil
+		}
+		if c.id >= 0 {
+			// Give the other Conns a turn.
+			c.wmu.Unlock()
+			runtime.Gosched()
+			c.wmu.Lock()
+		}
+	}
+}
+
+// ResetStream sends a yamux RST for the given stream, which the remote
+// side surfaces as yamux.ErrConnectionReset. The local stream should be
+// closed afterwards; yamux will reap it after its StreamCloseTimeout.
+func (c *Conn) ResetStream(id uint32) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	for (c.pending > 0 || c.writing) && !c.closed {
+		c.cond.Wait()
+	}
+	if c.closed {
+		return net.ErrClosed
+	}
+
+	hdr := make([]byte, yamuxHeaderSize)
+	hdr[0] = yamuxProtoVersion
+	hdr[1] = yamuxTypeWindowUpdate
+	binary.BigEndian.PutUint16(hdr[2:], yamuxFlagRST)
+	binary.BigEndian.PutUint32(hdr[yamuxStreamIDOffset:], id)
+	return c.writeMessage(c.id, hdr)
+}
+
+// OnMigrate sets f to be called with the URL of each MigrateMessage that
+// arrives. It applies to every Conn sharing the websocket.
+func (c *Conn) OnMigrate(f func(url string)) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	c.onMigrate = f
+}
+
+// Migrate sends a MigrateMessage naming url. It goes to the websocket, so
+// it only needs sending on one of the Conns sharing it.
+func (c *Conn) Migrate(url string) error {
+	if len(url) > MaxMigrateURL {
+		return fmt.Errorf("wsconn: migrate URL longer than %d bytes", MaxMigrateURL)
+	}
+	return c.sendControl(MigrateMessage + " " + url)
+}
+
+// OnIdle sets f to be called when an IdleMessage arrives. It applies to
+// every Conn sharing the websocket.
+func (c *Conn) OnIdle(f func()) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	c.onIdle = f
+}
+
+// Idle sends an IdleMessage. Like Migrate, it only needs sending on one of
+// the Conns sharing the websocket.
+func (c *Conn) Idle() error {
+	return c.sendControl(IdleMessage)
+}
+
+// sendControl writes msg to the websocket as a control message.
+func (c *Conn) sendControl(msg string) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.closed {
+		return net.ErrClosed
+	}
+	var deadline time.Time
+	if c.writeTimeout > 0 {
+		deadline = time.Now().Add(c.writeTimeout)
+	}
+	if err := c.ws.SetWriteDeadline(deadline); err != nil {
+		return err
+	}
+	return c.ws.WriteMessage(websocket.TextMessage, []byte(msg))
+}
+
+// Busy returns how long writes have been under way in total, including
+// time held up by the relay asking for a pause, and the current write.
+// While it grows about as fast as the clock, the websocket is the
+// bottleneck for whatever is being written to it. It covers every Conn
+// sharing the websocket.
+func (c *Conn) Busy() time.Duration {
+	busy := c.busy.Load()
+	if since := c.busySince.Load(); since != 0 {
+		busy += time.Now().UnixNano() - since
+	}
+	return time.Duration(busy)
+}
+
+// writeMessage writes b as a binary frame within the write timeout,
+// prefixed with id unless it's negative. The caller must hold wmu.
+func (l *link) writeMessage(id int, b []byte) error {
+	var deadline time.Time
+	if l.writeTimeout > 0 {
+		deadline = time.Now().Add(l.writeTimeout)
+	}
+	if err := l.ws.SetWriteDeadline(deadline); err != nil {
+		return err
+	}
+	if id < 0 {
+		return l.ws.WriteMessage(websocket.BinaryMessage, b)
+	}
+	// One frame, as without the prefix; NextWriter would cut the
+	// message into a frame per write buffer.
+	if cap(l.msg) < 1+len(b) {
+		l.msg = make([]byte, 1+len(b))
+	}
+	msg := l.msg[:1+len(b)]
+	msg[0] = byte(id)
+	copy(msg[1:], b)
+	return l.ws.WriteMessage(websocket.BinaryMessage, msg)
+}
+
+// Close closes the Conn. The websocket is closed along with the last Conn
+// on it, so Conns sharing it carry on when one of them is closed.
+func (c *Conn) Close() error {
+	c.wmu.Lock()
+	if c.closed {
+		c.wmu.Unlock()
+		return nil
+	}
+	c.closed = true
+	c.open--
+	last := c.open == 0
+	c.cond.Broadcast()
+	c.wmu.Unlock()
+	if c.in != nil {
+		c.in.close()
+	}
+	if !last {
+		return nil
+	}
+	return c.ws.Close()
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.ws.LocalAddr()
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.ws.RemoteAddr()
+}
@@ -0,0 +1,118 @@
+package wsconn
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/hashicorp/yamux"
+)
+
+func TestWriteTimeoutTearsDownSession(t *testing.T) {
+	client, _ := wsPair(t) // the server end is never read
+	conn := New(client)
+	const timeout = 200 * time.Millisecond
+	conn.SetWriteTimeout(timeout)
+	session, err := yamux.Client(conn, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+
+	// Each stream may send its initial window without hearing back, so
+	// enough of them fill the socket buffers whatever their size.
+	const streams = 128
+	var wg sync.WaitGroup
+	writeErrs := make(chan error, streams)
+	opened := 0
+	for ; opened < streams; opened++ {
+		stream, err := session.Open()
+		if err == yamux.ErrSessionShutdown {
+			// The write timeout already tore the session down.
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, 32*1024)
+			for {
+				if _, err := stream.Write(buf); err != nil {
+					writeErrs <- err
+					return
+				}
+			}
+		}()
+	}
+
+	select {
+	case <-session.CloseChan():
+	case <-time.After(10 * time.Second):
+		t.Fatal("session still open with a peer that stopped reading")
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream writes still blocked after the session closed")
+	}
+	if len(writeErrs) != opened {
+		t.Errorf("%d of %d stream writes failed", len(writeErrs), opened)
+	}
+}
+
+func TestLargeWriteSplitsIntoMessages(t *testing.T) {
+	cws, sws := wsPair(t)
+	conn := New(cws)
+	want := make([]byte, 3*MaxMessageSize+7)
+	for i := range want {
+		want[i] = byte(i * 7)
+	}
+	errs := make(chan error, 1)
+	go func() {
+		_, err := conn.Write(want)
+		errs <- err
+	}()
+
+	var got []byte
+	messages := 0
+	for len(got) < len(want) {
+		typ, msg, err := sws.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if typ != websocket.BinaryMessage || len(msg) > MaxMessageSize {
+			t.Fatalf("message %d: type %d, %d bytes", messages, typ, len(msg))
+		}
+		got = append(got, msg...)
+		messages++
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	if messages != 4 {
+		t.Errorf("%d messages, want 4", messages)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatal("data changed in transit")
+	}
+
+	// And read through a Conn, the messages come back as one stream.
+	go conn.Write(want)
+	got = make([]byte, len(want))
+	if _, err := io.ReadFull(New(sws), got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatal("data changed reading through a Conn")
+	}
+}